@@ -0,0 +1,201 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// collectionAccidentDetails is the private data collection holding the details of accident
+// reports, defined in collections_config.json for the insurers' organizations. Unlike the
+// insurers of policies and the registry's capabilities, its members are fixed when the
+// collections are deployed: onboarding an insurer means adding its MSP to the collection
+// policy and upgrading the chaincode with the new collections config.
+const collectionAccidentDetails = "accidentDetails"
+
+// accidentSeverities ranks the severities an accident can be reported with, least severe first
+var accidentSeverities = map[string]int{"MINOR": 1, "MAJOR": 2, "TOTAL_LOSS": 3}
+
+// Accident is the public record of an accident a bike was in. Its ID is the reporting
+// transaction ID; the details insurers need are kept under it in the accident details
+// collection. The bike itself carries the count and the worst severity, so accident
+// history shows wherever the bike does and stays with it through transfers.
+type Accident struct {
+	AccidentID string `json:"accidentID"`
+	BikeKey    string `json:"bikeKey"`
+	Seq        string `json:"seq"`
+	Severity   string `json:"severity"`
+	ReportedBy string `json:"reportedBy"`
+	ReportedAt int64  `json:"reportedAt"`
+}
+
+// AccidentDetails are the private details of an accident report. Details is whatever the
+// reporter passed in the transient field "details", e.g. a description or third parties.
+type AccidentDetails struct {
+	AccidentID   string          `json:"accidentID"`
+	BikeKey      string          `json:"bikeKey"`
+	LocationHash string          `json:"locationHash"`
+	PoliceRefNo  string          `json:"policeRefNo,omitempty"`
+	Details      json.RawMessage `json:"details,omitempty"`
+}
+
+// assertAccidentReporter fails unless the invoker owns the bike, insures it, belongs to an
+// organization with the police capability, or is a registrar
+func assertAccidentReporter(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	if assertOwner(APIstub, key, bike) == nil || assertRole(APIstub, "registrar") == nil {
+		return nil
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	if assertStrictCapability(APIstub, capabilityPolice, config.PoliceMSPs) == nil {
+		return nil
+	}
+	if policy, err := getPolicy(APIstub, key); err == nil && assertMSP(APIstub, policy.InsurerMSP) == nil {
+		return nil
+	}
+	return unauthorized("Only the owner or insurer of %s, the police or a registrar can report an accident", key)
+}
+
+/*
+ * reportAccident records an accident a bike was in. The bike's accident count and worst
+ * severity are updated on the public record; the location, given as a hex SHA-256 digest,
+ * the police reference and any transient "details" go to the accident details collection,
+ * which only the insurers' organizations can read. The owner, the insurer, the police and
+ * registrars may report. Args: bikeKey, severity (MINOR, MAJOR or TOTAL_LOSS),
+ * locationHash, policeRefNo (may be empty)
+ */
+func (s *SmartContract) reportAccident(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	rank, ok := accidentSeverities[args[1]]
+	if !ok {
+		return errorResponse(invalidArgs("Severity must be MINOR, MAJOR or TOTAL_LOSS"))
+	}
+	locationHash, err := parseDigest(args[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return errorResponse(err)
+	}
+	if details := transient["details"]; details != nil && !json.Valid(details) {
+		return errorResponse(invalidArgs("Transient field details must be JSON"))
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAccidentReporter(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	reporter, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	seq, err := nextSeq(APIstub, "ACCIDENT", args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	accident := Accident{
+		AccidentID: APIstub.GetTxID(),
+		BikeKey:    args[0],
+		Seq:        seq,
+		Severity:   args[1],
+		ReportedBy: reporter,
+		ReportedAt: now,
+	}
+	key, err := APIstub.CreateCompositeKey("ACCIDENT", []string{args[0], seq})
+	if err != nil {
+		return errorResponse(err)
+	}
+	accidentAsBytes, _ := json.Marshal(accident)
+	if err := APIstub.PutState(key, accidentAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	details := AccidentDetails{
+		AccidentID:   accident.AccidentID,
+		BikeKey:      args[0],
+		LocationHash: locationHash,
+		PoliceRefNo:  args[3],
+		Details:      transient["details"],
+	}
+	detailsKey, err := APIstub.CreateCompositeKey("ACCIDENTDETAILS", []string{accident.AccidentID})
+	if err != nil {
+		return errorResponse(err)
+	}
+	detailsAsBytes, _ := json.Marshal(details)
+	if err := APIstub.PutPrivateData(collectionAccidentDetails, detailsKey, detailsAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	bike.AccidentCount++
+	if rank > accidentSeverities[bike.AccidentSeverity] {
+		bike.AccidentSeverity = args[1]
+	}
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(accidentAsBytes)
+}
+
+// getAccidentHistory returns the public records of the accidents a bike was in, oldest first. Args: bikeKey
+func (s *SmartContract) getAccidentHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("ACCIDENT", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	accidents := []Accident{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		accident := Accident{}
+		if err := json.Unmarshal(queryResponse.Value, &accident); err != nil {
+			return errorResponse(err)
+		}
+		accidents = append(accidents, accident)
+	}
+
+	accidentsAsBytes, _ := json.Marshal(accidents)
+	return shim.Success(accidentsAsBytes)
+}
+
+// getAccidentDetails returns the private details of an accident report. Only members of the
+// organizations of the accident details collection can read them. Args: accidentID
+func (s *SmartContract) getAccidentDetails(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	key, err := APIstub.CreateCompositeKey("ACCIDENTDETAILS", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	detailsAsBytes, err := APIstub.GetPrivateData(collectionAccidentDetails, key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if detailsAsBytes == nil {
+		return errorResponse(notFound("Accident %s has no details", args[0]))
+	}
+
+	return shim.Success(detailsAsBytes)
+}
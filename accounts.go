@@ -0,0 +1,187 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Account holds a participant's token balance. IDs are the same identifiers used for
+// bike owners: enrollment IDs, or their pseudonyms if the config says so.
+type Account struct {
+	ID      string `json:"id"`
+	Balance int64  `json:"balance"`
+}
+
+func accountKey(APIstub shim.ChaincodeStubInterface, id string) (string, error) {
+	return APIstub.CreateCompositeKey("ACCOUNT", []string{id})
+}
+
+// getAccount loads an account; accounts that were never credited have a zero balance
+func getAccount(APIstub shim.ChaincodeStubInterface, id string) (Account, error) {
+	id, err := ownerRef(APIstub, id)
+	if err != nil {
+		return Account{}, err
+	}
+	account := Account{ID: id}
+
+	key, err := accountKey(APIstub, id)
+	if err != nil {
+		return account, err
+	}
+	accountAsBytes, err := APIstub.GetState(key)
+	if err != nil || accountAsBytes == nil {
+		return account, err
+	}
+
+	err = json.Unmarshal(accountAsBytes, &account)
+	return account, err
+}
+
+func putAccount(APIstub shim.ChaincodeStubInterface, account Account) error {
+	key, err := accountKey(APIstub, account.ID)
+	if err != nil {
+		return err
+	}
+	accountAsBytes, _ := json.Marshal(account)
+	return APIstub.PutState(key, accountAsBytes)
+}
+
+// moveFunds debits from and credits to by amount
+func moveFunds(APIstub shim.ChaincodeStubInterface, from string, to string, amount int64) error {
+	return payFunds(APIstub, from, map[string]int64{to: amount})
+}
+
+// payFunds debits from by the total of amounts and credits each payee with its amount.
+// A transaction cannot read its own writes, so everything one account pays in a transaction
+// has to go through a single call.
+func payFunds(APIstub shim.ChaincodeStubInterface, from string, amounts map[string]int64) error {
+	payees := make([]string, 0, len(amounts))
+	total := int64(0)
+	for payee, amount := range amounts {
+		if amount == 0 || payee == from {
+			continue
+		}
+		if total > math.MaxInt64-amount {
+			return fmt.Errorf("Payment from %s would overflow", from)
+		}
+		total = total + amount
+		payees = append(payees, payee)
+	}
+	if len(payees) == 0 {
+		return nil
+	}
+	sort.Strings(payees)
+
+	source, err := getAccount(APIstub, from)
+	if err != nil {
+		return err
+	}
+	if source.Balance < total {
+		return fmt.Errorf("Account %s has insufficient funds", from)
+	}
+	source.Balance = source.Balance - total
+	if err := putAccount(APIstub, source); err != nil {
+		return err
+	}
+
+	for _, payee := range payees {
+		target, err := getAccount(APIstub, payee)
+		if err != nil {
+			return err
+		}
+		if target.Balance > math.MaxInt64-amounts[payee] {
+			return fmt.Errorf("Account %s would overflow", payee)
+		}
+		target.Balance = target.Balance + amounts[payee]
+		if err := putAccount(APIstub, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assertTokenIssuer fails unless tokens are enabled and the invoker belongs to the configured issuer
+func assertTokenIssuer(APIstub shim.ChaincodeStubInterface) error {
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	if !config.featureEnabled(featureTokens) {
+		return fmt.Errorf("The %s feature is disabled", featureTokens)
+	}
+	return assertMSP(APIstub, config.TokenIssuerMSP)
+}
+
+func parseAmount(arg string) (int64, error) {
+	amount, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || amount <= 0 {
+		return 0, invalidArgs("Amount must be a positive integer")
+	}
+	return amount, nil
+}
+
+// mint creates tokens in an account. Args: accountID, amount
+func (s *SmartContract) mint(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	amount, err := parseAmount(args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertTokenIssuer(APIstub); err != nil {
+		return errorResponse(err)
+	}
+
+	account, err := getAccount(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if account.Balance > math.MaxInt64-amount {
+		return shim.Error(fmt.Sprintf("Account %s would overflow", args[0]))
+	}
+	account.Balance = account.Balance + amount
+	if err := putAccount(APIstub, account); err != nil {
+		return errorResponse(err)
+	}
+
+	accountAsBytes, _ := json.Marshal(account)
+	return shim.Success(accountAsBytes)
+}
+
+// transferFunds moves tokens between two accounts on the issuer's authority. Args: from, to, amount
+func (s *SmartContract) transferFunds(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	amount, err := parseAmount(args[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertTokenIssuer(APIstub); err != nil {
+		return errorResponse(err)
+	}
+	if err := moveFunds(APIstub, args[0], args[1], amount); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// getBalance returns an account and its balance
+func (s *SmartContract) getBalance(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	account, err := getAccount(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	accountAsBytes, _ := json.Marshal(account)
+	return shim.Success(accountAsBytes)
+}
@@ -0,0 +1,176 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// archivePrefix starts the keys of retired bikes. It sorts outside the live bike
+	// keys, so range queries over the key prefix never see archived bikes.
+	archivePrefix  = "ARCHIVE~"
+	statusArchived = "ARCHIVED"
+)
+
+func archiveKey(key string) string {
+	return archivePrefix + key
+}
+
+// assertOwnerOrAdmin fails unless the invoker owns the bike or belongs to an admin MSP
+func assertOwnerOrAdmin(APIstub shim.ChaincodeStubInterface, key string, owner string) error {
+	invoker, err := getInvokerRef(APIstub)
+	if err == nil && invoker == owner {
+		return nil
+	}
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	if err := assertAnyMSP(APIstub, config.AdminMSPs); err != nil {
+		return unauthorized("Only the owner of %s or an admin can do this", key)
+	}
+	return nil
+}
+
+func getArchivedBike(APIstub shim.ChaincodeStubInterface, key string) (Bike, error) {
+	bike := Bike{}
+
+	bikeAsBytes, err := APIstub.GetState(archiveKey(key))
+	if err != nil {
+		return bike, err
+	}
+	if bikeAsBytes == nil {
+		return bike, notFound("Bike %s is not archived", key)
+	}
+
+	if err := json.Unmarshal(bikeAsBytes, &bike); err != nil {
+		return bike, err
+	}
+	upgradeBike(&bike)
+	return bike, nil
+}
+
+/*
+ * archiveBike retires a bike: the record moves to the archive namespace, out of live
+ * queries and the owner's holdings, and keeps its history for the regulator.
+ * Records attached to the bike stay under its key. Only the owner or an admin may archive,
+ * and only a bike that is not rented or being auctioned. Args: key
+ */
+func (s *SmartContract) archiveBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwnerOrAdmin(APIstub, args[0], bike.Owner); err != nil {
+		return errorResponse(err)
+	}
+	if bike.Status != statusActive {
+		return shim.Error(fmt.Sprintf("Bike %s is %s and cannot be archived", args[0], bike.Status))
+	}
+	if err := assertNotAuctioned(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+
+	// A pending sale cannot go through any more
+	if _, key, err := getOffer(APIstub, args[0]); err == nil {
+		if err := APIstub.DelState(key); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	previousAt := bike.LastModifiedAt
+	bike.Status = statusArchived
+	bike.Version = bike.Version + 1
+	if err := stampAudit(APIstub, false, &bike); err != nil {
+		return errorResponse(err)
+	}
+	bikeAsBytes, _ := json.Marshal(bike)
+	if err := APIstub.PutState(archiveKey(args[0]), bikeAsBytes); err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.DelState(args[0]); err != nil {
+		return errorResponse(err)
+	}
+	if err := adjustBikeCount(APIstub, args[0], -1); err != nil {
+		return errorResponse(err)
+	}
+	if err := updateBikeIndexes(APIstub, args[0], bike, Bike{}); err != nil {
+		return errorResponse(err)
+	}
+	// Left behind so caches syncing by getBikesModifiedSince see the bike go
+	if err := moveModifiedIndex(APIstub, args[0], previousAt, bike.LastModifiedAt); err != nil {
+		return errorResponse(err)
+	}
+	if err := clearApproval(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	if err := clearReservation(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(bikeAsBytes)
+}
+
+/*
+ * restoreBike brings an archived bike back under its key. Only its last owner or an admin
+ * may restore it, and it fails if the key or registration number was reused meanwhile.
+ * Args: key
+ */
+func (s *SmartContract) restoreBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getArchivedBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwnerOrAdmin(APIstub, args[0], bike.Owner); err != nil {
+		return errorResponse(err)
+	}
+	existing, err := APIstub.GetState(args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if existing != nil {
+		return shim.Error("Key " + args[0] + " is already taken")
+	}
+	if bike.RegistrationNo != "" {
+		if err := claimRegistrationNo(APIstub, bike.RegistrationNo, args[0]); err != nil {
+			return errorResponse(err)
+		}
+	}
+	if bike.ChassisNo != "" {
+		if err := claimChassisNo(APIstub, bike.ChassisNo, args[0]); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	bike.Status = statusActive
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.DelState(archiveKey(args[0])); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// queryArchivedBike returns an archived bike by its original key
+func (s *SmartContract) queryArchivedBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getArchivedBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	bikeAsBytes, _ := json.Marshal(bike)
+	return shim.Success(bikeAsBytes)
+}
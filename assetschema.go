@@ -0,0 +1,265 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Deployments describe the fields they need beyond the built-in ones, such as an engine
+// number or a subsidy flag, with a JSON Schema per asset type. Bikes carry such fields in
+// their attributes. Every bike of the type is checked against the schema as a whole, built-in
+// fields included, when it is created, updated or patched; bikes written before a schema
+// was set are checked on their next write.
+//
+// jsonSchema is the subset of JSON Schema the chaincode enforces. Schemas using other
+// keywords are refused, so nobody relies on a rule that is silently ignored.
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+}
+
+var schemaTypes = map[string]bool{"": true, "string": true, "number": true, "integer": true, "boolean": true, "object": true, "array": true, "null": true}
+
+// parseSchema decodes and checks a schema
+func parseSchema(schemaAsBytes []byte) (*jsonSchema, error) {
+	schema := &jsonSchema{}
+	decoder := json.NewDecoder(bytes.NewReader(schemaAsBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(schema); err != nil {
+		return nil, invalidArgs("Schema must be a JSON object using only supported keywords: %s", err.Error())
+	}
+	if err := schema.check("schema"); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// check fails if the schema at path is not usable, e.g. has an unknown type or a bad pattern
+func (schema *jsonSchema) check(path string) error {
+	if !schemaTypes[schema.Type] {
+		return invalidArgs("%s: unsupported type %s", path, schema.Type)
+	}
+	if schema.Pattern != "" {
+		if _, err := regexp.Compile(schema.Pattern); err != nil {
+			return invalidArgs("%s: bad pattern: %s", path, err.Error())
+		}
+	}
+	for name, property := range schema.Properties {
+		if property == nil {
+			return invalidArgs("%s.%s: schema must be an object", path, name)
+		}
+		if err := property.check(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if schema.Items != nil {
+		return schema.Items.check(path + "[]")
+	}
+	return nil
+}
+
+// validate fails with an invalidArgs error naming the first part of value, found at path,
+// that breaks the schema. Properties are checked in name order, so every endorser reports
+// the same one.
+func (schema *jsonSchema) validate(value interface{}, path string) error {
+	if schema.Type != "" && !hasSchemaType(value, schema.Type) {
+		return invalidArgs("%s must be of type %s", path, schema.Type)
+	}
+	if len(schema.Enum) > 0 && !inEnum(value, schema.Enum) {
+		return invalidArgs("%s is not one of the allowed values", path)
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := len([]rune(value))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return invalidArgs("%s must be at least %d characters long", path, *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return invalidArgs("%s must be at most %d characters long", path, *schema.MaxLength)
+		}
+		if schema.Pattern != "" && !regexp.MustCompile(schema.Pattern).MatchString(value) {
+			return invalidArgs("%s does not match %s", path, schema.Pattern)
+		}
+	case float64:
+		if schema.Minimum != nil && value < *schema.Minimum {
+			return invalidArgs("%s must be at least %v", path, *schema.Minimum)
+		}
+		if schema.Maximum != nil && value > *schema.Maximum {
+			return invalidArgs("%s must be at most %v", path, *schema.Maximum)
+		}
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				return invalidArgs("%s.%s is required", path, name)
+			}
+		}
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return invalidArgs("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			if err := property.validate(value[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range value {
+				if err := schema.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hasSchemaType reports whether a decoded JSON value is of the JSON Schema type
+func hasSchemaType(value interface{}, schemaType string) bool {
+	switch value := value.(type) {
+	case string:
+		return schemaType == "string"
+	case float64:
+		return schemaType == "number" || (schemaType == "integer" && value == float64(int64(value)))
+	case bool:
+		return schemaType == "boolean"
+	case map[string]interface{}:
+		return schemaType == "object"
+	case []interface{}:
+		return schemaType == "array"
+	case nil:
+		return schemaType == "null"
+	}
+	return false
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	valueAsBytes, _ := json.Marshal(value)
+	for _, allowed := range enum {
+		allowedAsBytes, _ := json.Marshal(allowed)
+		if bytes.Equal(valueAsBytes, allowedAsBytes) {
+			return true
+		}
+	}
+	return false
+}
+
+func assetSchemaKey(APIstub shim.ChaincodeStubInterface, assetType string) (string, error) {
+	return APIstub.CreateCompositeKey("ASSETSCHEMA", []string{assetType})
+}
+
+// getAssetSchema returns the schema set for assetType, nil if there is none
+func getAssetSchema(APIstub shim.ChaincodeStubInterface, assetType string) (*jsonSchema, error) {
+	key, err := assetSchemaKey(APIstub, assetType)
+	if err != nil {
+		return nil, err
+	}
+	schemaAsBytes, err := APIstub.GetState(key)
+	if err != nil || schemaAsBytes == nil {
+		return nil, err
+	}
+	return parseSchema(schemaAsBytes)
+}
+
+// validateAssetSchema checks bike against the schema of its asset type, if one is set
+func validateAssetSchema(APIstub shim.ChaincodeStubInterface, bike Bike) error {
+	schema, err := getAssetSchema(APIstub, bike.AssetType)
+	if err != nil || schema == nil {
+		return err
+	}
+	bikeAsBytes, _ := json.Marshal(bike)
+	var document interface{}
+	if err := json.Unmarshal(bikeAsBytes, &document); err != nil {
+		return err
+	}
+	if err := schema.validate(document, "bike"); err != nil {
+		return invalidArgs("Bike does not match the %s schema: %s", bike.AssetType, err.Error())
+	}
+	return nil
+}
+
+/*
+ * setAssetSchema sets the JSON Schema bikes of an asset type must match, e.g.
+ * {"properties": {"attributes": {"required": ["engineNo"], "properties": {"engineNo": {"type": "string"}}}}}
+ * An empty schema removes it. Only admins may set schemas. Args: assetType, schema JSON
+ */
+func (s *SmartContract) setAssetSchema(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, config.AdminMSPs); err != nil {
+		return errorResponse(err)
+	}
+	if _, ok := assetKinds[args[0]]; !ok {
+		return errorResponse(invalidArgs("Unknown asset type %s", args[0]))
+	}
+	key, err := assetSchemaKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if args[1] == "" {
+		if err := APIstub.DelState(key); err != nil {
+			return errorResponse(err)
+		}
+		return shim.Success(nil)
+	}
+
+	schema, err := parseSchema([]byte(args[1]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	schemaAsBytes, _ := json.Marshal(schema)
+	if err := APIstub.PutState(key, schemaAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(schemaAsBytes)
+}
+
+// getAssetSchema returns the schema of an asset type, null if none is set. Args: assetType
+func (s *SmartContract) getAssetSchema(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	schema, err := getAssetSchema(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if schema == nil {
+		return shim.Success(nil)
+	}
+
+	schemaAsBytes, _ := json.Marshal(schema)
+	return shim.Success(schemaAsBytes)
+}
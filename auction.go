@@ -0,0 +1,449 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	auctionOpen   = "OPEN"
+	auctionClosed = "CLOSED"
+	// auctionRevealPeriod is how long, in seconds after bidding ends, bidders have to reveal their bids
+	auctionRevealPeriod = 24 * 60 * 60
+)
+
+// Auction is a sealed-bid sale of a bike. Bids are committed while the auction runs and
+// revealed once it has ended, so nobody can see the amounts before bidding closes.
+type Auction struct {
+	ID           string `json:"id"`
+	BikeKey      string `json:"bikeKey"`
+	Seller       string `json:"seller"`
+	ReservePrice int64  `json:"reservePrice"`
+	EndTime      int64  `json:"endTime"`
+	RevealEnd    int64  `json:"revealEnd"`
+	Status       string `json:"status"`
+	Winner       string `json:"winner,omitempty"`
+	WinningBid   int64  `json:"winningBid,omitempty"`
+}
+
+// Bid is a bidder's commitment, SHA-256 of "amount:salt", and the amount once revealed.
+// Revealed amounts are held in an escrow account until the auction closes.
+type Bid struct {
+	AuctionID   string `json:"auctionId"`
+	Bidder      string `json:"bidder"`
+	Commitment  string `json:"commitment"`
+	CommittedAt int64  `json:"committedAt"`
+	Revealed    bool   `json:"revealed"`
+	Amount      int64  `json:"amount,omitempty"`
+}
+
+// activeAuction marks the bike as being auctioned
+type activeAuction struct {
+	BikeKey   string `json:"bikeKey"`
+	AuctionID string `json:"auctionId"`
+}
+
+func auctionKey(APIstub shim.ChaincodeStubInterface, auctionID string) (string, error) {
+	return APIstub.CreateCompositeKey("AUCTION", []string{auctionID})
+}
+
+func activeAuctionKey(APIstub shim.ChaincodeStubInterface, bikeKey string) (string, error) {
+	return APIstub.CreateCompositeKey("ACTIVEAUCTION", []string{bikeKey})
+}
+
+func bidKey(APIstub shim.ChaincodeStubInterface, auctionID string, bidder string) (string, error) {
+	return APIstub.CreateCompositeKey("BID", []string{auctionID, bidder})
+}
+
+// escrowAccount holds one bidder's revealed bid. Every bid has its own escrow so closing
+// an auction touches each account only once.
+func escrowAccount(auctionID string, bidder string) string {
+	return "AUCTION~" + auctionID + "~" + bidder
+}
+
+func getAuction(APIstub shim.ChaincodeStubInterface, auctionID string) (Auction, error) {
+	auction := Auction{}
+
+	key, err := auctionKey(APIstub, auctionID)
+	if err != nil {
+		return auction, err
+	}
+	auctionAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return auction, err
+	}
+	if auctionAsBytes == nil {
+		return auction, notFound("Auction %s does not exist", auctionID)
+	}
+
+	err = json.Unmarshal(auctionAsBytes, &auction)
+	return auction, err
+}
+
+func putAuction(APIstub shim.ChaincodeStubInterface, auction Auction) error {
+	key, err := auctionKey(APIstub, auction.ID)
+	if err != nil {
+		return err
+	}
+	auctionAsBytes, _ := json.Marshal(auction)
+	return APIstub.PutState(key, auctionAsBytes)
+}
+
+func putBid(APIstub shim.ChaincodeStubInterface, bid Bid) error {
+	key, err := bidKey(APIstub, bid.AuctionID, bid.Bidder)
+	if err != nil {
+		return err
+	}
+	bidAsBytes, _ := json.Marshal(bid)
+	return APIstub.PutState(key, bidAsBytes)
+}
+
+// assertNotAuctioned fails while the bike is up for auction
+func assertNotAuctioned(APIstub shim.ChaincodeStubInterface, bikeKey string) error {
+	key, err := activeAuctionKey(APIstub, bikeKey)
+	if err != nil {
+		return err
+	}
+	markerAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if markerAsBytes != nil {
+		return fmt.Errorf("Bike %s is being auctioned", bikeKey)
+	}
+	return nil
+}
+
+// sealedBid reads the "bid" and "salt" transient fields and returns the amount with its commitment
+func sealedBid(APIstub shim.ChaincodeStubInterface) (int64, string, error) {
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return 0, "", err
+	}
+	if transient["bid"] == nil || len(transient["salt"]) == 0 {
+		return 0, "", invalidArgs("Bid and salt must be given in the transient fields \"bid\" and \"salt\"")
+	}
+	amount, err := parseAmount(string(transient["bid"]))
+	if err != nil {
+		return 0, "", err
+	}
+
+	digest := sha256.Sum256([]byte(strconv.FormatInt(amount, 10) + ":" + string(transient["salt"])))
+	return amount, hex.EncodeToString(digest[:]), nil
+}
+
+/*
+ * startAuction puts a bike up for a sealed-bid auction. Only the owner may start one, and
+ * the bike cannot be offered to anyone else until the auction is closed.
+ * Args: bikeKey, reservePrice, endTime (Unix seconds)
+ */
+func (s *SmartContract) startAuction(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	reservePrice, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || reservePrice < 0 {
+		return errorResponse(invalidArgs("Reserve price must be a non-negative integer"))
+	}
+	endTime, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errorResponse(invalidArgs("End time must be a Unix timestamp"))
+	}
+	if err := requireFeature(APIstub, featureTokens); err != nil {
+		return errorResponse(err)
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if endTime <= now {
+		return errorResponse(invalidArgs("End time must be in the future"))
+	}
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertTransferable(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertCapability(APIstub, capabilityTransfer, nil); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertNotAuctioned(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertNotReserved(APIstub, args[0], ""); err != nil {
+		return errorResponse(err)
+	}
+	if _, _, err := getOffer(APIstub, args[0]); err == nil {
+		return shim.Error("Bike " + args[0] + " has a pending transfer offer")
+	}
+
+	auction := Auction{
+		ID:           APIstub.GetTxID(),
+		BikeKey:      args[0],
+		Seller:       bike.Owner,
+		ReservePrice: reservePrice,
+		EndTime:      endTime,
+		RevealEnd:    endTime + auctionRevealPeriod,
+		Status:       auctionOpen,
+	}
+	if err := putAuction(APIstub, auction); err != nil {
+		return errorResponse(err)
+	}
+
+	markerKey, err := activeAuctionKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	markerAsBytes, _ := json.Marshal(activeAuction{BikeKey: args[0], AuctionID: auction.ID})
+	if err := APIstub.PutState(markerKey, markerAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	auctionAsBytes, _ := json.Marshal(auction)
+	return shim.Success(auctionAsBytes)
+}
+
+/*
+ * placeBid commits the invoker to a bid before the auction ends. The amount and a random
+ * salt go in the transient fields "bid" and "salt"; only their hash is written to the
+ * ledger. Bidding again replaces the earlier commitment. Args: auctionID
+ */
+func (s *SmartContract) placeBid(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	auction, err := getAuction(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if auction.Status != auctionOpen || now > auction.EndTime {
+		return shim.Error("Bidding on auction " + args[0] + " has ended")
+	}
+
+	bidder, err := getInvokerRef(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if bidder == auction.Seller {
+		return shim.Error("The seller cannot bid")
+	}
+	_, commitment, err := sealedBid(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	bid := Bid{AuctionID: auction.ID, Bidder: bidder, Commitment: commitment, CommittedAt: now}
+	if err := putBid(APIstub, bid); err != nil {
+		return errorResponse(err)
+	}
+
+	bidAsBytes, _ := json.Marshal(bid)
+	return shim.Success(bidAsBytes)
+}
+
+/*
+ * revealBid opens the invoker's bid once bidding has ended, with the same transient "bid"
+ * and "salt" used to place it. The amount moves from the bidder's account into escrow,
+ * to be paid to the seller if the bid wins or refunded at close. Args: auctionID
+ */
+func (s *SmartContract) revealBid(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	auction, err := getAuction(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if auction.Status != auctionOpen || now <= auction.EndTime || now > auction.RevealEnd {
+		return shim.Error("Bids on auction " + args[0] + " cannot be revealed now")
+	}
+
+	bidder, err := getInvokerRef(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := bidKey(APIstub, auction.ID, bidder)
+	if err != nil {
+		return errorResponse(err)
+	}
+	bidAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if bidAsBytes == nil {
+		return shim.Error(bidder + " did not bid on auction " + args[0])
+	}
+	bid := Bid{}
+	if err := json.Unmarshal(bidAsBytes, &bid); err != nil {
+		return errorResponse(err)
+	}
+	if bid.Revealed {
+		return shim.Error("Bid was already revealed")
+	}
+
+	amount, commitment, err := sealedBid(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if commitment != bid.Commitment {
+		return shim.Error("Bid and salt do not match the committed bid")
+	}
+	if err := moveFunds(APIstub, bidder, escrowAccount(auction.ID, bidder), amount); err != nil {
+		return errorResponse(err)
+	}
+
+	bid.Revealed = true
+	bid.Amount = amount
+	if err := putBid(APIstub, bid); err != nil {
+		return errorResponse(err)
+	}
+
+	bidAsBytes, _ = json.Marshal(bid)
+	return shim.Success(bidAsBytes)
+}
+
+/*
+ * closeAuction settles an auction after the reveal period. The highest revealed bid at or
+ * above the reserve wins, earlier commitments winning ties; the bike goes to the winner
+ * and the winning bid to the seller. Every other revealed bid is refunded. Anyone may
+ * close, since the outcome is fixed by the ledger. Args: auctionID
+ */
+func (s *SmartContract) closeAuction(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	auction, err := getAuction(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if auction.Status != auctionOpen {
+		return shim.Error("Auction " + args[0] + " is already closed")
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if now <= auction.RevealEnd {
+		return shim.Error("Auction " + args[0] + " cannot be closed before the reveal period ends")
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("BID", []string{auction.ID})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	var revealed []Bid
+	var winner *Bid
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		bid := Bid{}
+		if err := json.Unmarshal(queryResponse.Value, &bid); err != nil {
+			return errorResponse(err)
+		}
+		if !bid.Revealed {
+			continue
+		}
+		revealed = append(revealed, bid)
+	}
+	for i := range revealed {
+		bid := &revealed[i]
+		if bid.Amount < auction.ReservePrice {
+			continue
+		}
+		if winner == nil || bid.Amount > winner.Amount ||
+			(bid.Amount == winner.Amount && bid.CommittedAt < winner.CommittedAt) {
+			winner = bid
+		}
+	}
+
+	// The settlement moves funds and the bike in several steps, on staged state so each
+	// sees what the ones before wrote
+	staged := stageState(APIstub)
+
+	// The sale falls through if the bike can no longer change hands
+	if winner != nil {
+		bike, err := getBike(staged, auction.BikeKey)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if bike.Owner != auction.Seller || assertTransferable(staged, auction.BikeKey, bike) != nil ||
+			assertOwnerCapacity(staged, winner.Bidder) != nil ||
+			consumeLienApproval(staged, auction.BikeKey, winner.Bidder) != nil {
+			winner = nil
+		} else {
+			bike.Owner = winner.Bidder
+			if err := putBike(staged, auction.BikeKey, bike); err != nil {
+				return errorResponse(err)
+			}
+			if err := recordTransfer(staged, auction.BikeKey, auction.Seller, winner.Bidder, winner.Amount); err != nil {
+				return errorResponse(err)
+			}
+			// Anyone may close the auction, so the fee is left for the authority to collect
+			if _, err := recordTransferFee(staged, auction.BikeKey, auction.Seller, winner.Bidder, winner.Amount, false); err != nil {
+				return errorResponse(err)
+			}
+		}
+	}
+
+	for _, bid := range revealed {
+		payee := bid.Bidder
+		if winner != nil && bid.Bidder == winner.Bidder {
+			payee = auction.Seller
+		}
+		if err := moveFunds(staged, escrowAccount(auction.ID, bid.Bidder), payee, bid.Amount); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	auction.Status = auctionClosed
+	if winner != nil {
+		auction.Winner = winner.Bidder
+		auction.WinningBid = winner.Amount
+	}
+	if err := putAuction(staged, auction); err != nil {
+		return errorResponse(err)
+	}
+	markerKey, err := activeAuctionKey(staged, auction.BikeKey)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := staged.DelState(markerKey); err != nil {
+		return errorResponse(err)
+	}
+
+	auctionAsBytes, _ := json.Marshal(auction)
+	return shim.Success(auctionAsBytes)
+}
+
+// queryAuction returns an auction
+func (s *SmartContract) queryAuction(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	auction, err := getAuction(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	auctionAsBytes, _ := json.Marshal(auction)
+	return shim.Success(auctionAsBytes)
+}
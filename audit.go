@@ -0,0 +1,70 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// BikeAudit answers who registered a bike and who last changed it, and when
+type BikeAudit struct {
+	Key              string `json:"key"`
+	CreatedBy        string `json:"createdBy"`
+	CreatedTxID      string `json:"createdTxID"`
+	RegisteredAt     int64  `json:"registeredAt"`
+	LastModifiedBy   string `json:"lastModifiedBy"`
+	LastModifiedAt   int64  `json:"lastModifiedAt"`
+	LastModifiedTxID string `json:"lastModifiedTxID"`
+	LastTransferAt   int64  `json:"lastTransferAt"`
+}
+
+// stampAudit records the invoker and transaction on a bike about to be written. The
+// creation fields are only filled in for a new bike, so bikes registered before
+// auditing existed keep them empty rather than blaming a later editor.
+// Times come from the transaction timestamp, never the peer's clock, so endorsers agree.
+func stampAudit(APIstub shim.ChaincodeStubInterface, isNew bool, bike *Bike) error {
+	invoker, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return err
+	}
+
+	if isNew {
+		bike.CreatedBy = invoker
+		bike.CreatedTxID = APIstub.GetTxID()
+		bike.RegisteredAt = now
+	}
+	bike.LastModifiedBy = invoker
+	bike.LastModifiedAt = now
+	bike.LastModifiedTxID = APIstub.GetTxID()
+	return nil
+}
+
+// getBikeAudit returns the audit fields of a bike
+func (s *SmartContract) getBikeAudit(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	auditAsBytes, _ := json.Marshal(BikeAudit{
+		Key:              args[0],
+		CreatedBy:        bike.CreatedBy,
+		CreatedTxID:      bike.CreatedTxID,
+		RegisteredAt:     bike.RegisteredAt,
+		LastModifiedBy:   bike.LastModifiedBy,
+		LastModifiedAt:   bike.LastModifiedAt,
+		LastModifiedTxID: bike.LastModifiedTxID,
+		LastTransferAt:   bike.LastTransferAt,
+	})
+	return shim.Success(auditAsBytes)
+}
@@ -0,0 +1,233 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxBatchSize caps how many bikes a single createBikesBatch or transferBikesBatch transaction may handle
+const maxBatchSize = 1000
+
+// BatchBike is one entry of a createBikesBatch payload. Entries without an asset type are motorbikes.
+type BatchBike struct {
+	Key string `json:"key"`
+	VehicleInput
+}
+
+// BatchResult reports what happened to one entry of a batch
+type BatchResult struct {
+	Key   string `json:"key"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+/*
+ * createBikesBatch registers many bikes in one transaction. The bikes are a JSON array
+ * passed either as the only argument or, to keep large payloads out of the ledger,
+ * under the "bikes" transient key. Invalid entries are skipped and reported; valid
+ * ones are written. The response is the per-entry result list.
+ */
+func (s *SmartContract) createBikesBatch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	var payload []byte
+	if len(args) == 1 {
+		payload = []byte(args[0])
+	} else {
+		transient, err := APIstub.GetTransient()
+		if err != nil {
+			return errorResponse(err)
+		}
+		payload = transient["bikes"]
+		if payload == nil {
+			return errorResponse(invalidArgs("No bikes given as argument or in transient field \"bikes\""))
+		}
+	}
+
+	var bikes []BatchBike
+	if err := json.Unmarshal(payload, &bikes); err != nil {
+		return errorResponse(invalidArgs("Bikes must be a JSON array: %s", err.Error()))
+	}
+	if len(bikes) == 0 {
+		return errorResponse(invalidArgs("Batch is empty"))
+	}
+	if len(bikes) > maxBatchSize {
+		return errorResponse(invalidArgs("Batch holds %d bikes, the limit is %d", len(bikes), maxBatchSize))
+	}
+
+	quota, err := trackCreationQuota(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	results := make([]BatchResult, 0, len(bikes))
+	seen := make(map[string]bool)
+	seenRegNos := make(map[string]bool)
+	seenChassisNos := make(map[string]bool)
+	for _, b := range bikes {
+		result := BatchResult{Key: b.Key}
+		b.RegistrationNo = normalizeRegistrationNo(b.RegistrationNo)
+		b.ChassisNo = normalizeChassisNo(b.ChassisNo)
+		if err := validateBatchBike(b, seen, seenRegNos, seenChassisNos); err != nil {
+			result.Error = err.Error()
+		} else if err := quota.allow(); err != nil {
+			result.Error = err.Error()
+		} else if err := registerBike(APIstub, b.Key, b.toBike()); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.OK = true
+			quota.add()
+		}
+		seen[b.Key] = true
+		if b.RegistrationNo != "" {
+			seenRegNos[b.RegistrationNo] = true
+		}
+		if b.ChassisNo != "" {
+			seenChassisNos[b.ChassisNo] = true
+		}
+		results = append(results, result)
+	}
+	if err := quota.save(APIstub); err != nil {
+		return errorResponse(err)
+	}
+
+	resultsAsBytes, _ := json.Marshal(results)
+	return shim.Success(resultsAsBytes)
+}
+
+// validateBatchBike checks a batch entry does not reuse the key, registration number or
+// chassis number of an earlier entry. Writes are invisible to reads within a transaction, so registerBike
+// alone would not catch these.
+func validateBatchBike(b BatchBike, seen map[string]bool, seenRegNos map[string]bool, seenChassisNos map[string]bool) error {
+	if seen[b.Key] {
+		return invalidArgs("Key %s appears more than once in the batch", b.Key)
+	}
+	if seenRegNos[b.RegistrationNo] {
+		return invalidArgs("Registration number %s appears more than once in the batch", b.RegistrationNo)
+	}
+	if seenChassisNos[b.ChassisNo] {
+		return invalidArgs("Chassis number %s appears more than once in the batch", b.ChassisNo)
+	}
+	return nil
+}
+
+/*
+ * transferBikesBatch hands many bikes to newOwner in one transaction, e.g. a dealer moving
+ * stock to another branch. The invoker must own every bike. The batch is all or nothing:
+ * each bike is checked as for transferFrom, and if any fails the transaction fails naming
+ * them. Otherwise the response is the per-key result list. Args: newOwner, keys JSON array
+ */
+func (s *SmartContract) transferBikesBatch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	newOwner := args[0]
+	if newOwner == "" {
+		return errorResponse(invalidArgs("New owner must not be empty"))
+	}
+	var keys []string
+	if err := json.Unmarshal([]byte(args[1]), &keys); err != nil {
+		return errorResponse(invalidArgs("Keys must be a JSON array of strings: %s", err.Error()))
+	}
+	if len(keys) == 0 {
+		return errorResponse(invalidArgs("Batch is empty"))
+	}
+	if len(keys) > maxBatchSize {
+		return errorResponse(invalidArgs("Batch holds %d bikes, the limit is %d", len(keys), maxBatchSize))
+	}
+
+	// Reads do not see the writes of the same transaction, so the new owner's holdings
+	// are checked for the whole batch up front
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if config.MaxBikesPerOwner > 0 {
+		held, err := countOwnedBikes(APIstub, newOwner)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if held+len(keys) > config.MaxBikesPerOwner {
+			return shim.Error(fmt.Sprintf("%s holds %d bikes and may hold at most %d", newOwner, held, config.MaxBikesPerOwner))
+		}
+	}
+
+	results := make([]BatchResult, 0, len(keys))
+	bikes := make([]Bike, 0, len(keys))
+	var failed []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		result := BatchResult{Key: key}
+		bike, err := checkBatchTransfer(APIstub, key, newOwner, seen)
+		if err != nil {
+			result.Error = err.Error()
+			failed = append(failed, key+": "+result.Error)
+		} else {
+			result.OK = true
+		}
+		seen[key] = true
+		results = append(results, result)
+		bikes = append(bikes, bike)
+	}
+	if len(failed) > 0 {
+		return shim.Error(fmt.Sprintf("%d of %d bikes cannot be transferred: %s", len(failed), len(keys), strings.Join(failed, "; ")))
+	}
+
+	for i, key := range keys {
+		seller := bikes[i].Owner
+		// A pending sale cannot go through any more
+		if _, offer, err := getOffer(APIstub, key); err == nil {
+			if err := APIstub.DelState(offer); err != nil {
+				return errorResponse(err)
+			}
+		}
+		bikes[i].Owner = newOwner
+		if err := putBike(APIstub, key, bikes[i]); err != nil {
+			return errorResponse(err)
+		}
+		if err := recordTransfer(APIstub, key, seller, newOwner, 0); err != nil {
+			return errorResponse(err)
+		}
+		if _, err := recordTransferFee(APIstub, key, seller, newOwner, 0, false); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	resultsAsBytes, _ := json.Marshal(results)
+	return shim.Success(resultsAsBytes)
+}
+
+// checkBatchTransfer loads a bike of a transferBikesBatch and checks the invoker may hand it to newOwner
+func checkBatchTransfer(APIstub shim.ChaincodeStubInterface, key string, newOwner string, seen map[string]bool) (Bike, error) {
+	if seen[key] {
+		return Bike{}, invalidArgs("Key %s appears more than once in the batch", key)
+	}
+	bike, err := getMutableBike(APIstub, key)
+	if err != nil {
+		return bike, err
+	}
+	if err := assertOwnerOrDelegate(APIstub, key, bike); err != nil {
+		return bike, err
+	}
+	if bike.Owner == newOwner {
+		return bike, fmt.Errorf("Bike is already owned by %s", newOwner)
+	}
+	if err := assertTransferable(APIstub, key, bike); err != nil {
+		return bike, err
+	}
+	if err := assertCapability(APIstub, capabilityTransfer, nil); err != nil {
+		return bike, err
+	}
+	if err := assertNotAuctioned(APIstub, key); err != nil {
+		return bike, err
+	}
+	if err := assertNotReserved(APIstub, key, newOwner); err != nil {
+		return bike, err
+	}
+	return bike, consumeLienApproval(APIstub, key, newOwner)
+}
@@ -0,0 +1,138 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Chassis numbers are 17 character vehicle identification numbers after ISO 3779.
+// The letters I, O and Q are never used, to avoid confusion with 1 and 0.
+const (
+	chassisNoLength   = 17
+	chassisCheckDigit = 8
+)
+
+// chassisWeights are the weights of the positions of a chassis number in its check digit
+var chassisWeights = [chassisNoLength]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// chassisValue transliterates a character of a chassis number for the check digit, -1 if it is not allowed
+func chassisValue(r rune) int {
+	switch {
+	case r >= '0' && r <= '9':
+		return int(r - '0')
+	case r == 'I' || r == 'O' || r == 'Q':
+		return -1
+	case r >= 'A' && r <= 'H':
+		return int(r-'A') + 1
+	case r >= 'J' && r <= 'R':
+		return int(r-'J') + 1
+	case r >= 'S' && r <= 'Z':
+		return int(r-'S') + 2
+	}
+	return -1
+}
+
+// normalizeChassisNo strips spacing and case, as chassis numbers are written with the same
+// variations as registration numbers
+func normalizeChassisNo(chassisNo string) string {
+	return normalizeRegistrationNo(chassisNo)
+}
+
+// validateChassisNo checks the length, alphabet and check digit of a normalized chassis number
+func validateChassisNo(chassisNo string) error {
+	if len(chassisNo) != chassisNoLength {
+		return invalidArgs("Chassis number %s must be %d characters long", chassisNo, chassisNoLength)
+	}
+
+	sum := 0
+	for i, r := range chassisNo {
+		value := chassisValue(r)
+		if value < 0 {
+			return invalidArgs("Chassis number %s contains the invalid character %q", chassisNo, r)
+		}
+		sum += value * chassisWeights[i]
+	}
+	check := "0123456789X"[sum%11]
+	if chassisNo[chassisCheckDigit] != check {
+		return invalidArgs("Chassis number %s fails its check digit", chassisNo)
+	}
+	return nil
+}
+
+func chassisKey(APIstub shim.ChaincodeStubInterface, chassisNo string) (string, error) {
+	return APIstub.CreateCompositeKey("CHASSIS", []string{chassisNo})
+}
+
+// lookupChassisNo returns the key of the bike with chassisNo, or "" if none has it.
+// Index entries left behind by a bike that has since gone are ignored.
+func lookupChassisNo(APIstub shim.ChaincodeStubInterface, chassisNo string) (string, error) {
+	indexKey, err := chassisKey(APIstub, chassisNo)
+	if err != nil {
+		return "", err
+	}
+	keyAsBytes, err := APIstub.GetState(indexKey)
+	if err != nil || keyAsBytes == nil {
+		return "", err
+	}
+
+	bike, err := getBike(APIstub, string(keyAsBytes))
+	if err != nil || bike.ChassisNo != chassisNo {
+		return "", nil
+	}
+	return string(keyAsBytes), nil
+}
+
+// claimChassisNo records chassisNo as belonging to the bike under bikeKey, failing if another bike has it
+func claimChassisNo(APIstub shim.ChaincodeStubInterface, chassisNo string, bikeKey string) error {
+	holder, err := lookupChassisNo(APIstub, chassisNo)
+	if err != nil {
+		return err
+	}
+	if holder != "" && holder != bikeKey {
+		return fmt.Errorf("Chassis number %s is already registered to %s", chassisNo, holder)
+	}
+
+	indexKey, err := chassisKey(APIstub, chassisNo)
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(indexKey, []byte(bikeKey))
+}
+
+// queryBikeByChassis returns the bike with a chassis number as a QueryResult, optionally only the given fields
+func (s *SmartContract) queryBikeByChassis(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	fields, err := parseFields(args, 1)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := lookupChassisNo(APIstub, normalizeChassisNo(args[0]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	if key == "" {
+		return errorResponse(notFound("No bike with chassis number %s", args[0]))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertTenantKey(APIstub, config, key); err != nil {
+		return errorResponse(err)
+	}
+	bike, err := getBike(APIstub, key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	bikeAsBytes, _ := json.Marshal(bike)
+
+	resultAsBytes, _ := json.Marshal(newQueryResult(key, projectRecord(bikeAsBytes, fields)))
+	return shim.Success(resultAsBytes)
+}
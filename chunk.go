@@ -0,0 +1,132 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// defaultMaxResponseBytes keeps query responses well below the 4 MiB gRPC message limit
+// of peers and SDKs, leaving room for the envelope and the proposal response around them
+const defaultMaxResponseBytes = 2 << 20
+
+// ResultChunk is part of a query result that would not fit in one response. Results are
+// the entries from Offset on, of Total. Pass Continuation to continueQuery for the next
+// chunk; the last one has none.
+type ResultChunk struct {
+	Results      []json.RawMessage `json:"results"`
+	Offset       int               `json:"offset"`
+	Total        int               `json:"total"`
+	Continuation string            `json:"continuation,omitempty"`
+}
+
+// continuation is what a continuation token carries: the query to run again, where the
+// next chunk starts, and the hash of the whole result, which must not have changed meanwhile
+type continuation struct {
+	Function string   `json:"function"`
+	Args     []string `json:"args"`
+	Offset   int      `json:"offset"`
+	Hash     string   `json:"hash"`
+}
+
+// chunkedLayers are the middleware inside chunkResults, which continueQuery runs the
+// query through again
+var chunkedLayers = []Middleware{checkArgCount, scopeTenant, pseudonymizeOwners}
+
+// chunkResults splits the JSON array results of read-only functions into ResultChunks
+// when they exceed the maxResponseBytes of the config. Results that fit, and results that
+// are not arrays, pass unchanged, so callers only see chunks for large results.
+func chunkResults(name string, route Route, next HandlerFunc) HandlerFunc {
+	if !route.ReadOnly {
+		return next
+	}
+	return func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+		response := next(APIstub, args)
+		if response.Status >= shim.ERRORTHRESHOLD {
+			return response
+		}
+		config, err := getConfig(APIstub)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if config.MaxResponseBytes == 0 || len(response.Payload) <= config.MaxResponseBytes {
+			return response
+		}
+		entries := []json.RawMessage{}
+		if err := json.Unmarshal(response.Payload, &entries); err != nil {
+			return response
+		}
+		return chunkResponse(name, args, entries, stateHash(response.Payload), 0, config.MaxResponseBytes)
+	}
+}
+
+// chunkResponse returns the chunk of entries starting at offset, as many as fit in
+// maxBytes but at least one, with a continuation token unless it is the last chunk
+func chunkResponse(name string, args []string, entries []json.RawMessage, hash string, offset int, maxBytes int) sc.Response {
+	chunk := ResultChunk{Results: []json.RawMessage{}, Offset: offset, Total: len(entries)}
+	size := 0
+	end := offset
+	for end < len(entries) && (end == offset || size+len(entries[end])+1 <= maxBytes) {
+		size += len(entries[end]) + 1
+		end++
+	}
+	chunk.Results = entries[offset:end]
+	if end < len(entries) {
+		tokenAsBytes, _ := json.Marshal(continuation{Function: name, Args: args, Offset: end, Hash: hash})
+		chunk.Continuation = base64.RawURLEncoding.EncodeToString(tokenAsBytes)
+	}
+
+	chunkAsBytes, _ := json.Marshal(chunk)
+	return shim.Success(chunkAsBytes)
+}
+
+/*
+ * continueQuery returns the next chunk of a query result that was split into ResultChunks.
+ * The query runs again with the invoker's own rights; if its result changed since the
+ * first chunk, the call fails with STATE_CONFLICT and the query has to start over.
+ * Args: continuation token
+ */
+func (s *SmartContract) continueQuery(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	token := continuation{}
+	tokenAsBytes, err := base64.RawURLEncoding.DecodeString(args[0])
+	if err != nil || json.Unmarshal(tokenAsBytes, &token) != nil || token.Offset <= 0 {
+		return errorResponse(invalidArgs("Continuation token is not valid"))
+	}
+	route, ok := s.routes()[token.Function]
+	if !ok || !route.ReadOnly || token.Function == "continueQuery" {
+		return errorResponse(invalidArgs("Continuation token is not valid"))
+	}
+
+	handler := route.Handler
+	for i := len(chunkedLayers) - 1; i >= 0; i-- {
+		handler = chunkedLayers[i](token.Function, route, handler)
+	}
+	response := handler(APIstub, token.Args)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+	if stateHash(response.Payload) != token.Hash {
+		return errorResponse(stateConflict{what: "The result of " + token.Function})
+	}
+	entries := []json.RawMessage{}
+	if err := json.Unmarshal(response.Payload, &entries); err != nil || token.Offset >= len(entries) {
+		return errorResponse(invalidArgs("Continuation token is not valid"))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	maxBytes := config.MaxResponseBytes
+	if maxBytes == 0 {
+		maxBytes = len(response.Payload)
+	}
+
+	return chunkResponse(token.Function, token.Args, entries, token.Hash, token.Offset, maxBytes)
+}
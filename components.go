@@ -0,0 +1,356 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// componentReappearedEvent is the chaincode event set when a component is fitted to a bike
+// after having been on another one, the pattern of parts stripped from stolen bikes
+const componentReappearedEvent = "ComponentReappeared"
+
+// componentTypes are the major components tracked by serial number
+var componentTypes = map[string]bool{"engine": true, "frame": true, "battery": true}
+
+// Component is the component of a type currently fitted to a bike. SourceHash is the
+// SHA-256 digest of the document showing where it came from, such as an invoice.
+type Component struct {
+	BikeKey       string `json:"bikeKey"`
+	ComponentType string `json:"componentType"`
+	SerialNo      string `json:"serialNo"`
+	SourceHash    string `json:"sourceHash"`
+	FittedBy      string `json:"fittedBy"`
+	FittedAt      int64  `json:"fittedAt"`
+	TxID          string `json:"txID"`
+}
+
+// ComponentChange is an entry in the component log of a bike. PreviousSerialNo is the
+// component it replaced, empty for the first one of its type.
+type ComponentChange struct {
+	BikeKey          string `json:"bikeKey"`
+	Seq              string `json:"seq"`
+	ComponentType    string `json:"componentType"`
+	SerialNo         string `json:"serialNo"`
+	PreviousSerialNo string `json:"previousSerialNo,omitempty"`
+	SourceHash       string `json:"sourceHash"`
+	ChangedBy        string `json:"changedBy"`
+	ChangedAt        int64  `json:"changedAt"`
+	TxID             string `json:"txID"`
+}
+
+// ComponentTrail follows one component by serial number through the bikes it was fitted
+// to, oldest first. BikeKey is the bike it is on now, empty once it was replaced.
+type ComponentTrail struct {
+	ComponentType string            `json:"componentType"`
+	SerialNo      string            `json:"serialNo"`
+	BikeKey       string            `json:"bikeKey"`
+	Fittings      []ComponentFitted `json:"fittings"`
+}
+
+// ComponentFitted is a spell of a component on one bike. RemovedAt is 0 while it is still fitted.
+type ComponentFitted struct {
+	BikeKey   string `json:"bikeKey"`
+	FittedAt  int64  `json:"fittedAt"`
+	RemovedAt int64  `json:"removedAt,omitempty"`
+}
+
+// ComponentReappeared is the payload of the ComponentReappeared event
+type ComponentReappeared struct {
+	BikeKey       string   `json:"bikeKey"`
+	ComponentType string   `json:"componentType"`
+	SerialNo      string   `json:"serialNo"`
+	PreviousBikes []string `json:"previousBikes"`
+	Invoker       string   `json:"invoker"`
+}
+
+func componentKey(APIstub shim.ChaincodeStubInterface, bikeKey string, componentType string) (string, error) {
+	return APIstub.CreateCompositeKey("COMPONENT", []string{bikeKey, componentType})
+}
+
+func componentTrailKey(APIstub shim.ChaincodeStubInterface, componentType string, serialNo string) (string, error) {
+	return APIstub.CreateCompositeKey("COMPONENTTRAIL", []string{componentType, serialNo})
+}
+
+// getComponent returns the component of componentType fitted to a bike, or nil if there is none
+func getComponent(APIstub shim.ChaincodeStubInterface, bikeKey string, componentType string) (*Component, error) {
+	key, err := componentKey(APIstub, bikeKey, componentType)
+	if err != nil {
+		return nil, err
+	}
+	componentAsBytes, err := APIstub.GetState(key)
+	if err != nil || componentAsBytes == nil {
+		return nil, err
+	}
+
+	component := Component{}
+	err = json.Unmarshal(componentAsBytes, &component)
+	return &component, err
+}
+
+// getComponentTrail returns the trail of a component, empty if it was never fitted
+func getComponentTrail(APIstub shim.ChaincodeStubInterface, componentType string, serialNo string) (ComponentTrail, error) {
+	trail := ComponentTrail{ComponentType: componentType, SerialNo: serialNo, Fittings: []ComponentFitted{}}
+
+	key, err := componentTrailKey(APIstub, componentType, serialNo)
+	if err != nil {
+		return trail, err
+	}
+	trailAsBytes, err := APIstub.GetState(key)
+	if err != nil || trailAsBytes == nil {
+		return trail, err
+	}
+
+	err = json.Unmarshal(trailAsBytes, &trail)
+	return trail, err
+}
+
+func putComponentTrail(APIstub shim.ChaincodeStubInterface, trail ComponentTrail) error {
+	key, err := componentTrailKey(APIstub, trail.ComponentType, trail.SerialNo)
+	if err != nil {
+		return err
+	}
+	trailAsBytes, _ := json.Marshal(trail)
+	return APIstub.PutState(key, trailAsBytes)
+}
+
+// parseComponent checks a component type and normalizes a serial number, which are written
+// with the same variations of spacing and case as registration numbers
+func parseComponent(componentType string, serialNo string) (string, error) {
+	if !componentTypes[componentType] {
+		return "", invalidArgs("Unknown component type %s", componentType)
+	}
+	serialNo = normalizeRegistrationNo(serialNo)
+	if serialNo == "" {
+		return "", invalidArgs("Serial number must not be empty")
+	}
+	return serialNo, nil
+}
+
+/*
+ * replaceComponent fits a component to a bike, replacing the one of its type fitted so
+ * far, if any. The owner or a registrar may record it. A component fitted to another live
+ * bike cannot be fitted until it is replaced there. One that was on other bikes before
+ * raises a ComponentReappeared event naming them, for investigators to check against
+ * stolen bikes.
+ * Args: bikeKey, componentType, serialNo, sourceHash as a hex SHA-256 digest
+ */
+func (s *SmartContract) replaceComponent(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	serialNo, err := parseComponent(args[1], args[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+	digest, err := parseDigest(args[3])
+	if err != nil {
+		return errorResponse(err)
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwnerOrRegistrar(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	trail, err := getComponentTrail(APIstub, args[1], serialNo)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if trail.BikeKey == args[0] {
+		return shim.Error(fmt.Sprintf("The %s %s is already fitted to %s", args[1], serialNo, args[0]))
+	}
+	if trail.BikeKey != "" {
+		// A bike that is gone, e.g. scrapped and archived, leaves its components free
+		fitted, err := bikeExists(APIstub, trail.BikeKey)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if fitted {
+			return shim.Error(fmt.Sprintf("The %s %s is fitted to %s", args[1], serialNo, trail.BikeKey))
+		}
+	}
+
+	invoker, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	previous, err := getComponent(APIstub, args[0], args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	previousSerialNo := ""
+	if previous != nil {
+		previousSerialNo = previous.SerialNo
+		removed, err := getComponentTrail(APIstub, args[1], previous.SerialNo)
+		if err != nil {
+			return errorResponse(err)
+		}
+		removed.BikeKey = ""
+		if last := len(removed.Fittings) - 1; last >= 0 {
+			removed.Fittings[last].RemovedAt = now
+		}
+		if err := putComponentTrail(APIstub, removed); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	previousBikes := []string{}
+	for _, fitted := range trail.Fittings {
+		if fitted.BikeKey != args[0] {
+			previousBikes = append(previousBikes, fitted.BikeKey)
+		}
+	}
+	if last := len(trail.Fittings) - 1; last >= 0 && trail.Fittings[last].RemovedAt == 0 {
+		trail.Fittings[last].RemovedAt = now
+	}
+	trail.BikeKey = args[0]
+	trail.Fittings = append(trail.Fittings, ComponentFitted{BikeKey: args[0], FittedAt: now})
+	if err := putComponentTrail(APIstub, trail); err != nil {
+		return errorResponse(err)
+	}
+
+	component := Component{
+		BikeKey:       args[0],
+		ComponentType: args[1],
+		SerialNo:      serialNo,
+		SourceHash:    digest,
+		FittedBy:      invoker,
+		FittedAt:      now,
+		TxID:          APIstub.GetTxID(),
+	}
+	key, err := componentKey(APIstub, args[0], args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	componentAsBytes, _ := json.Marshal(component)
+	if err := APIstub.PutState(key, componentAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	seq, err := nextSeq(APIstub, "COMPONENTLOG", args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	change := ComponentChange{
+		BikeKey:          args[0],
+		Seq:              seq,
+		ComponentType:    args[1],
+		SerialNo:         serialNo,
+		PreviousSerialNo: previousSerialNo,
+		SourceHash:       digest,
+		ChangedBy:        invoker,
+		ChangedAt:        now,
+		TxID:             component.TxID,
+	}
+	logKey, err := APIstub.CreateCompositeKey("COMPONENTLOG", []string{args[0], seq})
+	if err != nil {
+		return errorResponse(err)
+	}
+	changeAsBytes, _ := json.Marshal(change)
+	if err := APIstub.PutState(logKey, changeAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	if len(previousBikes) > 0 {
+		alert := ComponentReappeared{BikeKey: args[0], ComponentType: args[1], SerialNo: serialNo, PreviousBikes: previousBikes, Invoker: invoker}
+		alertAsBytes, _ := json.Marshal(alert)
+		if err := APIstub.SetEvent(componentReappearedEvent, alertAsBytes); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	return shim.Success(componentAsBytes)
+}
+
+// getBikeComponents returns the components fitted to a bike, in type order. Args: bikeKey
+func (s *SmartContract) getBikeComponents(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("COMPONENT", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	components := []Component{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		component := Component{}
+		if err := json.Unmarshal(queryResponse.Value, &component); err != nil {
+			return errorResponse(err)
+		}
+		components = append(components, component)
+	}
+
+	componentsAsBytes, _ := json.Marshal(components)
+	return shim.Success(componentsAsBytes)
+}
+
+// getComponentLog returns every component change of a bike, oldest first. Args: bikeKey
+func (s *SmartContract) getComponentLog(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("COMPONENTLOG", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	changes := []ComponentChange{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		change := ComponentChange{}
+		if err := json.Unmarshal(queryResponse.Value, &change); err != nil {
+			return errorResponse(err)
+		}
+		changes = append(changes, change)
+	}
+
+	changesAsBytes, _ := json.Marshal(changes)
+	return shim.Success(changesAsBytes)
+}
+
+/*
+ * getComponentHistory returns the trail of a component through the bikes it was fitted
+ * to. A serial number that turns up on several bikes points to laundered parts.
+ * Args: componentType, serialNo
+ */
+func (s *SmartContract) getComponentHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	serialNo, err := parseComponent(args[0], args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	trail, err := getComponentTrail(APIstub, args[0], serialNo)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(trail.Fittings) == 0 {
+		return errorResponse(notFound("No %s with serial number %s was ever fitted", args[0], serialNo))
+	}
+
+	trailAsBytes, _ := json.Marshal(trail)
+	return shim.Success(trailAsBytes)
+}
@@ -0,0 +1,266 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// configKey holds the deployment's Config
+const configKey = "CONFIG"
+
+// Feature flags. Features are on unless the config switches them off.
+const (
+	featureRentals   = "rentals"
+	featureTelemetry = "telemetry"
+	featureTokens    = "tokens"
+	featureInsurance = "insurance"
+	featureLeasing   = "leasing"
+)
+
+// Config is the per-deployment policy, set at instantiate/upgrade time or through setConfig
+type Config struct {
+	// KeyPrefix starts every bike key; generated keys are KeyPrefix plus a padded number
+	KeyPrefix string `json:"keyPrefix"`
+	// ChaincodeName is the name clients reach this chaincode under, printed in QR payloads
+	ChaincodeName string `json:"chaincodeName"`
+	// MaxBikesPerOwner limits how many bikes one owner may hold, 0 for no limit
+	MaxBikesPerOwner int `json:"maxBikesPerOwner"`
+	// AdminMSPs may change the config
+	AdminMSPs []string `json:"adminMSPs"`
+	// RegistrarMSPs may register bikes; when empty anyone can. Both this and PoliceMSPs
+	// give way to the organization registry once an organization is onboarded.
+	RegistrarMSPs []string `json:"registrarMSPs"`
+	// TokenIssuerMSP may mint tokens and move them by fiat
+	TokenIssuerMSP string `json:"tokenIssuerMSP"`
+	// OfferTTLSeconds is how long a transfer offer stays open when the seller does not say
+	OfferTTLSeconds int64 `json:"offerTTLSeconds"`
+	// TelemetryRetention is how many telemetry entries are kept per bike
+	TelemetryRetention int `json:"telemetryRetention"`
+	// Manufacturers maps a make to the MSP of its manufacturer, who may issue recalls for it
+	Manufacturers map[string]string `json:"manufacturers"`
+	// StolenRegistry is consulted before transfers when its chaincode is set
+	StolenRegistry StolenRegistry `json:"stolenRegistry"`
+	// TestingAuthorityMSPs issue emission and fitness certificates
+	TestingAuthorityMSPs []string `json:"testingAuthorityMSPs"`
+	// BlockUnfit makes transferring a bike whose fitness certificate expired fail; otherwise
+	// the transaction goes through with a FitnessCertificateExpired event
+	BlockUnfit bool `json:"blockUnfit"`
+	// KYCRegistry is asked whether a new owner is verified before changeBikeOwner accepts
+	// them, when its chaincode is set
+	KYCRegistry KYCRegistry `json:"kycRegistry"`
+	// ArbiterMSPs resolve ownership disputes
+	ArbiterMSPs []string `json:"arbiterMSPs"`
+	// SubsidyMSPs are the government agencies that pay EV subsidies on e-bikes
+	SubsidyMSPs []string `json:"subsidyMSPs"`
+	// PoliceMSPs maintain the stolen bike watchlist
+	PoliceMSPs []string `json:"policeMSPs"`
+	// BlockWatchlisted makes registering or transferring a watchlisted bike fail; otherwise
+	// the transaction goes through with a StolenBikeAlert event
+	BlockWatchlisted bool `json:"blockWatchlisted"`
+	// ModificationApproval makes owners request changes to their bikes with
+	// requestModification, for a registrar to approve, instead of making them directly
+	ModificationApproval bool `json:"modificationApproval"`
+	// OwnerPseudonyms records owners, and the other parties named in records, by salted
+	// hash instead of enrollment ID, see pseudonym.go. It can only be switched on before
+	// any bike is registered, and not off again.
+	OwnerPseudonyms bool `json:"ownerPseudonyms"`
+	// TransferFees is the registration fee charged on changes of owner
+	TransferFees FeeSchedule `json:"transferFees"`
+	// CreationQuota caps how many bikes one identity may create, registrars excepted;
+	// zero means no cap
+	CreationQuota int `json:"creationQuota"`
+	// CreationQuotaWindowSeconds is the window the quota counts over; zero counts forever
+	CreationQuotaWindowSeconds int64 `json:"creationQuotaWindowSeconds"`
+	// Depreciation sets how estimateValue writes down the price a bike last sold at
+	Depreciation Depreciation `json:"depreciation"`
+	// Features switches optional subsystems off with false
+	Features map[string]bool `json:"features"`
+	// Tenants maps an MSP to the tenant its members are confined to, see tenant.go;
+	// without tenants the deployment is a single registry
+	Tenants map[string]string `json:"tenants"`
+	// MaxResponseBytes is the size above which query results are split into chunks, see
+	// chunk.go; zero never splits them
+	MaxResponseBytes int `json:"maxResponseBytes"`
+	// LogLevel is the chaincode log level, e.g. DEBUG or WARNING, unless the peer sets
+	// FABBIKE_LOG_LEVEL; empty keeps the shim's default
+	LogLevel string `json:"logLevel,omitempty"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		KeyPrefix:            "BIKE",
+		ChaincodeName:        "fabbike",
+		AdminMSPs:            []string{"Org1MSP"},
+		TokenIssuerMSP:       "Org1MSP",
+		PoliceMSPs:           []string{"PoliceMSP"},
+		TestingAuthorityMSPs: []string{"TestingAuthorityMSP"},
+		ArbiterMSPs:          []string{"ArbiterMSP"},
+		SubsidyMSPs:          []string{"GovernmentMSP"},
+		OfferTTLSeconds:      24 * 60 * 60,
+		TelemetryRetention:   100,
+		Depreciation:         Depreciation{Currency: "TOKEN", DefaultAnnualBps: 1500, FloorBps: 1000},
+		Features:             map[string]bool{},
+		MaxResponseBytes:     defaultMaxResponseBytes,
+	}
+}
+
+func (c Config) validate() error {
+	if c.KeyPrefix == "" || c.KeyPrefix[0] == 0x00 {
+		return invalidArgs("keyPrefix must be a non-empty simple key")
+	}
+	if c.ChaincodeName == "" || strings.Contains(c.ChaincodeName, qrSeparator) {
+		return invalidArgs("chaincodeName must be a non-empty chaincode name")
+	}
+	if c.MaxBikesPerOwner < 0 {
+		return invalidArgs("maxBikesPerOwner cannot be negative")
+	}
+	if c.CreationQuota < 0 || c.CreationQuotaWindowSeconds < 0 {
+		return invalidArgs("creationQuota and creationQuotaWindowSeconds cannot be negative")
+	}
+	if len(c.AdminMSPs) == 0 {
+		return invalidArgs("adminMSPs must name at least one organization")
+	}
+	if c.OfferTTLSeconds <= 0 {
+		return invalidArgs("offerTTLSeconds must be positive")
+	}
+	if c.TelemetryRetention <= 0 {
+		return invalidArgs("telemetryRetention must be positive")
+	}
+	if c.MaxResponseBytes < 0 {
+		return invalidArgs("maxResponseBytes cannot be negative")
+	}
+	for mspID, tenant := range c.Tenants {
+		if tenant == "" || strings.ContainsAny(tenant, tenantSeparator+"\x00") || strings.HasPrefix(tenant, c.KeyPrefix) {
+			return invalidArgs("tenants: %s must map to a name without %s that does not start with the key prefix", mspID, tenantSeparator)
+		}
+	}
+	// Keys are told apart by the tenant name they start with, see namespaceTenant
+	names := tenantNames(c)
+	for _, tenant := range names {
+		for _, other := range names {
+			if other != tenant && (strings.HasPrefix(other, tenant) || strings.HasSuffix(other, tenant)) {
+				return invalidArgs("tenants: %s and %s must not be prefixes or suffixes of one another", tenant, other)
+			}
+		}
+	}
+	if c.LogLevel != "" {
+		if _, err := shim.LogLevel(strings.ToUpper(c.LogLevel)); err != nil {
+			return fmt.Errorf("logLevel %s is not a log level", c.LogLevel)
+		}
+	}
+	if err := c.Depreciation.validate(); err != nil {
+		return err
+	}
+	return c.TransferFees.validate()
+}
+
+func (c Config) featureEnabled(name string) bool {
+	enabled, set := c.Features[name]
+	return !set || enabled
+}
+
+// getConfig returns the stored config, or the defaults if none was ever stored
+func getConfig(APIstub shim.ChaincodeStubInterface) (Config, error) {
+	config := defaultConfig()
+
+	configAsBytes, err := APIstub.GetState(configKey)
+	if err != nil || configAsBytes == nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(configAsBytes, &config)
+	return config, err
+}
+
+// applyConfig overlays the fields present in configJSON on the current config, validates
+// the result and stores it
+func applyConfig(APIstub shim.ChaincodeStubInterface, configJSON string) (Config, error) {
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return config, err
+	}
+	pseudonyms := config.OwnerPseudonyms
+	if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+		return config, invalidArgs("Config must be a JSON object: %s", err.Error())
+	}
+	if err := config.validate(); err != nil {
+		return config, err
+	}
+	if config.OwnerPseudonyms != pseudonyms {
+		if err := checkPseudonymSwitch(APIstub, config.OwnerPseudonyms); err != nil {
+			return config, err
+		}
+	}
+
+	configAsBytes, _ := json.Marshal(config)
+	if err := APIstub.PutState(configKey, configAsBytes); err != nil {
+		return config, err
+	}
+	configureLogging(config.LogLevel)
+	return config, nil
+}
+
+// requireFeature fails if the config switched the named feature off
+func requireFeature(APIstub shim.ChaincodeStubInterface, name string) error {
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	if !config.featureEnabled(name) {
+		return fmt.Errorf("The %s feature is disabled", name)
+	}
+	return nil
+}
+
+// assertAnyMSP fails unless the invoker belongs to one of mspIDs
+func assertAnyMSP(APIstub shim.ChaincodeStubInterface, mspIDs []string) error {
+	for _, mspID := range mspIDs {
+		if assertMSP(APIstub, mspID) == nil {
+			return nil
+		}
+	}
+	return unauthorized("Only members of %v can do this", mspIDs)
+}
+
+// getConfig returns the deployment config
+func (s *SmartContract) getConfig(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	configAsBytes, _ := json.Marshal(config)
+	return shim.Success(configAsBytes)
+}
+
+/*
+ * setConfig changes the deployment config. Only members of an admin MSP may call it.
+ * Fields left out of the JSON keep their current value. Args: config JSON
+ */
+func (s *SmartContract) setConfig(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	current, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, current.AdminMSPs); err != nil {
+		return errorResponse(err)
+	}
+
+	config, err := applyConfig(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	configAsBytes, _ := json.Marshal(config)
+	return shim.Success(configAsBytes)
+}
@@ -0,0 +1,226 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A new owner consents to a transfer by signing the ConsentPayload of buildConsentPayload
+// with the key of their enrollment certificate. The client passes the payload exactly as
+// returned in the transient field "consent" and the signature in "consentSignature".
+// Signatures are ECDSA over the SHA-256 of the payload, DER encoded, as the Fabric SDKs
+// produce them. They are checked against the certificate the new owner registered with
+// registerConsentCert, which the chaincode read from their own signed transaction.
+
+// ConsentPayload is what a new owner signs to accept a bike. It names the bike version, so
+// a consent is spent by the transfer it allows, and the channel, so it cannot be replayed elsewhere.
+type ConsentPayload struct {
+	Channel     string `json:"channel"`
+	BikeKey     string `json:"bikeKey"`
+	Seller      string `json:"seller"`
+	NewOwner    string `json:"newOwner"`
+	BikeVersion int    `json:"bikeVersion"`
+	ExpiresAt   int64  `json:"expiresAt"`
+}
+
+// ConsentCert is the certificate an owner verifies consents with
+type ConsentCert struct {
+	Owner        string `json:"owner"`
+	Certificate  string `json:"certificate"`
+	RegisteredAt int64  `json:"registeredAt"`
+}
+
+// ecdsaSignature is the DER structure of an ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func consentCertKey(APIstub shim.ChaincodeStubInterface, owner string) (string, error) {
+	return APIstub.CreateCompositeKey("CONSENTCERT", []string{owner})
+}
+
+// getConsentCert returns the certificate owner registered for consents, or nil if there is none
+func getConsentCert(APIstub shim.ChaincodeStubInterface, owner string) (*x509.Certificate, error) {
+	key, err := consentCertKey(APIstub, owner)
+	if err != nil {
+		return nil, err
+	}
+	certAsBytes, err := APIstub.GetState(key)
+	if err != nil || certAsBytes == nil {
+		return nil, err
+	}
+	record := ConsentCert{}
+	if err := json.Unmarshal(certAsBytes, &record); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(record.Certificate))
+	if block == nil {
+		return nil, fmt.Errorf("Consent certificate of %s is not PEM encoded", owner)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// hasConsent tells whether the transaction carries a signed consent
+func hasConsent(APIstub shim.ChaincodeStubInterface) (bool, error) {
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return false, err
+	}
+	return len(transient["consent"]) > 0, nil
+}
+
+// verifyConsent checks the transient consent was signed by newOwner for handing over the bike
+// under key as it stands now
+func verifyConsent(APIstub shim.ChaincodeStubInterface, key string, bike Bike, newOwner string) error {
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return err
+	}
+	payloadAsBytes, signatureAsBytes := transient["consent"], transient["consentSignature"]
+	if len(payloadAsBytes) == 0 || len(signatureAsBytes) == 0 {
+		return invalidArgs("Consent and signature must be given in the transient fields \"consent\" and \"consentSignature\"")
+	}
+
+	payload := ConsentPayload{}
+	if err := json.Unmarshal(payloadAsBytes, &payload); err != nil {
+		return invalidArgs("Consent must be a JSON object: %s", err.Error())
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return err
+	}
+	expected := ConsentPayload{
+		Channel:     APIstub.GetChannelID(),
+		BikeKey:     key,
+		Seller:      bike.Owner,
+		NewOwner:    newOwner,
+		BikeVersion: bike.Version,
+		ExpiresAt:   payload.ExpiresAt,
+	}
+	if payload != expected {
+		return fmt.Errorf("Consent is not for handing version %d of %s from %s to %s", bike.Version, key, bike.Owner, newOwner)
+	}
+	if now > payload.ExpiresAt {
+		return fmt.Errorf("Consent of %s expired", newOwner)
+	}
+
+	cert, err := getConsentCert(APIstub, newOwner)
+	if err != nil {
+		return err
+	}
+	if cert == nil {
+		return fmt.Errorf("%s has not registered a consent certificate", newOwner)
+	}
+	if now > cert.NotAfter.Unix() {
+		return fmt.Errorf("Consent certificate of %s expired", newOwner)
+	}
+	publicKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Consent certificate of %s does not hold an ECDSA key", newOwner)
+	}
+	signature := ecdsaSignature{}
+	if rest, err := asn1.Unmarshal(signatureAsBytes, &signature); err != nil || len(rest) > 0 {
+		return fmt.Errorf("Consent signature is not a DER encoded ECDSA signature")
+	}
+	digest := sha256.Sum256(payloadAsBytes)
+	if !ecdsa.Verify(publicKey, digest[:], signature.R, signature.S) {
+		return fmt.Errorf("Consent signature does not verify against the certificate of %s", newOwner)
+	}
+	return nil
+}
+
+/*
+ * registerConsentCert records the invoker's enrollment certificate for verifying their
+ * transfer consents. It is read from the identity that signed this transaction, so nobody
+ * can register a certificate for someone else. Registering again replaces the certificate,
+ * e.g. after re-enrolling.
+ */
+func (s *SmartContract) registerConsentCert(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	owner, err := getInvokerRef(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	identity, err := clientIdentity(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	cert, err := identity.GetX509Certificate()
+	if err != nil {
+		return errorResponse(err)
+	}
+	if cert == nil {
+		return errorResponse(unauthorized("Invoking identity has no X.509 certificate"))
+	}
+	if _, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok {
+		return shim.Error("Consents can only be verified for ECDSA certificates")
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	record := ConsentCert{
+		Owner:        owner,
+		Certificate:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		RegisteredAt: now,
+	}
+	key, err := consentCertKey(APIstub, owner)
+	if err != nil {
+		return errorResponse(err)
+	}
+	recordAsBytes, _ := json.Marshal(record)
+	if err := APIstub.PutState(key, recordAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(recordAsBytes)
+}
+
+/*
+ * buildConsentPayload returns the bytes the new owner has to sign to consent to having the
+ * bike handed to them by changeBikeOwner, as the JSON string in the data of the response.
+ * Client SDKs sign the string as it is, without re-encoding it, and pass it along with the
+ * signature. The consent is good until expiresAt, a Unix timestamp, or until the bike
+ * changes. Args: bikeKey, newOwner, expiresAt
+ */
+func (s *SmartContract) buildConsentPayload(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	expiresAt, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errorResponse(invalidArgs("Expiry must be a Unix timestamp"))
+	}
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if args[1] == "" || args[1] == bike.Owner {
+		return errorResponse(invalidArgs("New owner must be someone other than the owner"))
+	}
+
+	payloadAsBytes, _ := json.Marshal(ConsentPayload{
+		Channel:     APIstub.GetChannelID(),
+		BikeKey:     args[0],
+		Seller:      bike.Owner,
+		NewOwner:    args[1],
+		BikeVersion: bike.Version,
+		ExpiresAt:   expiresAt,
+	})
+	// As a JSON string the payload comes out of the envelope byte for byte
+	payloadAsString, _ := json.Marshal(string(payloadAsBytes))
+	return shim.Success(payloadAsString)
+}
@@ -0,0 +1,153 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// BikeCount is the answer of countBikes
+type BikeCount struct {
+	Tenant string `json:"tenant,omitempty"`
+	Count  int    `json:"count"`
+}
+
+// keyTenant returns the tenant of config whose namespace key lies in, "" for the plain
+// namespace and for keys outside every tenant's key prefix
+func keyTenant(config Config, key string) string {
+	for _, tenant := range tenantNames(config) {
+		if strings.HasPrefix(key, tenantKeyPrefix(config, tenant)) {
+			return tenant
+		}
+	}
+	return ""
+}
+
+// The count of a tenant is the sum of the entries under BIKECOUNT[tenant]. Each create or
+// archive adds its own BIKECOUNT[tenant, txID, bikeKey] entry of +1 or -1 rather than
+// rewriting a shared total, so concurrent registrations never conflict on the count.
+// compactBikeCounts folds the entries into one again, keyed by the compacting transaction.
+
+// getBikeCount returns the number of live bikes of tenant
+func getBikeCount(APIstub shim.ChaincodeStubInterface, tenant string) (int, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("BIKECOUNT", []string{tenant})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		delta, err := strconv.Atoi(string(queryResponse.Value))
+		if err != nil {
+			return 0, fmt.Errorf("Bike count entry %s is not a number", queryResponse.Key)
+		}
+		count += delta
+	}
+	return count, nil
+}
+
+// putBikeCount replaces the entries of tenant's count by one holding count
+func putBikeCount(APIstub shim.ChaincodeStubInterface, tenant string, count int) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("BIKECOUNT", []string{tenant})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if err := APIstub.DelState(queryResponse.Key); err != nil {
+			return err
+		}
+	}
+	key, err := APIstub.CreateCompositeKey("BIKECOUNT", []string{tenant, APIstub.GetTxID(), ""})
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(key, []byte(strconv.Itoa(count)))
+}
+
+// adjustBikeCount adds delta to the count of live bikes in the namespace of bike key
+func adjustBikeCount(APIstub shim.ChaincodeStubInterface, key string, delta int) error {
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	countKey, err := APIstub.CreateCompositeKey("BIKECOUNT", []string{keyTenant(config, key), APIstub.GetTxID(), key})
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(countKey, []byte(strconv.Itoa(delta)))
+}
+
+/*
+ * countBikes returns how many live bikes there are, from counters kept up as bikes are
+ * created and archived, so it reads the entries written since the last compaction rather
+ * than the fleet. Invokers confined to a tenant get the count of its bikes. Bikes created
+ * before the counter existed are counted once an admin runs rebuildIndexes.
+ */
+func (s *SmartContract) countBikes(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	tenant, err := callerTenant(APIstub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
+	count, err := getBikeCount(APIstub, tenant)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	countAsBytes, _ := json.Marshal(BikeCount{Tenant: tenant, Count: count})
+	return shim.Success(countAsBytes)
+}
+
+/*
+ * compactBikeCounts folds the count entries of every tenant into one, so countBikes reads
+ * a single key again. Concurrent creations and archives only make the compaction itself
+ * fail validation, to be retried. Only admins may run it.
+ */
+func (s *SmartContract) compactBikeCounts(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, config.AdminMSPs); err != nil {
+		return errorResponse(err)
+	}
+
+	counts := []BikeCount{}
+	for _, tenant := range append([]string{""}, tenantNames(config)...) {
+		count, err := getBikeCount(APIstub, tenant)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if err := putBikeCount(APIstub, tenant, count); err != nil {
+			return errorResponse(err)
+		}
+		counts = append(counts, BikeCount{Tenant: tenant, Count: count})
+	}
+
+	countsAsBytes, _ := json.Marshal(counts)
+	return shim.Success(countsAsBytes)
+}
@@ -0,0 +1,194 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Delegation is a power of attorney: the owner who granted it lets DelegateID, a dealer or
+// a family member say, transfer the bike on their behalf until Expiry. It lapses by itself
+// once the transaction timestamp passes Expiry, or once the bike changes hands.
+type Delegation struct {
+	BikeKey    string `json:"bikeKey"`
+	DelegateID string `json:"delegateID"`
+	GrantedBy  string `json:"grantedBy"`
+	GrantedAt  int64  `json:"grantedAt"`
+	Expiry     int64  `json:"expiry"`
+}
+
+func delegationKey(APIstub shim.ChaincodeStubInterface, bikeKey string, delegateID string) (string, error) {
+	return APIstub.CreateCompositeKey("DELEGATE", []string{bikeKey, delegateID})
+}
+
+// valid reports whether the delegation still holds for bike at now
+func (delegation Delegation) valid(bike Bike, now int64) bool {
+	return delegation.GrantedBy == bike.Owner && now <= delegation.Expiry
+}
+
+// getDelegation returns the delegation to delegateID that holds for bike right now, or nil
+func getDelegation(APIstub shim.ChaincodeStubInterface, bikeKey string, bike Bike, delegateID string) (*Delegation, error) {
+	key, err := delegationKey(APIstub, bikeKey, delegateID)
+	if err != nil {
+		return nil, err
+	}
+	delegationAsBytes, err := APIstub.GetState(key)
+	if err != nil || delegationAsBytes == nil {
+		return nil, err
+	}
+	delegation := Delegation{}
+	if err := json.Unmarshal(delegationAsBytes, &delegation); err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return nil, err
+	}
+	if !delegation.valid(bike, now) {
+		return nil, nil
+	}
+	return &delegation, nil
+}
+
+// assertOwnerOrDelegate fails unless the invoker owns the bike under key or holds a
+// delegation from its owner to transfer it
+func assertOwnerOrDelegate(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	if assertOwner(APIstub, key, bike) == nil {
+		return nil
+	}
+	invoker, err := getInvokerRef(APIstub)
+	if err != nil {
+		return err
+	}
+	delegation, err := getDelegation(APIstub, key, bike, invoker)
+	if err != nil {
+		return err
+	}
+	if delegation == nil {
+		return unauthorized("Only the owner of %s or their delegate can do this", key)
+	}
+	return nil
+}
+
+/*
+ * grantDelegate lets delegateID transfer a bike on the owner's behalf until expiry, a Unix
+ * timestamp. Only the owner may grant; a new grant to the same delegate replaces the last.
+ * The delegate may offer the bike and hand it over, but not do anything else an owner can.
+ * Args: bikeKey, delegateID, expiry
+ */
+func (s *SmartContract) grantDelegate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Delegate ID must not be empty"))
+	}
+	expiry, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errorResponse(invalidArgs("Expiry must be a Unix timestamp"))
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if args[1] == bike.Owner {
+		return errorResponse(invalidArgs("Bike %s is already owned by %s", args[0], args[1]))
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if expiry <= now {
+		return errorResponse(invalidArgs("Expiry must be after %d", now))
+	}
+
+	delegation := Delegation{
+		BikeKey:    args[0],
+		DelegateID: args[1],
+		GrantedBy:  bike.Owner,
+		GrantedAt:  now,
+		Expiry:     expiry,
+	}
+	key, err := delegationKey(APIstub, args[0], args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	delegationAsBytes, _ := json.Marshal(delegation)
+	if err := APIstub.PutState(key, delegationAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(delegationAsBytes)
+}
+
+// revokeDelegate withdraws a delegation before it expires. Only the owner may revoke. Args: bikeKey, delegateID
+func (s *SmartContract) revokeDelegate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	delegation, err := getDelegation(APIstub, args[0], bike, args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if delegation == nil {
+		return errorResponse(notFound("%s is not a delegate for %s", args[1], args[0]))
+	}
+
+	key, err := delegationKey(APIstub, args[0], args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.DelState(key); err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+// getDelegates returns the delegations that hold for a bike right now. Args: bikeKey
+func (s *SmartContract) getDelegates(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("DELEGATE", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	delegations := []Delegation{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		delegation := Delegation{}
+		if err := json.Unmarshal(queryResponse.Value, &delegation); err != nil {
+			return errorResponse(err)
+		}
+		if delegation.valid(bike, now) {
+			delegations = append(delegations, delegation)
+		}
+	}
+
+	delegationsAsBytes, _ := json.Marshal(delegations)
+	return shim.Success(delegationsAsBytes)
+}
@@ -0,0 +1,303 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// statusDisputed is the status of a bike while a dispute over its ownership is open.
+	// Like a rented bike, it cannot change hands meanwhile.
+	statusDisputed = "DISPUTED"
+
+	disputeOpen     = "OPEN"
+	disputeResolved = "RESOLVED"
+)
+
+// Dispute is a claim that a bike belongs to someone other than its owner, typically the
+// victim of a theft against the buyer of the stolen bike. Its ID is the opening transaction ID.
+type Dispute struct {
+	DisputeID  string     `json:"disputeID"`
+	BikeKey    string     `json:"bikeKey"`
+	Claimant   string     `json:"claimant"`
+	Respondent string     `json:"respondent"`
+	Evidence   []Evidence `json:"evidence"`
+	Status     string     `json:"status"`
+	OpenedBy   string     `json:"openedBy"`
+	OpenedAt   int64      `json:"openedAt"`
+	Winner     string     `json:"winner,omitempty"`
+	ResolvedBy string     `json:"resolvedBy,omitempty"`
+	ResolvedAt int64      `json:"resolvedAt,omitempty"`
+}
+
+// Evidence anchors a document kept off-chain by its SHA-256 digest
+type Evidence struct {
+	SHA256      string `json:"sha256"`
+	SubmittedBy string `json:"submittedBy"`
+	SubmittedAt int64  `json:"submittedAt"`
+}
+
+func getDispute(APIstub shim.ChaincodeStubInterface, disputeID string) (Dispute, error) {
+	dispute := Dispute{}
+
+	key, err := APIstub.CreateCompositeKey("DISPUTE", []string{disputeID})
+	if err != nil {
+		return dispute, err
+	}
+	disputeAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return dispute, err
+	}
+	if disputeAsBytes == nil {
+		return dispute, notFound("Dispute %s does not exist", disputeID)
+	}
+
+	err = json.Unmarshal(disputeAsBytes, &dispute)
+	return dispute, err
+}
+
+func putDispute(APIstub shim.ChaincodeStubInterface, dispute Dispute) error {
+	key, err := APIstub.CreateCompositeKey("DISPUTE", []string{dispute.DisputeID})
+	if err != nil {
+		return err
+	}
+	disputeAsBytes, _ := json.Marshal(dispute)
+	return APIstub.PutState(key, disputeAsBytes)
+}
+
+// newEvidence records digest as submitted by the invoker now
+func newEvidence(APIstub shim.ChaincodeStubInterface, digest string) (Evidence, error) {
+	submitter, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return Evidence{}, err
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return Evidence{}, err
+	}
+	return Evidence{SHA256: digest, SubmittedBy: submitter, SubmittedAt: now}, nil
+}
+
+// assertArbiter fails unless the invoker belongs to one of the arbiter MSPs of the config
+func assertArbiter(APIstub shim.ChaincodeStubInterface) error {
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	return assertAnyMSP(APIstub, config.ArbiterMSPs)
+}
+
+/*
+ * openDispute contests the ownership of a bike on behalf of claimantID, who says it is
+ * theirs, e.g. because it was stolen from them. The claimant opens it themselves, or a
+ * registrar for them. Until an arbiter resolves the dispute the bike is DISPUTED and cannot
+ * change hands. Args: bikeKey, claimantID, evidenceHash as a hex SHA-256 digest
+ */
+func (s *SmartContract) openDispute(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Claimant must not be empty"))
+	}
+	digest, err := parseDigest(args[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if invoker, err := getInvokerRef(APIstub); err != nil || invoker != args[1] {
+		if err := assertRole(APIstub, "registrar"); err != nil {
+			return errorResponse(unauthorized("Only %s or a registrar can open this dispute", args[1]))
+		}
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if bike.Owner == args[1] {
+		return errorResponse(invalidArgs("Bike %s is already owned by %s", args[0], args[1]))
+	}
+	if bike.Status != statusActive {
+		return shim.Error(fmt.Sprintf("Bike %s is %s and cannot be disputed", args[0], bike.Status))
+	}
+
+	evidence, err := newEvidence(APIstub, digest)
+	if err != nil {
+		return errorResponse(err)
+	}
+	dispute := Dispute{
+		DisputeID:  APIstub.GetTxID(),
+		BikeKey:    args[0],
+		Claimant:   args[1],
+		Respondent: bike.Owner,
+		Evidence:   []Evidence{evidence},
+		Status:     disputeOpen,
+		OpenedBy:   evidence.SubmittedBy,
+		OpenedAt:   evidence.SubmittedAt,
+	}
+	if err := putDispute(APIstub, dispute); err != nil {
+		return errorResponse(err)
+	}
+	indexKey, err := APIstub.CreateCompositeKey("DISPUTEBYBIKE", []string{args[0], dispute.DisputeID})
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.PutState(indexKey, []byte{0x00}); err != nil {
+		return errorResponse(err)
+	}
+	bike.Status = statusDisputed
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	disputeAsBytes, _ := json.Marshal(dispute)
+	return shim.Success(disputeAsBytes)
+}
+
+/*
+ * submitEvidence adds a document to an open dispute. The claimant, the respondent, and
+ * the arbiters may submit. Args: disputeID, evidenceHash as a hex SHA-256 digest
+ */
+func (s *SmartContract) submitEvidence(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	digest, err := parseDigest(args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	dispute, err := getDispute(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if dispute.Status != disputeOpen {
+		return shim.Error(fmt.Sprintf("Dispute %s is already %s", args[0], dispute.Status))
+	}
+	if invoker, err := getInvokerRef(APIstub); err != nil || (invoker != dispute.Claimant && invoker != dispute.Respondent) {
+		if err := assertArbiter(APIstub); err != nil {
+			return errorResponse(unauthorized("Only the parties to dispute %s or an arbiter can submit evidence", args[0]))
+		}
+	}
+	for _, evidence := range dispute.Evidence {
+		if evidence.SHA256 == digest {
+			return shim.Error("Evidence is already submitted")
+		}
+	}
+
+	evidence, err := newEvidence(APIstub, digest)
+	if err != nil {
+		return errorResponse(err)
+	}
+	dispute.Evidence = append(dispute.Evidence, evidence)
+	if err := putDispute(APIstub, dispute); err != nil {
+		return errorResponse(err)
+	}
+
+	disputeAsBytes, _ := json.Marshal(dispute)
+	return shim.Success(disputeAsBytes)
+}
+
+/*
+ * resolveDispute settles an open dispute in favour of winner, the claimant or the
+ * respondent. Only the arbiter MSPs of the config may resolve. If the claimant wins the
+ * bike passes to them, logged as a transfer; either way it is ACTIVE again.
+ * Args: disputeID, winner
+ */
+func (s *SmartContract) resolveDispute(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertArbiter(APIstub); err != nil {
+		return errorResponse(err)
+	}
+	dispute, err := getDispute(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if dispute.Status != disputeOpen {
+		return shim.Error(fmt.Sprintf("Dispute %s is already %s", args[0], dispute.Status))
+	}
+	if args[1] != dispute.Claimant && args[1] != dispute.Respondent {
+		return errorResponse(invalidArgs("Winner must be the claimant %s or the respondent %s", dispute.Claimant, dispute.Respondent))
+	}
+	bike, err := getMutableBike(APIstub, dispute.BikeKey)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	arbiter, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	dispute.Status = disputeResolved
+	dispute.Winner = args[1]
+	dispute.ResolvedBy = arbiter
+	dispute.ResolvedAt = now
+	if err := putDispute(APIstub, dispute); err != nil {
+		return errorResponse(err)
+	}
+
+	previousOwner := bike.Owner
+	bike.Status = statusActive
+	bike.Owner = args[1]
+	if err := putBike(APIstub, dispute.BikeKey, bike); err != nil {
+		return errorResponse(err)
+	}
+	if previousOwner != bike.Owner {
+		if err := recordTransfer(APIstub, dispute.BikeKey, previousOwner, bike.Owner, 0); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	disputeAsBytes, _ := json.Marshal(dispute)
+	return shim.Success(disputeAsBytes)
+}
+
+// getDispute returns a dispute with its evidence. Args: disputeID
+func (s *SmartContract) getDispute(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	dispute, err := getDispute(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	disputeAsBytes, _ := json.Marshal(dispute)
+	return shim.Success(disputeAsBytes)
+}
+
+// getDisputes returns every dispute opened over a bike, resolved ones included. Args: bikeKey
+func (s *SmartContract) getDisputes(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("DISPUTEBYBIKE", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	disputes := []Dispute{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return errorResponse(err)
+		}
+		dispute, err := getDispute(APIstub, attributes[1])
+		if err != nil {
+			return errorResponse(err)
+		}
+		disputes = append(disputes, dispute)
+	}
+
+	disputesAsBytes, _ := json.Marshal(disputes)
+	return shim.Success(disputesAsBytes)
+}
@@ -0,0 +1,192 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Document anchors a file kept off-chain (photos, RC book) by its SHA-256 digest
+type Document struct {
+	BikeKey    string `json:"bikeKey"`
+	DocType    string `json:"docType"`
+	SHA256     string `json:"sha256"`
+	URI        string `json:"uri"`
+	AttachedBy string `json:"attachedBy"`
+	AttachedAt int64  `json:"attachedAt"`
+	Revoked    bool   `json:"revoked"`
+	RevokedAt  int64  `json:"revokedAt,omitempty"`
+}
+
+// parseDigest accepts a hex encoded SHA-256 digest in either case and returns it in lower case
+func parseDigest(digest string) (string, error) {
+	digest = strings.ToLower(digest)
+	decoded, err := hex.DecodeString(digest)
+	if err != nil || len(decoded) != 32 {
+		return "", invalidArgs("Digest must be a hex encoded SHA-256 hash")
+	}
+	return digest, nil
+}
+
+func documentKey(APIstub shim.ChaincodeStubInterface, bikeKey string, docType string, digest string) (string, error) {
+	return APIstub.CreateCompositeKey("DOC", []string{bikeKey, docType, digest})
+}
+
+func getDocument(APIstub shim.ChaincodeStubInterface, bikeKey string, docType string, digest string) (*Document, string, error) {
+	key, err := documentKey(APIstub, bikeKey, docType, digest)
+	if err != nil {
+		return nil, "", err
+	}
+	docAsBytes, err := APIstub.GetState(key)
+	if err != nil || docAsBytes == nil {
+		return nil, key, err
+	}
+
+	doc := Document{}
+	err = json.Unmarshal(docAsBytes, &doc)
+	return &doc, key, err
+}
+
+/*
+ * attachDocument anchors an off-chain document to a bike. Only the owner may attach.
+ * Args: bikeKey, docType, sha256, uri
+ */
+func (s *SmartContract) attachDocument(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Document type must not be empty"))
+	}
+	digest, err := parseDigest(args[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	existing, key, err := getDocument(APIstub, args[0], args[1], digest)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if existing != nil && !existing.Revoked {
+		return shim.Error("Document is already attached")
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	doc := Document{
+		BikeKey:    args[0],
+		DocType:    args[1],
+		SHA256:     digest,
+		URI:        args[3],
+		AttachedBy: bike.Owner,
+		AttachedAt: now,
+	}
+	docAsBytes, _ := json.Marshal(doc)
+	if err := APIstub.PutState(key, docAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(docAsBytes)
+}
+
+// DocumentVerification is the answer to verifyDocument
+type DocumentVerification struct {
+	Valid    bool      `json:"valid"`
+	Document *Document `json:"document,omitempty"`
+}
+
+/*
+ * verifyDocument tells whether a file with the given digest is attached to the bike as
+ * docType and has not been revoked. Args: bikeKey, docType, sha256
+ */
+func (s *SmartContract) verifyDocument(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	digest, err := parseDigest(args[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+	doc, _, err := getDocument(APIstub, args[0], args[1], digest)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	verificationAsBytes, _ := json.Marshal(DocumentVerification{Valid: doc != nil && !doc.Revoked, Document: doc})
+	return shim.Success(verificationAsBytes)
+}
+
+// revokeDocument withdraws an attached document. Only the owner may revoke. Args: bikeKey, docType, sha256
+func (s *SmartContract) revokeDocument(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	digest, err := parseDigest(args[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	doc, key, err := getDocument(APIstub, args[0], args[1], digest)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if doc == nil || doc.Revoked {
+		return errorResponse(notFound("No such attached document"))
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	doc.Revoked = true
+	doc.RevokedAt = now
+	docAsBytes, _ := json.Marshal(doc)
+	if err := APIstub.PutState(key, docAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(docAsBytes)
+}
+
+// listDocuments returns the documents of a bike, revoked ones included.
+// Args: bikeKey and optionally a docType to narrow the list.
+func (s *SmartContract) listDocuments(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("DOC", args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	docs := []Document{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		doc := Document{}
+		if err := json.Unmarshal(queryResponse.Value, &doc); err != nil {
+			return errorResponse(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	docsAsBytes, _ := json.Marshal(docs)
+	return shim.Success(docsAsBytes)
+}
@@ -0,0 +1,75 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * setBikeEndorsementPolicy attaches a key-level endorsement policy to a bike, so any later
+ * write to it, a transfer included, needs a peer endorsement from every listed organization.
+ * Only the owner may set it, and the change itself must satisfy whatever policy is already set.
+ * Args: key, mspID...
+ */
+func (s *SmartContract) setBikeEndorsementPolicy(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	ep, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := ep.AddOrgs(statebased.RoleTypePeer, args[1:]...); err != nil {
+		return errorResponse(err)
+	}
+	policy, err := ep.Policy()
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.SetStateValidationParameter(args[0], policy); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// getBikeEndorsementPolicy lists the organizations that must endorse writes to a bike
+func (s *SmartContract) getBikeEndorsementPolicy(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	orgs, err := endorsingOrgs(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	orgsAsBytes, _ := json.Marshal(orgs)
+	return shim.Success(orgsAsBytes)
+}
+
+// endorsingOrgs lists the organizations the key-level endorsement policy of key names, none without one
+func endorsingOrgs(APIstub shim.ChaincodeStubInterface, key string) ([]string, error) {
+	policy, err := APIstub.GetStateValidationParameter(key)
+	if err != nil || policy == nil {
+		return []string{}, err
+	}
+	ep, err := statebased.NewStateEP(policy)
+	if err != nil {
+		return nil, err
+	}
+	return ep.ListOrgs(), nil
+}
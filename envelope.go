@@ -0,0 +1,162 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Every function answers with an Envelope, so clients can handle all responses alike.
+// Successful calls carry it as the payload, with their result as data. Failed calls carry
+// it as the message, peers passing no payload back for failures, with a stable code that
+// clients can branch on rather than on the wording of the message.
+
+// Error codes, with the response status each is returned under
+const (
+	codeInvalidArgs     = "INVALID_ARGS"
+	codeUnauthorized    = "UNAUTHORIZED"
+	codeBikeNotFound    = "BIKE_NOT_FOUND"
+	codeNotFound        = "NOT_FOUND"
+	codeVersionConflict = "VERSION_CONFLICT"
+	codeStateConflict   = "STATE_CONFLICT"
+	codeKYCRequired     = "KYC_REQUIRED"
+	codeQuotaExceeded   = "QUOTA_EXCEEDED"
+	codeUnknownFunction = "UNKNOWN_FUNCTION"
+	// codeFailed covers every other failure, mostly business rules the call broke
+	codeFailed = "FAILED"
+)
+
+var codeStatus = map[string]int32{
+	codeInvalidArgs:     400,
+	codeUnauthorized:    403,
+	codeBikeNotFound:    404,
+	codeNotFound:        404,
+	codeVersionConflict: statusConflict,
+	codeStateConflict:   statusConflict,
+	codeKYCRequired:     statusKYCRequired,
+	codeQuotaExceeded:   statusQuotaExceeded,
+	codeUnknownFunction: 400,
+	codeFailed:          shim.ERROR,
+}
+
+// retryableCodes are those of transient failures, see staged.go
+var retryableCodes = map[string]bool{
+	codeVersionConflict: true,
+	codeStateConflict:   true,
+}
+
+// Envelope wraps the response of every function
+type Envelope struct {
+	Status int32           `json:"status"`
+	TxID   string          `json:"txId"`
+	Data   json.RawMessage `json:"data"`
+	Error  *EnvelopeError  `json:"error"`
+}
+
+// EnvelopeError tells why a call failed, and whether calling again on fresh state may succeed
+type EnvelopeError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+// codedError is an error with its own code
+type codedError struct {
+	code    string
+	message string
+}
+
+func (e codedError) Error() string {
+	return e.message
+}
+
+// invalidArgs, unauthorized and notFound format an error with their code, as fmt.Errorf does
+
+func invalidArgs(format string, args ...interface{}) error {
+	return codedError{code: codeInvalidArgs, message: fmt.Sprintf(format, args...)}
+}
+
+func unauthorized(format string, args ...interface{}) error {
+	return codedError{code: codeUnauthorized, message: fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return codedError{code: codeNotFound, message: fmt.Sprintf(format, args...)}
+}
+
+// bikeNotFound reports that there is no bike under key
+func bikeNotFound(key string) error {
+	return codedError{code: codeBikeNotFound, message: fmt.Sprintf("Bike %s does not exist", key)}
+}
+
+// errorCode returns the code of err, codeFailed for plain errors
+func errorCode(err error) string {
+	switch e := err.(type) {
+	case codedError:
+		return e.code
+	case conflictError:
+		return codeVersionConflict
+	case stateConflict:
+		return codeStateConflict
+	case kycError:
+		return codeKYCRequired
+	}
+	return codeFailed
+}
+
+// errorResponse turns err into an error response under the status of its code. The code
+// rides in the payload for wrapEnvelope to pick up.
+func errorResponse(err error) sc.Response {
+	code := errorCode(err)
+	return sc.Response{Status: codeStatus[code], Message: err.Error(), Payload: []byte(code)}
+}
+
+// wrapEnvelope puts the response of every route but the raw ones into an Envelope
+func wrapEnvelope(name string, route Route, next HandlerFunc) HandlerFunc {
+	if route.Raw {
+		return next
+	}
+	return func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+		return envelope(APIstub, next(APIstub, args))
+	}
+}
+
+// envelope wraps response. Payloads that are not JSON become a JSON string, none becomes
+// null. Failures without a code, from shim.Error, get codeFailed.
+func envelope(APIstub shim.ChaincodeStubInterface, response sc.Response) sc.Response {
+	wrapped := Envelope{Status: response.Status, TxID: APIstub.GetTxID(), Data: json.RawMessage("null")}
+	if response.Status >= shim.ERRORTHRESHOLD {
+		code := string(response.Payload)
+		if _, ok := codeStatus[code]; !ok {
+			code = codeFailed
+		}
+		wrapped.Error = &EnvelopeError{Code: code, Message: response.Message, Retryable: retryableCodes[code]}
+		return sc.Response{Status: response.Status, Message: string(marshalEnvelope(wrapped))}
+	}
+
+	switch {
+	case len(response.Payload) == 0:
+	case json.Valid(response.Payload):
+		wrapped.Data = response.Payload
+	default:
+		wrapped.Data, _ = json.Marshal(string(response.Payload))
+	}
+	return sc.Response{Status: response.Status, Message: response.Message, Payload: marshalEnvelope(wrapped)}
+}
+
+// marshalEnvelope encodes an envelope without escaping HTML characters, so messages read
+// the same inside it as out
+func marshalEnvelope(wrapped Envelope) []byte {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(wrapped)
+	return bytes.TrimRight(buffer.Bytes(), "\n")
+}
@@ -0,0 +1,125 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	defaultExportPageSize = 100
+	maxExportPageSize     = 1000
+)
+
+// csvHeader names the columns written by bikeCSVRow, in order
+var csvHeader = []string{"key", "assetType", "make", "model", "colour", "owner", "registrationNo", "chassisNo", "status", "engineCC", "batteryCapacityKWh", "registeredAt", "lastTransferAt"}
+
+func bikeCSVRow(key string, bike Bike) []string {
+	return []string{
+		key, bike.AssetType, bike.Make, bike.Model, bike.Colour, bike.Owner, bike.RegistrationNo, bike.ChassisNo, bike.Status,
+		strconv.Itoa(bike.EngineCC), strconv.FormatFloat(bike.BatteryCapacityKWh, 'f', -1, 64),
+		strconv.FormatInt(bike.RegisteredAt, 10), strconv.FormatInt(bike.LastTransferAt, 10),
+	}
+}
+
+// ExportChunk is one page of an export. Data holds the records in the requested format;
+// pass Bookmark back to fetch the next page, an empty Bookmark means the range is done.
+type ExportChunk struct {
+	Format   string `json:"format"`
+	Count    int32  `json:"count"`
+	Bookmark string `json:"bookmark"`
+	Data     string `json:"data"`
+}
+
+/*
+ * exportLedger dumps the bikes in [startKey, endKey) as NDJSON or CSV, one page at a time.
+ * Args: startKey, endKey, format ("ndjson" or "csv"), and optionally pageSize and bookmark.
+ * The CSV header is only written on the first page so chunks can be concatenated.
+ */
+func (s *SmartContract) exportLedger(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	format := args[2]
+	if format != "ndjson" && format != "csv" {
+		return errorResponse(invalidArgs("Format must be ndjson or csv"))
+	}
+	pageSize := int64(defaultExportPageSize)
+	if len(args) > 3 && args[3] != "" {
+		var err error
+		pageSize, err = strconv.ParseInt(args[3], 10, 32)
+		if err != nil || pageSize <= 0 || pageSize > maxExportPageSize {
+			return errorResponse(invalidArgs("Page size must be between 1 and %d", maxExportPageSize))
+		}
+	}
+	bookmark := ""
+	if len(args) > 4 {
+		bookmark = args[4]
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertTenantRange(APIstub, config, args[0], args[1]); err != nil {
+		return errorResponse(err)
+	}
+
+	resultsIterator, metadata, err := APIstub.GetStateByRangeWithPagination(args[0], args[1], int32(pageSize), bookmark)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if format == "csv" && bookmark == "" {
+		writer.Write(csvHeader)
+	}
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		if format == "ndjson" {
+			line, err := json.Marshal(newQueryResult(queryResponse.Key, queryResponse.Value))
+			if err != nil {
+				return errorResponse(err)
+			}
+			buffer.Write(line)
+			buffer.WriteString("\n")
+			continue
+		}
+		bike := Bike{}
+		if err := json.Unmarshal(queryResponse.Value, &bike); err != nil {
+			return shim.Error(fmt.Sprintf("Record %s is not a bike", queryResponse.Key))
+		}
+		upgradeBike(&bike)
+		writer.Write(bikeCSVRow(queryResponse.Key, bike))
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return errorResponse(err)
+	}
+
+	chunk := ExportChunk{
+		Format:   format,
+		Count:    metadata.FetchedRecordsCount,
+		Bookmark: metadata.Bookmark,
+		Data:     buffer.String(),
+	}
+	// The bookmark of the last page points past the end of the range
+	if chunk.Count < int32(pageSize) {
+		chunk.Bookmark = ""
+	}
+
+	chunkAsBytes, _ := json.Marshal(chunk)
+	return shim.Success(chunkAsBytes)
+}
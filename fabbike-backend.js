@@ -27,13 +27,13 @@ const io = socketIO(server)
 async function carExists(carID, success, failure){
     channel.queryByChaincode({
             chaincodeId: 'fabbike',
-            fcn: 'queryBike',
+            fcn: 'bikeExists',
             args: [carID]
     }).then( query_responses => {
         if (query_responses && query_responses.length == 1) {
             if (query_responses[0] instanceof Error) {
                 failure()
-            } else if (query_responses.toString().length > 0) {
+            } else if (JSON.parse(query_responses[0]).data === true) {
                 success()
             } else {
                 failure()
@@ -55,7 +55,8 @@ async function query(request, socket){
             console.error("error from query = ", query_responses[0]);
             socket.emit('RESPONSE' , {type: 'ERROR' , payload: resp});
         } else {
-            data =  JSON.parse(query_responses[0]);
+            // every function answers with a {status, txId, data, error} envelope
+            data =  JSON.parse(query_responses[0]).data;
             socket.emit('RESPONSE', {type: 'END', payload: "Data retrieved" });
             if (!data.length) {
                  // additional data for response for query single
@@ -160,6 +161,8 @@ async function invoke(request, socket){
                 socket.emit('RESPONSE',{type: 'FEED' , payload: `TRANSACTION IS ${tx}`})
                 console.log("TRANSACTION IS" ,tx);
                 if (code !== 'VALID') {
+                    // Read conflicts mean another transaction got there first, a retry may succeed
+                    return_status.retryable = code === 'MVCC_READ_CONFLICT' || code === 'PHANTOM_READ_CONFLICT';
                     console.error('The transaction was invalid, code = ' + code);
                     socket.emit('RESPONSE',{type: 'ERROR' , payload: `The transaction was invalid, code = ${code}`})
                     resolve(return_status); 
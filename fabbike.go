@@ -29,7 +29,6 @@ package main
  * 2 specific Hyperledger Fabric specific libraries for Smart Contracts
  */
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"strconv"
@@ -42,19 +41,71 @@ import (
 type SmartContract struct {
 }
 
-// Define the car structure, with 4 properties.  Structure tags are used by encoding/json library
+// Define the bike structure.  Structure tags are used by encoding/json library
+// Despite the name it covers every type of two-wheeler, told apart by AssetType, see vehicle.go
+// SchemaVersion records which layout the stored record follows, see schema.go
 type Bike struct {
-	Make   string `json:"make"`
-	Model  string `json:"model"`
-	Colour string `json:"colour"`
-	Owner  string `json:"owner"`
+	AssetType      string `json:"assetType"`
+	Make           string `json:"make"`
+	Model          string `json:"model"`
+	Colour         string `json:"colour"`
+	Owner          string `json:"owner"`
+	RegistrationNo string `json:"registrationNo,omitempty"`
+	ChassisNo      string `json:"chassisNo,omitempty"`
+	Status         string `json:"status"`
+	SchemaVersion  int    `json:"schemaVersion"`
+	// Version counts the writes to the bike, for optimistic concurrency control
+	Version int `json:"version"`
+
+	// Legal hold, see freeze.go. A bike is frozen while FrozenBy is set.
+	FrozenBy     string `json:"frozenBy,omitempty"`
+	FreezeReason string `json:"freezeReason,omitempty"`
+	FrozenAt     int64  `json:"frozenAt,omitempty"`
+
+	// Accident history, see accident.go: how many were reported and the worst severity
+	AccidentCount    int    `json:"accidentCount,omitempty"`
+	AccidentSeverity string `json:"accidentSeverity,omitempty"`
+
+	// Type-specific attributes
+	EngineCC           int     `json:"engineCC,omitempty"`
+	BatteryCapacityKWh float64 `json:"batteryCapacityKWh,omitempty"`
+	// Deployment-specific attributes, described by the schema of the asset type, see assetschema.go
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+
+	// Audit trail, maintained by putBike. Times are transaction timestamps in Unix seconds.
+	CreatedBy        string `json:"createdBy,omitempty"`
+	CreatedTxID      string `json:"createdTxID,omitempty"`
+	RegisteredAt     int64  `json:"registeredAt,omitempty"`
+	LastModifiedBy   string `json:"lastModifiedBy,omitempty"`
+	LastModifiedAt   int64  `json:"lastModifiedAt,omitempty"`
+	LastModifiedTxID string `json:"lastModifiedTxID,omitempty"`
+	LastTransferAt   int64  `json:"lastTransferAt,omitempty"`
 }
 
 /*
- * The Init method is called when the Smart Contract "fabcar" is instantiated by the blockchain network
+ * The Init method is called when the Smart Contract "fabbike" is instantiated or upgraded by the blockchain network
  * Best practice is to have any Ledger initialization in separate function -- see initLedger()
+ * An optional JSON config is overlaid on the current one, see config.go:
+ * ["init", "{\"maxBikesPerOwner\": 20, \"stolenRegistry\": {\"chaincode\": \"stolenregistry\"}}"]
+ * Without args the existing config is kept, so upgrades don't have to repeat it.
  */
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	return envelope(APIstub, s.initConfig(APIstub))
+}
+
+// initConfig applies the config Init was called with
+func (s *SmartContract) initConfig(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	_, args := APIstub.GetFunctionAndParameters()
+	if len(args) > 1 {
+		return errorResponse(invalidArgs("Incorrect number of arguments. Expecting 0 or 1"))
+	}
+	if len(args) == 1 {
+		if _, err := applyConfig(APIstub, args[0]); err != nil {
+			return errorResponse(err)
+		}
+	}
+
 	return shim.Success(nil)
 }
 
@@ -66,30 +117,36 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 
 	// Retrieve the requested Smart Contract function and arguments
 	function, args := APIstub.GetFunctionAndParameters()
-	// Route to the appropriate handler function to interact with the ledger appropriately
-	if function == "queryBike" {
-		return s.queryBike(APIstub, args)
-	} else if function == "initLedger" {
-		return s.initLedger(APIstub)
-	} else if function == "createBike" {
-		return s.createBike(APIstub, args)
-	} else if function == "queryAllBikes" {
-		return s.queryAllBikes(APIstub)
-	} else if function == "changeBikeOwner" {
-		return s.changeBikeOwner(APIstub, args)
-	}
-
-	return shim.Error("Invalid Smart Contract function name.")
+	// Route to the appropriate handler function to interact with the ledger appropriately, see routes()
+	return s.dispatch(APIstub, function, args)
 }
 
+// queryBike returns the bike stored under a key, optionally only the fields named by a JSON array, see projection.go
 func (s *SmartContract) queryBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	fields, err := parseFields(args, 1)
+	if err != nil {
+		return errorResponse(err)
 	}
+	bikeAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if bikeAsBytes == nil {
+		return errorResponse(bikeNotFound(args[0]))
+	}
+	return shim.Success(projectRecord(bikeAsBytes, fields))
+}
+
+// bikeExists answers whether a live bike is stored under a key, true or false. Args: key
+func (s *SmartContract) bikeExists(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	bikeAsBytes, _ := APIstub.GetState(args[0])
-	return shim.Success(bikeAsBytes)
+	exists, err := bikeExists(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	existsAsBytes, _ := json.Marshal(exists)
+	return shim.Success(existsAsBytes)
 }
 
 func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Response {
@@ -106,99 +163,396 @@ func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Respo
 		Bike{Make: "Hardly Davidson", Model: "Iron 883", Colour: "black", Owner: "Dinesh"},
 	}
 
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	prefix, err := scopedKeyPrefix(APIstub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	log := txLog(APIstub)
 	i := 0
 	for i < len(bikes) {
-		fmt.Println("i is ", i)
-		bikeAsBytes, _ := json.Marshal(bikes[i])
-		APIstub.PutState("BIKE"+strconv.Itoa(i), bikeAsBytes)
-		fmt.Println("Added", bikes[i])
+		putBike(APIstub, bikeKey(prefix, i), bikes[i])
+		log.Debugf("Added %s: %+v", bikeKey(prefix, i), bikes[i])
 		i = i + 1
 	}
 
 	return shim.Success(nil)
 }
 
+/*
+ * createBike registers a motorbike. Args: key, make, model, colour, owner and optionally the
+ * registration number, which must not already belong to another bike, and the chassis number.
+ * See createVehicle for other types.
+ */
 func (s *SmartContract) createBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 5")
-	}
-
 	var bike = Bike{Make: args[1], Model: args[2], Colour: args[3], Owner: args[4]}
+	if len(args) > 5 {
+		bike.RegistrationNo = args[5]
+	}
+	if len(args) > 6 {
+		bike.ChassisNo = args[6]
+	}
 
-	bikeAsBytes, _ := json.Marshal(bike)
-	APIstub.PutState(args[0], bikeAsBytes)
+	err := createWithinQuota(APIstub, func() error {
+		return registerBike(APIstub, args[0], bike)
+	})
+	if err != nil {
+		return errorResponse(err)
+	}
 
 	return shim.Success(nil)
 }
 
-func (s *SmartContract) queryAllBikes(APIstub shim.ChaincodeStubInterface) sc.Response {
+/*
+ * createBikeAutoKey registers a motorbike under a generated key, the next one after the
+ * key prefix of the invoker's tenant, e.g. BIKE000042, and returns the key. Zero-padding
+ * keeps generated keys in order under range queries. Args: as for createBike, without the key
+ */
+func (s *SmartContract) createBikeAutoKey(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	startKey := "BIKE0"
-	endKey := "BIKE999"
+	var bike = Bike{Make: args[0], Model: args[1], Colour: args[2], Owner: args[3]}
+	if len(args) > 4 {
+		bike.RegistrationNo = args[4]
+	}
+	if len(args) > 5 {
+		bike.ChassisNo = args[5]
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	prefix, err := scopedKeyPrefix(APIstub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
 
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	var key string
+	err = createWithinQuota(APIstub, func() error {
+		var err error
+		if key, err = nextBikeKey(APIstub, prefix); err != nil {
+			return err
+		}
+		return registerBike(APIstub, key, bike)
+	})
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	keyAsBytes, _ := json.Marshal(key)
+	return shim.Success(keyAsBytes)
+}
 
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
+/*
+ * queryAllBikes lists the live bikes, only those of the invoker's tenant if they have one.
+ * With the argument "includeArchived" the archived ones follow them, under their archive
+ * keys. Args: optionally "includeArchived" or "", then the fields to return
+ */
+func (s *SmartContract) queryAllBikes(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	fields, err := parseFields(args, 1)
+	if err != nil {
+		return errorResponse(err)
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	prefix, err := scopedKeyPrefix(APIstub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(args) == 0 || args[0] != "includeArchived" {
+		return queryBikeRange(APIstub, prefix, prefixRangeEnd(prefix), fields)
+	}
+
+	results := []QueryResult{}
+	for _, prefix := range []string{prefix, archiveKey(prefix)} {
+		resultsIterator, err := APIstub.GetStateByRange(prefix, prefixRangeEnd(prefix))
 		if err != nil {
-			return shim.Error(err.Error())
+			return errorResponse(err)
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		found, err := collectResults(resultsIterator, nil)
+		resultsIterator.Close()
+		if err != nil {
+			return errorResponse(err)
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
+		results = append(results, found...)
+	}
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	projectResults(results, fields)
+	return resultsResponse(results)
+}
+
+// getBikesByRange returns the bikes with keys in [startKey, endKey). Args: startKey, endKey and optionally the fields to return
+func (s *SmartContract) getBikesByRange(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	fields, err := parseFields(args, 2)
+	if err != nil {
+		return errorResponse(err)
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertTenantRange(APIstub, config, args[0], args[1]); err != nil {
+		return errorResponse(err)
+	}
+	return queryBikeRange(APIstub, args[0], args[1], fields)
+}
+
+// queryBikeRange returns the records in [startKey, endKey) as a JSON array of QueryResult,
+// projected to fields unless they are nil
+func queryBikeRange(APIstub shim.ChaincodeStubInterface, startKey string, endKey string, fields []string) sc.Response {
+
+	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return errorResponse(err)
 	}
-	buffer.WriteString("]")
+	defer resultsIterator.Close()
 
-	fmt.Printf("- queryAllBikes:\n%s\n", buffer.String())
+	results, err := collectResults(resultsIterator, nil)
+	if err != nil {
+		return errorResponse(err)
+	}
 
-	return shim.Success(buffer.Bytes())
+	projectResults(results, fields)
+	return resultsResponse(results)
 }
 
+/*
+ * changeBikeOwner is kept for existing clients. Ownership only moves instantly with the new
+ * owner's signed consent in the transient fields, see consent.go, so a bike cannot be pushed
+ * onto someone unwilling. Without a consent it opens a zero-price offer that the new owner
+ * has to accept with acceptTransfer. Either way only the owner or their delegate may call
+ * it, and the new owner must have passed KYC if a KYC registry is configured, see kyc.go.
+ * Args: key, newOwner and optionally the version of the bike the caller last read.
+ */
 func (s *SmartContract) changeBikeOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	consented, err := hasConsent(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if !consented {
+		if err := assertKYCVerified(APIstub, args[1]); err != nil {
+			return errorResponse(err)
+		}
+		offerArgs := []string{args[0], args[1], "0", ""}
+		if len(args) == 3 {
+			offerArgs = append(offerArgs, args[2])
+		}
+		return s.offerTransfer(APIstub, offerArgs)
 	}
 
-	bikeAsBytes, _ := APIstub.GetState(args[0])
-	bike := Bike {}
+	key, to := args[0], args[1]
+	bike, err := getMutableBike(APIstub, key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(args) == 3 {
+		if err := checkVersion(key, bike, args[2]); err != nil {
+			return errorResponse(err)
+		}
+	}
+	if err := assertOwnerOrDelegate(APIstub, key, bike); err != nil {
+		return errorResponse(err)
+	}
+	if to == "" || to == bike.Owner {
+		return shim.Error("Bike is already owned by " + bike.Owner)
+	}
+	if err := assertKYCVerified(APIstub, to); err != nil {
+		return errorResponse(err)
+	}
+	if err := verifyConsent(APIstub, key, bike, to); err != nil {
+		return errorResponse(err)
+	}
 
-	json.Unmarshal(bikeAsBytes, &bike)
-	bike.Owner = args[1]
+	if err := assertTransferable(APIstub, key, bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertCapability(APIstub, capabilityTransfer, nil); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertNotAuctioned(APIstub, key); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertNotReserved(APIstub, key, to); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwnerCapacity(APIstub, to); err != nil {
+		return errorResponse(err)
+	}
+	if err := consumeLienApproval(APIstub, key, to); err != nil {
+		return errorResponse(err)
+	}
 
-	bikeAsBytes, _ = json.Marshal(bike)
-	APIstub.PutState(args[0], bikeAsBytes)
+	// A pending sale cannot go through any more
+	if _, offer, err := getOffer(APIstub, key); err == nil {
+		if err := APIstub.DelState(offer); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	from := bike.Owner
+	bike.Owner = to
+	if err := putBike(APIstub, key, bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := recordTransfer(APIstub, key, from, to, 0); err != nil {
+		return errorResponse(err)
+	}
+	// The new owner consented to the bike, not to paying for it, so any fee is collected off-chain
+	if _, err := recordTransferFee(APIstub, key, from, to, 0, false); err != nil {
+		return errorResponse(err)
+	}
 
 	return shim.Success(nil)
 }
 
+// getBike loads the bike stored under key, failing if there is none
+func getBike(APIstub shim.ChaincodeStubInterface, key string) (Bike, error) {
+	bike := Bike{}
+
+	bikeAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return bike, err
+	}
+	if bikeAsBytes == nil {
+		return bike, bikeNotFound(key)
+	}
+
+	if err := json.Unmarshal(bikeAsBytes, &bike); err != nil {
+		return bike, err
+	}
+	upgradeBike(&bike)
+	return bike, nil
+}
+
+// bikeExists reports whether a live bike is stored under key
+func bikeExists(APIstub shim.ChaincodeStubInterface, key string) (bool, error) {
+	bikeAsBytes, err := APIstub.GetState(key)
+	return bikeAsBytes != nil, err
+}
+
+// assertBikeKnown fails with BIKE_NOT_FOUND unless key holds a bike, live or archived.
+// Readers of the records attached to a bike check it, so a mistyped key is not answered
+// with an empty list; archived bikes pass, as their records stay behind.
+func assertBikeKnown(APIstub shim.ChaincodeStubInterface, key string) error {
+	exists, err := bikeExists(APIstub, key)
+	if err != nil || exists {
+		return err
+	}
+	if _, err := getArchivedBike(APIstub, key); err != nil {
+		if errorCode(err) == codeNotFound {
+			return bikeNotFound(key)
+		}
+		return err
+	}
+	return nil
+}
+
+// putBike writes bike to the ledger under key, in the current schema, with its audit
+// fields updated, its version bumped and the secondary indexes and bike count following its changes.
+// A change of owner also clears the transfer approval and any reservation made by the previous one.
+func putBike(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	previousAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return err
+	}
+	previous := Bike{}
+	if previousAsBytes != nil {
+		if err := json.Unmarshal(previousAsBytes, &previous); err != nil {
+			return err
+		}
+	}
+
+	upgradeBike(&bike)
+	bike.Version = bike.Version + 1
+	// A restored bike is not new, it keeps the creation stamp from before it was archived
+	if err := stampAudit(APIstub, previousAsBytes == nil && bike.CreatedTxID == "", &bike); err != nil {
+		return err
+	}
+	if previous.Owner != "" && previous.Owner != bike.Owner {
+		bike.LastTransferAt = bike.LastModifiedAt
+	}
+	bikeAsBytes, err := json.Marshal(bike)
+	if err != nil {
+		return err
+	}
+	if err := APIstub.PutState(key, bikeAsBytes); err != nil {
+		return err
+	}
+	if previousAsBytes == nil {
+		if err := adjustBikeCount(APIstub, key, 1); err != nil {
+			return err
+		}
+	}
+	if err := moveModifiedIndex(APIstub, key, previous.LastModifiedAt, bike.LastModifiedAt); err != nil {
+		return err
+	}
+
+	if err := updateBikeIndexes(APIstub, key, previous, bike); err != nil {
+		return err
+	}
+	if previous.Owner != "" && previous.Owner != bike.Owner {
+		if err := clearApproval(APIstub, key); err != nil {
+			return err
+		}
+		return clearReservation(APIstub, key)
+	}
+	return nil
+}
+
+// nextSeq hands out the next sequence number for records of objectType attached to
+// parent. Numbers are zero-padded so composite key iteration returns them in order.
+func nextSeq(APIstub shim.ChaincodeStubInterface, objectType string, parent string) (string, error) {
+	counterKey, err := APIstub.CreateCompositeKey("SEQ", []string{objectType, parent})
+	if err != nil {
+		return "", err
+	}
+	counterAsBytes, err := APIstub.GetState(counterKey)
+	if err != nil {
+		return "", err
+	}
+
+	next := 0
+	if counterAsBytes != nil {
+		next, err = strconv.Atoi(string(counterAsBytes))
+		if err != nil {
+			return "", err
+		}
+	}
+	next = next + 1
+
+	if err := APIstub.PutState(counterKey, []byte(strconv.Itoa(next))); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08d", next), nil
+}
+
+// txTime returns the transaction timestamp in Unix seconds. Every endorser sees the
+// same value, unlike the wall clock.
+func txTime(APIstub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return ts.Seconds, nil
+}
+
 // The main function is only relevant in unit test mode. Only included here for completeness.
 func main() {
 
+	configureLogging("")
 	// Create a new Smart Contract
 	err := shim.Start(new(SmartContract))
 	if err != nil {
-		fmt.Printf("Error creating new Smart Contract: %s", err)
+		logger.Criticalf("Error creating new Smart Contract: %s", err)
 	}
 }
@@ -0,0 +1,3039 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testIdentity stands in for the X.509 identity of a transaction's signer
+type testIdentity struct {
+	mspID string
+	id    string
+	attrs map[string]string
+	cert  *x509.Certificate
+}
+
+func (i *testIdentity) GetID() (string, error)    { return "x509::" + i.id, nil }
+func (i *testIdentity) GetMSPID() (string, error) { return i.mspID, nil }
+func (i *testIdentity) GetAttributeValue(name string) (string, bool, error) {
+	if name == "hf.EnrollmentID" {
+		return i.id, true, nil
+	}
+	value, found := i.attrs[name]
+	return value, found, nil
+}
+func (i *testIdentity) AssertAttributeValue(name string, value string) error {
+	if actual, found, _ := i.GetAttributeValue(name); !found || actual != value {
+		return fmt.Errorf("attribute %s is not %s", name, value)
+	}
+	return nil
+}
+func (i *testIdentity) GetX509Certificate() (*x509.Certificate, error) { return i.cert, nil }
+
+var (
+	admin        = &testIdentity{mspID: "Org1MSP", id: "admin"}
+	alice        = &testIdentity{mspID: "Org2MSP", id: "alice"}
+	bob          = &testIdentity{mspID: "Org2MSP", id: "bob"}
+	carol        = &testIdentity{mspID: "Org2MSP", id: "carol"}
+	workshop     = &testIdentity{mspID: "Org2MSP", id: "garage", attrs: map[string]string{"role": "workshop"}}
+	device       = &testIdentity{mspID: "Org2MSP", id: "lock42", attrs: map[string]string{"role": "device"}}
+	registrar    = &testIdentity{mspID: "Org2MSP", id: "rto", attrs: map[string]string{"role": "registrar"}}
+	bank         = &testIdentity{mspID: "BankMSP", id: "loans"}
+	insurer      = &testIdentity{mspID: "InsurerMSP", id: "claims"}
+	manufacturer = &testIdentity{mspID: "HondaMSP", id: "quality"}
+	police       = &testIdentity{mspID: "PoliceMSP", id: "officer"}
+	court        = &testIdentity{mspID: "PoliceMSP", id: "court", attrs: map[string]string{"role": "authority"}}
+	analyst      = &testIdentity{mspID: "Org1MSP", id: "bi", attrs: map[string]string{"role": "analyst"}}
+)
+
+// testStub wraps the shim's MockStub with what it cannot do itself: signing identities,
+// transient data and a transaction clock the test controls
+type testStub struct {
+	*shim.MockStub
+	txSeq     int
+	now       int64
+	function  string
+	args      []string
+	identity  *testIdentity
+	transient map[string][]byte
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	return stub.function, stub.args
+}
+
+func (stub *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.now}, nil
+}
+
+func (stub *testStub) GetTransient() (map[string][]byte, error) {
+	return stub.transient, nil
+}
+
+// DelPrivateData is missing from MockStub
+func (stub *testStub) DelPrivateData(collection string, key string) error {
+	delete(stub.PvtState[collection], key)
+	return nil
+}
+
+// GetQueryResultWithPagination fails as it does on LevelDB, where MockStub keeps its state
+func (stub *testStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *sc.QueryResponseMetadata, error) {
+	return nil, nil, errors.New("rich queries are not supported by LevelDB")
+}
+
+// GetStateByRangeWithPagination pages through a range query. The bookmark is the key the
+// next page starts at, as the peer's LevelDB bookmarks are.
+func (stub *testStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *sc.QueryResponseMetadata, error) {
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+
+	page := &pageIterator{}
+	metadata := &sc.QueryResponseMetadata{}
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if int32(len(page.kvs)) == pageSize {
+			metadata.Bookmark = kv.Key
+			break
+		}
+		page.kvs = append(page.kvs, kv)
+	}
+	metadata.FetchedRecordsCount = int32(len(page.kvs))
+	return page, metadata, nil
+}
+
+// pageIterator iterates over one page of results fetched up front
+type pageIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (iter *pageIterator) HasNext() bool { return len(iter.kvs) > 0 }
+func (iter *pageIterator) Close() error  { return nil }
+func (iter *pageIterator) Next() (*queryresult.KV, error) {
+	kv := iter.kvs[0]
+	iter.kvs = iter.kvs[1:]
+	return kv, nil
+}
+
+func TestMain(m *testing.M) {
+	clientIdentity = func(APIstub shim.ChaincodeStubInterface) (cid.ClientIdentity, error) {
+		if staged, ok := APIstub.(*stagedState); ok {
+			APIstub = staged.ChaincodeStubInterface
+		}
+		stub, ok := APIstub.(*testStub)
+		if !ok || stub.identity == nil {
+			return nil, errors.New("failed to get transaction invoker's identity from the chaincode stub")
+		}
+		return stub.identity, nil
+	}
+	os.Exit(m.Run())
+}
+
+func newTestStub(t *testing.T) *testStub {
+	stub := &testStub{MockStub: shim.NewMockStub("fabbike", new(SmartContract)), now: 1600000000}
+	if resp := stub.MockInit("init", nil); resp.Status != shim.OK {
+		t.Fatalf("Init failed: %s", resp.Message)
+	}
+	return stub
+}
+
+// invoke runs one transaction signed by identity. MockStub applies writes as they happen,
+// so a failed transaction has its writes undone here, as the peer would never commit them.
+func (stub *testStub) invoke(identity *testIdentity, function string, args ...string) sc.Response {
+	stub.txSeq++
+	txID := fmt.Sprintf("tx%04d", stub.txSeq)
+	stub.function, stub.args, stub.identity = function, args, identity
+
+	state := map[string][]byte{}
+	for key, value := range stub.State {
+		state[key] = value
+	}
+	stub.MockTransactionStart(txID)
+	resp := new(SmartContract).Invoke(stub)
+	if resp.Status >= shim.ERRORTHRESHOLD {
+		for key := range stub.State {
+			if _, ok := state[key]; !ok {
+				stub.DelState(key)
+			}
+		}
+		for key, value := range state {
+			stub.PutState(key, value)
+		}
+	}
+	stub.MockTransactionEnd(txID)
+	return resp
+}
+
+// invokeTransient runs a transaction carrying transient fields
+func (stub *testStub) invokeTransient(identity *testIdentity, transient map[string]string, function string, args ...string) sc.Response {
+	stub.transient = map[string][]byte{}
+	for name, value := range transient {
+		stub.transient[name] = []byte(value)
+	}
+	defer func() { stub.transient = nil }()
+	return stub.invoke(identity, function, args...)
+}
+
+// mustSucceed returns the data of a successful response, with JSON strings unquoted and
+// null as nil
+func mustSucceed(t *testing.T, resp sc.Response) []byte {
+	t.Helper()
+	if resp.Status != shim.OK {
+		t.Fatalf("expected success, got status %d: %s", resp.Status, resp.Message)
+	}
+	wrapped := Envelope{}
+	mustDecode(t, resp.Payload, &wrapped)
+	if wrapped.Status != resp.Status || wrapped.Error != nil {
+		t.Fatalf("unexpected envelope %s", resp.Payload)
+	}
+	var text string
+	if json.Unmarshal(wrapped.Data, &text) == nil {
+		return []byte(text)
+	}
+	if string(wrapped.Data) == "null" {
+		return nil
+	}
+	return wrapped.Data
+}
+
+// mustFail checks the response failed with message in its envelope, and returns its code
+func mustFail(t *testing.T, resp sc.Response, message string) string {
+	t.Helper()
+	if resp.Status < shim.ERRORTHRESHOLD {
+		t.Fatalf("expected failure containing %q, got status %d", message, resp.Status)
+	}
+	wrapped := Envelope{}
+	mustDecode(t, []byte(resp.Message), &wrapped)
+	if wrapped.Error == nil || wrapped.Status != resp.Status || string(wrapped.Data) != "null" {
+		t.Fatalf("unexpected envelope %s", resp.Message)
+	}
+	if !strings.Contains(wrapped.Error.Message, message) {
+		t.Fatalf("expected failure containing %q, got %q", message, wrapped.Error.Message)
+	}
+	return wrapped.Error.Code
+}
+
+func mustDecode(t *testing.T, payload []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(payload, v); err != nil {
+		t.Fatalf("cannot decode %s: %s", payload, err)
+	}
+}
+
+// createBikeFor registers a Honda Shine owned by owner under key
+func (stub *testStub) createBikeFor(t *testing.T, key string, owner *testIdentity) {
+	t.Helper()
+	mustSucceed(t, stub.invoke(owner, "createBike", key, "Honda", "Shine", "blue", owner.id))
+}
+
+func (stub *testStub) bike(t *testing.T, key string) Bike {
+	t.Helper()
+	bike := Bike{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryBike", key)), &bike)
+	return bike
+}
+
+func (stub *testStub) balance(t *testing.T, id string) int64 {
+	t.Helper()
+	account := Account{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getBalance", id)), &account)
+	return account.Balance
+}
+
+// events drains the chaincode events set so far
+func (stub *testStub) events() []*sc.ChaincodeEvent {
+	events := []*sc.ChaincodeEvent{}
+	for {
+		select {
+		case event := <-stub.ChaincodeEventsChannel:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func (stub *testStub) countKeys(t *testing.T, objectType string, attributes ...string) int {
+	t.Helper()
+	resultsIterator, err := stub.MockStub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resultsIterator.Close()
+	n := 0
+	for resultsIterator.HasNext() {
+		if _, err := resultsIterator.Next(); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	return n
+}
+
+func TestInvalidFunction(t *testing.T) {
+	stub := newTestStub(t)
+	mustFail(t, stub.invoke(alice, "noSuchFunction"), "Invalid Smart Contract function name")
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	stub := newTestStub(t)
+	resp := stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "blue", "alice")
+	wrapped := Envelope{}
+	mustDecode(t, resp.Payload, &wrapped)
+	if wrapped.Status != shim.OK || wrapped.TxID != "tx0001" || string(wrapped.Data) != "null" || wrapped.Error != nil {
+		t.Fatalf("unexpected envelope %s", resp.Payload)
+	}
+	if owner := mustSucceed(t, stub.invoke(bob, "ownerOf", "BIKE000001")); string(owner) != "Org2MSP/alice" {
+		t.Fatalf("ownerOf answered %s", owner)
+	}
+
+	codes := []struct {
+		resp sc.Response
+		code string
+	}{
+		{stub.invoke(bob, "ownerOf", "BIKE000009"), codeBikeNotFound},
+		{stub.invoke(bob, "updateBike", "BIKE000001", "1", `{"colour": "red"}`), codeUnauthorized},
+		{stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "free"), codeInvalidArgs},
+		{stub.invoke(alice, "updateBike", "BIKE000001", "7", `{"colour": "red"}`), codeVersionConflict},
+		{stub.invoke(alice, "getReservation", "BIKE000001"), codeNotFound},
+		{stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "blue", "alice"), codeFailed},
+		{stub.invoke(alice, "noSuchFunction"), codeUnknownFunction},
+	}
+	for i, c := range codes {
+		if code := mustFail(t, c.resp, ""); code != c.code {
+			t.Fatalf("case %d failed with code %s, want %s", i, code, c.code)
+		}
+		if c.resp.Status != codeStatus[c.code] {
+			t.Fatalf("case %d failed with status %d", i, c.resp.Status)
+		}
+	}
+}
+
+// Every routed function rejects too few and too many arguments before touching the ledger
+func TestArgumentCounts(t *testing.T) {
+	stub := newTestStub(t)
+	for name, route := range new(SmartContract).routes() {
+		check := func(resp sc.Response) {
+			t.Helper()
+			if route.Raw && resp.Status >= shim.ERRORTHRESHOLD && strings.Contains(resp.Message, "Incorrect number of arguments") {
+				return
+			}
+			if code := mustFail(t, resp, "Incorrect number of arguments"); code != codeInvalidArgs {
+				t.Fatalf("%s failed with code %s", name, code)
+			}
+		}
+		if route.MinArgs > 0 {
+			check(stub.invoke(alice, name, make([]string, route.MinArgs-1)...))
+		}
+		if route.MaxArgs >= 0 {
+			check(stub.invoke(alice, name, make([]string, route.MaxArgs+1)...))
+		}
+	}
+}
+
+// Every routed function has its arguments named, as many as it takes
+func TestContractMetadata(t *testing.T) {
+	stub := newTestStub(t)
+	routes := new(SmartContract).routes()
+	for name, route := range routes {
+		names, ok := routeArgs[name]
+		if !ok {
+			t.Fatalf("%s has no entry in routeArgs", name)
+		}
+		if want := route.MaxArgs; (want >= 0 && len(names) != want) || (want < 0 && len(names) != route.MinArgs) {
+			t.Fatalf("%s takes %d to %d arguments but names %v", name, route.MinArgs, route.MaxArgs, names)
+		}
+	}
+	for name := range routeArgs {
+		if _, ok := routes[name]; !ok {
+			t.Fatalf("routeArgs names arguments of unknown function %s", name)
+		}
+	}
+
+	metadata := ContractMetadata{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getContractMetadata")), &metadata)
+	if metadata.Chaincode != "fabbike" || metadata.ContractVersion != contractVersion || metadata.SchemaVersion != currentSchemaVersion || metadata.QRVersion != qrVersion {
+		t.Fatalf("unexpected versions %+v", metadata)
+	}
+	if len(metadata.Functions) != len(routes) || !sort.SliceIsSorted(metadata.Functions, func(i, j int) bool { return metadata.Functions[i].Name < metadata.Functions[j].Name }) {
+		t.Fatalf("expected %d functions in name order", len(routes))
+	}
+	for _, function := range metadata.Functions {
+		switch function.Name {
+		case "offerTransfer":
+			price, ttl := function.Args[2], function.Args[3]
+			if function.ReadOnly || price != (ArgMetadata{Name: "price", Kind: "integer"}) || !ttl.Optional {
+				t.Fatalf("unexpected offerTransfer metadata %+v", function)
+			}
+		case "setBikeEndorsementPolicy":
+			if last := function.Args[len(function.Args)-1]; function.MaxArgs != -1 || !last.Repeated || last.Optional {
+				t.Fatalf("unexpected setBikeEndorsementPolicy metadata %+v", function)
+			}
+		case "queryCar":
+			if !function.Raw || !function.ReadOnly {
+				t.Fatalf("unexpected queryCar metadata %+v", function)
+			}
+		}
+	}
+}
+
+func TestMissingBike(t *testing.T) {
+	stub := newTestStub(t)
+	missing := "BIKE999999"
+	digest := strings.Repeat("ab", 32)
+	future := strconv.FormatInt(stub.now+3600, 10)
+
+	tests := []struct {
+		function string
+		identity *testIdentity
+		args     []string
+	}{
+		{"updateBike", alice, []string{missing, "1", `{"colour": "red"}`}},
+		{"offerTransfer", alice, []string{missing, "bob", "0"}},
+		{"changeBikeOwner", alice, []string{missing, "bob"}},
+		{"addServiceRecord", alice, []string{missing, "2020-01-01", "100", "garage", "oil"}},
+		{"recordOdometer", workshop, []string{missing, "100", "1"}},
+		{"rentBike", alice, []string{missing, "bob", "2"}},
+		{"returnBike", alice, []string{missing}},
+		{"setBikeEndorsementPolicy", alice, []string{missing, "Org1MSP"}},
+		{"getBikeAudit", alice, []string{missing}},
+		{"attachPolicy", insurer, []string{missing, "P1", "InsurerMSP", future}},
+		{"fileClaim", alice, []string{missing, "crash"}},
+		{"recordTelemetry", device, []string{missing, "12.9", "77.5", "locked", "80", "1"}},
+		{"attachDocument", alice, []string{missing, "rc", digest, "ipfs://rc"}},
+		{"startAuction", alice, []string{missing, "100", future}},
+		{"registerLien", alice, []string{missing, "BankMSP", "1000"}},
+		{"archiveBike", alice, []string{missing}},
+		{"getOpenRecalls", alice, []string{missing}},
+		{"markRecallCompleted", workshop, []string{missing, "R1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.function, func(t *testing.T) {
+			mustFail(t, stub.invoke(test.identity, test.function, test.args...), "does not exist")
+		})
+	}
+}
+
+func TestUnauthorizedCallers(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	digest := strings.Repeat("ab", 32)
+	future := strconv.FormatInt(stub.now+3600, 10)
+
+	tests := []struct {
+		function string
+		identity *testIdentity
+		args     []string
+		message  string
+	}{
+		{"updateBike", bob, []string{"BIKE000001", "1", `{"colour": "red"}`}, "Only the owner"},
+		{"offerTransfer", bob, []string{"BIKE000001", "carol", "0"}, "Only the owner"},
+		{"changeBikeOwner", bob, []string{"BIKE000001", "bob"}, "Only the owner"},
+		{"rentBike", bob, []string{"BIKE000001", "carol", "2"}, "Only the owner"},
+		{"setBikeEndorsementPolicy", bob, []string{"BIKE000001", "Org2MSP"}, "Only the owner"},
+		{"attachDocument", bob, []string{"BIKE000001", "rc", digest, "ipfs://rc"}, "Only the owner"},
+		{"startAuction", bob, []string{"BIKE000001", "100", future}, "Only the owner"},
+		{"registerLien", bob, []string{"BIKE000001", "BankMSP", "1000"}, "Only the owner"},
+		{"archiveBike", bob, []string{"BIKE000001"}, "Only the owner of BIKE000001 or an admin"},
+		{"fileClaim", bob, []string{"BIKE000001", "crash"}, "Only the owner"},
+		{"recordOdometer", alice, []string{"BIKE000001", "100", "1"}, "workshop role"},
+		{"recordTelemetry", alice, []string{"BIKE000001", "12.9", "77.5", "locked", "80", "1"}, "device role"},
+		{"attachPolicy", alice, []string{"BIKE000001", "P1", "InsurerMSP", future}, "Only members of InsurerMSP"},
+		{"mint", alice, []string{"alice", "100"}, "Only members of Org1MSP"},
+		{"transferFunds", alice, []string{"bob", "alice", "100"}, "Only members of Org1MSP"},
+		{"setConfig", alice, []string{`{"maxBikesPerOwner": 1}`}, "Only members of"},
+		{"registerOwner", bob, []string{"alice", "Alice", "alice@example.com", digest}, "or a registrar"},
+	}
+	for _, test := range tests {
+		t.Run(test.function, func(t *testing.T) {
+			mustFail(t, stub.invoke(test.identity, test.function, test.args...), test.message)
+		})
+	}
+}
+
+func TestConfig(t *testing.T) {
+	stub := newTestStub(t)
+
+	config := Config{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getConfig")), &config)
+	if config.KeyPrefix != "BIKE" || config.OfferTTLSeconds != 24*60*60 {
+		t.Fatalf("unexpected default config %+v", config)
+	}
+
+	resp := stub.MockInit("upgrade", [][]byte{[]byte("init"), []byte(`{"maxBikesPerOwner": 1, "features": {"rentals": false}}`)})
+	mustSucceed(t, resp)
+	mustSucceed(t, stub.MockInit("upgrade", nil))
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getConfig")), &config)
+	if config.MaxBikesPerOwner != 1 || config.featureEnabled(featureRentals) || config.KeyPrefix != "BIKE" {
+		t.Fatalf("Init config not kept: %+v", config)
+	}
+
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000002", "Honda", "Shine", "blue", "alice"), "maximum of 1 bikes")
+	mustFail(t, stub.invoke(alice, "rentBike", "BIKE000001", "bob", "2"), "rentals feature is disabled")
+
+	mustFail(t, stub.invoke(admin, "setConfig", `{"keyPrefix": ""}`), "keyPrefix")
+	mustFail(t, stub.invoke(admin, "setConfig", `not json`), "Config must be a JSON object")
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"maxBikesPerOwner": 0, "registrarMSPs": ["Org3MSP"]}`))
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000002", "Honda", "Shine", "blue", "alice"), "Only members of [Org3MSP]")
+
+	mustFail(t, stub.invoke(admin, "setConfig", `{"logLevel": "LOUD"}`), "logLevel LOUD is not a log level")
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"logLevel": "debug"}`))
+	if appliedLogLevel != "DEBUG" {
+		t.Fatalf("log level %q applied, want DEBUG", appliedLogLevel)
+	}
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"logLevel": "info"}`))
+	stub.MockTransactionStart("logged")
+	if prefix := txLog(stub).prefix; !strings.HasPrefix(prefix, "[logged ") {
+		t.Fatalf("log lines start with %q", prefix)
+	}
+	stub.MockTransactionEnd("logged")
+}
+
+func TestInitLedgerAndQueries(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(admin, "initLedger"))
+
+	if bike := stub.bike(t, "BIKE000000"); bike.Make != "Honda" || bike.Owner != "Gowda" || bike.Version != 1 {
+		t.Fatalf("unexpected first bike %+v", bike)
+	}
+
+	results := []QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryAllBikes")), &results)
+	if len(results) != 10 {
+		t.Fatalf("queryAllBikes returned %d bikes, want 10", len(results))
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getBikesByRange", "BIKE000002", "BIKE000005")), &results)
+	if len(results) != 3 || results[0].Key != "BIKE000002" {
+		t.Fatalf("getBikesByRange returned %+v", results)
+	}
+
+	filters := []struct {
+		filter string
+		want   int
+	}{
+		{`{"make": "Honda"}`, 2},
+		{`{"colour": "blue", "make": "KTM"}`, 1},
+		{`{"owner": {"$prefix": "Ra"}}`, 2},
+		{`{"make": "Ducati"}`, 0},
+	}
+	for _, test := range filters {
+		mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryBikesByFilter", test.filter)), &results)
+		if len(results) != test.want {
+			t.Errorf("filter %s matched %d bikes, want %d", test.filter, len(results), test.want)
+		}
+	}
+	mustFail(t, stub.invoke(alice, "queryBikesByFilter", `{"wheels": "2"}`), "wheels")
+
+	// Page through the blue bikes three bike keys at a time
+	blue := 0
+	bookmark := ""
+	for pages := 0; pages < 10; pages++ {
+		page := PagedResults{}
+		mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryBikesByFilter", `{"colour": "blue"}`, "3", bookmark)), &page)
+		blue += len(page.Results)
+		if page.ResponseMetadata.FetchedRecordsCount > 3 {
+			t.Fatalf("page fetched %d records, want at most 3", page.ResponseMetadata.FetchedRecordsCount)
+		}
+		bookmark = page.ResponseMetadata.Bookmark
+		if bookmark == "" {
+			break
+		}
+	}
+	if blue != 4 {
+		t.Errorf("paginated filter matched %d blue bikes, want 4", blue)
+	}
+	mustFail(t, stub.invoke(alice, "queryBikesByFilter", `{"colour": "blue"}`, "0"), "Page size")
+
+	versions := map[string]int{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getSchemaVersion")), &versions)
+	if versions["ledger"] != 1 || versions["chaincode"] != currentSchemaVersion {
+		t.Fatalf("unexpected schema versions %v", versions)
+	}
+}
+
+func TestChunkedResults(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(admin, "initLedger"))
+	mustFail(t, stub.invoke(admin, "setConfig", `{"maxResponseBytes": -1}`), "maxResponseBytes")
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"maxResponseBytes": 1000}`))
+
+	chunk := ResultChunk{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryAllBikes")), &chunk)
+	first := chunk
+	keys := []string{}
+	for chunks := 1; ; chunks++ {
+		if len(chunk.Results) == 0 || chunk.Offset != len(keys) || chunk.Total != 10 {
+			t.Fatalf("unexpected chunk %+v", chunk)
+		}
+		for _, entry := range chunk.Results {
+			result := QueryResult{}
+			mustDecode(t, entry, &result)
+			keys = append(keys, result.Key)
+		}
+		if chunk.Continuation == "" {
+			if chunks < 3 {
+				t.Fatalf("results came in %d chunks", chunks)
+			}
+			break
+		}
+		next := chunk.Continuation
+		chunk = ResultChunk{}
+		mustDecode(t, mustSucceed(t, stub.invoke(bob, "continueQuery", next)), &chunk)
+	}
+	if len(keys) != 10 || keys[0] != "BIKE000000" || keys[9] != "BIKE000009" {
+		t.Fatalf("chunks held %v", keys)
+	}
+
+	// Results that fit are not chunked
+	if bike := stub.bike(t, "BIKE000001"); bike.Make != "BMW" {
+		t.Fatalf("unexpected bike %+v", bike)
+	}
+	results := []QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryAllBikes", "", `["owner"]`)), &results)
+	if len(results) != 10 {
+		t.Fatalf("projected results %v", results)
+	}
+
+	mustFail(t, stub.invoke(bob, "continueQuery", "garbage"), "not valid")
+	token, _ := json.Marshal(continuation{Function: "setConfig", Args: []string{`{}`}, Offset: 1})
+	mustFail(t, stub.invoke(bob, "continueQuery", base64.RawURLEncoding.EncodeToString(token)), "not valid")
+	mustSucceed(t, stub.invoke(alice, "createBike", "BIKE000010", "Honda", "Shine", "blue", "alice"))
+	resp := stub.invoke(bob, "continueQuery", first.Continuation)
+	if code := mustFail(t, resp, "changed since it was read"); code != codeStateConflict {
+		t.Fatalf("stale continuation failed with %s", code)
+	}
+}
+
+func TestQueryWithSelector(t *testing.T) {
+	stub := newTestStub(t)
+	mustFail(t, stub.invoke(admin, "queryWithSelector", `{"make": "Honda"}`, "10"), "analyst")
+	mustFail(t, stub.invoke(analyst, "queryWithSelector", `["make"]`, "10"), "must be a JSON object")
+	mustFail(t, stub.invoke(analyst, "queryWithSelector", `{"make": "Honda"}`, "0"), "Page size")
+	mustFail(t, stub.invoke(analyst, "queryWithSelector", `{"make": "Honda"}`, "10"), "need CouchDB")
+
+	query, err := selectorQuery(`{"_id": {"$gt": ""}, "engineCC": {"$gte": 150}}`, "BIKE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"selector":{"$and":[{"_id":{"$regex":"^BIKE"}},{"_id":{"$gt":""},"engineCC":{"$gte":150}}]}}`
+	if query != want {
+		t.Fatalf("selector rendered as %s", query)
+	}
+}
+
+func TestProjection(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(admin, "initLedger"))
+
+	onlyFields := func(results []QueryResult, want int) {
+		t.Helper()
+		if len(results) != want {
+			t.Fatalf("got %d results, want %d", len(results), want)
+		}
+		for _, result := range results {
+			record := map[string]interface{}{}
+			mustDecode(t, result.Record, &record)
+			if len(record) != 2 || record["make"] == nil || record["owner"] == nil {
+				t.Fatalf("record %s not projected: %v", result.Key, record)
+			}
+		}
+	}
+	fields := `["make", "owner"]`
+
+	results := []QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryAllBikes", "", fields)), &results)
+	onlyFields(results, 10)
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getBikesByRange", "BIKE000002", "BIKE000005", fields)), &results)
+	onlyFields(results, 3)
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryBikesByFilter", `{"make": "Honda"}`, "", "", fields)), &results)
+	onlyFields(results, 2)
+
+	onlyFields([]QueryResult{{Key: "BIKE000000", Record: mustSucceed(t, stub.invoke(alice, "queryBike", "BIKE000000", fields))}}, 1)
+
+	// Without fields the whole record comes back
+	bike := Bike{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryBike", "BIKE000000", "")), &bike)
+	if bike.Colour == "" || bike.Version != 1 {
+		t.Fatalf("unprojected query lost fields: %+v", bike)
+	}
+
+	mustFail(t, stub.invoke(alice, "queryAllBikes", "", `["wheels"]`), "Unknown bike field wheels")
+	mustFail(t, stub.invoke(alice, "queryBike", "BIKE000000", "make"), "JSON array")
+}
+
+func TestBikeStats(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(admin, "initLedger"))
+	mustSucceed(t, stub.invoke(admin, "archiveBike", "BIKE000001"))
+
+	stats := BikeStats{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getBikeStats", "make")), &stats)
+	if stats.Total != 9 || stats.Counts["Honda"] != 2 || stats.Counts["BMW"] != 0 || len(stats.Counts) != 8 {
+		t.Fatalf("unexpected stats by make %+v", stats)
+	}
+	stats = BikeStats{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getBikeStats", "colour")), &stats)
+	if stats.Counts["blue"] != 4 || stats.Counts["black"] != 2 {
+		t.Fatalf("unexpected stats by colour %+v", stats)
+	}
+	stats = BikeStats{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getBikeStats", "status")), &stats)
+	if stats.Counts[statusActive] != 9 || len(stats.Counts) != 1 {
+		t.Fatalf("unexpected stats by status %+v", stats)
+	}
+	mustFail(t, stub.invoke(alice, "getBikeStats", "wheels"), "grouped by assetType, colour, make, owner, status")
+}
+
+func TestCountBikes(t *testing.T) {
+	stub := newTestStub(t)
+	count := func(identity *testIdentity) BikeCount {
+		count := BikeCount{}
+		mustDecode(t, mustSucceed(t, stub.invoke(identity, "countBikes")), &count)
+		return count
+	}
+	if c := count(alice); c.Count != 0 {
+		t.Fatalf("empty ledger counts %+v", c)
+	}
+	mustSucceed(t, stub.invoke(admin, "initLedger"))
+	mustSucceed(t, stub.invoke(admin, "archiveBike", "BIKE000001"))
+	stub.createBikeFor(t, "BIKE000011", alice)
+	mustSucceed(t, stub.invoke(alice, "updateBike", "BIKE000011", "", `{"colour": "red"}`))
+	if c := count(alice); c.Count != 10 {
+		t.Fatalf("expected 10 bikes, got %+v", c)
+	}
+	mustSucceed(t, stub.invoke(admin, "restoreBike", "BIKE000001"))
+	if c := count(alice); c.Count != 11 {
+		t.Fatalf("expected the restored bike to count, got %+v", c)
+	}
+
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"tenants": {"Org3MSP": "SOUTH"}}`))
+	south := &testIdentity{mspID: "Org3MSP", id: "sam"}
+	mustSucceed(t, stub.invoke(south, "createBike", "SOUTH|BIKE000001", "Bajaj", "Pulsar", "red", "sam"))
+	if c := count(south); c.Tenant != "SOUTH" || c.Count != 1 {
+		t.Fatalf("SOUTH counts %+v", c)
+	}
+	if c := count(alice); c.Count != 11 {
+		t.Fatalf("SOUTH bike counted outside its tenant: %+v", c)
+	}
+
+	// A bike written behind the counter's back is counted once rebuildIndexes recounts
+	stub.MockTransactionStart("drift")
+	stub.PutState("BIKE000042", []byte(`{"make": "Honda", "model": "Shine", "colour": "blue", "owner": "bob"}`))
+	stub.MockTransactionEnd("drift")
+	mustSucceed(t, stub.invoke(admin, "rebuildIndexes"))
+	if c := count(alice); c.Count != 12 {
+		t.Fatalf("expected rebuildIndexes to recount, got %+v", c)
+	}
+
+	// Every create and archive writes an entry of its own, so none of them conflict
+	stub.createBikeFor(t, "BIKE000043", alice)
+	stub.createBikeFor(t, "BIKE000044", alice)
+	mustSucceed(t, stub.invoke(alice, "archiveBike", "BIKE000044"))
+	if n := stub.countKeys(t, "BIKECOUNT", ""); n != 4 {
+		t.Fatalf("expected the recount and 3 entries, got %d", n)
+	}
+	mustFail(t, stub.invoke(alice, "compactBikeCounts"), "Only members of")
+	mustSucceed(t, stub.invoke(admin, "compactBikeCounts"))
+	if n := stub.countKeys(t, "BIKECOUNT", ""); n != 1 {
+		t.Fatalf("compaction left %d entries", n)
+	}
+	if c := count(alice); c.Count != 13 {
+		t.Fatalf("compaction changed the count to %+v", c)
+	}
+
+	// Pages of every bike carry the total from the counters
+	page := PagedResults{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryBikesByFilter", "{}", "5", "")), &page)
+	if len(page.Results) != 5 || page.ResponseMetadata.TotalCount == nil || *page.ResponseMetadata.TotalCount != 13 {
+		t.Fatalf("unexpected page %+v", page.ResponseMetadata)
+	}
+	page = PagedResults{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryBikesByFilter", `{"make": "Honda"}`, "5", "")), &page)
+	if page.ResponseMetadata.TotalCount != nil {
+		t.Fatalf("filtered page carries the fleet total %+v", page.ResponseMetadata)
+	}
+
+	// Keys are only taken for a tenant's when they lie under its key prefix
+	config := Config{KeyPrefix: "BIKE", Tenants: map[string]string{"Org3MSP": "SOUTH"}}
+	if keyTenant(config, "SOUTH|BIKE000001") != "SOUTH" || keyTenant(config, "OLD|BIKE000001") != "" || keyTenant(Config{KeyPrefix: "BIKE"}, "SOUTH|BIKE000001") != "" {
+		t.Fatal("keys assigned to the wrong tenants")
+	}
+
+	// Records under the key prefix that are not bikes do not break the stats
+	stub.MockTransactionStart("garbage")
+	stub.PutState("BIKE-NOTES", []byte("plain text"))
+	stub.MockTransactionEnd("garbage")
+	stats := BikeStats{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getBikeStats", "make")), &stats)
+	if stats.Total != 13 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	stub := newTestStub(t)
+	south := &testIdentity{mspID: "Org3MSP", id: "sam"}
+	mustFail(t, stub.invoke(admin, "setConfig", `{"tenants": {"Org2MSP": "NO|RTH"}}`), "tenants")
+	mustFail(t, stub.invoke(admin, "setConfig", `{"tenants": {"Org2MSP": "NORTH", "Org3MSP": "TH"}}`), "TH and NORTH must not be prefixes or suffixes")
+	mustFail(t, stub.invoke(admin, "setConfig", `{"tenants": {"Org2MSP": "NORTH", "Org3MSP": "NORTHWEST"}}`), "must not be prefixes or suffixes")
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"tenants": {"Org2MSP": "NORTH", "Org3MSP": "SOUTH"}}`))
+
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "blue", "alice"), "outside the namespace of tenant NORTH")
+	mustSucceed(t, stub.invoke(alice, "createBike", "NORTH|BIKE000001", "Honda", "Shine", "blue", "alice"))
+	mustSucceed(t, stub.invoke(south, "createBike", "SOUTH|BIKE000001", "Bajaj", "Pulsar", "red", "sam"))
+	mustSucceed(t, stub.invoke(admin, "createBike", "BIKE000001", "TVS", "Apache", "blue", "admin"))
+
+	results := []QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryAllBikes")), &results)
+	if len(results) != 1 || results[0].Key != "NORTH|BIKE000001" {
+		t.Fatalf("NORTH sees %+v", results)
+	}
+	stats := BikeStats{}
+	mustDecode(t, mustSucceed(t, stub.invoke(south, "getBikeStats", "make")), &stats)
+	if stats.Total != 1 || stats.Counts["Bajaj"] != 1 {
+		t.Fatalf("SOUTH counts %+v", stats)
+	}
+	mustFail(t, stub.invoke(south, "queryBike", "NORTH|BIKE000001"), "Tenant SOUTH cannot use the keys of tenant NORTH")
+	mustFail(t, stub.invoke(south, "transferBikesBatch", "sam", `["NORTH|BIKE000001"]`), "cannot use the keys of tenant NORTH")
+	mustFail(t, stub.invoke(south, "transferBikesBatch", "sam", `["NORTH\u007cBIKE000001"]`), "cannot use the keys of tenant NORTH")
+	mustFail(t, stub.invoke(south, "transferBikesBatch", "sam", `"[\"NORTH|BIKE000001\"]"`), "cannot use the keys of tenant NORTH")
+	mustFail(t, stub.invoke(alice, "getBikesByRange", "", "~"), "Range must lie in the namespace of tenant NORTH")
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getBikesByRange", "NORTH|BIKE", "NORTH|BIKF")), &results)
+	if len(results) != 1 {
+		t.Fatalf("NORTH range returned %+v", results)
+	}
+
+	mustFail(t, stub.invoke(alice, "queryAllTenants"), "Only members of")
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "queryAllTenants")), &results)
+	if len(results) != 3 || results[0].Key != "BIKE000001" {
+		t.Fatalf("admin sees %+v", results)
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "queryAllTenants", "SOUTH")), &results)
+	if len(results) != 1 || results[0].Key != "SOUTH|BIKE000001" {
+		t.Fatalf("admin sees %+v of SOUTH", results)
+	}
+}
+
+func TestBikeNotFound(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	stub.createBikeFor(t, "BIKE000002", alice)
+	mustSucceed(t, stub.invoke(workshop, "addServiceRecord", "BIKE000002", "2020-01-02", "100", "garage", "oil"))
+	mustSucceed(t, stub.invoke(alice, "archiveBike", "BIKE000002"))
+
+	for _, fn := range []string{"queryBike", "getServiceRecords", "getCertificates", "getOdometer", "getLien"} {
+		if code := mustFail(t, stub.invoke(alice, fn, "BIKE000009"), "Bike BIKE000009 does not exist"); code != codeBikeNotFound {
+			t.Errorf("%s gave code %s", fn, code)
+		}
+	}
+	if code := mustFail(t, stub.invoke(alice, "queryBike", "BIKE000002"), "does not exist"); code != codeBikeNotFound {
+		t.Errorf("archived bike gave code %s", code)
+	}
+	records := []ServiceRecord{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getServiceRecords", "BIKE000002")), &records)
+	if len(records) != 1 {
+		t.Fatalf("archived bike lost its service records: %+v", records)
+	}
+	if code := mustFail(t, stub.invoke(alice, "getLien", "BIKE000001"), "has no lien"); code != codeNotFound {
+		t.Errorf("bike without lien gave code %s", code)
+	}
+
+	for key, want := range map[string]bool{"BIKE000001": true, "BIKE000002": false, "BIKE000009": false} {
+		if exists := mustSucceed(t, stub.invoke(alice, "bikeExists", key)); string(exists) != strconv.FormatBool(want) {
+			t.Errorf("bikeExists %s = %s", key, exists)
+		}
+	}
+}
+
+func TestBikesModifiedSince(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	stub.now += 10
+	since := strconv.FormatInt(stub.now, 10)
+	stub.createBikeFor(t, "BIKE000002", alice)
+	stub.createBikeFor(t, "BIKE000003", bob)
+	stub.now += 10
+	mustSucceed(t, stub.invoke(alice, "updateBike", "BIKE000002", "1", `{"colour": "red"}`))
+	mustSucceed(t, stub.invoke(bob, "archiveBike", "BIKE000003"))
+
+	results := []QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(carol, "getBikesModifiedSince", since)), &results)
+	if len(results) != 2 || results[0].Key != "BIKE000002" || results[1].Key != "BIKE000003" {
+		t.Fatalf("unexpected changes %+v", results)
+	}
+	if string(results[1].Record) != "null" {
+		t.Fatalf("archived bike came back as %s", results[1].Record)
+	}
+	bike := Bike{}
+	mustDecode(t, results[0].Record, &bike)
+	if bike.Colour != "red" {
+		t.Fatalf("stale record %+v", bike)
+	}
+
+	page := PagedResults{}
+	mustDecode(t, mustSucceed(t, stub.invoke(carol, "getBikesModifiedSince", "0", "2")), &page)
+	if len(page.Results) != 2 || page.Results[0].Key != "BIKE000001" || page.ResponseMetadata.Bookmark == "" {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(carol, "getBikesModifiedSince", "0", "2", page.ResponseMetadata.Bookmark)), &page)
+	if len(page.Results) != 1 || page.Results[0].Key != "BIKE000003" {
+		t.Fatalf("unexpected second page %+v", page)
+	}
+	mustFail(t, stub.invoke(carol, "getBikesModifiedSince", "yesterday"), "Unix timestamp")
+}
+
+func TestCreateVehicle(t *testing.T) {
+	fixtures, err := ioutil.ReadFile("testdata/vehicles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Name    string          `json:"name"`
+		Key     string          `json:"key"`
+		Vehicle json.RawMessage `json:"vehicle"`
+		Error   string          `json:"error"`
+	}{}
+	if err := json.Unmarshal(fixtures, &tests); err != nil {
+		t.Fatal(err)
+	}
+
+	stub := newTestStub(t)
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			resp := stub.invoke(alice, "createVehicle", test.Key, string(test.Vehicle))
+			if test.Error != "" {
+				mustFail(t, resp, test.Error)
+				return
+			}
+			mustSucceed(t, resp)
+
+			input := VehicleInput{}
+			mustDecode(t, test.Vehicle, &input)
+			if bike := stub.bike(t, test.Key); bike.AssetType != input.AssetType || bike.Make != input.Make {
+				t.Fatalf("stored %+v for %s", bike, test.Vehicle)
+			}
+		})
+	}
+}
+
+func TestAssetSchema(t *testing.T) {
+	stub := newTestStub(t)
+	schema := `{"required": ["attributes"], "properties": {
+		"colour": {"enum": ["red", "blue"]},
+		"attributes": {"type": "object", "required": ["engineNo"], "additionalProperties": false, "properties": {
+			"engineNo": {"type": "string", "pattern": "^EN[0-9]{6}$"},
+			"subsidised": {"type": "boolean"}}}}}`
+
+	mustFail(t, stub.invoke(alice, "setAssetSchema", assetMotorbike, schema), "Only members of")
+	mustFail(t, stub.invoke(admin, "setAssetSchema", "tractor", schema), "Unknown asset type")
+	mustFail(t, stub.invoke(admin, "setAssetSchema", assetMotorbike, `{"format": "date"}`), "supported keywords")
+	mustFail(t, stub.invoke(admin, "setAssetSchema", assetMotorbike, `{"pattern": "("}`), "bad pattern")
+	mustSucceed(t, stub.invoke(admin, "setAssetSchema", assetMotorbike, schema))
+	if stored := mustSucceed(t, stub.invoke(bob, "getAssetSchema", assetMotorbike)); stored == nil {
+		t.Fatal("schema not stored")
+	}
+	if stored := mustSucceed(t, stub.invoke(bob, "getAssetSchema", assetCycle)); len(stored) != 0 {
+		t.Fatalf("cycles have schema %s", stored)
+	}
+
+	vehicle := `{"assetType": "motorbike", "make": "Honda", "model": "Shine", "colour": "red", "owner": "alice", "attributes": %s}`
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "red", "alice"), "bike.attributes is required")
+	mustFail(t, stub.invoke(alice, "createVehicle", "BIKE000001", fmt.Sprintf(vehicle, `{"subsidised": false}`)), "bike.attributes.engineNo is required")
+	mustFail(t, stub.invoke(alice, "createVehicle", "BIKE000001", fmt.Sprintf(vehicle, `{"engineNo": "123"}`)), "does not match")
+	mustFail(t, stub.invoke(alice, "createVehicle", "BIKE000001", fmt.Sprintf(vehicle, `{"engineNo": "EN123456", "vin": "x"}`)), "vin is not allowed")
+	mustSucceed(t, stub.invoke(alice, "createVehicle", "BIKE000001", fmt.Sprintf(vehicle, `{"engineNo": "EN123456"}`)))
+	mustSucceed(t, stub.invoke(alice, "createVehicle", "BIKE000002", `{"assetType": "cycle", "make": "Hero", "model": "Sprint", "colour": "green", "owner": "alice"}`))
+
+	mustFail(t, stub.invoke(alice, "updateBike", "BIKE000001", "1", `{"attributes": {"subsidised": "yes"}}`), "subsidised must be of type boolean")
+	mustFail(t, stub.invoke(alice, "updateBike", "BIKE000001", "1", `{"attributes": {"engineNo": null}}`), "attributes is required")
+	mustSucceed(t, stub.invoke(alice, "updateBike", "BIKE000001", "1", `{"attributes": {"subsidised": true}}`))
+	mustFail(t, stub.invoke(alice, "patchBike", "BIKE000001", `{"colour": "green"}`), "colour is not one of the allowed values")
+	if bike := stub.bike(t, "BIKE000001"); bike.Attributes["engineNo"] != "EN123456" || bike.Attributes["subsidised"] != true {
+		t.Fatalf("unexpected attributes %v", bike.Attributes)
+	}
+
+	mustSucceed(t, stub.invoke(admin, "setAssetSchema", assetMotorbike, ""))
+	mustSucceed(t, stub.invoke(alice, "patchBike", "BIKE000001", `{"colour": "green"}`))
+}
+
+func TestCreateBike(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "blue", "alice", "ka-01 ab 1234"))
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "blue", "alice"), "already exists")
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000002", "Honda", "Shine", "blue", "alice", "KA01AB1234"), "already assigned to BIKE000001")
+	mustFail(t, stub.invoke(alice, "createBike", "", "Honda", "Shine", "blue", "alice"), "Key must not be empty")
+
+	result := QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "queryBikeByRegistrationNo", "KA 01 AB 1234")), &result)
+	if result.Key != "BIKE000001" {
+		t.Fatalf("registration number found %s", result.Key)
+	}
+	mustFail(t, stub.invoke(bob, "queryBikeByRegistrationNo", "KA99"), "KA99")
+
+	bike := stub.bike(t, "BIKE000001")
+	if bike.Status != statusActive || bike.SchemaVersion != currentSchemaVersion || bike.AssetType != assetMotorbike {
+		t.Fatalf("new bike not at the current schema: %+v", bike)
+	}
+
+	audit := BikeAudit{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getBikeAudit", "BIKE000001")), &audit)
+	if audit.CreatedBy != "Org2MSP/alice" || audit.CreatedTxID == "" || audit.LastModifiedAt != stub.now ||
+		audit.RegisteredAt != stub.now || audit.LastTransferAt != 0 {
+		t.Fatalf("unexpected audit %+v", audit)
+	}
+}
+
+func TestCreateBikeAutoKey(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(admin, "initLedger"))
+
+	// initLedger took BIKE000000 to BIKE000009
+	if key := mustSucceed(t, stub.invoke(alice, "createBikeAutoKey", "Honda", "Shine", "blue", "alice")); string(key) != "BIKE000010" {
+		t.Fatalf("first generated key is %s", key)
+	}
+	if key := mustSucceed(t, stub.invoke(alice, "createBikeAutoKey", "Honda", "Shine", "blue", "alice", "KA01AB1234")); string(key) != "BIKE000011" {
+		t.Fatalf("second generated key is %s", key)
+	}
+	mustFail(t, stub.invoke(alice, "createBikeAutoKey", "Honda", "Shine", "blue", "alice", "KA01AB1234"), "already assigned")
+	if bike := stub.bike(t, "BIKE000011"); bike.RegistrationNo != "KA01AB1234" || bike.Owner != "Org2MSP/alice" {
+		t.Fatalf("unexpected bike %+v", bike)
+	}
+
+	counter, _ := stub.CreateCompositeKey("SEQ", []string{"BIKEKEY", "BIKE"})
+	stub.MockTransactionStart("counter")
+	stub.PutState(counter, []byte("999"))
+	stub.MockTransactionEnd("counter")
+	if key := mustSucceed(t, stub.invoke(alice, "createBikeAutoKey", "Honda", "Shine", "blue", "alice")); string(key) != "BIKE001000" {
+		t.Fatalf("key after 999 is %s", key)
+	}
+	results := []QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryAllBikes")), &results)
+	if last := results[len(results)-1].Key; len(results) != 13 || last != "BIKE001000" {
+		t.Fatalf("range query ends with %s of %d bikes", last, len(results))
+	}
+}
+
+func TestQRPayload(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "blue", "alice", "", "1M8GDM9AXKP042788"))
+	stub.createBikeFor(t, "BIKE000002", bob)
+
+	payload := string(mustSucceed(t, stub.invoke(alice, "getBikeQRPayload", "BIKE000001")))
+	if payload != "FB1;;fabbike;"+qrChassisHash("1M8GDM9AXKP042788")+";BIKE000001" || len(qrChassisHash("x")) != qrHashLength {
+		t.Fatalf("unexpected payload %s", payload)
+	}
+	result := QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(police, "resolveQRPayload", payload)), &result)
+	bike := Bike{}
+	mustDecode(t, result.Record, &bike)
+	if result.Key != "BIKE000001" || bike.ChassisNo != "1M8GDM9AXKP042788" {
+		t.Fatalf("resolved to %s: %+v", result.Key, bike)
+	}
+	payload = string(mustSucceed(t, stub.invoke(bob, "getBikeQRPayload", "BIKE000002")))
+	mustSucceed(t, stub.invoke(police, "resolveQRPayload", payload))
+
+	mustFail(t, stub.invoke(police, "resolveQRPayload", "FB1;;fabbike;;BIKE000001"), "does not match the chassis number")
+	mustFail(t, stub.invoke(police, "resolveQRPayload", "FB2;;fabbike;;BIKE000002"), "version FB2")
+	mustFail(t, stub.invoke(police, "resolveQRPayload", "FB1;mychannel;fabbike;;BIKE000002"), "on channel mychannel")
+	mustFail(t, stub.invoke(police, "resolveQRPayload", "https://example.com"), "not a bike QR payload")
+	mustFail(t, stub.invoke(police, "resolveQRPayload", "FB1;;fabbike;;BIKE000009"), "does not exist")
+}
+
+func TestChassisNo(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "blue", "alice", "", "1m8gdm9axkp042788"))
+	if bike := stub.bike(t, "BIKE000001"); bike.ChassisNo != "1M8GDM9AXKP042788" {
+		t.Fatalf("chassis number stored as %s", bike.ChassisNo)
+	}
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000002", "Honda", "Shine", "red", "alice", "", "1M8GDM9AXKP042788"), "already registered to BIKE000001")
+
+	result := QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "queryBikeByChassis", "1M8-GDM9AX-KP042788")), &result)
+	if result.Key != "BIKE000001" {
+		t.Fatalf("queryBikeByChassis found %s", result.Key)
+	}
+	mustFail(t, stub.invoke(bob, "queryBikeByChassis", "MD2A11CZ2KWA00001"), "No bike with chassis number")
+
+	// The number comes free again while the bike is archived, and is reclaimed on restore
+	mustSucceed(t, stub.invoke(alice, "archiveBike", "BIKE000001"))
+	mustFail(t, stub.invoke(bob, "queryBikeByChassis", "1M8GDM9AXKP042788"), "No bike with chassis number")
+	mustSucceed(t, stub.invoke(alice, "restoreBike", "BIKE000001"))
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "queryBikeByChassis", "1M8GDM9AXKP042788")), &result)
+
+	batch := `[
+		{"key": "BIKE000002", "make": "KTM", "model": "Duke", "colour": "orange", "owner": "bob", "chassisNo": "MD2A11CZ2KWA00001"},
+		{"key": "BIKE000003", "make": "KTM", "model": "Duke", "colour": "orange", "owner": "bob", "chassisNo": "md2a11cz2kwa00001"}
+	]`
+	results := []BatchResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "createBikesBatch", batch)), &results)
+	if !results[0].OK || results[1].OK || !strings.Contains(results[1].Error, "more than once") {
+		t.Fatalf("unexpected batch results %+v", results)
+	}
+}
+
+func TestCreateBikesBatch(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	batch := `[
+		{"key": "BIKE000002", "assetType": "motorbike", "make": "KTM", "model": "Duke", "colour": "orange", "owner": "bob"},
+		{"key": "BIKE000001", "assetType": "motorbike", "make": "KTM", "model": "Duke", "colour": "orange", "owner": "bob"},
+		{"key": "BIKE000002", "assetType": "motorbike", "make": "KTM", "model": "Duke", "colour": "orange", "owner": "bob"},
+		{"key": "BIKE000003", "assetType": "ebike", "make": "Ather", "model": "450X", "colour": "grey", "owner": "bob"}
+	]`
+	results := []BatchResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "createBikesBatch", batch)), &results)
+	want := []bool{true, false, false, false}
+	for i, result := range results {
+		if result.OK != want[i] {
+			t.Errorf("entry %d: got %+v", i, result)
+		}
+	}
+
+	transient := map[string]string{"bikes": `[{"key": "BIKE000004", "assetType": "cycle", "make": "Hero", "model": "Sprint", "colour": "red", "owner": "bob"}]`}
+	mustDecode(t, mustSucceed(t, stub.invokeTransient(alice, transient, "createBikesBatch")), &results)
+	if len(results) != 1 || !results[0].OK {
+		t.Fatalf("transient batch failed: %+v", results)
+	}
+	mustFail(t, stub.invoke(alice, "createBikesBatch"), "No bikes given")
+	mustFail(t, stub.invoke(alice, "createBikesBatch", `[]`), "Batch is empty")
+}
+
+func TestTransferBikesBatch(t *testing.T) {
+	stub := newTestStub(t)
+	for _, key := range []string{"BIKE000001", "BIKE000002", "BIKE000003"} {
+		stub.createBikeFor(t, key, alice)
+	}
+	stub.createBikeFor(t, "BIKE000004", bob)
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000002", "carol", "0"))
+
+	mustFail(t, stub.invoke(alice, "transferBikesBatch", "bob", `["BIKE000001", "BIKE000004", "BIKE000001"]`), "2 of 3 bikes cannot be transferred")
+	if stub.countKeys(t, "OWNERBIKE", "Org2MSP/bob") != 1 {
+		t.Fatal("a failed batch moved bikes")
+	}
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"maxBikesPerOwner": 3}`))
+	mustFail(t, stub.invoke(alice, "transferBikesBatch", "bob", `["BIKE000001", "BIKE000002", "BIKE000003"]`), "at most 3")
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"maxBikesPerOwner": 0}`))
+
+	results := []BatchResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "transferBikesBatch", "bob", `["BIKE000001", "BIKE000002", "BIKE000003"]`)), &results)
+	if len(results) != 3 || !results[0].OK || !results[1].OK || !results[2].OK {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if stub.countKeys(t, "OWNERBIKE", "Org2MSP/alice") != 0 || stub.countKeys(t, "OWNERBIKE", "Org2MSP/bob") != 4 {
+		t.Fatal("owner index not moved for the batch")
+	}
+	mustFail(t, stub.invoke(carol, "acceptTransfer", "BIKE000002"), "No pending transfer offer")
+	mustFail(t, stub.invoke(alice, "transferBikesBatch", "bob", `[]`), "Batch is empty")
+}
+
+func TestUpdateBike(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustSucceed(t, stub.invoke(alice, "updateBike", "BIKE000001", "1", `{"colour": "red"}`))
+	if bike := stub.bike(t, "BIKE000001"); bike.Colour != "red" || bike.Version != 2 {
+		t.Fatalf("update not applied: %+v", bike)
+	}
+
+	resp := stub.invoke(alice, "updateBike", "BIKE000001", "1", `{"colour": "green"}`)
+	if resp.Status != statusConflict {
+		t.Fatalf("stale update got status %d, want %d", resp.Status, statusConflict)
+	}
+	mustFail(t, stub.invoke(alice, "updateBike", "BIKE000001", "2", `{"batteryCapacityKWh": 2}`), "no traction battery")
+}
+
+func TestPatchBike(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "blue", "alice", "KA01AB1234"))
+	mustSucceed(t, stub.invoke(bob, "createBike", "BIKE000002", "Honda", "Shine", "blue", "bob", "KA01AB9999"))
+
+	mustSucceed(t, stub.invoke(alice, "patchBike", "BIKE000001", `{"colour": "red", "model": "Shine SP"}`, "1"))
+	if bike := stub.bike(t, "BIKE000001"); bike.Colour != "red" || bike.Model != "Shine SP" || bike.RegistrationNo != "KA01AB1234" {
+		t.Fatalf("patch not applied: %+v", bike)
+	}
+	mustFail(t, stub.invoke(alice, "patchBike", "BIKE000001", `{"colour": "green", "registrationNo": "KA01AB5678"}`), "does not have the registrar role")
+	mustFail(t, stub.invoke(registrar, "patchBike", "BIKE000001", `{"colour": "green"}`), "Only the owner")
+	mustFail(t, stub.invoke(alice, "patchBike", "BIKE000001", `{"owner": "bob"}`), "Field owner cannot be patched")
+	mustFail(t, stub.invoke(alice, "patchBike", "BIKE000001", `{"colour": 3}`), "must be a string or null")
+	mustFail(t, stub.invoke(alice, "patchBike", "BIKE000001", `[]`), "Patch must be a JSON object")
+	mustFail(t, stub.invoke(alice, "patchBike", "BIKE000001", `{"colour": "green"}`, "1"), "re-read it and retry")
+	mustFail(t, stub.invoke(registrar, "patchBike", "BIKE000001", `{"registrationNo": "KA01AB9999"}`), "already assigned to BIKE000002")
+
+	mustSucceed(t, stub.invoke(registrar, "patchBike", "BIKE000001", `{"registrationNo": "ka01 ab 5678", "model": "Shine"}`))
+	mustFail(t, stub.invoke(alice, "queryBikeByRegistrationNo", "KA01AB1234"), "No bike with registration number")
+	mustSucceed(t, stub.invoke(alice, "queryBikeByRegistrationNo", "KA01AB5678"))
+	mustSucceed(t, stub.invoke(registrar, "patchBike", "BIKE000001", `{"registrationNo": null}`))
+	if bike := stub.bike(t, "BIKE000001"); bike.RegistrationNo != "" || bike.Model != "Shine" || bike.Colour != "red" {
+		t.Fatalf("unexpected bike %+v", bike)
+	}
+	if stub.countKeys(t, "REGNO", "KA01AB5678") != 0 {
+		t.Fatal("cleared registration number still indexed")
+	}
+}
+
+func TestModificationApproval(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"modificationApproval": true}`))
+	mustFail(t, stub.invoke(alice, "updateBike", "BIKE000001", "", `{"colour": "red"}`), "need registrar approval")
+	mustFail(t, stub.invoke(alice, "patchBike", "BIKE000001", `{"colour": "red"}`), "need registrar approval")
+
+	mustFail(t, stub.invoke(bob, "requestModification", "BIKE000001", `{"colour": "red"}`), "Only the owner")
+	mustFail(t, stub.invoke(alice, "requestModification", "BIKE000001", `{}`), "non-empty JSON object")
+	request := ModificationRequest{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "requestModification", "BIKE000001", `{"colour": "red", "engineCC": 150}`)), &request)
+	rejected := ModificationRequest{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "requestModification", "BIKE000001", `{"model": "Unicorn"}`)), &rejected)
+	if request.Status != modificationPending || request.RequestedBy != "Org2MSP/alice" {
+		t.Fatalf("unexpected request %+v", request)
+	}
+	pending := []ModificationRequest{}
+	mustDecode(t, mustSucceed(t, stub.invoke(registrar, "getPendingModifications", "BIKE000001")), &pending)
+	if len(pending) != 2 || pending[0].RequestID != request.RequestID {
+		t.Fatalf("unexpected pending requests %v", pending)
+	}
+	if bike := stub.bike(t, "BIKE000001"); bike.Colour == "red" {
+		t.Fatal("request changed the bike before approval")
+	}
+
+	mustFail(t, stub.invoke(alice, "approveModification", request.RequestID), "registrar")
+	mustDecode(t, mustSucceed(t, stub.invoke(registrar, "approveModification", request.RequestID)), &request)
+	if request.Status != modificationApproved || request.DecidedBy != "Org2MSP/rto" {
+		t.Fatalf("unexpected approved request %+v", request)
+	}
+	if bike := stub.bike(t, "BIKE000001"); bike.Colour != "red" || bike.EngineCC != 150 {
+		t.Fatalf("approved modification not applied: %+v", bike)
+	}
+	mustFail(t, stub.invoke(registrar, "approveModification", request.RequestID), "already APPROVED")
+	mustFail(t, stub.invoke(registrar, "rejectModification", rejected.RequestID, ""), "Reason")
+	mustSucceed(t, stub.invoke(registrar, "rejectModification", rejected.RequestID, "no inspection report"))
+	mustDecode(t, mustSucceed(t, stub.invoke(registrar, "getPendingModifications")), &pending)
+	if len(pending) != 0 {
+		t.Fatalf("decided requests still pending: %v", pending)
+	}
+	mustSucceed(t, stub.invoke(registrar, "patchBike", "BIKE000001", `{"model": "Unicorn"}`))
+}
+
+func TestTransfer(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustFail(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "alice", "0"), "already owned by Org2MSP/alice")
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+
+	offer := TransferOffer{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "queryTransferOffer", "BIKE000001")), &offer)
+	if offer.Seller != "Org2MSP/alice" || offer.NewOwner != "Org2MSP/bob" || offer.ExpiresAt != stub.now+24*60*60 {
+		t.Fatalf("unexpected offer %+v", offer)
+	}
+
+	mustFail(t, stub.invoke(carol, "acceptTransfer", "BIKE000001"), "Only Org2MSP/bob can accept")
+	registeredAt := stub.now
+	stub.now += 100
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+	bike := stub.bike(t, "BIKE000001")
+	if bike.Owner != "Org2MSP/bob" {
+		t.Fatalf("owner is %s after transfer", bike.Owner)
+	}
+	if bike.RegisteredAt != registeredAt || bike.LastTransferAt != stub.now {
+		t.Fatalf("registered at %d and transferred at %d", bike.RegisteredAt, bike.LastTransferAt)
+	}
+	mustFail(t, stub.invoke(bob, "queryTransferOffer", "BIKE000001"), "No pending transfer offer")
+	if stub.countKeys(t, "OWNERBIKE", "Org2MSP/alice") != 0 || stub.countKeys(t, "OWNERBIKE", "Org2MSP/bob") != 1 {
+		t.Fatal("owner index not moved")
+	}
+
+	mustSucceed(t, stub.invoke(bob, "offerTransfer", "BIKE000001", "carol", "0", "60"))
+	stub.now += 61
+	mustFail(t, stub.invoke(carol, "acceptTransfer", "BIKE000001"), "expired")
+
+	resp := stub.invoke(bob, "changeBikeOwner", "BIKE000001", "carol", "1")
+	if resp.Status != statusConflict {
+		t.Fatalf("stale changeBikeOwner got status %d", resp.Status)
+	}
+	mustSucceed(t, stub.invoke(bob, "changeBikeOwner", "BIKE000001", "carol"))
+	mustSucceed(t, stub.invoke(bob, "updateBike", "BIKE000001", "2", `{"colour": "red"}`))
+	resp = stub.invoke(carol, "acceptTransfer", "BIKE000001")
+	if resp.Status != statusConflict {
+		t.Fatalf("accepting an offer for a changed bike got status %d", resp.Status)
+	}
+}
+
+func TestStagedState(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "100"))
+	read := TransferOffer{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "queryTransferOffer", "BIKE000001")), &read)
+	if read.StateHash == "" {
+		t.Fatal("offer has no state hash")
+	}
+
+	// The seller re-prices after bob read the offer
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+	resp := stub.invoke(bob, "acceptTransfer", "BIKE000001", read.StateHash)
+	if code := mustFail(t, resp, "changed since it was read"); code != codeStateConflict || resp.Status != statusConflict {
+		t.Fatalf("stale offer failed with %s, status %d", code, resp.Status)
+	}
+	wrapped := Envelope{}
+	mustDecode(t, []byte(resp.Message), &wrapped)
+	if !wrapped.Error.Retryable {
+		t.Fatalf("state conflict not retryable: %s", resp.Message)
+	}
+	if code := mustFail(t, stub.invoke(bob, "acceptTransfer", "BIKE000002"), "No pending transfer offer"); retryableCodes[code] {
+		t.Fatalf("%s is retryable", code)
+	}
+
+	current := TransferOffer{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "queryTransferOffer", "BIKE000001")), &current)
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001", current.StateHash))
+	if owner := stub.bike(t, "BIKE000001").Owner; owner != "Org2MSP/bob" {
+		t.Fatalf("owner is %s", owner)
+	}
+
+	stub.MockTransactionStart("staged")
+	staged := stageState(stub)
+	if stageState(staged) != staged {
+		t.Fatal("staged state wrapped twice")
+	}
+	committed, _ := staged.GetState("KEY")
+	if err := staged.PutState("KEY", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := staged.GetState("KEY"); string(value) != "new" {
+		t.Fatalf("read %q after write", value)
+	}
+	if err := staged.assertUnchanged("KEY", stateHash([]byte("new")), "Key"); err == nil {
+		t.Fatal("precondition checked against a staged write")
+	}
+	if err := staged.DelState("KEY"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := staged.GetState("KEY"); value != nil || committed != nil {
+		t.Fatalf("read %q after delete", value)
+	}
+	stub.MockTransactionEnd("staged")
+}
+
+func TestDelegates(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	expiry := strconv.FormatInt(stub.now+7*24*60*60, 10)
+
+	mustFail(t, stub.invoke(bob, "grantDelegate", "BIKE000001", "dealer", expiry), "Only the owner")
+	mustFail(t, stub.invoke(alice, "grantDelegate", "BIKE000001", "dealer", strconv.FormatInt(stub.now, 10)), "Expiry must be after")
+	mustFail(t, stub.invoke(carol, "offerTransfer", "BIKE000001", "bob", "0"), "or their delegate")
+	mustSucceed(t, stub.invoke(alice, "grantDelegate", "BIKE000001", "carol", expiry))
+	delegations := []Delegation{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getDelegates", "BIKE000001")), &delegations)
+	if len(delegations) != 1 || delegations[0].DelegateID != "Org2MSP/carol" || delegations[0].GrantedBy != "Org2MSP/alice" {
+		t.Fatalf("unexpected delegations %v", delegations)
+	}
+
+	// The delegate sells in the owner's name
+	mustSucceed(t, stub.invoke(carol, "offerTransfer", "BIKE000001", "bob", "0"))
+	offer := TransferOffer{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "queryTransferOffer", "BIKE000001")), &offer)
+	if offer.Seller != "Org2MSP/alice" {
+		t.Fatalf("unexpected offer %+v", offer)
+	}
+	mustFail(t, stub.invoke(carol, "updateBike", "BIKE000001", "", `{"colour": "red"}`), "Only the owner")
+	mustSucceed(t, stub.invoke(alice, "revokeDelegate", "BIKE000001", "carol"))
+	mustFail(t, stub.invoke(carol, "offerTransfer", "BIKE000001", "bob", "0"), "or their delegate")
+	mustFail(t, stub.invoke(alice, "revokeDelegate", "BIKE000001", "carol"), "not a delegate")
+
+	// A delegation lapses at expiry and when the bike changes hands
+	mustSucceed(t, stub.invoke(alice, "grantDelegate", "BIKE000001", "carol", expiry))
+	stub.now += 8 * 24 * 60 * 60
+	mustFail(t, stub.invoke(carol, "changeBikeOwner", "BIKE000001", "bob"), "or their delegate")
+	mustSucceed(t, stub.invoke(alice, "grantDelegate", "BIKE000001", "carol", strconv.FormatInt(stub.now+60, 10)))
+	mustSucceed(t, stub.invoke(carol, "offerTransfer", "BIKE000001", "bob", "0"))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+	mustFail(t, stub.invoke(carol, "offerTransfer", "BIKE000001", "dave", "0"), "or their delegate")
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getDelegates", "BIKE000001")), &delegations)
+	if len(delegations) != 0 {
+		t.Fatalf("delegation survived the transfer: %v", delegations)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	stub.createBikeFor(t, "BIKE000002", alice)
+	until := strconv.FormatInt(stub.now+3600, 10)
+
+	mustFail(t, stub.invoke(bob, "reserveBike", "BIKE000001", until, "bob"), "Only the owner")
+	mustFail(t, stub.invoke(alice, "reserveBike", "BIKE000001", strconv.FormatInt(stub.now, 10), "bob"), "Until must be after")
+	mustFail(t, stub.invoke(alice, "reserveBike", "BIKE000001", strconv.FormatInt(stub.now+15*24*3600, 10), "bob"), "at most")
+	mustSucceed(t, stub.invoke(alice, "reserveBike", "BIKE000001", until, "bob"))
+	mustSucceed(t, stub.invoke(alice, "reserveBike", "BIKE000002", until))
+
+	mustFail(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "carol", "0"), "reserved until")
+	mustFail(t, stub.invoke(alice, "transferFrom", "alice", "carol", "BIKE000001"), "reserved until")
+	mustFail(t, stub.invoke(alice, "transferFrom", "alice", "bob", "BIKE000002"), "reserved until")
+	mustFail(t, stub.invoke(alice, "rentBike", "BIKE000002", "bob", "2"), "reserved until")
+	mustFail(t, stub.invoke(alice, "startAuction", "BIKE000001", "100", until), "reserved until")
+	mustFail(t, stub.invoke(carol, "cancelReservation", "BIKE000001"), "Only the owner or the customer")
+
+	// The customer the bike is held for can still buy it, which fulfils the reservation
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+	mustFail(t, stub.invoke(bob, "getReservation", "BIKE000001"), "not reserved")
+
+	// A reservation lapses by itself once its time is up
+	reservation := Reservation{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getReservation", "BIKE000002")), &reservation)
+	if reservation.ReservedBy != "Org2MSP/alice" || reservation.ReservedFor != "" || strconv.FormatInt(reservation.Until, 10) != until {
+		t.Fatalf("unexpected reservation %+v", reservation)
+	}
+	stub.now += 3601
+	mustFail(t, stub.invoke(bob, "getReservation", "BIKE000002"), "not reserved")
+	mustSucceed(t, stub.invoke(alice, "transferFrom", "alice", "carol", "BIKE000002"))
+
+	mustSucceed(t, stub.invoke(carol, "reserveBike", "BIKE000002", strconv.FormatInt(stub.now+60, 10), "alice"))
+	mustSucceed(t, stub.invoke(alice, "cancelReservation", "BIKE000002"))
+	mustSucceed(t, stub.invoke(carol, "transferFrom", "carol", "bob", "BIKE000002"))
+}
+
+// newSigner returns an identity with a self-signed ECDSA enrollment certificate, and its key
+func newSigner(t *testing.T, id string) (*testIdentity, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(4000000000, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIdentity{mspID: "Org2MSP", id: id, cert: cert}, key
+}
+
+// sign signs a consent payload the way the Fabric SDKs sign
+func sign(t *testing.T, key *ecdsa.PrivateKey, payload []byte) string {
+	digest := sha256.Sum256(payload)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(signature)
+}
+
+func TestSignedConsent(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	dave, daveKey := newSigner(t, "dave")
+	_, otherKey := newSigner(t, "mallory")
+	expiry := strconv.FormatInt(stub.now+600, 10)
+
+	payload := mustSucceed(t, stub.invoke(dave, "buildConsentPayload", "BIKE000001", "dave", expiry))
+	consent := map[string]string{"consent": string(payload), "consentSignature": sign(t, daveKey, payload)}
+	mustFail(t, stub.invokeTransient(alice, consent, "changeBikeOwner", "BIKE000001", "dave"), "has not registered a consent certificate")
+	mustFail(t, stub.invoke(alice, "registerConsentCert"), "no X.509 certificate")
+	mustSucceed(t, stub.invoke(dave, "registerConsentCert"))
+
+	forged := map[string]string{"consent": string(payload), "consentSignature": sign(t, otherKey, payload)}
+	mustFail(t, stub.invokeTransient(alice, forged, "changeBikeOwner", "BIKE000001", "dave"), "does not verify")
+	mustFail(t, stub.invokeTransient(alice, consent, "changeBikeOwner", "BIKE000001", "carol"), "Consent is not for handing")
+	mustFail(t, stub.invokeTransient(bob, consent, "changeBikeOwner", "BIKE000001", "dave"), "Only the owner")
+	mustFail(t, stub.invokeTransient(alice, map[string]string{"consent": string(payload)}, "changeBikeOwner", "BIKE000001", "dave"), "consentSignature")
+
+	mustSucceed(t, stub.invokeTransient(alice, consent, "changeBikeOwner", "BIKE000001", "dave"))
+	if bike := stub.bike(t, "BIKE000001"); bike.Owner != "Org2MSP/dave" {
+		t.Fatalf("owner is %s after a consented transfer", bike.Owner)
+	}
+
+	// The consent was for the version the transfer replaced, so it cannot be used again
+	mustSucceed(t, stub.invoke(dave, "offerTransfer", "BIKE000001", "alice", "0"))
+	mustSucceed(t, stub.invoke(alice, "acceptTransfer", "BIKE000001"))
+	mustFail(t, stub.invokeTransient(alice, consent, "changeBikeOwner", "BIKE000001", "dave"), "Consent is not for handing")
+
+	payload = mustSucceed(t, stub.invoke(dave, "buildConsentPayload", "BIKE000001", "dave", expiry))
+	stub.now += 601
+	mustFail(t, stub.invokeTransient(alice, map[string]string{"consent": string(payload), "consentSignature": sign(t, daveKey, payload)}, "changeBikeOwner", "BIKE000001", "dave"), "expired")
+}
+
+func TestTokensAndBuyBike(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustSucceed(t, stub.invoke(admin, "mint", "Org2MSP/bob", "1000"))
+	mustSucceed(t, stub.invoke(admin, "transferFunds", "Org2MSP/bob", "Org2MSP/carol", "100"))
+	mustFail(t, stub.invoke(admin, "transferFunds", "Org2MSP/carol", "Org2MSP/bob", "101"), "insufficient funds")
+	mustFail(t, stub.invoke(admin, "mint", "Org2MSP/bob", "-5"), "positive integer")
+
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "500"))
+	mustFail(t, stub.invoke(bob, "buyBike", "BIKE000001", "400"), "offered at 500")
+	mustSucceed(t, stub.invoke(bob, "buyBike", "BIKE000001", "500"))
+
+	if stub.balance(t, "alice") != 500 || stub.balance(t, "bob") != 400 || stub.balance(t, "carol") != 100 {
+		t.Fatal("balances wrong after sale")
+	}
+	if bike := stub.bike(t, "BIKE000001"); bike.Owner != "Org2MSP/bob" {
+		t.Fatalf("buyer does not own the bike: %+v", bike)
+	}
+}
+
+func TestTransferLog(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustSucceed(t, stub.invoke(admin, "mint", "Org2MSP/bob", "1000"))
+
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "500"))
+	mustSucceed(t, stub.invoke(bob, "buyBike", "BIKE000001", "500"))
+	sold := stub.now
+	stub.now += 100
+	mustSucceed(t, stub.invoke(bob, "transferFrom", "bob", "carol", "BIKE000001"))
+	mustSucceed(t, stub.invoke(carol, "updateBike", "BIKE000001", "3", `{"colour": "red"}`))
+
+	events := []TransferEvent{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getTransferLog", "BIKE000001")), &events)
+	if len(events) != 2 {
+		t.Fatalf("transfer log has %d events, want 2: %+v", len(events), events)
+	}
+	if first := events[0]; first.From != "Org2MSP/alice" || first.To != "Org2MSP/bob" || first.Price != 500 || first.Function != "buyBike" || first.TransferredAt != sold || first.TxID == "" {
+		t.Fatalf("unexpected first transfer %+v", first)
+	}
+	if second := events[1]; second.From != "Org2MSP/bob" || second.To != "Org2MSP/carol" || second.Price != 0 || second.Seq <= events[0].Seq {
+		t.Fatalf("unexpected second transfer %+v", second)
+	}
+	if code := mustFail(t, stub.invoke(alice, "getTransferLog", "BIKE000002"), "does not exist"); code != codeBikeNotFound {
+		t.Fatalf("unknown bike gave code %s", code)
+	}
+}
+
+func TestPriceHistory(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustFail(t, stub.invoke(alice, "estimateValue", "BIKE000001"), "No sale price")
+
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "500"))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+	mustFail(t, stub.invoke(bob, "recordSalePrice", "BIKE000001", "450", "INR"), "already recorded")
+	stub.now += secondsPerYear
+	estimate := ValueEstimate{}
+	mustDecode(t, mustSucceed(t, stub.invoke(insurer, "estimateValue", "BIKE000001")), &estimate)
+	if estimate.LastPrice != 500 || estimate.Currency != "TOKEN" || estimate.EstimatedValue != 425 {
+		t.Fatalf("unexpected estimate %+v", estimate)
+	}
+
+	mustSucceed(t, stub.invoke(bob, "transferFrom", "bob", "carol", "BIKE000001"))
+	mustFail(t, stub.invoke(bob, "recordSalePrice", "BIKE000001", "300", "INR"), "Only the owner")
+	mustFail(t, stub.invoke(carol, "recordSalePrice", "BIKE000001", "300", "Rs."), "currency code")
+	mustSucceed(t, stub.invoke(carol, "recordSalePrice", "BIKE000001", "300", "inr"))
+	mustFail(t, stub.invoke(carol, "recordSalePrice", "BIKE000001", "300", "INR"), "already recorded")
+
+	sales := []SalePrice{}
+	mustDecode(t, mustSucceed(t, stub.invoke(insurer, "getPriceHistory", "BIKE000001")), &sales)
+	if len(sales) != 2 || sales[0].Seller != "Org2MSP/alice" || sales[0].Source != saleOnLedger ||
+		sales[1].Buyer != "Org2MSP/carol" || sales[1].Currency != "INR" || sales[1].Source != saleDeclared || sales[1].SoldAt != stub.now {
+		t.Fatalf("unexpected price history %+v", sales)
+	}
+
+	stub.now += 20 * secondsPerYear
+	mustDecode(t, mustSucceed(t, stub.invoke(insurer, "estimateValue", "BIKE000001")), &estimate)
+	if estimate.EstimatedValue != 30 {
+		t.Fatalf("estimate %+v went below the floor", estimate)
+	}
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"depreciation": {"annualBps": {"motorbike": 0}}}`))
+	mustDecode(t, mustSucceed(t, stub.invoke(insurer, "estimateValue", "BIKE000001")), &estimate)
+	if estimate.EstimatedValue != 300 || estimate.AnnualBps != 0 {
+		t.Fatalf("unexpected estimate %+v without depreciation", estimate)
+	}
+	mustFail(t, stub.invoke(admin, "setConfig", `{"depreciation": {"floorBps": 20000}}`), "basis points")
+}
+
+func TestTransferFees(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustFail(t, stub.invoke(admin, "setConfig", `{"transferFees": {"slabs": [{"upTo": 0, "flat": 10}, {"upTo": 1000}]}}`), "unbounded")
+	mustFail(t, stub.invoke(admin, "setConfig", `{"transferFees": {"slabs": [{"flat": 10}], "debitBuyer": true}}`), "collector")
+	schedule := `{"transferFees": {"slabs": [{"upTo": 1000, "flat": 10}, {"flat": 5, "rateBps": 200}], "collector": "rto-fees", "debitBuyer": true}}`
+	mustSucceed(t, stub.invoke(admin, "setConfig", schedule))
+
+	quote := FeeReceipt{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "quoteTransferFee", "5000")), &quote)
+	if quote.Fee != 105 || quote.Slab != 1 {
+		t.Fatalf("unexpected quote %+v", quote)
+	}
+
+	// The buyer pays price and fee in one go
+	mustSucceed(t, stub.invoke(admin, "mint", "Org2MSP/bob", "600"))
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "500"))
+	mustSucceed(t, stub.invoke(bob, "buyBike", "BIKE000001", "500"))
+	saleTxID := fmt.Sprintf("tx%04d", stub.txSeq)
+	if stub.balance(t, "bob") != 90 || stub.balance(t, "alice") != 500 || stub.balance(t, "rto-fees") != 10 {
+		t.Fatal("balances wrong after a sale with a fee")
+	}
+	receipts := []FeeReceipt{}
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "getFeeReceipts", saleTxID)), &receipts)
+	if len(receipts) != 1 || receipts[0].Fee != 10 || !receipts[0].Paid || receipts[0].Buyer != "Org2MSP/bob" {
+		t.Fatalf("unexpected receipts %+v", receipts)
+	}
+
+	// A buyer who cannot cover the fee cannot take the bike
+	mustSucceed(t, stub.invoke(bob, "offerTransfer", "BIKE000001", "carol", "0"))
+	mustFail(t, stub.invoke(carol, "acceptTransfer", "BIKE000001"), "insufficient funds")
+	mustSucceed(t, stub.invoke(admin, "mint", "Org2MSP/carol", "10"))
+	mustSucceed(t, stub.invoke(carol, "acceptTransfer", "BIKE000001"))
+	if stub.balance(t, "carol") != 0 || stub.balance(t, "rto-fees") != 20 {
+		t.Fatal("fee not debited on acceptTransfer")
+	}
+
+	// Handing a bike over with transferFrom leaves the fee unpaid, as the new owner did not sign
+	mustSucceed(t, stub.invoke(carol, "transferFrom", "carol", "alice", "BIKE000001"))
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "getFeeReceipts", fmt.Sprintf("tx%04d", stub.txSeq))), &receipts)
+	if len(receipts) != 1 || receipts[0].Paid || receipts[0].Fee != 10 {
+		t.Fatalf("unexpected receipts %+v", receipts)
+	}
+}
+
+func TestAuction(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustSucceed(t, stub.invoke(admin, "mint", "Org2MSP/bob", "1000"))
+	mustSucceed(t, stub.invoke(admin, "mint", "Org2MSP/carol", "1000"))
+
+	endTime := stub.now + 100
+	auction := Auction{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "startAuction", "BIKE000001", "250", strconv.FormatInt(endTime, 10))), &auction)
+	mustFail(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"), "being auctioned")
+
+	bobBid := map[string]string{"bid": "300", "salt": "bob-salt"}
+	carolBid := map[string]string{"bid": "400", "salt": "carol-salt"}
+	mustFail(t, stub.invokeTransient(alice, bobBid, "placeBid", auction.ID), "seller cannot bid")
+	mustFail(t, stub.invoke(bob, "placeBid", auction.ID), "transient")
+	mustSucceed(t, stub.invokeTransient(bob, bobBid, "placeBid", auction.ID))
+	mustSucceed(t, stub.invokeTransient(carol, carolBid, "placeBid", auction.ID))
+	mustFail(t, stub.invokeTransient(carol, carolBid, "revealBid", auction.ID), "cannot be revealed now")
+
+	stub.now = endTime + 1
+	mustFail(t, stub.invokeTransient(bob, bobBid, "placeBid", auction.ID), "has ended")
+	mustFail(t, stub.invokeTransient(bob, carolBid, "revealBid", auction.ID), "do not match")
+	mustSucceed(t, stub.invokeTransient(bob, bobBid, "revealBid", auction.ID))
+	mustSucceed(t, stub.invokeTransient(carol, carolBid, "revealBid", auction.ID))
+	if stub.balance(t, "bob") != 700 {
+		t.Fatal("revealed bid not escrowed")
+	}
+	mustFail(t, stub.invoke(bob, "closeAuction", auction.ID), "before the reveal period ends")
+
+	stub.now = auction.RevealEnd + 1
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "closeAuction", auction.ID)), &auction)
+	if auction.Winner != "Org2MSP/carol" || auction.WinningBid != 400 || auction.Status != auctionClosed {
+		t.Fatalf("unexpected outcome %+v", auction)
+	}
+	if stub.bike(t, "BIKE000001").Owner != "Org2MSP/carol" {
+		t.Fatal("winner does not own the bike")
+	}
+	if stub.balance(t, "alice") != 400 || stub.balance(t, "bob") != 1000 || stub.balance(t, "carol") != 600 {
+		t.Fatal("auction not settled")
+	}
+	mustFail(t, stub.invoke(bob, "closeAuction", auction.ID), "already closed")
+	mustSucceed(t, stub.invoke(carol, "offerTransfer", "BIKE000001", "bob", "0"))
+}
+
+func TestTokenInterface(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	stub.createBikeFor(t, "BIKE000002", alice)
+
+	if owner := string(mustSucceed(t, stub.invoke(bob, "ownerOf", "BIKE000001"))); owner != "Org2MSP/alice" {
+		t.Fatalf("ownerOf returned %s", owner)
+	}
+	if balance := string(mustSucceed(t, stub.invoke(bob, "balanceOf", "alice"))); balance != "2" {
+		t.Fatalf("balanceOf returned %s", balance)
+	}
+
+	mustFail(t, stub.invoke(bob, "transferFrom", "alice", "bob", "BIKE000001"), "neither the owner")
+	mustFail(t, stub.invoke(bob, "approve", "bob", "BIKE000001"), "Only the owner")
+	mustSucceed(t, stub.invoke(alice, "approve", "bob", "BIKE000001"))
+	if approved := string(mustSucceed(t, stub.invoke(carol, "getApproved", "BIKE000001"))); approved != "Org2MSP/bob" {
+		t.Fatalf("getApproved returned %s", approved)
+	}
+	mustFail(t, stub.invoke(bob, "transferFrom", "carol", "bob", "BIKE000001"), "not owned by Org2MSP/carol")
+	mustSucceed(t, stub.invoke(bob, "transferFrom", "alice", "carol", "BIKE000001"))
+	if bike := stub.bike(t, "BIKE000001"); bike.Owner != "Org2MSP/carol" {
+		t.Fatalf("owner is %s after transferFrom", bike.Owner)
+	}
+	if approved := mustSucceed(t, stub.invoke(carol, "getApproved", "BIKE000001")); len(approved) != 0 {
+		t.Fatalf("approval %s survived the transfer", approved)
+	}
+	mustFail(t, stub.invoke(bob, "transferFrom", "carol", "bob", "BIKE000001"), "neither the owner")
+
+	// An approval does not outlive a sale through an offer either
+	mustSucceed(t, stub.invoke(alice, "approve", "bob", "BIKE000002"))
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000002", "carol", "0"))
+	mustSucceed(t, stub.invoke(carol, "acceptTransfer", "BIKE000002"))
+	if stub.countKeys(t, "APPROVAL") != 0 {
+		t.Fatal("approval not cleared by acceptTransfer")
+	}
+	mustSucceed(t, stub.invoke(carol, "transferFrom", "carol", "alice", "BIKE000002"))
+	if balance := string(mustSucceed(t, stub.invoke(bob, "balanceOf", "carol"))); balance != "1" {
+		t.Fatalf("balanceOf returned %s", balance)
+	}
+}
+
+func TestLien(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustSucceed(t, stub.invoke(alice, "registerLien", "BIKE000001", "BankMSP", "1000"))
+	mustFail(t, stub.invoke(alice, "registerLien", "BIKE000001", "BankMSP", "1000"), "already has a lien")
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+	mustFail(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"), "encumbered by a lien of BankMSP")
+
+	mustFail(t, stub.invoke(alice, "approveLienTransfer", "BIKE000001", "bob"), "Only members of BankMSP")
+	mustSucceed(t, stub.invoke(bank, "approveLienTransfer", "BIKE000001", "Org2MSP/bob"))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+
+	lien := Lien{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getLien", "BIKE000001")), &lien)
+	if lien.ApprovedTo != "" || lien.Amount != 1000 {
+		t.Fatalf("approval not consumed: %+v", lien)
+	}
+
+	mustFail(t, stub.invoke(bob, "releaseLien", "BIKE000001"), "Only members of BankMSP")
+	mustSucceed(t, stub.invoke(bank, "releaseLien", "BIKE000001"))
+	mustFail(t, stub.invoke(bob, "getLien", "BIKE000001"), "has no lien")
+}
+
+func TestValidateTransfer(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	failed := func(validation TransferValidation) []string {
+		names := []string{}
+		for _, check := range validation.Checks {
+			if !check.Passed {
+				names = append(names, check.Check)
+			}
+		}
+		return names
+	}
+
+	validation := TransferValidation{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "validateTransfer", "BIKE000001", "bob")), &validation)
+	if !validation.Valid || len(failed(validation)) != 0 || len(validation.Checks) != 13 {
+		t.Fatalf("unexpected validation %+v", validation)
+	}
+
+	mustSucceed(t, stub.invoke(alice, "registerLien", "BIKE000001", "BankMSP", "1000"))
+	mustSucceed(t, stub.invoke(court, "freezeBike", "BIKE000001", "court order 12/2020"))
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "validateTransfer", "BIKE000001", "bob")), &validation)
+	if names := failed(validation); validation.Valid || fmt.Sprint(names) != "[freeze lien]" {
+		t.Fatalf("expected freeze and lien to fail, got %v", names)
+	}
+	if check := validation.Checks[1]; check.Code != codeFailed || !strings.Contains(check.Message, "frozen by PoliceMSP/court") {
+		t.Fatalf("unexpected freeze check %+v", check)
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "validateTransfer", "BIKE000001", "alice")), &validation)
+	if names := failed(validation); fmt.Sprint(names) != "[freeze newOwner lien]" {
+		t.Fatalf("expected newOwner to fail as well, got %v", names)
+	}
+
+	// Nothing was written, so the lien approval is still there to be used
+	mustSucceed(t, stub.invoke(court, "unfreezeBike", "BIKE000001"))
+	mustSucceed(t, stub.invoke(bank, "approveLienTransfer", "BIKE000001", "Org2MSP/bob"))
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "validateTransfer", "BIKE000001", "bob")), &validation)
+	if !validation.Valid {
+		t.Fatalf("expected a valid transfer, got %v", failed(validation))
+	}
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+	mustFail(t, stub.invoke(bob, "validateTransfer", "BIKE000404", "bob"), "does not exist")
+}
+
+func TestArchive(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	stub.createBikeFor(t, "BIKE000002", alice)
+
+	mustSucceed(t, stub.invoke(alice, "archiveBike", "BIKE000001"))
+	mustFail(t, stub.invoke(alice, "archiveBike", "BIKE000001"), "does not exist")
+
+	results := []QueryResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryAllBikes")), &results)
+	if len(results) != 1 {
+		t.Fatalf("archived bike still listed: %+v", results)
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryAllBikes", "includeArchived")), &results)
+	if len(results) != 2 || results[1].Key != archiveKey("BIKE000001") {
+		t.Fatalf("archived bike not listed: %+v", results)
+	}
+
+	bike := Bike{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "queryArchivedBike", "BIKE000001")), &bike)
+	if bike.Status != statusArchived {
+		t.Fatalf("archived bike has status %s", bike.Status)
+	}
+
+	mustFail(t, stub.invoke(bob, "restoreBike", "BIKE000001"), "or an admin")
+	mustSucceed(t, stub.invoke(alice, "restoreBike", "BIKE000001"))
+	bike = stub.bike(t, "BIKE000001")
+	if bike.Status != statusActive || bike.CreatedTxID == "" {
+		t.Fatalf("restored bike %+v", bike)
+	}
+	mustFail(t, stub.invoke(bob, "queryArchivedBike", "BIKE000001"), "is not archived")
+}
+
+func TestDisputes(t *testing.T) {
+	stub := newTestStub(t)
+	arbiter := &testIdentity{mspID: "ArbiterMSP", id: "arbiter"}
+	stub.createBikeFor(t, "BIKE000001", alice)
+	receipt := strings.Repeat("ab", 32)
+	fir := strings.Repeat("cd", 32)
+
+	mustFail(t, stub.invoke(carol, "openDispute", "BIKE000001", "bob", receipt), "Only Org2MSP/bob or a registrar")
+	mustFail(t, stub.invoke(bob, "openDispute", "BIKE000001", "bob", "receipt"), "SHA-256")
+	dispute := Dispute{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "openDispute", "BIKE000001", "bob", receipt)), &dispute)
+	if dispute.Claimant != "Org2MSP/bob" || dispute.Respondent != "Org2MSP/alice" || dispute.Status != disputeOpen || len(dispute.Evidence) != 1 {
+		t.Fatalf("unexpected dispute %+v", dispute)
+	}
+	if bike := stub.bike(t, "BIKE000001"); bike.Status != statusDisputed {
+		t.Fatalf("bike is %s", bike.Status)
+	}
+	mustFail(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "carol"), "is DISPUTED")
+	mustFail(t, stub.invoke(registrar, "openDispute", "BIKE000001", "carol", fir), "cannot be disputed")
+
+	mustFail(t, stub.invoke(carol, "submitEvidence", dispute.DisputeID, fir), "Only the parties")
+	mustFail(t, stub.invoke(bob, "submitEvidence", dispute.DisputeID, receipt), "already submitted")
+	mustFail(t, stub.invoke(registrar, "openDispute", "BIKE000009", "bob", fir), "does not exist")
+	mustSucceed(t, stub.invoke(alice, "submitEvidence", dispute.DisputeID, fir))
+
+	mustFail(t, stub.invoke(admin, "resolveDispute", dispute.DisputeID, "Org2MSP/bob"), "Only members of")
+	mustFail(t, stub.invoke(arbiter, "resolveDispute", dispute.DisputeID, "carol"), "Winner must be")
+	mustDecode(t, mustSucceed(t, stub.invoke(arbiter, "resolveDispute", dispute.DisputeID, "Org2MSP/bob")), &dispute)
+	if dispute.Status != disputeResolved || dispute.Winner != "Org2MSP/bob" || dispute.ResolvedBy != "ArbiterMSP/arbiter" || len(dispute.Evidence) != 2 {
+		t.Fatalf("unexpected resolution %+v", dispute)
+	}
+	if bike := stub.bike(t, "BIKE000001"); bike.Owner != "Org2MSP/bob" || bike.Status != statusActive {
+		t.Fatalf("bike not handed to the claimant: %+v", bike)
+	}
+	events := []TransferEvent{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getTransferLog", "BIKE000001")), &events)
+	if len(events) != 1 || events[0].From != "Org2MSP/alice" || events[0].To != "Org2MSP/bob" || events[0].Function != "resolveDispute" {
+		t.Fatalf("unexpected transfer log %+v", events)
+	}
+	mustFail(t, stub.invoke(arbiter, "resolveDispute", dispute.DisputeID, "alice"), "already RESOLVED")
+
+	disputes := []Dispute{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getDisputes", "BIKE000001")), &disputes)
+	if len(disputes) != 1 || disputes[0].DisputeID != dispute.DisputeID {
+		t.Fatalf("unexpected disputes %+v", disputes)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+
+	mustFail(t, stub.invoke(police, "freezeBike", "BIKE000001", "court order 12/2020"), "authority role")
+	mustSucceed(t, stub.invoke(court, "freezeBike", "BIKE000001", "court order 12/2020"))
+	if bike := stub.bike(t, "BIKE000001"); bike.FrozenBy != "PoliceMSP/court" || bike.FreezeReason != "court order 12/2020" {
+		t.Fatalf("unexpected frozen bike %+v", bike)
+	}
+
+	frozen := []struct {
+		function string
+		identity *testIdentity
+		args     []string
+	}{
+		{"acceptTransfer", bob, []string{"BIKE000001"}},
+		{"offerTransfer", alice, []string{"BIKE000001", "carol", "0"}},
+		{"updateBike", alice, []string{"BIKE000001", "", `{"colour": "red"}`}},
+		{"transferFrom", alice, []string{"alice", "carol", "BIKE000001"}},
+		{"archiveBike", alice, []string{"BIKE000001"}},
+		{"addServiceRecord", workshop, []string{"BIKE000001", "2020-01-01", "100", "garage", "oil"}},
+		{"recordSalePrice", alice, []string{"BIKE000001", "450", "INR"}},
+		{"issueFitnessCertificate", &testIdentity{mspID: "TestingAuthorityMSP", id: "inspector"}, []string{"BIKE000001", "PUC-1", "1700000000"}},
+		{"applySubsidy", &testIdentity{mspID: "GovernmentMSP", id: "ev-cell"}, []string{"BIKE000001", "FAME2", "15000"}},
+		{"registerWarranty", manufacturer, []string{"BIKE000001", "24"}},
+		{"fileWarrantyClaim", alice, []string{"BIKE000001", "clutch slips"}},
+		{"freezeBike", court, []string{"BIKE000001", "again"}},
+	}
+	for _, test := range frozen {
+		t.Run(test.function, func(t *testing.T) {
+			mustFail(t, stub.invoke(test.identity, test.function, test.args...), "frozen by PoliceMSP/court")
+		})
+	}
+
+	mustFail(t, stub.invoke(alice, "unfreezeBike", "BIKE000001"), "authority role")
+	mustSucceed(t, stub.invoke(court, "unfreezeBike", "BIKE000001"))
+	mustFail(t, stub.invoke(court, "unfreezeBike", "BIKE000001"), "not frozen")
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+}
+
+func TestRecalls(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustFail(t, stub.invoke(manufacturer, "issueRecall", "Honda", "Shine", "R1", "brake hose"), "No manufacturer is configured")
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"manufacturers": {"honda": "HondaMSP"}}`))
+	mustFail(t, stub.invoke(alice, "issueRecall", "Honda", "Shine", "R1", "brake hose"), "Only members of HondaMSP")
+	mustSucceed(t, stub.invoke(manufacturer, "issueRecall", "Honda", "Shine", "R1", "brake hose"))
+	mustSucceed(t, stub.invoke(manufacturer, "issueRecall", "Honda", "Unicorn", "R2", "chain"))
+
+	recalls := []Recall{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getOpenRecalls", "BIKE000001")), &recalls)
+	if len(recalls) != 1 || recalls[0].RecallID != "R1" {
+		t.Fatalf("open recalls %+v", recalls)
+	}
+
+	offer := TransferOffer{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0")), &offer)
+	if len(offer.OpenRecalls) != 1 {
+		t.Fatalf("offer does not show the recall: %+v", offer)
+	}
+
+	mustFail(t, stub.invoke(alice, "markRecallCompleted", "BIKE000001", "R1"), "Only a workshop")
+	mustFail(t, stub.invoke(workshop, "markRecallCompleted", "BIKE000001", "R2"), "does not cover")
+	mustSucceed(t, stub.invoke(workshop, "markRecallCompleted", "BIKE000001", "R1"))
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "queryTransferOffer", "BIKE000001")), &offer)
+	if len(offer.OpenRecalls) != 0 {
+		t.Fatalf("completed recall still open: %+v", offer.OpenRecalls)
+	}
+}
+
+func TestServiceAndOdometer(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustFail(t, stub.invoke(workshop, "addServiceRecord", "BIKE000001", "01/02/2020", "100", "garage", "oil"), "YYYY-MM-DD")
+	mustSucceed(t, stub.invoke(workshop, "addServiceRecord", "BIKE000001", "2020-01-02", "100", "garage", "oil"))
+	mustSucceed(t, stub.invoke(workshop, "addServiceRecord", "BIKE000001", "2020-06-02", "900", "garage", "chain"))
+	records := []ServiceRecord{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getServiceRecords", "BIKE000001")), &records)
+	if len(records) != 2 || records[1].Description != "chain" {
+		t.Fatalf("service records %+v", records)
+	}
+
+	mustSucceed(t, stub.invoke(workshop, "recordOdometer", "BIKE000001", "900", "100"))
+	mustFail(t, stub.invoke(workshop, "recordOdometer", "BIKE000001", "800", "200"), "lower")
+	reading := OdometerReading{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getOdometer", "BIKE000001")), &reading)
+	if reading.Reading != 900 {
+		t.Fatalf("odometer %+v", reading)
+	}
+}
+
+func TestComponents(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	stub.createBikeFor(t, "BIKE000002", bob)
+	invoice := strings.Repeat("ab", 32)
+
+	mustFail(t, stub.invoke(alice, "replaceComponent", "BIKE000001", "wheel", "W1", invoice), "Unknown component type")
+	mustFail(t, stub.invoke(alice, "replaceComponent", "BIKE000001", "engine", "EN1", "invoice"), "Digest")
+	mustFail(t, stub.invoke(bob, "replaceComponent", "BIKE000001", "engine", "EN1", invoice), "Only the owner of BIKE000001 or a registrar")
+	mustSucceed(t, stub.invoke(alice, "replaceComponent", "BIKE000001", "engine", "en 1", invoice))
+	mustSucceed(t, stub.invoke(registrar, "replaceComponent", "BIKE000001", "frame", "FR1", invoice))
+	mustFail(t, stub.invoke(alice, "replaceComponent", "BIKE000001", "engine", "EN1", invoice), "already fitted to BIKE000001")
+	mustFail(t, stub.invoke(bob, "replaceComponent", "BIKE000002", "engine", "EN1", invoice), "is fitted to BIKE000001")
+
+	// The engine moves over to bob's bike once alice's gets a new one
+	stub.events()
+	mustSucceed(t, stub.invoke(alice, "replaceComponent", "BIKE000001", "engine", "EN2", invoice))
+	if events := stub.events(); len(events) != 0 {
+		t.Fatalf("unexpected events %v for a new engine", events)
+	}
+	mustSucceed(t, stub.invoke(bob, "replaceComponent", "BIKE000002", "engine", "EN1", invoice))
+	events := stub.events()
+	if len(events) != 1 || events[0].EventName != componentReappearedEvent {
+		t.Fatalf("expected a ComponentReappeared event, got %v", events)
+	}
+	alert := ComponentReappeared{}
+	mustDecode(t, events[0].Payload, &alert)
+	if alert.BikeKey != "BIKE000002" || len(alert.PreviousBikes) != 1 || alert.PreviousBikes[0] != "BIKE000001" {
+		t.Fatalf("unexpected alert %+v", alert)
+	}
+
+	components := []Component{}
+	mustDecode(t, mustSucceed(t, stub.invoke(carol, "getBikeComponents", "BIKE000001")), &components)
+	if len(components) != 2 || components[0].ComponentType != "engine" || components[0].SerialNo != "EN2" || components[1].FittedBy != "Org2MSP/rto" {
+		t.Fatalf("unexpected components %+v", components)
+	}
+	changes := []ComponentChange{}
+	mustDecode(t, mustSucceed(t, stub.invoke(carol, "getComponentLog", "BIKE000001")), &changes)
+	if len(changes) != 3 || changes[2].SerialNo != "EN2" || changes[2].PreviousSerialNo != "EN1" {
+		t.Fatalf("unexpected component log %+v", changes)
+	}
+	trail := ComponentTrail{}
+	mustDecode(t, mustSucceed(t, stub.invoke(carol, "getComponentHistory", "engine", "EN1")), &trail)
+	if trail.BikeKey != "BIKE000002" || len(trail.Fittings) != 2 || trail.Fittings[0].RemovedAt == 0 || trail.Fittings[1].RemovedAt != 0 {
+		t.Fatalf("unexpected trail %+v", trail)
+	}
+	mustFail(t, stub.invoke(carol, "getComponentHistory", "engine", "EN9"), "was ever fitted")
+	mustFail(t, stub.invoke(carol, "getBikeComponents", "BIKE000009"), "does not exist")
+
+	// Parts of a bike that is gone are free to be fitted elsewhere
+	mustSucceed(t, stub.invoke(admin, "archiveBike", "BIKE000001"))
+	mustSucceed(t, stub.invoke(bob, "replaceComponent", "BIKE000002", "frame", "FR1", invoice))
+}
+
+func TestRentals(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustFail(t, stub.invoke(alice, "rentBike", "BIKE000001", "bob", "0"), "Duration must be between")
+	mustSucceed(t, stub.invoke(alice, "rentBike", "BIKE000001", "bob", "2"))
+	if stub.bike(t, "BIKE000001").Status != statusRented {
+		t.Fatal("bike not marked rented")
+	}
+	mustFail(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "carol", "0"), "RENTED")
+	mustFail(t, stub.invoke(carol, "returnBike", "BIKE000001"), "Only the owner or the renter")
+	mustSucceed(t, stub.invoke(bob, "returnBike", "BIKE000001"))
+	mustFail(t, stub.invoke(bob, "returnBike", "BIKE000001"), "not rented out")
+
+	rentals := []Rental{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getRentalHistory", "BIKE000001")), &rentals)
+	if len(rentals) != 1 || rentals[0].RenterID != "Org2MSP/bob" {
+		t.Fatalf("rental history %+v", rentals)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustFail(t, stub.invoke(alice, "startLease", "BIKE000001", "bob", "100", "0"), "Months must be between")
+	mustFail(t, stub.invoke(bob, "startLease", "BIKE000001", "bob", "100", "3"), "Only the owner")
+	lease := Lease{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "startLease", "BIKE000001", "bob", "100", "3")), &lease)
+	if lease.Lessor != "Org2MSP/alice" || stub.bike(t, "BIKE000001").Status != statusLeased {
+		t.Fatalf("unexpected lease %+v", lease)
+	}
+	mustFail(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "carol", "0"), "LEASED")
+	mustFail(t, stub.invoke(alice, "rentBike", "BIKE000001", "carol", "2"), "LEASED")
+
+	status := LeaseStatus{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getLeaseStatus", lease.LeaseID)), &status)
+	if status.Due != 0 || status.Overdue || status.NextDueAt != lease.StartAt+leaseMonthSeconds {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	stub.now += leaseMonthSeconds + 1
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getLeaseStatus", lease.LeaseID)), &status)
+	if status.Due != 100 || status.Outstanding != 100 || !status.Overdue {
+		t.Fatalf("missed instalment not overdue: %+v", status)
+	}
+
+	mustFail(t, stub.invoke(bob, "recordLeasePayment", lease.LeaseID, "100"), "Only Org2MSP/alice can record")
+	mustFail(t, stub.invoke(alice, "recordLeasePayment", lease.LeaseID, "301"), "Only 300 remains")
+	mustSucceed(t, stub.invoke(court, "freezeBike", "BIKE000001", "court order"))
+	mustFail(t, stub.invoke(alice, "recordLeasePayment", lease.LeaseID, "100"), "frozen by PoliceMSP/court")
+	mustSucceed(t, stub.invoke(court, "unfreezeBike", "BIKE000001"))
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "recordLeasePayment", lease.LeaseID, "150")), &status)
+	if status.Overdue || status.Paid != 150 || status.NextDueAt != lease.StartAt+2*leaseMonthSeconds {
+		t.Fatalf("unexpected status after payment %+v", status)
+	}
+	stub.now += 2 * leaseMonthSeconds
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getLeaseStatus", lease.LeaseID)), &status)
+	if status.Due != 300 || status.Outstanding != 150 || !status.Overdue {
+		t.Fatalf("unexpected status at the end of the term %+v", status)
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "recordLeasePayment", lease.LeaseID, "150")), &status)
+	if status.Status != leaseCompleted || status.Overdue || len(status.Payments) != 2 || status.NextDueAt != 0 {
+		t.Fatalf("paid lease not completed: %+v", status)
+	}
+	if stub.bike(t, "BIKE000001").Status != statusActive {
+		t.Fatal("bike still leased")
+	}
+	mustFail(t, stub.invoke(alice, "recordLeasePayment", lease.LeaseID, "1"), "already COMPLETED")
+	mustFail(t, stub.invoke(bob, "getLeaseStatus", "tx0009"), "does not exist")
+}
+
+func TestInsurance(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	expiry := strconv.FormatInt(stub.now+3600, 10)
+
+	mustFail(t, stub.invoke(alice, "fileClaim", "BIKE000001", "crash"), "no insurance policy")
+	mustSucceed(t, stub.invoke(insurer, "attachPolicy", "BIKE000001", "P1", "InsurerMSP", expiry))
+	policy := InsurancePolicy{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getBikePolicy", "BIKE000001")), &policy)
+	if policy.PolicyID != "P1" {
+		t.Fatalf("policy %+v", policy)
+	}
+
+	claim := Claim{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "fileClaim", "BIKE000001", "crash")), &claim)
+	mustFail(t, stub.invoke(alice, "settleClaim", claim.ClaimID, "100"), "Only members of InsurerMSP")
+	mustSucceed(t, stub.invoke(insurer, "settleClaim", claim.ClaimID, "100"))
+	mustFail(t, stub.invoke(insurer, "settleClaim", claim.ClaimID, "100"), "already SETTLED")
+
+	claims := []Claim{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getClaims", "BIKE000001")), &claims)
+	if len(claims) != 1 || claims[0].Payout != 100 {
+		t.Fatalf("claims %+v", claims)
+	}
+
+	stub.now += 3601
+	mustFail(t, stub.invoke(alice, "fileClaim", "BIKE000001", "theft"), "expired")
+}
+
+func TestAccidents(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	location := strings.Repeat("ab", 32)
+	expiry := strconv.FormatInt(stub.now+3600, 10)
+
+	mustFail(t, stub.invoke(alice, "reportAccident", "BIKE000001", "SCRATCH", location, ""), "Severity")
+	mustFail(t, stub.invoke(alice, "reportAccident", "BIKE000001", "MINOR", "here", ""), "SHA-256")
+	mustFail(t, stub.invoke(bob, "reportAccident", "BIKE000001", "MINOR", location, ""), "Only the owner or insurer")
+	mustFail(t, stub.invoke(insurer, "reportAccident", "BIKE000001", "MINOR", location, ""), "Only the owner or insurer")
+	mustSucceed(t, stub.invoke(insurer, "attachPolicy", "BIKE000001", "P1", "InsurerMSP", expiry))
+
+	accident := Accident{}
+	details := `{"thirdParty":"KA01AB1234"}`
+	mustDecode(t, mustSucceed(t, stub.invokeTransient(police, map[string]string{"details": details}, "reportAccident", "BIKE000001", "MAJOR", location, "FIR-77/2020")), &accident)
+	if accident.Severity != "MAJOR" || accident.ReportedBy != "PoliceMSP/officer" {
+		t.Fatalf("unexpected accident %+v", accident)
+	}
+	mustSucceed(t, stub.invoke(insurer, "reportAccident", "BIKE000001", "MINOR", location, ""))
+	if bike := stub.bike(t, "BIKE000001"); bike.AccidentCount != 2 || bike.AccidentSeverity != "MAJOR" {
+		t.Fatalf("unexpected accident flags on %+v", bike)
+	}
+
+	// The history travels with the bike; the details stay private
+	mustSucceed(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "bob"))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+	accidents := []Accident{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getAccidentHistory", "BIKE000001")), &accidents)
+	if len(accidents) != 2 || accidents[0].AccidentID != accident.AccidentID || accidents[1].Severity != "MINOR" {
+		t.Fatalf("unexpected accident history %v", accidents)
+	}
+	accidentKey, _ := stub.CreateCompositeKey("ACCIDENT", []string{"BIKE000001", accident.Seq})
+	if strings.Contains(string(stub.State[accidentKey]), "FIR-77") {
+		t.Fatal("police reference leaked into the public state")
+	}
+	private := AccidentDetails{}
+	mustDecode(t, mustSucceed(t, stub.invoke(insurer, "getAccidentDetails", accident.AccidentID)), &private)
+	if private.PoliceRefNo != "FIR-77/2020" || private.LocationHash != location || string(private.Details) != details {
+		t.Fatalf("unexpected accident details %+v", private)
+	}
+	mustFail(t, stub.invoke(insurer, "getAccidentDetails", "tx9999"), "has no details")
+}
+
+func TestSubsidies(t *testing.T) {
+	stub := newTestStub(t)
+	government := &testIdentity{mspID: "GovernmentMSP", id: "ev-cell"}
+	ebike := `{"assetType": "ebike", "make": "Ather", "model": "450X", "colour": "grey", "owner": "alice", "chassisNo": "MD2A11CZ2KWA00001", "batteryCapacityKWh": 2.9}`
+	mustSucceed(t, stub.invoke(alice, "createVehicle", "BIKE000001", ebike))
+	stub.createBikeFor(t, "BIKE000002", alice)
+
+	mustFail(t, stub.invoke(alice, "applySubsidy", "BIKE000001", "FAME2", "15000"), "Only members of")
+	mustFail(t, stub.invoke(government, "applySubsidy", "BIKE000001", "FAME2", "0"), "positive")
+	mustFail(t, stub.invoke(government, "applySubsidy", "BIKE000002", "FAME2", "15000"), "only for e-bikes")
+	mustFail(t, stub.invoke(government, "applySubsidy", "BIKE999999", "FAME2", "15000"), "does not exist")
+
+	subsidy := Subsidy{}
+	mustDecode(t, mustSucceed(t, stub.invoke(government, "applySubsidy", "BIKE000001", "FAME2", "15000")), &subsidy)
+	if subsidy.Amount != 15000 || subsidy.GrantedTo != "Org2MSP/alice" || subsidy.GrantedBy != "GovernmentMSP/ev-cell" || subsidy.GrantedAt != stub.now {
+		t.Fatalf("unexpected subsidy %+v", subsidy)
+	}
+	mustFail(t, stub.invoke(government, "applySubsidy", "BIKE000001", "FAME2", "15000"), "already paid a subsidy on BIKE000001")
+	mustSucceed(t, stub.invoke(government, "applySubsidy", "BIKE000001", "STATE-EV", "5000"))
+
+	// Registering the same bike again under a new key does not open the scheme again
+	mustSucceed(t, stub.invoke(admin, "archiveBike", "BIKE000001"))
+	mustSucceed(t, stub.invoke(alice, "createVehicle", "BIKE000003", ebike))
+	mustFail(t, stub.invoke(government, "applySubsidy", "BIKE000003", "FAME2", "15000"), "chassis number")
+
+	subsidies := []Subsidy{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getSubsidies", "BIKE000001")), &subsidies)
+	if len(subsidies) != 2 || subsidies[0].SchemeID != "FAME2" || subsidies[1].SchemeID != "STATE-EV" {
+		t.Fatalf("unexpected subsidies %+v", subsidies)
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getSubsidies", "BIKE000003")), &subsidies)
+	if len(subsidies) != 0 {
+		t.Fatalf("the new registration has subsidies %+v", subsidies)
+	}
+	mustFail(t, stub.invoke(alice, "getSubsidies", "BIKE999999"), "does not exist")
+
+	// The chassis guard follows a bike migrated to a padded key
+	stub.MockTransactionStart("legacy")
+	stub.PutState("BIKE7", []byte(`{"assetType": "ebike", "make": "Ather", "model": "450X", "colour": "grey", "owner": "alice", "chassisNo": "MD2A11CZ2KWA00007"}`))
+	stub.MockTransactionEnd("legacy")
+	mustSucceed(t, stub.invoke(government, "applySubsidy", "BIKE7", "FAME2", "15000"))
+	mustSucceed(t, stub.invoke(admin, "migrateBikeKeys"))
+	guard, _ := stub.CreateCompositeKey("SUBSIDYCHASSIS", []string{"FAME2", "MD2A11CZ2KWA00007"})
+	if claimedBy := string(stub.State[guard]); claimedBy != "BIKE000007" {
+		t.Fatalf("chassis guard points at %s", claimedBy)
+	}
+	mustFail(t, stub.invoke(government, "applySubsidy", "BIKE000007", "FAME2", "15000"), "already paid a subsidy on BIKE000007")
+}
+
+func TestOwnerPseudonyms(t *testing.T) {
+	stub := newTestStub(t)
+	salt := map[string]string{"salt": "0123456789abcdef0123456789abcdef"}
+	mustFail(t, stub.invoke(admin, "setConfig", `{"ownerPseudonyms": true}`), "setOwnerSalt first")
+	mustFail(t, stub.invokeTransient(alice, salt, "setOwnerSalt"), "Only members of")
+	mustFail(t, stub.invokeTransient(admin, map[string]string{"salt": "short"}, "setOwnerSalt"), "at least 16 bytes")
+	mustSucceed(t, stub.invokeTransient(admin, salt, "setOwnerSalt"))
+	mustFail(t, stub.invokeTransient(admin, salt, "setOwnerSalt"), "already set")
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"ownerPseudonyms": true}`))
+	mustFail(t, stub.invoke(admin, "setConfig", `{"ownerPseudonyms": false}`), "cannot be switched off")
+
+	stub.createBikeFor(t, "BIKE000001", alice)
+	owner := stub.bike(t, "BIKE000001").Owner
+	if !isPseudonym(owner) {
+		t.Fatalf("owner stored as %s", owner)
+	}
+	if state, _ := stub.GetState("BIKE000001"); strings.Contains(string(state), "alice") {
+		t.Fatalf("owner name in the world state: %s", state)
+	}
+	mustSucceed(t, stub.invoke(alice, "updateBike", "BIKE000001", "", `{"colour": "red"}`))
+	mustFail(t, stub.invoke(bob, "updateBike", "BIKE000001", "", `{"colour": "green"}`), "Only the owner")
+
+	// Owners can be named by enrollment ID or by pseudonym alike
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+	bobRef := stub.bike(t, "BIKE000001").Owner
+	if !isPseudonym(bobRef) || bobRef == owner {
+		t.Fatalf("bike now owned by %s", bobRef)
+	}
+	for _, name := range []string{"bob", bobRef} {
+		if n := string(mustSucceed(t, stub.invoke(alice, "balanceOf", name))); n != "1" {
+			t.Fatalf("balanceOf %s is %s", name, n)
+		}
+		results := []QueryResult{}
+		mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryBikesByFilter", fmt.Sprintf(`{"owner": %q}`, name))), &results)
+		if len(results) != 1 || results[0].Key != "BIKE000001" {
+			t.Fatalf("filtering by %s found %+v", name, results)
+		}
+	}
+	log := []TransferEvent{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getTransferLog", "BIKE000001")), &log)
+	if len(log) != 1 || log[0].From != owner || log[0].To != bobRef {
+		t.Fatalf("unexpected transfer log %+v", log)
+	}
+	mustSucceed(t, stub.invoke(admin, "mint", "Org2MSP/bob", "100"))
+	if stub.balance(t, bobRef) != 100 {
+		t.Fatal("token account not kept under the pseudonym")
+	}
+
+	mustFail(t, stub.invoke(alice, "resolveOwnerHash", bobRef), "Only registrars and the police")
+	mustFail(t, stub.invoke(registrar, "resolveOwnerHash", "bob"), "not an owner pseudonym")
+	resolved := ResolvedOwner{}
+	for _, identity := range []*testIdentity{registrar, police} {
+		mustDecode(t, mustSucceed(t, stub.invoke(identity, "resolveOwnerHash", bobRef)), &resolved)
+		if resolved.Owner != "Org2MSP/bob" {
+			t.Fatalf("resolved %+v", resolved)
+		}
+	}
+
+	// Queries derive pseudonyms without recording who is behind them
+	recorded := len(stub.PvtState[collectionOwnerPseudonyms])
+	mustSucceed(t, stub.invoke(alice, "balanceOf", "dave"))
+	mustSucceed(t, stub.invoke(&testIdentity{mspID: "Org2MSP", id: "erin"}, "queryBike", "BIKE000001"))
+	if n := len(stub.PvtState[collectionOwnerPseudonyms]); n != recorded {
+		t.Fatalf("queries recorded %d pseudonyms", n-recorded)
+	}
+
+	// Chunked owner queries page through continuations replaying the owner as first seen
+	stub.createBikeFor(t, "BIKE000002", bob)
+	stub.createBikeFor(t, "BIKE000003", bob)
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"ownerPseudonyms": true, "maxResponseBytes": 600}`))
+	chunk := ResultChunk{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "queryBikesByFilter", `{"owner": "bob"}`)), &chunk)
+	found := len(chunk.Results)
+	for chunk.Continuation != "" {
+		next := chunk.Continuation
+		chunk = ResultChunk{}
+		mustDecode(t, mustSucceed(t, stub.invoke(alice, "continueQuery", next)), &chunk)
+		found += len(chunk.Results)
+	}
+	if found != 3 || chunk.Total != 3 {
+		t.Fatalf("chunks held %d of %d bikes", found, chunk.Total)
+	}
+	var replayed []string
+	handler := HandlerFunc(func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+		replayed = args
+		return shim.Success(nil)
+	})
+	for i := len(chunkedLayers) - 1; i >= 0; i-- {
+		handler = chunkedLayers[i]("balanceOf", new(SmartContract).routes()["balanceOf"], handler)
+	}
+	stub.identity = alice
+	stub.MockTransactionStart("replay")
+	handler(stub, []string{"bob"})
+	stub.MockTransactionEnd("replay")
+	if len(replayed) != 1 || replayed[0] != bobRef {
+		t.Fatalf("continuations replay balanceOf with %v", replayed)
+	}
+
+	// Pseudonyms cannot be switched on over owners already recorded by name
+	stub = newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustSucceed(t, stub.invokeTransient(admin, salt, "setOwnerSalt"))
+	mustFail(t, stub.invoke(admin, "setConfig", `{"ownerPseudonyms": true}`), "before any bike is registered")
+}
+
+func TestWarranty(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"manufacturers": {"honda": "HondaMSP"}}`))
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustFail(t, stub.invoke(alice, "checkWarranty", "BIKE000001"), "has no warranty")
+	mustFail(t, stub.invoke(alice, "fileWarrantyClaim", "BIKE000001", "clutch slips"), "has no warranty")
+	mustFail(t, stub.invoke(alice, "registerWarranty", "BIKE000001", "24"), "Only members of HondaMSP")
+	mustFail(t, stub.invoke(manufacturer, "registerWarranty", "BIKE000001", "0"), "between 1 and 120")
+	mustFail(t, stub.invoke(manufacturer, "registerWarranty", "BIKE999999", "24"), "does not exist")
+
+	warranty := Warranty{}
+	mustDecode(t, mustSucceed(t, stub.invoke(manufacturer, "registerWarranty", "BIKE000001", "24")), &warranty)
+	expires := time.Unix(stub.now, 0).UTC().AddDate(2, 0, 0).Unix()
+	if warranty.StartsAt != stub.now || warranty.ExpiresAt != expires || warranty.RegisteredBy != "HondaMSP" {
+		t.Fatalf("unexpected warranty %+v", warranty)
+	}
+	if code := mustFail(t, stub.invoke(manufacturer, "registerWarranty", "BIKE000001", "36"), "already has a warranty"); code != codeInvalidArgs {
+		t.Fatalf("second warranty failed with %s", code)
+	}
+
+	mustFail(t, stub.invoke(bob, "fileWarrantyClaim", "BIKE000001", "clutch slips"), "Only the owner")
+	mustFail(t, stub.invoke(alice, "fileWarrantyClaim", "BIKE000001", ""), "must not be empty")
+	mustSucceed(t, stub.invoke(alice, "fileWarrantyClaim", "BIKE000001", "clutch slips"))
+	mustSucceed(t, stub.invoke(workshop, "fileWarrantyClaim", "BIKE000001", "headlamp flickers"))
+
+	status := WarrantyStatus{}
+	mustDecode(t, mustSucceed(t, stub.invoke(workshop, "checkWarranty", "BIKE000001")), &status)
+	if !status.Valid || len(status.Claims) != 2 || status.Claims[0].Issue != "clutch slips" || status.Claims[1].FiledBy != "Org2MSP/garage" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// The warranty runs from registration, not from when it was recorded
+	stub.now = expires + 1
+	mustDecode(t, mustSucceed(t, stub.invoke(workshop, "checkWarranty", "BIKE000001")), &status)
+	if status.Valid || status.CheckedAt != expires+1 {
+		t.Fatalf("expired warranty reported as %+v", status)
+	}
+	mustFail(t, stub.invoke(alice, "fileWarrantyClaim", "BIKE000001", "brakes fade"), "expired")
+	mustFail(t, stub.invoke(alice, "checkWarranty", "BIKE999999"), "does not exist")
+}
+
+func TestOwners(t *testing.T) {
+	stub := newTestStub(t)
+	digest := strings.Repeat("ab", 32)
+
+	mustSucceed(t, stub.invoke(alice, "registerOwner", "alice", "Alice", "alice@example.com", digest))
+	mustFail(t, stub.invoke(alice, "registerOwner", "alice", "Alice", "alice@example.com", digest), "already registered")
+	mustSucceed(t, stub.invoke(registrar, "registerOwner", "bob", "Bob", "bob@example.com", digest))
+	mustFail(t, stub.invoke(alice, "registerOwner", "dave", "Dave", "", "not-a-digest"), "SHA-256")
+	mustSucceed(t, stub.invoke(alice, "updateOwner", "alice", "Alice K", "alice@example.org", digest))
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	profile := OwnerProfile{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getOwnerProfile", "alice")), &profile)
+	if profile.Owner.Name != "Alice K" || len(profile.Bikes) != 1 {
+		t.Fatalf("profile %+v", profile)
+	}
+	mustFail(t, stub.invoke(bob, "getOwnerProfile", "nobody"), "nobody")
+
+	// Personal data stays out of the public state, and can be passed out of band
+	key, _ := stub.CreateCompositeKey("OWNER", []string{"Org2MSP/alice"})
+	if strings.Contains(string(stub.State[key]), "Alice") {
+		t.Fatalf("public owner record holds personal data: %s", stub.State[key])
+	}
+	pii := map[string]string{"pii": `{"name": "Carol", "contact": "carol@example.com"}`}
+	mustSucceed(t, stub.invokeTransient(carol, pii, "registerOwner", "carol", "", "", digest))
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getOwnerProfile", "carol")), &profile)
+	if profile.Owner.Name != "Carol" || profile.Owner.Contact != "carol@example.com" {
+		t.Fatalf("profile %+v", profile)
+	}
+
+	mustFail(t, stub.invoke(bob, "purgeOwnerPII", "alice"), "or a registrar")
+	mustSucceed(t, stub.invoke(alice, "purgeOwnerPII", "alice"))
+	profile = OwnerProfile{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getOwnerProfile", "alice")), &profile)
+	if profile.Owner.Name != "" || profile.Owner.Contact != "" || profile.Owner.PIIPurgedAt != stub.now || len(profile.Bikes) != 1 {
+		t.Fatalf("profile after purge %+v", profile)
+	}
+}
+
+func TestOwnersAcrossOrganizations(t *testing.T) {
+	stub := newTestStub(t)
+	digest := strings.Repeat("ab", 32)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustSucceed(t, stub.invoke(alice, "registerOwner", "alice", "Alice", "alice@example.com", digest))
+
+	// Enrollment IDs are only unique within an organization
+	impostor, _ := newSigner(t, "alice")
+	impostor.mspID = "Org3MSP"
+	mallory := &testIdentity{mspID: "Org3MSP", id: "mallory"}
+	mustFail(t, stub.invoke(impostor, "offerTransfer", "BIKE000001", "mallory", "0"), "Only the owner")
+	mustFail(t, stub.invoke(mallory, "acceptTransfer", "BIKE000001"), "No pending transfer")
+	mustFail(t, stub.invoke(impostor, "updateBike", "BIKE000001", "1", `{"colour": "red"}`), "Only the owner")
+	mustFail(t, stub.invoke(impostor, "updateOwner", "Org2MSP/alice", "Mallory", "", digest), "or a registrar")
+	if bike := stub.bike(t, "BIKE000001"); bike.Owner != "Org2MSP/alice" || bike.Colour != "blue" {
+		t.Fatalf("impostor changed the bike %+v", bike)
+	}
+
+	// Bare IDs name the invoker's own organization
+	mustSucceed(t, stub.invoke(impostor, "registerOwner", "alice", "Alice of Org3", "", digest))
+	mustSucceed(t, stub.invoke(impostor, "registerConsentCert"))
+	if stub.countKeys(t, "OWNER", "Org3MSP/alice") != 1 || stub.countKeys(t, "CONSENTCERT", "Org3MSP/alice") != 1 ||
+		stub.countKeys(t, "CONSENTCERT", "Org2MSP/alice") != 0 {
+		t.Fatal("impostor's records not kept apart from alice's")
+	}
+	profile := OwnerProfile{}
+	mustDecode(t, mustSucceed(t, stub.invoke(impostor, "getOwnerProfile", "alice")), &profile)
+	if profile.Owner.Name != "Alice of Org3" || len(profile.Bikes) != 0 {
+		t.Fatalf("profile %+v", profile)
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"telemetryRetention": 2}`))
+
+	for _, ts := range []string{"10", "30", "20"} {
+		mustSucceed(t, stub.invoke(device, "recordTelemetry", "BIKE000001", "12.97", "77.59", "locked", "80", ts))
+	}
+	mustFail(t, stub.invoke(device, "recordTelemetry", "BIKE000001", "91", "77.59", "locked", "80", "40"), "Latitude")
+	if n := stub.countKeys(t, "TELEMETRY", "BIKE000001"); n != 2 {
+		t.Fatalf("%d telemetry entries kept, want 2", n)
+	}
+
+	latest := Telemetry{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getLatestTelemetry", "BIKE000001")), &latest)
+	if latest.TS != 30 {
+		t.Fatalf("latest telemetry %+v", latest)
+	}
+}
+
+func TestDocuments(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	digest := strings.Repeat("AB", 32)
+
+	mustFail(t, stub.invoke(alice, "attachDocument", "BIKE000001", "rc", "abcd", "ipfs://rc"), "SHA-256")
+	mustSucceed(t, stub.invoke(alice, "attachDocument", "BIKE000001", "rc", digest, "ipfs://rc"))
+
+	verification := DocumentVerification{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "verifyDocument", "BIKE000001", "rc", digest)), &verification)
+	if !verification.Valid {
+		t.Fatalf("attached document not valid: %+v", verification)
+	}
+
+	mustFail(t, stub.invoke(bob, "revokeDocument", "BIKE000001", "rc", digest), "Only the owner")
+	mustSucceed(t, stub.invoke(alice, "revokeDocument", "BIKE000001", "rc", digest))
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "verifyDocument", "BIKE000001", "rc", digest)), &verification)
+	if verification.Valid {
+		t.Fatal("revoked document still valid")
+	}
+
+	documents := []Document{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "listDocuments", "BIKE000001", "rc")), &documents)
+	if len(documents) != 1 || !documents[0].Revoked {
+		t.Fatalf("documents %+v", documents)
+	}
+}
+
+func TestEndorsementPolicy(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	mustSucceed(t, stub.invoke(alice, "setBikeEndorsementPolicy", "BIKE000001", "Org1MSP", "Org2MSP"))
+	orgs := []string{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getBikeEndorsementPolicy", "BIKE000001")), &orgs)
+	if len(orgs) != 2 {
+		t.Fatalf("endorsing orgs %v", orgs)
+	}
+}
+
+func TestBikeWithMetadata(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	metadata := BikeWithMetadata{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getBikeWithMetadata", "BIKE000001")), &metadata)
+	stored := Bike{}
+	mustDecode(t, metadata.Bike, &stored)
+	if metadata.StateHash != stateHash(metadata.Bike) || metadata.TxID == "" || metadata.TxID != stored.CreatedTxID ||
+		metadata.Version != 1 || metadata.Namespace != "fabbike" || len(metadata.EndorsingOrgs) != 0 {
+		t.Fatalf("unexpected metadata %+v", metadata)
+	}
+
+	resp := stub.invoke(alice, "patchBike", "BIKE000001", `{"colour": "red"}`)
+	mustSucceed(t, resp)
+	wrapped := Envelope{}
+	mustDecode(t, resp.Payload, &wrapped)
+	mustSucceed(t, stub.invoke(alice, "setBikeEndorsementPolicy", "BIKE000001", "Org1MSP"))
+	previous := metadata
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getBikeWithMetadata", "BIKE000001")), &metadata)
+	if metadata.TxID != wrapped.TxID || metadata.StateHash == previous.StateHash || metadata.Version != 2 ||
+		len(metadata.EndorsingOrgs) != 1 || metadata.EndorsingOrgs[0] != "Org1MSP" {
+		t.Fatalf("unexpected metadata after an update %+v", metadata)
+	}
+	mustFail(t, stub.invoke(bob, "getBikeWithMetadata", "BIKE000009"), "does not exist")
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	stub.createBikeFor(t, "BIKE000002", alice)
+	mustSucceed(t, stub.invoke(alice, "updateBike", "BIKE000001", "1", `{"make": "Hero"}`))
+	if stub.countKeys(t, "MAKEBIKE", "Honda") != 1 || stub.countKeys(t, "MAKEBIKE", "Hero", "BIKE000001") != 1 {
+		t.Fatal("make index not moved")
+	}
+	mustSucceed(t, stub.invoke(alice, "archiveBike", "BIKE000001"))
+	if stub.countKeys(t, "MAKEBIKE", "Hero") != 0 || stub.countKeys(t, "OWNERBIKE", "Org2MSP/alice") != 1 {
+		t.Fatal("archived bike left in the indexes")
+	}
+
+	// A bike written before the indexes existed, and entries of a bike that never did
+	stub.MockTransactionStart("drift")
+	stub.PutState("BIKE000005", []byte(`{"make": "Honda", "model": "Shine", "colour": "blue", "owner": "Org2MSP/bob", "registrationNo": "KA01AB1234"}`))
+	ghostOwner, _ := stub.CreateCompositeKey("OWNERBIKE", []string{"Org2MSP/carol", "BIKE000009"})
+	stub.PutState(ghostOwner, []byte{0x00})
+	ghostRegNo, _ := stub.CreateCompositeKey("REGNO", []string{"KA01ZZ0000"})
+	stub.PutState(ghostRegNo, []byte("BIKE000009"))
+	stub.MockTransactionEnd("drift")
+
+	mustFail(t, stub.invoke(alice, "rebuildIndexes"), "Only members of")
+	repair := IndexRepair{}
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "rebuildIndexes")), &repair)
+	if repair.Bikes != 2 || repair.Added != 4 || repair.Removed != 2 {
+		t.Fatalf("unexpected repair %+v", repair)
+	}
+	if stub.countKeys(t, "OWNERBIKE", "Org2MSP/bob") != 1 || stub.countKeys(t, "MAKEBIKE", "Honda") != 2 || stub.countKeys(t, "OWNERBIKE", "Org2MSP/carol") != 0 {
+		t.Fatal("indexes not repaired")
+	}
+	mustSucceed(t, stub.invoke(alice, "queryBikeByRegistrationNo", "KA01AB1234"))
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "rebuildIndexes")), &repair)
+	if repair.Added != 0 || repair.Removed != 0 {
+		t.Fatalf("second repair changed %+v", repair)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	stub := newTestStub(t)
+
+	// A bike as stored before keys were padded, statuses and asset types existed
+	stub.MockTransactionStart("legacy")
+	stub.PutState("BIKE7", []byte(`{"make": "Honda", "model": "Shine", "colour": "blue", "owner": "alice"}`))
+	serviceKey, _ := stub.CreateCompositeKey("SERVICE", []string{"BIKE7", "00000001"})
+	stub.PutState(serviceKey, []byte(`{"bikeKey": "BIKE7", "seq": "00000001", "date": "2020-01-01"}`))
+	stub.MockTransactionEnd("legacy")
+
+	migrations := []KeyMigration{}
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "migrateBikeKeys")), &migrations)
+	if len(migrations) != 1 || migrations[0].To != "BIKE000007" {
+		t.Fatalf("key migrations %+v", migrations)
+	}
+	records := []ServiceRecord{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getServiceRecords", "BIKE000007")), &records)
+	if len(records) != 1 || records[0].BikeKey != "BIKE000007" {
+		t.Fatalf("service records not moved: %+v", records)
+	}
+
+	status := MigrationStatus{}
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "migrate")), &status)
+	if !status.Done || status.Migrated != 1 {
+		t.Fatalf("migration status %+v", status)
+	}
+	raw := map[string]interface{}{}
+	mustDecode(t, stub.State["BIKE000007"], &raw)
+	if raw["status"] != statusActive || raw["assetType"] != assetMotorbike {
+		t.Fatalf("bike not migrated: %v", raw)
+	}
+	versions := map[string]int{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getSchemaVersion")), &versions)
+	if versions["ledger"] != currentSchemaVersion {
+		t.Fatalf("schema versions %v", versions)
+	}
+
+	// Index entries holding a marker byte rather than a record are moved as they are
+	stub.MockTransactionStart("legacy-claim")
+	stub.PutState("BIKE9", []byte(`{"make": "Honda", "model": "Shine", "colour": "blue", "owner": "Org2MSP/alice", "status": "ACTIVE"}`))
+	stub.MockTransactionEnd("legacy-claim")
+	future := strconv.FormatInt(stub.now+3600, 10)
+	mustSucceed(t, stub.invoke(insurer, "attachPolicy", "BIKE9", "P1", "InsurerMSP", future))
+	mustSucceed(t, stub.invoke(alice, "fileClaim", "BIKE9", "crash"))
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "migrateBikeKeys")), &migrations)
+	if len(migrations) != 1 || migrations[0].To != "BIKE000009" {
+		t.Fatalf("key migrations of a bike with a claim %+v", migrations)
+	}
+	claims := []Claim{}
+	mustDecode(t, mustSucceed(t, stub.invoke(insurer, "getClaims", "BIKE000009")), &claims)
+	if len(claims) != 1 || claims[0].Details != "crash" || claims[0].BikeKey != "BIKE000009" || stub.countKeys(t, "CLAIMBYBIKE", "BIKE9") != 0 {
+		t.Fatalf("claims not moved: %+v", claims)
+	}
+	stub.MockTransactionStart("legacy-dispute")
+	stub.PutState("BIKE10", []byte(`{"make": "Honda", "model": "Shine", "colour": "blue", "owner": "Org2MSP/alice", "status": "ACTIVE"}`))
+	stub.MockTransactionEnd("legacy-dispute")
+	mustSucceed(t, stub.invoke(bob, "openDispute", "BIKE10", "bob", strings.Repeat("ab", 32)))
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "migrateBikeKeys")), &migrations)
+	if len(migrations) != 1 || migrations[0].To != "BIKE000010" {
+		t.Fatalf("key migrations of a bike with a dispute %+v", migrations)
+	}
+	disputes := []Dispute{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getDisputes", "BIKE000010")), &disputes)
+	if len(disputes) != 1 || disputes[0].Status != disputeOpen || disputes[0].BikeKey != "BIKE000010" || stub.countKeys(t, "DISPUTEBYBIKE", "BIKE10") != 0 {
+		t.Fatalf("disputes not moved: %+v", disputes)
+	}
+	mustSucceed(t, stub.invoke(admin, "migrate"))
+
+	// Records kept under IDs of their own are pointed at the new keys
+	stub.MockTransactionStart("legacy-records")
+	stub.PutState("BIKE11", []byte(`{"make": "Honda", "model": "Shine", "colour": "blue", "owner": "Org2MSP/alice", "status": "ACTIVE"}`))
+	stub.PutState("BIKE12", []byte(`{"make": "Honda", "model": "Shine", "colour": "blue", "owner": "Org2MSP/alice", "status": "ACTIVE"}`))
+	stub.MockTransactionEnd("legacy-records")
+	accident := Accident{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "reportAccident", "BIKE11", "MINOR", strings.Repeat("ab", 32), "FIR-1")), &accident)
+	request := ModificationRequest{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "requestModification", "BIKE11", `{"colour": "red"}`)), &request)
+	auction := Auction{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "startAuction", "BIKE11", "100", future)), &auction)
+	lease := Lease{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "startLease", "BIKE12", "bob", "100", "3")), &lease)
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "migrateBikeKeys")), &migrations)
+	if len(migrations) != 2 {
+		t.Fatalf("key migrations of bikes with records %+v", migrations)
+	}
+	references := []struct{ objectType, id, bikeKey string }{
+		{"MODREQ", request.RequestID, "BIKE000011"},
+		{"AUCTION", auction.ID, "BIKE000011"},
+		{"LEASE", lease.LeaseID, "BIKE000012"},
+	}
+	for _, reference := range references {
+		key, _ := stub.CreateCompositeKey(reference.objectType, []string{reference.id})
+		mustDecode(t, stub.State[key], &raw)
+		if raw["bikeKey"] != reference.bikeKey {
+			t.Fatalf("%s record not pointed at %s: %v", reference.objectType, reference.bikeKey, raw)
+		}
+	}
+	detailsKey, _ := stub.CreateCompositeKey("ACCIDENTDETAILS", []string{accident.AccidentID})
+	mustDecode(t, stub.PvtState[collectionAccidentDetails][detailsKey], &raw)
+	if raw["bikeKey"] != "BIKE000011" || raw["policeRefNo"] != "FIR-1" {
+		t.Fatalf("accident details not pointed at BIKE000011: %v", raw)
+	}
+	mustSucceed(t, stub.invoke(admin, "migrate"))
+
+	// A bike that cannot be moved fails the call rather than being reported
+	stub.createBikeFor(t, "BIKE000013", alice)
+	stub.MockTransactionStart("legacy-taken")
+	stub.PutState("BIKE13", []byte(`{"make": "Honda", "model": "Shine", "colour": "blue", "owner": "Org2MSP/alice", "status": "ACTIVE"}`))
+	stub.MockTransactionEnd("legacy-taken")
+	mustFail(t, stub.invoke(admin, "migrateBikeKeys"), "BIKE000013 is already taken")
+	stub.MockTransactionStart("legacy-taken")
+	stub.DelState("BIKE13")
+	stub.MockTransactionEnd("legacy-taken")
+
+	// Bikes in a tenant's namespace are migrated too
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"tenants": {"Org2MSP": "NORTH"}}`))
+	stub.MockTransactionStart("legacy-north")
+	stub.PutState("NORTH|BIKE8", []byte(`{"make": "Honda", "model": "Shine", "colour": "blue", "owner": "alice"}`))
+	stub.MockTransactionEnd("legacy-north")
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "migrateBikeKeys")), &migrations)
+	if len(migrations) != 1 || migrations[0].To != "NORTH|BIKE000008" {
+		t.Fatalf("tenant key migrations %+v", migrations)
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "migrate")), &status)
+	if !status.Done || status.Migrated != 1 {
+		t.Fatalf("tenant migration status %+v", status)
+	}
+	mustDecode(t, stub.State["NORTH|BIKE000008"], &raw)
+	if raw["status"] != statusActive {
+		t.Fatalf("tenant bike not migrated: %v", raw)
+	}
+}
+
+func TestImportFromFabcar(t *testing.T) {
+	stub := newTestStub(t)
+
+	cars := `[
+		{"Key": "CAR0", "Record": {"make": "Toyota", "model": "Prius", "colour": "blue", "owner": "Tomoko"}},
+		{"Key": "CAR12", "Record": {"make": "Ford", "model": "Mustang", "color": "red", "owner": "Brad", "docType": "car"}},
+		{"Key": "CAR0", "Record": {"make": "Hyundai", "model": "Tucson", "colour": "green", "owner": "Jin Soo"}},
+		{"Key": "TRUCK1", "Record": {"make": "Volvo", "model": "FH", "colour": "white", "owner": "Max"}},
+		{"Key": "CAR3", "Record": {"make": "Peugeot", "model": "205", "colour": "purple"}}
+	]`
+	results := []FabcarImport{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "importFromFabcar", cars)), &results)
+	if len(results) != 5 || !results[0].OK || !results[1].OK || results[2].OK || results[3].OK || results[4].OK {
+		t.Fatalf("unexpected import results %+v", results)
+	}
+	if results[1].Key != "BIKE000012" || results[1].CarKey != "CAR12" {
+		t.Fatalf("CAR12 imported as %+v", results[1])
+	}
+	if bike := stub.bike(t, "BIKE000012"); bike.Colour != "red" || bike.Owner != "Org2MSP/Brad" || bike.AssetType != assetMotorbike {
+		t.Fatalf("unexpected imported bike %+v", bike)
+	}
+
+	// Cars left in state by a FabCar chaincode upgraded in place
+	stub.MockTransactionStart("fabcar")
+	stub.PutState("CAR7", []byte(`{"make": "Tata", "model": "Nano", "color": "yellow", "owner": "Ratan"}`))
+	stub.MockTransactionEnd("fabcar")
+
+	car := FabcarCar{}
+	// queryCar answers like FabCar, outside the envelope
+	mustDecode(t, stub.invoke(alice, "queryCar", "CAR7").Payload, &car)
+	if car.Colour != "yellow" || car.Owner != "Ratan" {
+		t.Fatalf("unexpected car %+v", car)
+	}
+	mustFail(t, stub.invoke(alice, "importFromFabcar"), "Only members of")
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "importFromFabcar")), &results)
+	if len(results) != 1 || !results[0].OK || results[0].Key != "BIKE000007" {
+		t.Fatalf("unexpected in-place import %+v", results)
+	}
+	if stub.State["CAR7"] != nil {
+		t.Fatal("CAR7 left behind after the import")
+	}
+	car = FabcarCar{}
+	mustDecode(t, stub.invoke(alice, "queryCar", "CAR7").Payload, &car)
+	if car.Make != "Tata" || car.Colour != "yellow" {
+		t.Fatalf("imported car reads back as %+v", car)
+	}
+	mustFail(t, stub.invoke(admin, "importFromFabcar"), "No cars to import")
+	if resp := stub.invoke(alice, "queryCar", "CAR99"); resp.Status < shim.ERRORTHRESHOLD || resp.Message != "Car CAR99 does not exist" {
+		t.Fatalf("unexpected response %+v for a missing car", resp)
+	}
+}
+
+// fakeRegistry answers isStolen for the bikes it was told about
+type fakeRegistry struct {
+	stolen map[string]bool
+}
+
+func (r *fakeRegistry) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	return shim.Success(nil)
+}
+
+func (r *fakeRegistry) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response {
+	_, args := APIstub.GetFunctionAndParameters()
+	return shim.Success([]byte(strconv.FormatBool(r.stolen[args[0]])))
+}
+
+func TestWatchlist(t *testing.T) {
+	stub := newTestStub(t)
+	mustFail(t, stub.invoke(alice, "addToWatchlist", "ME4JC651", "taken from a car park"), "Only members of [PoliceMSP]")
+	mustSucceed(t, stub.invoke(police, "addToWatchlist", "me4-jc6514lt000123", "taken from a car park"))
+	entry := WatchlistEntry{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "checkChassisNo", "ME4JC6514LT000123")), &entry)
+	if entry.ChassisNo != "ME4JC6514LT000123" || entry.ReportedBy != "PoliceMSP/officer" {
+		t.Fatalf("unexpected watchlist entry %+v", entry)
+	}
+
+	stub.events()
+	mustSucceed(t, stub.invoke(alice, "createBike", "BIKE000001", "Honda", "Shine", "blue", "alice", "", "ME4 JC6514 LT000123"))
+	events := stub.events()
+	if len(events) != 1 || events[0].EventName != "StolenBikeAlert" {
+		t.Fatalf("expected a StolenBikeAlert, got %v", events)
+	}
+	alert := StolenBikeAlert{}
+	mustDecode(t, events[0].Payload, &alert)
+	if alert.BikeKey != "BIKE000001" || alert.Function != "createBike" || alert.Entry.ChassisNo != "ME4JC6514LT000123" {
+		t.Fatalf("unexpected alert %+v", alert)
+	}
+	mustSucceed(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "bob"))
+	if events := stub.events(); len(events) != 1 {
+		t.Fatalf("expected an alert on transfer, got %v", events)
+	}
+
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"blockWatchlisted": true}`))
+	mustFail(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "carol"), "watchlist")
+	mustSucceed(t, stub.invoke(police, "addToWatchlist", "ME4JC6516LT000124", "taken from a driveway"))
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000002", "Honda", "Shine", "red", "alice", "", "ME4JC6516LT000124"), "watchlist")
+
+	mustSucceed(t, stub.invoke(police, "removeFromWatchlist", "ME4JC6514LT000123"))
+	mustSucceed(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "carol"))
+	entries := []WatchlistEntry{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getWatchlist")), &entries)
+	if len(entries) != 1 || entries[0].ChassisNo != "ME4JC6516LT000124" {
+		t.Fatalf("unexpected watchlist %v", entries)
+	}
+}
+
+func TestOrganizations(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	mustFail(t, stub.invoke(alice, "setOrganization", "Org2MSP", `{"canRegister": true}`), "Only members of")
+
+	org := Organization{}
+	mustDecode(t, mustSucceed(t, stub.invoke(admin, "setOrganization", "Org1MSP", `{"name": "Transport Dept", "canRegister": true}`)), &org)
+	if org.MSPID != "Org1MSP" || !org.CanRegister || org.CanTransfer || org.OnboardedBy != "Org1MSP/admin" {
+		t.Fatalf("unexpected organization %+v", org)
+	}
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000002", "Honda", "Shine", "red", "alice"), "Organization Org2MSP is not onboarded")
+	mustFail(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"), "not onboarded")
+	mustFail(t, stub.invoke(police, "addToWatchlist", "ME4JC6514LT000123", "taken from a car park"), "Organization PoliceMSP is not onboarded")
+
+	onboardedAt := stub.now
+	mustSucceed(t, stub.invoke(admin, "setOrganization", "Org2MSP", `{"canRegister": true}`))
+	mustSucceed(t, stub.invoke(alice, "createBike", "BIKE000002", "Honda", "Shine", "red", "alice"))
+	mustFail(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"), "does not have the transfer capability")
+	mustFail(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "bob"), "transfer capability")
+	stub.now += 100
+	mustSucceed(t, stub.invoke(admin, "setOrganization", "Org2MSP", `{"canRegister": true, "canTransfer": true}`))
+	mustSucceed(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "bob"))
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getOrganization", "Org2MSP")), &org)
+	if org.OnboardedAt != onboardedAt || org.UpdatedAt != stub.now {
+		t.Fatalf("update changed the onboarding of %+v", org)
+	}
+
+	mustSucceed(t, stub.invoke(admin, "setOrganization", "PoliceMSP", `{"canPolice": false}`))
+	mustFail(t, stub.invoke(police, "addToWatchlist", "ME4JC6514LT000123", "taken from a car park"), "police capability")
+	mustSucceed(t, stub.invoke(admin, "setOrganization", "PoliceMSP", `{"canPolice": true}`))
+	mustSucceed(t, stub.invoke(police, "addToWatchlist", "ME4JC6514LT000123", "taken from a car park"))
+
+	orgs := []Organization{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getOrganizations")), &orgs)
+	if len(orgs) != 3 || orgs[0].MSPID != "Org1MSP" || orgs[2].MSPID != "PoliceMSP" {
+		t.Fatalf("unexpected organizations %v", orgs)
+	}
+	mustSucceed(t, stub.invoke(admin, "removeOrganization", "Org2MSP"))
+	mustFail(t, stub.invoke(admin, "removeOrganization", "Org2MSP"), "not onboarded")
+	mustFail(t, stub.invoke(alice, "getOrganization", "Org2MSP"), "not onboarded")
+	mustFail(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "carol"), "not onboarded")
+
+	// Emptying the registry returns to the MSP lists of the config
+	mustSucceed(t, stub.invoke(admin, "removeOrganization", "Org1MSP"))
+	mustSucceed(t, stub.invoke(admin, "removeOrganization", "PoliceMSP"))
+	mustSucceed(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "carol"))
+}
+
+func TestRegistryPolice(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invokeTransient(admin, map[string]string{"salt": "0123456789abcdef0123456789abcdef"}, "setOwnerSalt"))
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"ownerPseudonyms": true}`))
+	mustSucceed(t, stub.invoke(admin, "setOrganization", "Org2MSP", `{"canRegister": true}`))
+	stub.createBikeFor(t, "BIKE000001", alice)
+	owner := stub.bike(t, "BIKE000001").Owner
+	location := strings.Repeat("ab", 32)
+
+	// An organization onboarded through the registry alone acts as the police everywhere,
+	// while the config's police MSPs count for nothing once the registry is in use
+	cityPolice := &testIdentity{mspID: "CityPoliceMSP", id: "officer"}
+	mustSucceed(t, stub.invoke(admin, "setOrganization", "CityPoliceMSP", `{"canPolice": true}`))
+	calls := []struct {
+		function string
+		args     []string
+		refused  string
+	}{
+		{"addToWatchlist", []string{"ME4JC6514LT000123", "taken from a car park"}, "Organization PoliceMSP is not onboarded"},
+		{"removeFromWatchlist", []string{"ME4JC6514LT000123"}, "Organization PoliceMSP is not onboarded"},
+		{"reportAccident", []string{"BIKE000001", "MINOR", location, "FIR-1"}, "Only the owner or insurer"},
+		{"resolveOwnerHash", []string{owner}, "Only registrars and the police"},
+	}
+	for _, call := range calls {
+		t.Run(call.function, func(t *testing.T) {
+			mustFail(t, stub.invoke(police, call.function, call.args...), call.refused)
+			mustSucceed(t, stub.invoke(cityPolice, call.function, call.args...))
+		})
+	}
+	resolved := ResolvedOwner{}
+	mustDecode(t, mustSucceed(t, stub.invoke(cityPolice, "resolveOwnerHash", owner)), &resolved)
+	if resolved.Owner != "Org2MSP/alice" {
+		t.Fatalf("resolved %+v", resolved)
+	}
+}
+
+func TestFitnessCertificates(t *testing.T) {
+	stub := newTestStub(t)
+	tester := &testIdentity{mspID: "TestingAuthorityMSP", id: "inspector"}
+	stub.createBikeFor(t, "BIKE000001", alice)
+	expiry := strconv.FormatInt(stub.now+100, 10)
+	mustFail(t, stub.invoke(alice, "issueFitnessCertificate", "BIKE000001", "PUC-1", expiry), "Only members of [TestingAuthorityMSP]")
+	mustFail(t, stub.invoke(tester, "issueFitnessCertificate", "BIKE000001", "PUC-1", strconv.FormatInt(stub.now, 10)), "in the future")
+	mustSucceed(t, stub.invoke(tester, "issueFitnessCertificate", "BIKE000001", "PUC-1", expiry))
+	mustFail(t, stub.invoke(tester, "issueFitnessCertificate", "BIKE000001", "PUC-1", expiry), "already issued")
+
+	stub.events()
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+	if events := stub.events(); len(events) != 0 {
+		t.Fatalf("unexpected events %v for a fit bike", events)
+	}
+
+	stub.now += 200
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+	events := stub.events()
+	if len(events) != 1 || events[0].EventName != fitnessExpiredEvent {
+		t.Fatalf("expected a fitness alert, got %v", events)
+	}
+	alert := FitnessExpiredAlert{}
+	mustDecode(t, events[0].Payload, &alert)
+	if alert.BikeKey != "BIKE000001" || alert.CertID != "PUC-1" || alert.Function != "offerTransfer" {
+		t.Fatalf("unexpected alert %+v", alert)
+	}
+
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"blockUnfit": true}`))
+	mustFail(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"), "PUC-1 of bike BIKE000001 expired")
+	mustSucceed(t, stub.invoke(tester, "issueFitnessCertificate", "BIKE000001", "PUC-2", strconv.FormatInt(stub.now+100, 10)))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+
+	certs := []FitnessCertificate{}
+	mustDecode(t, mustSucceed(t, stub.invoke(bob, "getCertificates", "BIKE000001")), &certs)
+	if len(certs) != 2 || certs[0].CertID != "PUC-1" || certs[1].IssuedBy != "TestingAuthorityMSP/inspector" {
+		t.Fatalf("unexpected certificates %+v", certs)
+	}
+}
+
+func TestStolenRegistry(t *testing.T) {
+	stub := newTestStub(t)
+	registry := &fakeRegistry{stolen: map[string]bool{"BIKE000002": true}}
+	stub.MockPeerChaincode("stolenregistry", shim.NewMockStub("stolenregistry", registry))
+	resp := stub.MockInit("upgrade", [][]byte{[]byte("init"), []byte(`{"stolenRegistry": {"chaincode": "stolenregistry"}}`)})
+	mustSucceed(t, resp)
+
+	stub.createBikeFor(t, "BIKE000001", alice)
+	stub.createBikeFor(t, "BIKE000002", alice)
+	mustSucceed(t, stub.invoke(alice, "offerTransfer", "BIKE000001", "bob", "0"))
+	mustFail(t, stub.invoke(alice, "offerTransfer", "BIKE000002", "bob", "0"), "stolen")
+}
+
+// fakeKYC answers isVerified for the owners it was told about, and fails for "offline"
+type fakeKYC struct {
+	verified map[string]bool
+}
+
+func (k *fakeKYC) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	return shim.Success(nil)
+}
+
+func (k *fakeKYC) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response {
+	_, args := APIstub.GetFunctionAndParameters()
+	if args[0] == "Org2MSP/offline" {
+		return shim.Error("KYC service unavailable")
+	}
+	return shim.Success([]byte(strconv.FormatBool(k.verified[args[0]])))
+}
+
+func TestKYCRegistry(t *testing.T) {
+	stub := newTestStub(t)
+	stub.MockPeerChaincode("kyc", shim.NewMockStub("kyc", &fakeKYC{verified: map[string]bool{"Org2MSP/bob": true}}))
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"kycRegistry": {"chaincode": "kyc"}}`))
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	resp := stub.invoke(alice, "changeBikeOwner", "BIKE000001", "carol")
+	mustFail(t, resp, "carol has not passed KYC")
+	if resp.Status != statusKYCRequired {
+		t.Fatalf("expected status %d, got %d", statusKYCRequired, resp.Status)
+	}
+	mustFail(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "offline"), "KYC service unavailable")
+	mustSucceed(t, stub.invoke(alice, "changeBikeOwner", "BIKE000001", "bob"))
+	mustSucceed(t, stub.invoke(bob, "acceptTransfer", "BIKE000001"))
+	if bike := stub.bike(t, "BIKE000001"); bike.Owner != "Org2MSP/bob" {
+		t.Fatalf("bike went to %s", bike.Owner)
+	}
+}
+
+func TestCreationQuota(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(admin, "setConfig", `{"creationQuota": 2, "creationQuotaWindowSeconds": 3600}`))
+	stub.createBikeFor(t, "BIKE000001", alice)
+
+	batch := `[
+		{"key": "BIKE000002", "assetType": "cycle", "make": "Hero", "model": "Sprint", "colour": "red", "owner": "alice"},
+		{"key": "BIKE000003", "assetType": "cycle", "make": "Hero", "model": "Sprint", "colour": "red", "owner": "alice"}
+	]`
+	results := []BatchResult{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "createBikesBatch", batch)), &results)
+	if !results[0].OK || results[1].OK || !strings.Contains(results[1].Error, "quota of 2") {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	resp := stub.invoke(alice, "createBike", "BIKE000004", "Honda", "Shine", "blue", "alice")
+	if code := mustFail(t, resp, "used up the quota"); code != codeQuotaExceeded || resp.Status != statusQuotaExceeded {
+		t.Fatalf("got code %s, status %d", code, resp.Status)
+	}
+	quota := CreationQuota{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getCreationQuota")), &quota)
+	if quota.Count != 2 || quota.Limit != 2 {
+		t.Fatalf("unexpected quota %+v", quota)
+	}
+
+	stub.createBikeFor(t, "BIKE000005", registrar)
+	stub.createBikeFor(t, "BIKE000006", bob)
+	stub.now += 3600
+	stub.createBikeFor(t, "BIKE000004", alice)
+	mustFail(t, stub.invoke(admin, "setConfig", `{"creationQuota": -1}`), "cannot be negative")
+}
+
+func TestMetrics(t *testing.T) {
+	stub := newTestStub(t)
+	stub.createBikeFor(t, "BIKE000001", alice)
+	stub.createBikeFor(t, "BIKE000002", alice)
+	mustFail(t, stub.invoke(alice, "createBike", "BIKE000002", "Honda", "Shine", "blue", "alice"), "already exists")
+	stub.bike(t, "BIKE000001")
+
+	counts := map[string]int{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "getMetrics")), &counts)
+	if counts["createBike"] != 2 || counts["queryBike"] != 0 {
+		t.Fatalf("metrics %v", counts)
+	}
+}
+
+func TestExportLedger(t *testing.T) {
+	stub := newTestStub(t)
+	mustSucceed(t, stub.invoke(alice, "initLedger"))
+
+	chunk := ExportChunk{}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "exportLedger", "BIKE0", "BIKE9", "csv", "4")), &chunk)
+	if chunk.Count != 4 || chunk.Bookmark == "" || !strings.HasPrefix(chunk.Data, "key,assetType") {
+		t.Fatalf("unexpected first chunk %+v", chunk)
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "exportLedger", "BIKE0", "BIKE9", "ndjson", "4", chunk.Bookmark)), &chunk)
+	if chunk.Count != 4 || strings.Count(chunk.Data, "\n") != 4 {
+		t.Fatalf("unexpected second chunk %+v", chunk)
+	}
+	mustDecode(t, mustSucceed(t, stub.invoke(alice, "exportLedger", "BIKE0", "BIKE9", "ndjson", "4", chunk.Bookmark)), &chunk)
+	if chunk.Count != 2 || chunk.Bookmark != "" {
+		t.Fatalf("unexpected last chunk %+v", chunk)
+	}
+
+	mustFail(t, stub.invoke(alice, "exportLedger", "BIKE0", "BIKE9", "xml"), "ndjson or csv")
+	mustFail(t, stub.invoke(alice, "exportLedger", "BIKE0", "BIKE9", "csv", "0"), "Page size")
+}
@@ -0,0 +1,209 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// fabcarKeyPrefix starts the keys of the FabCar sample chaincode, CAR0, CAR1 and so on
+const fabcarKeyPrefix = "CAR"
+
+// FabcarCar is a car as the FabCar samples store it. The Go sample spells colour the
+// British way, the JavaScript one does not, so both are read.
+type FabcarCar struct {
+	Make   string `json:"make"`
+	Model  string `json:"model"`
+	Colour string `json:"colour,omitempty"`
+	Color  string `json:"color,omitempty"`
+	Owner  string `json:"owner"`
+}
+
+// FabcarRecord is one entry of the FabCar queryAllCars output, the payload importFromFabcar takes
+type FabcarRecord struct {
+	Key    string    `json:"Key"`
+	Record FabcarCar `json:"Record"`
+}
+
+// FabcarImport reports what became of one car: the bike key it was imported under, or why not
+type FabcarImport struct {
+	CarKey string `json:"carKey"`
+	BatchResult
+}
+
+// toBike translates a FabCar car into a motorbike with the same make, model, colour and owner
+func (car FabcarCar) toBike() Bike {
+	colour := car.Colour
+	if colour == "" {
+		colour = car.Color
+	}
+	return Bike{AssetType: assetMotorbike, Make: car.Make, Model: car.Model, Colour: colour, Owner: car.Owner}
+}
+
+// fabcarBikeKey returns the bike key a FabCar key is imported under: CAR12 becomes BIKE000012
+// with the default key prefix, so the numbering of the cars carries over
+func fabcarBikeKey(prefix string, carKey string) (string, error) {
+	match := legacyBikeKey(fabcarKeyPrefix).FindStringSubmatch(carKey)
+	if match == nil {
+		return "", invalidArgs("%s is not a FabCar key", carKey)
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return "", invalidArgs("%s is not a FabCar key", carKey)
+	}
+	return bikeKey(prefix, n), nil
+}
+
+// readFabcarState returns the cars left under CAR keys in this chaincode's own state, as on
+// a channel where FabCar was upgraded to FabBike in place
+func readFabcarState(APIstub shim.ChaincodeStubInterface) ([]FabcarRecord, error) {
+	resultsIterator, err := APIstub.GetStateByRange(fabcarKeyPrefix, prefixRangeEnd(fabcarKeyPrefix))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	records := []FabcarRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		record := FabcarRecord{Key: queryResponse.Key}
+		if err := json.Unmarshal(queryResponse.Value, &record.Record); err != nil {
+			return nil, fmt.Errorf("%s is not a FabCar record: %s", queryResponse.Key, err.Error())
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+/*
+ * importFromFabcar registers the cars of a FabCar network as bikes, keeping their numbering,
+ * see fabcarBikeKey. The cars are the JSON array queryAllCars returns on that network.
+ * Without an argument the cars still under CAR keys in this chaincode's own state are
+ * imported instead, and their CAR keys deleted; only admins may migrate state like that.
+ * Cars are registered like any new bike, and ones that cannot be are skipped and reported.
+ * Args: optionally the cars JSON array
+ */
+func (s *SmartContract) importFromFabcar(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	var cars []FabcarRecord
+	inPlace := len(args) == 0
+	if inPlace {
+		if err := assertAnyMSP(APIstub, config.AdminMSPs); err != nil {
+			return errorResponse(err)
+		}
+		cars, err = readFabcarState(APIstub)
+		if err != nil {
+			return errorResponse(err)
+		}
+	} else if err := json.Unmarshal([]byte(args[0]), &cars); err != nil {
+		return errorResponse(invalidArgs("Cars must be a JSON array: %s", err.Error()))
+	}
+	if len(cars) == 0 {
+		return errorResponse(invalidArgs("No cars to import"))
+	}
+	if len(cars) > maxBatchSize {
+		return errorResponse(invalidArgs("Batch holds %d cars, the limit is %d", len(cars), maxBatchSize))
+	}
+
+	prefix, err := scopedKeyPrefix(APIstub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	quota, err := trackCreationQuota(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	results := make([]FabcarImport, 0, len(cars))
+	seen := make(map[string]bool)
+	for _, car := range cars {
+		result := FabcarImport{CarKey: car.Key}
+		result.Key, err = fabcarBikeKey(prefix, car.Key)
+		if err == nil && seen[result.Key] {
+			err = invalidArgs("Key %s appears more than once in the batch", car.Key)
+		}
+		if err == nil {
+			seen[result.Key] = true
+			err = quota.allow()
+		}
+		if err == nil {
+			err = registerBike(APIstub, result.Key, car.Record.toBike())
+		}
+		if err == nil && inPlace {
+			err = APIstub.DelState(car.Key)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.OK = true
+			quota.add()
+		}
+		results = append(results, result)
+	}
+	if err := quota.save(APIstub); err != nil {
+		return errorResponse(err)
+	}
+
+	resultsAsBytes, _ := json.Marshal(results)
+	return shim.Success(resultsAsBytes)
+}
+
+/*
+ * queryCar answers the FabCar function of the same name, so FabCar clients keep working
+ * while a network migrates: it returns the bike a car was imported as in the FabCar format,
+ * or the car itself if it is still under its CAR key. Its answer is not put in the response
+ * envelope, as FabCar clients would not expect it. Args: carKey
+ */
+func (s *SmartContract) queryCar(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	prefix, err := scopedKeyPrefix(APIstub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := fabcarBikeKey(prefix, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	car := FabcarCar{}
+	bike, err := getBike(APIstub, key)
+	if err == nil {
+		car = FabcarCar{Make: bike.Make, Model: bike.Model, Colour: bike.Colour, Owner: bike.Owner}
+	} else {
+		carAsBytes, err := APIstub.GetState(args[0])
+		if err != nil {
+			return errorResponse(err)
+		}
+		if carAsBytes == nil {
+			return errorResponse(notFound("Car %s does not exist", args[0]))
+		}
+		if err := json.Unmarshal(carAsBytes, &car); err != nil {
+			return errorResponse(err)
+		}
+		car.Colour = car.toBike().Colour
+		car.Color = ""
+	}
+
+	carAsBytes, _ := json.Marshal(car)
+	return shim.Success(carAsBytes)
+}
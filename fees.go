@@ -0,0 +1,164 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// FeeSlab is one band of the transfer fee schedule. It applies to prices up to UpTo,
+// or to any price when UpTo is 0, and charges Flat plus RateBps basis points of the price.
+type FeeSlab struct {
+	UpTo    int64 `json:"upTo"`
+	Flat    int64 `json:"flat"`
+	RateBps int64 `json:"rateBps"`
+}
+
+// FeeSchedule, part of the Config, sets the registration fee due on every change of owner.
+// Without slabs no fee is due. With DebitBuyer the fee is paid from the buyer's token
+// account to Collector when the buyer signs the transfer.
+type FeeSchedule struct {
+	Slabs      []FeeSlab `json:"slabs"`
+	Collector  string    `json:"collector"`
+	DebitBuyer bool      `json:"debitBuyer"`
+}
+
+// FeeReceipt records the fee due on one transfer. Paid tells whether it was debited in
+// the same transaction; otherwise the authority collects it off-chain.
+type FeeReceipt struct {
+	TxID      string `json:"txID"`
+	BikeKey   string `json:"bikeKey"`
+	Seller    string `json:"seller"`
+	Buyer     string `json:"buyer"`
+	Price     int64  `json:"price"`
+	Fee       int64  `json:"fee"`
+	Slab      int    `json:"slab"`
+	Paid      bool   `json:"paid"`
+	Collector string `json:"collector,omitempty"`
+	ChargedAt int64  `json:"chargedAt"`
+}
+
+func (f FeeSchedule) validate() error {
+	for i, slab := range f.Slabs {
+		if slab.Flat < 0 || slab.RateBps < 0 || slab.UpTo < 0 {
+			return invalidArgs("transferFees slab %d cannot have negative values", i)
+		}
+		if slab.UpTo == 0 && i != len(f.Slabs)-1 {
+			return invalidArgs("transferFees slab %d is unbounded but not the last", i)
+		}
+		if i > 0 && slab.UpTo != 0 && slab.UpTo <= f.Slabs[i-1].UpTo {
+			return invalidArgs("transferFees slabs must be in ascending order of upTo")
+		}
+	}
+	if f.DebitBuyer && f.Collector == "" {
+		return invalidArgs("transferFees needs a collector to debit buyers")
+	}
+	return nil
+}
+
+// fee returns the fee due on a transfer at price and the index of the slab charged,
+// or -1 if no slab covers the price
+func (f FeeSchedule) fee(price int64) (int64, int) {
+	for i, slab := range f.Slabs {
+		if slab.UpTo == 0 || price <= slab.UpTo {
+			// Split the price so the rate cannot overflow int64
+			return slab.Flat + price/10000*slab.RateBps + price%10000*slab.RateBps/10000, i
+		}
+	}
+	return 0, -1
+}
+
+func feeReceiptKey(APIstub shim.ChaincodeStubInterface, txID string, bikeKey string) (string, error) {
+	return APIstub.CreateCompositeKey("FEE", []string{txID, bikeKey})
+}
+
+/*
+ * recordTransferFee writes the fee receipt for handing bikeKey from seller to buyer at price.
+ * The receipt is marked Paid when the schedule debits buyers, tokens are enabled and the
+ * buyer signed the transaction; the caller then has to move Fee from the buyer to the
+ * Collector, in the same payment as anything else the buyer pays, see payFunds.
+ * Without a fee schedule nothing is recorded and the zero receipt is returned.
+ */
+func recordTransferFee(APIstub shim.ChaincodeStubInterface, bikeKey string, seller string, buyer string, price int64, buyerSigned bool) (FeeReceipt, error) {
+	receipt := FeeReceipt{}
+
+	config, err := getConfig(APIstub)
+	if err != nil || len(config.TransferFees.Slabs) == 0 {
+		return receipt, err
+	}
+	schedule := config.TransferFees
+	now, err := txTime(APIstub)
+	if err != nil {
+		return receipt, err
+	}
+
+	receipt = FeeReceipt{
+		TxID:      APIstub.GetTxID(),
+		BikeKey:   bikeKey,
+		Seller:    seller,
+		Buyer:     buyer,
+		Price:     price,
+		ChargedAt: now,
+	}
+	receipt.Fee, receipt.Slab = schedule.fee(price)
+	if receipt.Fee > 0 && schedule.DebitBuyer && buyerSigned && config.featureEnabled(featureTokens) {
+		receipt.Paid = true
+		receipt.Collector = schedule.Collector
+	}
+
+	key, err := feeReceiptKey(APIstub, receipt.TxID, bikeKey)
+	if err != nil {
+		return receipt, err
+	}
+	receiptAsBytes, _ := json.Marshal(receipt)
+	return receipt, APIstub.PutState(key, receiptAsBytes)
+}
+
+// quoteTransferFee returns the fee the current schedule charges on a transfer at a price. Args: price
+func (s *SmartContract) quoteTransferFee(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	price, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || price < 0 {
+		return errorResponse(invalidArgs("Price must be a non-negative integer"))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fee, slab := config.TransferFees.fee(price)
+	receiptAsBytes, _ := json.Marshal(FeeReceipt{Price: price, Fee: fee, Slab: slab})
+	return shim.Success(receiptAsBytes)
+}
+
+// getFeeReceipts returns the fee receipts recorded by a transaction. Args: txID
+func (s *SmartContract) getFeeReceipts(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("FEE", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	receipts := []FeeReceipt{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		receipt := FeeReceipt{}
+		if err := json.Unmarshal(queryResponse.Value, &receipt); err != nil {
+			return errorResponse(err)
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	receiptsAsBytes, _ := json.Marshal(receipts)
+	return shim.Success(receiptsAsBytes)
+}
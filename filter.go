@@ -0,0 +1,208 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// fieldMatch is the condition on one field of a filter: an exact value or a prefix
+type fieldMatch struct {
+	Equals string
+	Prefix string
+	exact  bool
+}
+
+func (m fieldMatch) matches(value string) bool {
+	if m.exact {
+		return value == m.Equals
+	}
+	return strings.HasPrefix(value, m.Prefix)
+}
+
+// parseFilter reads a filter such as {"make": "Honda", "owner": {"$prefix": "Ra"}}.
+// Every key must be a bike field; all conditions have to hold.
+func parseFilter(filterJSON string) (map[string]fieldMatch, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(filterJSON), &raw); err != nil {
+		return nil, invalidArgs("Filter must be a JSON object: %s", err.Error())
+	}
+
+	fields := bikeFieldNames()
+	filter := make(map[string]fieldMatch)
+	for field, condition := range raw {
+		if !fields[field] {
+			return nil, invalidArgs("Unknown bike field %s", field)
+		}
+		var equals string
+		if err := json.Unmarshal(condition, &equals); err == nil {
+			filter[field] = fieldMatch{Equals: equals, exact: true}
+			continue
+		}
+		var prefix struct {
+			Prefix *string `json:"$prefix"`
+		}
+		if err := json.Unmarshal(condition, &prefix); err != nil || prefix.Prefix == nil {
+			return nil, invalidArgs("Condition on %s must be a string or {\"$prefix\": string}", field)
+		}
+		filter[field] = fieldMatch{Prefix: *prefix.Prefix}
+	}
+	return filter, nil
+}
+
+// bikeFieldNames returns the JSON names of the Bike fields
+func bikeFieldNames() map[string]bool {
+	names := make(map[string]bool)
+	bikeType := reflect.TypeOf(Bike{})
+	for i := 0; i < bikeType.NumField(); i++ {
+		name := strings.Split(bikeType.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// mangoSelector renders a filter as a CouchDB query restricted to keys starting with keyPrefix
+func mangoSelector(filter map[string]fieldMatch, keyPrefix string) string {
+	selector := map[string]interface{}{
+		"_id": map[string]string{"$regex": "^" + regexp.QuoteMeta(keyPrefix)},
+	}
+	for field, m := range filter {
+		if m.exact {
+			selector[field] = m.Equals
+		} else {
+			selector[field] = map[string]string{"$regex": "^" + regexp.QuoteMeta(m.Prefix)}
+		}
+	}
+	queryAsBytes, _ := json.Marshal(map[string]interface{}{"selector": selector})
+	return string(queryAsBytes)
+}
+
+// matchesFilter evaluates a filter against a stored bike, for state databases without rich queries
+func matchesFilter(filter map[string]fieldMatch, bikeAsBytes []byte) bool {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(bikeAsBytes, &fields); err != nil {
+		return false
+	}
+	for field, m := range filter {
+		value, ok := fields[field]
+		if !ok {
+			value = ""
+		}
+		if !m.matches(fmt.Sprint(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * queryBikesByFilter returns the bikes matching every condition of a JSON filter, e.g.
+ * {"make": "Honda", "colour": "blue", "owner": {"$prefix": "Ra"}}.
+ * On CouchDB the filter runs as a Mango query; on LevelDB, which has no rich queries,
+ * the bike range is scanned and filtered here instead.
+ * Optional pageSize and bookmark args return one page at a time as PagedResults. On LevelDB
+ * the page is taken from the bike range before filtering, so it may hold fewer matches.
+ * Pages of the empty filter {}, which lists every bike, tell the total number of bikes
+ * from the counters of countBikes, so dashboards paging the fleet need no count of their own.
+ * Args: filter[, pageSize[, bookmark[, fields]]], with an empty pageSize for all matches at once
+ */
+func (s *SmartContract) queryBikesByFilter(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	filter, err := parseFilter(args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	// Owners are matched as they are recorded; prefixes of pseudonyms match nothing useful
+	if owner, ok := filter["owner"]; ok && owner.exact {
+		if owner.Equals, err = ownerRef(APIstub, owner.Equals); err != nil {
+			return errorResponse(err)
+		}
+		filter["owner"] = owner
+	}
+	fields, err := parseFields(args, 3)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	prefix, err := scopedKeyPrefix(APIstub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
+	selector := mangoSelector(filter, prefix)
+	startKey, endKey := prefix, prefixRangeEnd(prefix)
+
+	paged := len(args) > 1 && args[1] != ""
+	var pageSize int32
+	bookmark := ""
+	if paged {
+		pageSize, err = parsePageSize(args[1])
+		if err != nil {
+			return errorResponse(err)
+		}
+		if len(args) > 2 {
+			bookmark = args[2]
+		}
+	}
+
+	var resultsIterator shim.StateQueryIteratorInterface
+	var metadata *sc.QueryResponseMetadata
+	if paged {
+		resultsIterator, metadata, err = APIstub.GetQueryResultWithPagination(selector, pageSize, bookmark)
+	} else {
+		resultsIterator, err = APIstub.GetQueryResult(selector)
+	}
+	scanned := false
+	if err != nil {
+		if paged {
+			resultsIterator, metadata, err = APIstub.GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+		} else {
+			resultsIterator, err = APIstub.GetStateByRange(startKey, endKey)
+		}
+		if err != nil {
+			return errorResponse(err)
+		}
+		scanned = true
+	}
+	defer resultsIterator.Close()
+
+	results, err := collectResults(resultsIterator, func(queryResponse *queryresult.KV) bool {
+		return !scanned || matchesFilter(filter, queryResponse.Value)
+	})
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	projectResults(results, fields)
+	if paged && len(filter) == 0 {
+		tenant, err := callerTenant(APIstub, config)
+		if err != nil {
+			return errorResponse(err)
+		}
+		total, err := getBikeCount(APIstub, tenant)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return countedPagedResponse(results, metadata, &total)
+	}
+	if paged {
+		return pagedResponse(results, metadata)
+	}
+	return resultsResponse(results)
+}
@@ -0,0 +1,175 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// fitnessExpiredEvent is the chaincode event set when a bike whose fitness certificate
+// has run out is transferred
+const fitnessExpiredEvent = "FitnessCertificateExpired"
+
+// FitnessCertificate is an emission or fitness certificate a testing authority issued for a bike
+type FitnessCertificate struct {
+	BikeKey  string `json:"bikeKey"`
+	CertID   string `json:"certID"`
+	IssuedBy string `json:"issuedBy"`
+	IssuedAt int64  `json:"issuedAt"`
+	Expiry   int64  `json:"expiry"`
+}
+
+// FitnessExpiredAlert is the payload of the FitnessCertificateExpired event
+type FitnessExpiredAlert struct {
+	BikeKey   string `json:"bikeKey"`
+	Function  string `json:"function"`
+	CertID    string `json:"certID"`
+	ExpiredAt int64  `json:"expiredAt"`
+	AlertedAt int64  `json:"alertedAt"`
+}
+
+func fitnessKey(APIstub shim.ChaincodeStubInterface, bikeKey string, certID string) (string, error) {
+	return APIstub.CreateCompositeKey("FITNESS", []string{bikeKey, certID})
+}
+
+// getCertificates returns the fitness certificates issued for a bike
+func getCertificates(APIstub shim.ChaincodeStubInterface, bikeKey string) ([]FitnessCertificate, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("FITNESS", []string{bikeKey})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	certs := []FitnessCertificate{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		cert := FitnessCertificate{}
+		if err := json.Unmarshal(queryResponse.Value, &cert); err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// checkFitness raises a FitnessCertificateExpired event if none of the bike's certificates
+// is still valid, and fails instead if the config blocks unfit bikes. Bikes that were never
+// certified pass, as the chaincode cannot tell which of them need a certificate.
+func checkFitness(APIstub shim.ChaincodeStubInterface, key string) error {
+	certs, err := getCertificates(APIstub, key)
+	if err != nil || len(certs) == 0 {
+		return err
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return err
+	}
+	latest := certs[0]
+	for _, cert := range certs[1:] {
+		if cert.Expiry > latest.Expiry {
+			latest = cert
+		}
+	}
+	if latest.Expiry >= now {
+		return nil
+	}
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	if config.BlockUnfit {
+		return fmt.Errorf("Fitness certificate %s of bike %s expired", latest.CertID, key)
+	}
+	function, _ := APIstub.GetFunctionAndParameters()
+	alert := FitnessExpiredAlert{
+		BikeKey:   key,
+		Function:  function,
+		CertID:    latest.CertID,
+		ExpiredAt: latest.Expiry,
+		AlertedAt: now,
+	}
+	alertAsBytes, _ := json.Marshal(alert)
+	return APIstub.SetEvent(fitnessExpiredEvent, alertAsBytes)
+}
+
+/*
+ * issueFitnessCertificate records an emission or fitness certificate for a bike. Only the
+ * testing authority MSPs of the config may issue them, and a certificate ID can be used
+ * once per bike. Args: bikeKey, certID, expiry as a Unix timestamp
+ */
+func (s *SmartContract) issueFitnessCertificate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Certificate ID must not be empty"))
+	}
+	expiry, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errorResponse(invalidArgs("Expiry must be a Unix timestamp"))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, config.TestingAuthorityMSPs); err != nil {
+		return errorResponse(err)
+	}
+	if _, err := getMutableBike(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if expiry <= now {
+		return errorResponse(invalidArgs("Expiry must be in the future"))
+	}
+
+	key, err := fitnessKey(APIstub, args[0], args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	existing, err := APIstub.GetState(key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if existing != nil {
+		return shim.Error(fmt.Sprintf("Certificate %s was already issued for bike %s", args[1], args[0]))
+	}
+	issuer, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	cert := FitnessCertificate{BikeKey: args[0], CertID: args[1], IssuedBy: issuer, IssuedAt: now, Expiry: expiry}
+	certAsBytes, _ := json.Marshal(cert)
+	if err := APIstub.PutState(key, certAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(certAsBytes)
+}
+
+// getCertificates returns the fitness certificates of a bike, expired ones included. Args: bikeKey
+func (s *SmartContract) getCertificates(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	certs, err := getCertificates(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	certsAsBytes, _ := json.Marshal(certs)
+	return shim.Success(certsAsBytes)
+}
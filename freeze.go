@@ -0,0 +1,95 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// getMutableBike loads a bike for a change, failing if it is frozen under a legal hold.
+// Every function that changes a bike or attaches records to it loads it through here.
+func getMutableBike(APIstub shim.ChaincodeStubInterface, key string) (Bike, error) {
+	bike, err := getBike(APIstub, key)
+	if err != nil {
+		return bike, err
+	}
+	if err := assertNotFrozen(key, bike); err != nil {
+		return bike, err
+	}
+	return bike, nil
+}
+
+func assertNotFrozen(key string, bike Bike) error {
+	if bike.FrozenBy != "" {
+		return fmt.Errorf("Bike %s is frozen by %s: %s", key, bike.FrozenBy, bike.FreezeReason)
+	}
+	return nil
+}
+
+/*
+ * freezeBike puts a bike under a legal hold: until unfreezeBike it cannot change hands or
+ * be changed in any other way. Only identities with the role=authority attribute may freeze.
+ * Args: key, reason
+ */
+func (s *SmartContract) freezeBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertRole(APIstub, "authority"); err != nil {
+		return errorResponse(err)
+	}
+	if args[1] == "" {
+		return errorResponse(invalidArgs("A reason for the freeze is required"))
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	authority, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	bike.FrozenBy = authority
+	bike.FreezeReason = args[1]
+	bike.FrozenAt = now
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	bikeAsBytes, _ := json.Marshal(bike)
+	return shim.Success(bikeAsBytes)
+}
+
+// unfreezeBike lifts the legal hold on a bike. Only identities with the role=authority attribute may unfreeze.
+func (s *SmartContract) unfreezeBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertRole(APIstub, "authority"); err != nil {
+		return errorResponse(err)
+	}
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if bike.FrozenBy == "" {
+		return shim.Error("Bike " + args[0] + " is not frozen")
+	}
+
+	bike.FrozenBy = ""
+	bike.FreezeReason = ""
+	bike.FrozenAt = 0
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	bikeAsBytes, _ := json.Marshal(bike)
+	return shim.Success(bikeAsBytes)
+}
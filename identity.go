@@ -0,0 +1,158 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// clientIdentity returns the identity that signed the transaction. It is a variable so the
+// tests can stand in identities, which the shim's MockStub cannot carry.
+var clientIdentity = func(APIstub shim.ChaincodeStubInterface) (cid.ClientIdentity, error) {
+	return cid.New(APIstub)
+}
+
+// getInvokerID returns the enrollment ID of the identity that signed the transaction.
+// Enrollment IDs are only unique within an organization, so owners are recorded by the
+// qualified ID of getInvokerQualifiedID and ownership checks compare against getInvokerRef.
+func getInvokerID(APIstub shim.ChaincodeStubInterface) (string, error) {
+	identity, err := clientIdentity(APIstub)
+	if err != nil {
+		return "", err
+	}
+	id, found, err := identity.GetAttributeValue("hf.EnrollmentID")
+	if err != nil {
+		return "", err
+	}
+	if !found || id == "" {
+		return "", unauthorized("Invoking identity has no enrollment ID")
+	}
+	return id, nil
+}
+
+// getInvokerQualifiedID returns the invoker as <mspID>/<enrollmentID>, which no identity
+// of another organization can share
+func getInvokerQualifiedID(APIstub shim.ChaincodeStubInterface) (string, error) {
+	id, err := getInvokerID(APIstub)
+	if err != nil {
+		return "", err
+	}
+	mspID, err := getInvokerMSP(APIstub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + id, nil
+}
+
+// getInvokerMSP returns the organization of the identity that signed the transaction
+func getInvokerMSP(APIstub shim.ChaincodeStubInterface) (string, error) {
+	identity, err := clientIdentity(APIstub)
+	if err != nil {
+		return "", err
+	}
+	return identity.GetMSPID()
+}
+
+// qualifyOwner returns the owner named id as <mspID>/<enrollmentID>. A bare enrollment ID
+// stands for the identity of that name in the invoker's own organization; qualified IDs
+// and pseudonyms are returned as they are.
+func qualifyOwner(APIstub shim.ChaincodeStubInterface, id string) (string, error) {
+	if id == "" || isPseudonym(id) || strings.Contains(id, "/") {
+		return id, nil
+	}
+	mspID, err := getInvokerMSP(APIstub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + id, nil
+}
+
+// getInvokerRef returns the invoker as owners are recorded: by qualified ID, or by its
+// pseudonym if the config says so. Checks against owners and the parties of records
+// compare against this.
+func getInvokerRef(APIstub shim.ChaincodeStubInterface) (string, error) {
+	id, err := getInvokerQualifiedID(APIstub)
+	if err != nil {
+		return "", err
+	}
+	return ownerPseudonym(APIstub, id)
+}
+
+// assertRole fails unless the invoking identity carries the attribute role=<role>
+func assertRole(APIstub shim.ChaincodeStubInterface, role string) error {
+	identity, err := clientIdentity(APIstub)
+	if err != nil {
+		return err
+	}
+	if err := identity.AssertAttributeValue("role", role); err != nil {
+		return unauthorized("Invoking identity does not have the %s role", role)
+	}
+	return nil
+}
+
+// assertOwner fails unless the invoking identity owns the bike stored under key
+func assertOwner(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	invoker, err := getInvokerRef(APIstub)
+	if err != nil {
+		return err
+	}
+	if invoker != bike.Owner {
+		return unauthorized("Only the owner of %s can do this", key)
+	}
+	return nil
+}
+
+// assertMSP fails unless the invoking identity belongs to the organization mspID
+func assertMSP(APIstub shim.ChaincodeStubInterface, mspID string) error {
+	identity, err := clientIdentity(APIstub)
+	if err != nil {
+		return err
+	}
+	invokerMSP, err := identity.GetMSPID()
+	if err != nil {
+		return err
+	}
+	if invokerMSP != mspID {
+		return unauthorized("Only members of %s can do this", mspID)
+	}
+	return nil
+}
+
+// getInvokerLabel identifies the invoker across organizations as <mspID>/<enrollmentID>,
+// the qualified ID owners are recorded by. Identities issued without an enrollment ID
+// attribute fall back to their X.509 based ID. Labels are written to the world state, so
+// with owner pseudonyms on the qualified ID is pseudonymized, see identityLabel.
+func getInvokerLabel(APIstub shim.ChaincodeStubInterface) (string, error) {
+	identity, err := clientIdentity(APIstub)
+	if err != nil {
+		return "", err
+	}
+	mspID, err := identity.GetMSPID()
+	if err != nil {
+		return "", err
+	}
+	id, err := getInvokerID(APIstub)
+	if err != nil {
+		id, err = identity.GetID()
+		if err != nil {
+			return "", err
+		}
+	}
+	return identityLabel(APIstub, mspID, id)
+}
+
+// identityLabel returns the label of the identity id of mspID: <mspID>/<id>, or
+// <mspID>/<pseudonym of mspID/id> with owner pseudonyms on
+func identityLabel(APIstub shim.ChaincodeStubInterface, mspID string, id string) (string, error) {
+	qualified := mspID + "/" + id
+	ref, err := ownerPseudonym(APIstub, qualified)
+	if err != nil || ref == qualified {
+		return qualified, err
+	}
+	return mspID + "/" + ref, nil
+}
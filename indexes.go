@@ -0,0 +1,270 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// bikeIndex is a secondary index over an attribute of bikes. Entries of plain indexes are
+// composite keys objectType~attribute~bikeKey, so the bikes sharing a value are listed by
+// partial key. Entries of unique indexes are objectType~attribute, holding the bike key.
+type bikeIndex struct {
+	objectType string
+	attribute  func(bike Bike) string
+	unique     bool
+}
+
+// bikeIndexes are kept up to date by putBike, archiveBike and moveBike
+var bikeIndexes = []bikeIndex{
+	{objectType: "OWNERBIKE", attribute: func(bike Bike) string { return bike.Owner }},
+	{objectType: "MAKEBIKE", attribute: func(bike Bike) string { return bike.Make }},
+}
+
+// uniqueBikeIndexes are claimed on registration, see claimRegistrationNo and claimChassisNo
+var uniqueBikeIndexes = []bikeIndex{
+	{objectType: "REGNO", attribute: func(bike Bike) string { return bike.RegistrationNo }, unique: true},
+	{objectType: "CHASSIS", attribute: func(bike Bike) string { return bike.ChassisNo }, unique: true},
+}
+
+// entry returns the state key and value of the entry of bike key with value in the index
+func (index bikeIndex) entry(APIstub shim.ChaincodeStubInterface, value string, key string) (string, []byte, error) {
+	if index.unique {
+		indexKey, err := APIstub.CreateCompositeKey(index.objectType, []string{value})
+		return indexKey, []byte(key), err
+	}
+	indexKey, err := APIstub.CreateCompositeKey(index.objectType, []string{value, key})
+	return indexKey, []byte{0x00}, err
+}
+
+// moveIndex moves bike key from the from entry of a plain index to the to entry.
+// Either may be empty, when the bike is new, goes away or has no value.
+func moveIndex(APIstub shim.ChaincodeStubInterface, index bikeIndex, key string, from string, to string) error {
+	if from != "" {
+		indexKey, _, err := index.entry(APIstub, from, key)
+		if err != nil {
+			return err
+		}
+		if err := APIstub.DelState(indexKey); err != nil {
+			return err
+		}
+	}
+	if to != "" {
+		indexKey, value, err := index.entry(APIstub, to, key)
+		if err != nil {
+			return err
+		}
+		if err := APIstub.PutState(indexKey, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateBikeIndexes moves the entries of bike key in bikeIndexes from the values of
+// previous to those of bike, within the transaction writing it. A zero previous is a new
+// bike, a zero bike one going away. Unchanged entries are rewritten too, so bikes stored
+// before an index existed join it on their next write.
+func updateBikeIndexes(APIstub shim.ChaincodeStubInterface, key string, previous Bike, bike Bike) error {
+	for _, index := range bikeIndexes {
+		from, to := index.attribute(previous), index.attribute(bike)
+		if from == to {
+			from = ""
+		}
+		if err := moveIndex(APIstub, index, key, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IndexRepair is the result of rebuildIndexes
+type IndexRepair struct {
+	Bikes   int `json:"bikes"`
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+}
+
+/*
+ * rebuildIndexes repairs the secondary indexes: it removes the entries of bikes that are
+ * gone or no longer carry the indexed value, and adds those missing for live bikes, such
+ * as bikes written before an index existed. This covers the owner and make indexes, the
+ * registration and chassis numbers and the modified index, whose entries of bikes that
+ * are gone stay as the tombstones getBikesModifiedSince reports. It also resets the bike
+ * counts of countBikes to the bikes found. Only admins may run it.
+ */
+func (s *SmartContract) rebuildIndexes(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, config.AdminMSPs); err != nil {
+		return errorResponse(err)
+	}
+
+	bikes := map[string]Bike{}
+	keys := []string{}
+	for _, tenant := range append([]string{""}, tenantNames(config)...) {
+		found := len(keys)
+		prefix := tenantKeyPrefix(config, tenant)
+		resultsIterator, err := APIstub.GetStateByRange(prefix, prefixRangeEnd(prefix))
+		if err != nil {
+			return errorResponse(err)
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return errorResponse(err)
+			}
+			bike := Bike{}
+			if err := json.Unmarshal(queryResponse.Value, &bike); err != nil {
+				resultsIterator.Close()
+				return shim.Error("Record " + queryResponse.Key + " is not a bike")
+			}
+			bikes[queryResponse.Key] = bike
+			keys = append(keys, queryResponse.Key)
+		}
+		resultsIterator.Close()
+		if err := putBikeCount(APIstub, tenant, len(keys)-found); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	// Deletes are invisible to reads within a transaction, so the pruned entries are tracked here
+	pruned := map[string]bool{}
+	indexes := append(append([]bikeIndex{}, bikeIndexes...), uniqueBikeIndexes...)
+	for _, index := range indexes {
+		if err := pruneIndex(APIstub, index, bikes, pruned); err != nil {
+			return errorResponse(err)
+		}
+	}
+	if err := pruneModifiedIndex(APIstub, bikes, pruned); err != nil {
+		return errorResponse(err)
+	}
+	repair := IndexRepair{Bikes: len(keys), Removed: len(pruned)}
+
+	for _, key := range keys {
+		bike := bikes[key]
+		for _, index := range indexes {
+			value := index.attribute(bike)
+			if value == "" {
+				continue
+			}
+			indexKey, entry, err := index.entry(APIstub, value, key)
+			if err != nil {
+				return errorResponse(err)
+			}
+			added, err := putMissing(APIstub, indexKey, entry, index.unique, pruned)
+			if err != nil {
+				return errorResponse(err)
+			}
+			if added {
+				repair.Added++
+			}
+		}
+		added, err := putMissing(APIstub, modifiedKey(bike.LastModifiedAt, key), []byte{0x00}, false, pruned)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if added {
+			repair.Added++
+		}
+	}
+
+	repairAsBytes, _ := json.Marshal(repair)
+	return shim.Success(repairAsBytes)
+}
+
+// pruneIndex deletes the entries of index that do not match a live bike, adding them to pruned
+func pruneIndex(APIstub shim.ChaincodeStubInterface, index bikeIndex, bikes map[string]Bike, pruned map[string]bool) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(index.objectType, []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return err
+		}
+		key := string(queryResponse.Value)
+		if !index.unique && len(attributes) > 1 {
+			key = attributes[1]
+		}
+		if bike, ok := bikes[key]; ok && len(attributes) > 0 && index.attribute(bike) == attributes[0] {
+			continue
+		}
+		if err := APIstub.DelState(queryResponse.Key); err != nil {
+			return err
+		}
+		pruned[queryResponse.Key] = true
+	}
+	return nil
+}
+
+// pruneModifiedIndex deletes the entries of live bikes other than their latest one, adding
+// them to pruned. Entries of bikes that are gone are kept.
+func pruneModifiedIndex(APIstub shim.ChaincodeStubInterface, bikes map[string]Bike, pruned map[string]bool) error {
+	resultsIterator, err := APIstub.GetStateByRange(modifiedIndexPrefix, prefixRangeEnd(modifiedIndexPrefix))
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		// The key follows the timestamp and its separator
+		entry := strings.TrimPrefix(queryResponse.Key, modifiedIndexPrefix)
+		if len(entry) <= 13 {
+			continue
+		}
+		bike, ok := bikes[entry[13:]]
+		if !ok {
+			continue
+		}
+		if modifiedAt, err := strconv.ParseInt(entry[:12], 10, 64); err == nil && modifiedAt == bike.LastModifiedAt {
+			continue
+		}
+		if err := APIstub.DelState(queryResponse.Key); err != nil {
+			return err
+		}
+		pruned[queryResponse.Key] = true
+	}
+	return nil
+}
+
+// putMissing writes value under key unless the key already holds it, and reports whether
+// it wrote. An entry of a unique index held by another bike is left to it.
+func putMissing(APIstub shim.ChaincodeStubInterface, key string, value []byte, unique bool, pruned map[string]bool) (bool, error) {
+	existing, err := APIstub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	if pruned[key] {
+		existing = nil
+	}
+	if string(existing) == string(value) || (unique && existing != nil) {
+		return false, nil
+	}
+	if pruned[key] {
+		delete(pruned, key)
+	}
+	return true, APIstub.PutState(key, value)
+}
@@ -0,0 +1,270 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	claimOpen    = "OPEN"
+	claimSettled = "SETTLED"
+)
+
+// InsurancePolicy is the cover an insurer has put on a bike. A bike carries at most one.
+type InsurancePolicy struct {
+	BikeKey    string `json:"bikeKey"`
+	PolicyID   string `json:"policyID"`
+	InsurerMSP string `json:"insurerMSP"`
+	Expiry     int64  `json:"expiry"`
+	TxID       string `json:"txID"`
+}
+
+// Claim is a request for payout under a bike's policy. Its ID is the filing transaction ID.
+type Claim struct {
+	ClaimID    string `json:"claimID"`
+	BikeKey    string `json:"bikeKey"`
+	PolicyID   string `json:"policyID"`
+	InsurerMSP string `json:"insurerMSP"`
+	Details    string `json:"details"`
+	Status     string `json:"status"`
+	FiledBy    string `json:"filedBy"`
+	FiledAt    int64  `json:"filedAt"`
+	Payout     int64  `json:"payout"`
+	SettledAt  int64  `json:"settledAt,omitempty"`
+}
+
+func getPolicy(APIstub shim.ChaincodeStubInterface, bikeKey string) (InsurancePolicy, error) {
+	policy := InsurancePolicy{}
+
+	key, err := APIstub.CreateCompositeKey("POLICY", []string{bikeKey})
+	if err != nil {
+		return policy, err
+	}
+	policyAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return policy, err
+	}
+	if policyAsBytes == nil {
+		return policy, notFound("Bike %s has no insurance policy", bikeKey)
+	}
+
+	err = json.Unmarshal(policyAsBytes, &policy)
+	return policy, err
+}
+
+func getClaim(APIstub shim.ChaincodeStubInterface, claimID string) (Claim, error) {
+	claim := Claim{}
+
+	key, err := APIstub.CreateCompositeKey("CLAIM", []string{claimID})
+	if err != nil {
+		return claim, err
+	}
+	claimAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return claim, err
+	}
+	if claimAsBytes == nil {
+		return claim, notFound("Claim %s does not exist", claimID)
+	}
+
+	err = json.Unmarshal(claimAsBytes, &claim)
+	return claim, err
+}
+
+func putClaim(APIstub shim.ChaincodeStubInterface, claim Claim) error {
+	key, err := APIstub.CreateCompositeKey("CLAIM", []string{claim.ClaimID})
+	if err != nil {
+		return err
+	}
+	claimAsBytes, _ := json.Marshal(claim)
+	return APIstub.PutState(key, claimAsBytes)
+}
+
+/*
+ * attachPolicy puts an insurer's policy on a bike, replacing any earlier one.
+ * It must be submitted by a member of the insurer's organization.
+ * Args: bikeKey, policyID, insurerMSP, expiry (Unix seconds)
+ */
+func (s *SmartContract) attachPolicy(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	expiry, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return errorResponse(invalidArgs("Expiry must be Unix seconds"))
+	}
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Policy ID must not be empty"))
+	}
+	if err := requireFeature(APIstub, featureInsurance); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertMSP(APIstub, args[2]); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertCapability(APIstub, capabilityInsure, nil); err != nil {
+		return errorResponse(err)
+	}
+	if _, err := getMutableBike(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+
+	policy := InsurancePolicy{
+		BikeKey:    args[0],
+		PolicyID:   args[1],
+		InsurerMSP: args[2],
+		Expiry:     expiry,
+		TxID:       APIstub.GetTxID(),
+	}
+	key, err := APIstub.CreateCompositeKey("POLICY", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	policyAsBytes, _ := json.Marshal(policy)
+	if err := APIstub.PutState(key, policyAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(policyAsBytes)
+}
+
+// getBikePolicy returns the insurance policy on a bike
+func (s *SmartContract) getBikePolicy(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	policy, err := getPolicy(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	policyAsBytes, _ := json.Marshal(policy)
+	return shim.Success(policyAsBytes)
+}
+
+/*
+ * fileClaim lodges a claim against the policy on a bike. Only the owner may file, and
+ * only while the policy is in force. Args: bikeKey, claimDetails
+ */
+func (s *SmartContract) fileClaim(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	policy, err := getPolicy(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if now > policy.Expiry {
+		return shim.Error(fmt.Sprintf("Policy %s expired", policy.PolicyID))
+	}
+
+	claim := Claim{
+		ClaimID:    APIstub.GetTxID(),
+		BikeKey:    args[0],
+		PolicyID:   policy.PolicyID,
+		InsurerMSP: policy.InsurerMSP,
+		Details:    args[1],
+		Status:     claimOpen,
+		FiledBy:    bike.Owner,
+		FiledAt:    now,
+	}
+	if err := putClaim(APIstub, claim); err != nil {
+		return errorResponse(err)
+	}
+	indexKey, err := APIstub.CreateCompositeKey("CLAIMBYBIKE", []string{args[0], claim.ClaimID})
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.PutState(indexKey, []byte{0x00}); err != nil {
+		return errorResponse(err)
+	}
+
+	claimAsBytes, _ := json.Marshal(claim)
+	return shim.Success(claimAsBytes)
+}
+
+// settleClaim closes an open claim with a payout. Only the insurer's organization may settle.
+// Args: claimID, payout
+func (s *SmartContract) settleClaim(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	payout, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || payout < 0 {
+		return errorResponse(invalidArgs("Payout must be a non-negative integer"))
+	}
+	claim, err := getClaim(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertMSP(APIstub, claim.InsurerMSP); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertCapability(APIstub, capabilityInsure, nil); err != nil {
+		return errorResponse(err)
+	}
+	if claim.Status != claimOpen {
+		return shim.Error(fmt.Sprintf("Claim %s is already %s", args[0], claim.Status))
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	claim.Status = claimSettled
+	claim.Payout = payout
+	claim.SettledAt = now
+	if err := putClaim(APIstub, claim); err != nil {
+		return errorResponse(err)
+	}
+
+	claimAsBytes, _ := json.Marshal(claim)
+	return shim.Success(claimAsBytes)
+}
+
+// getClaims returns every claim filed against a bike
+func (s *SmartContract) getClaims(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("CLAIMBYBIKE", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	claims := []Claim{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return errorResponse(err)
+		}
+		claim, err := getClaim(APIstub, attributes[1])
+		if err != nil {
+			return errorResponse(err)
+		}
+		claims = append(claims, claim)
+	}
+
+	claimsAsBytes, _ := json.Marshal(claims)
+	return shim.Success(claimsAsBytes)
+}
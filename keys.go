@@ -0,0 +1,429 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// bikeKeyDigits keeps generated keys in numeric order under lexical range queries
+	bikeKeyDigits = 6
+	// defaultMigrationLimit bounds how many bikes one migrateBikeKeys call moves
+	defaultMigrationLimit = 100
+)
+
+// bikeRecordTypes are the composite key object types whose first attribute is a bike key.
+// migrateBikeKeys moves these records along with the bike.
+var bikeRecordTypes = []string{"OFFER", "SERVICE", "ODOMETER", "RENTAL", "ACTIVERENTAL", "POLICY", "CLAIMBYBIKE", "TELEMETRY", "DOC", "ACTIVEAUCTION", "LIEN", "RECALLDONE", "APPROVAL", "TRANSFER", "RESERVATION", "PRICE", "FITNESS", "DISPUTEBYBIKE", "COMPONENT", "COMPONENTLOG", "DELEGATE", "ACCIDENT", "SUBSIDY", "WARRANTY", "WARRANTYCLAIM"}
+
+// bikeReferenceTypes are the composite key object types of records kept under IDs of their
+// own that name their bike in the bikeKey field. migrateBikeKeys rewrites the field.
+var bikeReferenceTypes = []string{"CLAIM", "DISPUTE", "LEASE", "AUCTION", "MODREQ"}
+
+// legacyBikeKey matches numeric bike keys written before keys were zero-padded
+func legacyBikeKey(prefix string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "([0-9]+)$")
+}
+
+// bikeKey formats the n-th generated bike key, e.g. BIKE000042
+func bikeKey(prefix string, n int) string {
+	return fmt.Sprintf("%s%0*d", prefix, bikeKeyDigits, n)
+}
+
+// nextBikeKey hands out the next generated key under prefix from a counter on the ledger,
+// skipping keys taken by bikes registered under keys of their own choosing. Concurrent
+// callers read the same counter, so all but one of them fail validation with an MVCC read
+// conflict and can simply retry; two bikes never end up under one key.
+func nextBikeKey(APIstub shim.ChaincodeStubInterface, prefix string) (string, error) {
+	for {
+		seq, err := nextSeq(APIstub, "BIKEKEY", prefix)
+		if err != nil {
+			return "", err
+		}
+		n, err := strconv.Atoi(seq)
+		if err != nil {
+			return "", err
+		}
+		key := bikeKey(prefix, n)
+		exists, err := bikeExists(APIstub, key)
+		if err != nil || !exists {
+			return key, err
+		}
+	}
+}
+
+// prefixRangeEnd returns the range end key that includes every key starting with prefix
+func prefixRangeEnd(prefix string) string {
+	return prefix + string(utf8.MaxRune)
+}
+
+// KeyMigration reports a bike moved by migrateBikeKeys
+type KeyMigration struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+/*
+ * migrateBikeKeys rewrites unpadded numeric keys such as BIKE7 to the padded form BIKE000007,
+ * moving the records attached to the bike and its index entries with it, in every tenant.
+ * If any bike cannot be moved the whole call fails, so no bike is left half moved. Private
+ * accident details are moved too, so it must be endorsed by peers of their collection.
+ * Args: optionally the maximum number of bikes to move; call again until nothing is returned.
+ */
+func (s *SmartContract) migrateBikeKeys(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	limit := defaultMigrationLimit
+	if len(args) == 1 {
+		var err error
+		limit, err = strconv.Atoi(args[0])
+		if err != nil || limit <= 0 {
+			return errorResponse(invalidArgs("Limit must be a positive integer"))
+		}
+	}
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	migrations := []KeyMigration{}
+	for _, tenant := range append([]string{""}, tenantNames(config)...) {
+		if err := migratePrefixKeys(APIstub, tenantKeyPrefix(config, tenant), limit, &migrations); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	migrationsAsBytes, _ := json.Marshal(migrations)
+	return shim.Success(migrationsAsBytes)
+}
+
+// migratePrefixKeys moves the bikes under prefix with unpadded keys until migrations holds limit of them
+func migratePrefixKeys(APIstub shim.ChaincodeStubInterface, prefix string, limit int, migrations *[]KeyMigration) error {
+	if len(*migrations) >= limit {
+		return nil
+	}
+	legacy := legacyBikeKey(prefix)
+
+	resultsIterator, err := APIstub.GetStateByRange(prefix, prefixRangeEnd(prefix))
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() && len(*migrations) < limit {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		match := legacy.FindStringSubmatch(queryResponse.Key)
+		if match == nil {
+			continue
+		}
+		n, err := strconv.Atoi(match[1])
+		if err != nil || bikeKey(prefix, n) == queryResponse.Key {
+			continue
+		}
+		migration := KeyMigration{From: queryResponse.Key, To: bikeKey(prefix, n)}
+		if err := moveBike(APIstub, migration.From, migration.To, queryResponse.Value); err != nil {
+			return err
+		}
+		*migrations = append(*migrations, migration)
+	}
+	return nil
+}
+
+// moveBike re-keys a bike and every record attached to it
+func moveBike(APIstub shim.ChaincodeStubInterface, from string, to string, bikeAsBytes []byte) error {
+	existing, err := APIstub.GetState(to)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("Key %s is already taken", to)
+	}
+
+	bike := Bike{}
+	if err := json.Unmarshal(bikeAsBytes, &bike); err != nil {
+		return err
+	}
+	// Moving counts as a change, so caches syncing by getBikesModifiedSince pick up the new key
+	previousAt := bike.LastModifiedAt
+	if err := stampAudit(APIstub, false, &bike); err != nil {
+		return err
+	}
+	bikeAsBytes, _ = json.Marshal(bike)
+	if err := APIstub.PutState(to, bikeAsBytes); err != nil {
+		return err
+	}
+	if err := APIstub.DelState(from); err != nil {
+		return err
+	}
+	if err := moveModifiedIndex(APIstub, from, previousAt, bike.LastModifiedAt); err != nil {
+		return err
+	}
+	if err := moveModifiedIndex(APIstub, to, 0, bike.LastModifiedAt); err != nil {
+		return err
+	}
+	if err := updateBikeIndexes(APIstub, from, bike, Bike{}); err != nil {
+		return err
+	}
+	if err := updateBikeIndexes(APIstub, to, Bike{}, bike); err != nil {
+		return err
+	}
+	if bike.RegistrationNo != "" {
+		indexKey, err := regNoKey(APIstub, bike.RegistrationNo)
+		if err != nil {
+			return err
+		}
+		if err := APIstub.PutState(indexKey, []byte(to)); err != nil {
+			return err
+		}
+	}
+	if bike.ChassisNo != "" {
+		indexKey, err := chassisKey(APIstub, bike.ChassisNo)
+		if err != nil {
+			return err
+		}
+		if err := APIstub.PutState(indexKey, []byte(to)); err != nil {
+			return err
+		}
+	}
+
+	// Reads do not see this transaction's writes, so the guards and accident details are
+	// found by the old records
+	if err := moveSubsidyChassis(APIstub, from, to, bike); err != nil {
+		return err
+	}
+	if err := rekeyAccidentDetails(APIstub, from, to); err != nil {
+		return err
+	}
+	for _, objectType := range bikeReferenceTypes {
+		if err := rekeyBikeReferences(APIstub, objectType, from, to); err != nil {
+			return err
+		}
+	}
+	if err := moveFeeReceipts(APIstub, from, to); err != nil {
+		return err
+	}
+	if err := rekeyComponentTrails(APIstub, from, to); err != nil {
+		return err
+	}
+
+	for _, objectType := range bikeRecordTypes {
+		if err := moveBikeRecords(APIstub, objectType, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeyRecord returns a record with the bikeKey field it carries set to to. Values that
+// are not JSON objects, such as the marker byte of index entries, are returned as they are.
+func rekeyRecord(recordAsBytes []byte, to string) []byte {
+	record := map[string]json.RawMessage{}
+	if err := json.Unmarshal(recordAsBytes, &record); err != nil {
+		return recordAsBytes
+	}
+	if _, ok := record["bikeKey"]; !ok {
+		return recordAsBytes
+	}
+	record["bikeKey"], _ = json.Marshal(to)
+	recordAsBytes, _ = json.Marshal(record)
+	return recordAsBytes
+}
+
+// moveBikeRecords moves the objectType records of bike from over to bike to, along with
+// their sequence counter, rewriting the bikeKey field they carry
+func moveBikeRecords(APIstub shim.ChaincodeStubInterface, objectType string, from string, to string) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(objectType, []string{from})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return err
+		}
+		attributes[0] = to
+		newKey, err := APIstub.CreateCompositeKey(objectType, attributes)
+		if err != nil {
+			return err
+		}
+
+		if err := APIstub.PutState(newKey, rekeyRecord(queryResponse.Value, to)); err != nil {
+			return err
+		}
+		if err := APIstub.DelState(queryResponse.Key); err != nil {
+			return err
+		}
+	}
+
+	oldCounter, err := APIstub.CreateCompositeKey("SEQ", []string{objectType, from})
+	if err != nil {
+		return err
+	}
+	counterAsBytes, err := APIstub.GetState(oldCounter)
+	if err != nil || counterAsBytes == nil {
+		return err
+	}
+	newCounter, err := APIstub.CreateCompositeKey("SEQ", []string{objectType, to})
+	if err != nil {
+		return err
+	}
+	if err := APIstub.PutState(newCounter, counterAsBytes); err != nil {
+		return err
+	}
+	return APIstub.DelState(oldCounter)
+}
+
+// rekeyBikeReferences points the objectType records of bike from, which are kept under IDs
+// of their own, at bike to. Nothing indexes all of them by bike, so every one is read.
+func rekeyBikeReferences(APIstub shim.ChaincodeStubInterface, objectType string, from string, to string) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(objectType, []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		reference := struct {
+			BikeKey string `json:"bikeKey"`
+		}{}
+		if err := json.Unmarshal(queryResponse.Value, &reference); err != nil {
+			return err
+		}
+		if reference.BikeKey != from {
+			continue
+		}
+		if err := APIstub.PutState(queryResponse.Key, rekeyRecord(queryResponse.Value, to)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveFeeReceipts moves the fee receipts of bike from, which are keyed by transaction ID first
+func moveFeeReceipts(APIstub shim.ChaincodeStubInterface, from string, to string) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("FEE", []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return err
+		}
+		if attributes[1] != from {
+			continue
+		}
+		newKey, err := feeReceiptKey(APIstub, attributes[0], to)
+		if err != nil {
+			return err
+		}
+		if err := APIstub.PutState(newKey, rekeyRecord(queryResponse.Value, to)); err != nil {
+			return err
+		}
+		if err := APIstub.DelState(queryResponse.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeyComponentTrails points the trails of components fitted to bike from, now or before, at bike to
+func rekeyComponentTrails(APIstub shim.ChaincodeStubInterface, from string, to string) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("COMPONENTTRAIL", []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		trail := ComponentTrail{}
+		if err := json.Unmarshal(queryResponse.Value, &trail); err != nil {
+			return err
+		}
+		fitted := trail.BikeKey == from
+		if fitted {
+			trail.BikeKey = to
+		}
+		for i := range trail.Fittings {
+			if trail.Fittings[i].BikeKey == from {
+				trail.Fittings[i].BikeKey = to
+				fitted = true
+			}
+		}
+		if !fitted {
+			continue
+		}
+		if err := putComponentTrail(APIstub, trail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeyAccidentDetails points the private details of the accidents of bike from at bike to.
+// They are kept by accident ID, so they are found by the accident records.
+func rekeyAccidentDetails(APIstub shim.ChaincodeStubInterface, from string, to string) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("ACCIDENT", []string{from})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		accident := Accident{}
+		if err := json.Unmarshal(queryResponse.Value, &accident); err != nil {
+			return err
+		}
+		key, err := APIstub.CreateCompositeKey("ACCIDENTDETAILS", []string{accident.AccidentID})
+		if err != nil {
+			return err
+		}
+		detailsAsBytes, err := APIstub.GetPrivateData(collectionAccidentDetails, key)
+		if err != nil {
+			return err
+		}
+		if detailsAsBytes == nil {
+			continue
+		}
+		if err := APIstub.PutPrivateData(collectionAccidentDetails, key, rekeyRecord(detailsAsBytes, to)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
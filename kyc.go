@@ -0,0 +1,62 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// statusKYCRequired is the response status when a new owner has not passed KYC. Clients
+// can tell it apart from other failures and send the owner through verification first.
+const statusKYCRequired = 403
+
+// KYCRegistry, part of the Config, names the identity verification chaincode consulted
+// before changeBikeOwner accepts a new owner. It must implement isVerified(ownerID)
+// returning the payload "true" or "false". An empty Channel means the channel this
+// chaincode runs on.
+type KYCRegistry struct {
+	Chaincode string `json:"chaincode"`
+	Channel   string `json:"channel"`
+}
+
+// kycError reports a new owner the KYC registry has not verified
+type kycError struct {
+	owner string
+}
+
+func (e kycError) Error() string {
+	return fmt.Sprintf("Owner %s has not passed KYC verification", e.owner)
+}
+
+// assertKYCVerified asks the configured KYC registry about owner and fails with a kycError
+// unless they are verified. Without a registry configured every owner passes; if the
+// registry cannot be reached the check fails rather than letting an unverified owner in.
+func assertKYCVerified(APIstub shim.ChaincodeStubInterface, owner string) error {
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	registry := config.KYCRegistry
+	if registry.Chaincode == "" {
+		return nil
+	}
+	// The registry knows owners by qualified enrollment ID, <mspID>/<enrollmentID>
+	if isPseudonym(owner) {
+		if owner, err = pseudonymOwner(APIstub, owner); err != nil {
+			return err
+		}
+	}
+
+	response := APIstub.InvokeChaincode(registry.Chaincode, [][]byte{[]byte("isVerified"), []byte(owner)}, registry.Channel)
+	if response.Status != shim.OK {
+		return fmt.Errorf("Could not check %s against the KYC registry: %s", owner, response.Message)
+	}
+	if string(response.Payload) != "true" {
+		return kycError{owner: owner}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// statusLeased is the status of a bike while a lease on it runs. Like a rented bike,
+	// it cannot change hands meanwhile.
+	statusLeased = "LEASED"
+
+	leaseActive    = "ACTIVE"
+	leaseCompleted = "COMPLETED"
+
+	// leaseMonthSeconds is the length of a lease month, 30 days
+	leaseMonthSeconds = 30 * 24 * 60 * 60
+	// maxLeaseMonths caps a lease at five years
+	maxLeaseMonths = 60
+)
+
+// Lease is the hire of a bike to a lessee for a number of months, paid monthly in
+// arrears: instalment n falls due n lease months after StartAt. Its ID is the starting
+// transaction ID. It completes once every instalment is paid, freeing the bike.
+type Lease struct {
+	LeaseID       string         `json:"leaseID"`
+	BikeKey       string         `json:"bikeKey"`
+	Lessor        string         `json:"lessor"`
+	LesseeID      string         `json:"lesseeID"`
+	MonthlyAmount int64          `json:"monthlyAmount"`
+	Months        int64          `json:"months"`
+	StartAt       int64          `json:"startAt"`
+	Paid          int64          `json:"paid"`
+	Payments      []LeasePayment `json:"payments"`
+	Status        string         `json:"status"`
+}
+
+// LeasePayment is one payment towards a lease, as recorded by the lessor
+type LeasePayment struct {
+	Amount int64  `json:"amount"`
+	PaidAt int64  `json:"paidAt"`
+	TxID   string `json:"txID"`
+}
+
+// LeaseStatus is a lease as of the time of the query. Due is what the instalments fallen
+// due so far add up to; Overdue is set while less than that has been paid. NextDueAt is
+// when the next unpaid instalment falls due, 0 once all are paid.
+type LeaseStatus struct {
+	Lease
+	AsOf        int64 `json:"asOf"`
+	Due         int64 `json:"due"`
+	Outstanding int64 `json:"outstanding"`
+	Overdue     bool  `json:"overdue"`
+	NextDueAt   int64 `json:"nextDueAt"`
+}
+
+// total is what the lease costs over its whole term
+func (lease Lease) total() int64 {
+	return lease.MonthlyAmount * lease.Months
+}
+
+// status works out what is due on the lease at now
+func (lease Lease) status(now int64) LeaseStatus {
+	status := LeaseStatus{Lease: lease, AsOf: now}
+	fallen := (now - lease.StartAt) / leaseMonthSeconds
+	if fallen > lease.Months {
+		fallen = lease.Months
+	}
+	status.Due = fallen * lease.MonthlyAmount
+	if lease.Status == leaseActive && lease.Paid < status.Due {
+		status.Outstanding = status.Due - lease.Paid
+		status.Overdue = true
+	}
+	if lease.Paid < lease.total() {
+		// The first instalment the payments so far do not cover in full
+		status.NextDueAt = lease.StartAt + (lease.Paid/lease.MonthlyAmount+1)*leaseMonthSeconds
+	}
+	return status
+}
+
+func getLease(APIstub shim.ChaincodeStubInterface, leaseID string) (Lease, error) {
+	lease := Lease{}
+
+	key, err := APIstub.CreateCompositeKey("LEASE", []string{leaseID})
+	if err != nil {
+		return lease, err
+	}
+	leaseAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return lease, err
+	}
+	if leaseAsBytes == nil {
+		return lease, notFound("Lease %s does not exist", leaseID)
+	}
+
+	err = json.Unmarshal(leaseAsBytes, &lease)
+	return lease, err
+}
+
+func putLease(APIstub shim.ChaincodeStubInterface, lease Lease) error {
+	key, err := APIstub.CreateCompositeKey("LEASE", []string{lease.LeaseID})
+	if err != nil {
+		return err
+	}
+	leaseAsBytes, _ := json.Marshal(lease)
+	return APIstub.PutState(key, leaseAsBytes)
+}
+
+/*
+ * startLease leases a bike out to lesseeID for a number of months at a monthly amount.
+ * Only the owner may lease it out. The bike is LEASED, and cannot be transferred or
+ * rented, until the lease is paid off. Args: bikeKey, lesseeID, monthlyAmount, months
+ */
+func (s *SmartContract) startLease(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Lessee ID must not be empty"))
+	}
+	amount, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || amount <= 0 {
+		return errorResponse(invalidArgs("Monthly amount must be a positive integer"))
+	}
+	months, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || months <= 0 || months > maxLeaseMonths {
+		return errorResponse(invalidArgs("Months must be between 1 and %d", maxLeaseMonths))
+	}
+	if err := requireFeature(APIstub, featureLeasing); err != nil {
+		return errorResponse(err)
+	}
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if args[1] == bike.Owner {
+		return errorResponse(invalidArgs("Bike %s is already owned by %s", args[0], args[1]))
+	}
+	if bike.Status != statusActive {
+		return shim.Error(fmt.Sprintf("Bike %s is %s and cannot be leased", args[0], bike.Status))
+	}
+	if err := assertNotReserved(APIstub, args[0], args[1]); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertNotAuctioned(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	lease := Lease{
+		LeaseID:       APIstub.GetTxID(),
+		BikeKey:       args[0],
+		Lessor:        bike.Owner,
+		LesseeID:      args[1],
+		MonthlyAmount: amount,
+		Months:        months,
+		StartAt:       now,
+		Payments:      []LeasePayment{},
+		Status:        leaseActive,
+	}
+	if err := putLease(APIstub, lease); err != nil {
+		return errorResponse(err)
+	}
+	bike.Status = statusLeased
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	leaseAsBytes, _ := json.Marshal(lease)
+	return shim.Success(leaseAsBytes)
+}
+
+/*
+ * recordLeasePayment records a payment the lessor received towards a lease; only the
+ * lessor may record one. Payments may be made ahead of time but not beyond what the lease
+ * costs in total. The payment that settles the lease completes it and makes the bike
+ * ACTIVE again, so no payment is recorded while the bike is frozen: a lease could
+ * otherwise be paid up to its last instalment and then never complete. Args: leaseID, amount
+ */
+func (s *SmartContract) recordLeasePayment(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || amount <= 0 {
+		return errorResponse(invalidArgs("Amount must be a positive integer"))
+	}
+	lease, err := getLease(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if invoker, err := getInvokerRef(APIstub); err != nil || invoker != lease.Lessor {
+		return errorResponse(unauthorized("Only %s can record payments for lease %s", lease.Lessor, args[0]))
+	}
+	if lease.Status != leaseActive {
+		return shim.Error(fmt.Sprintf("Lease %s is already %s", args[0], lease.Status))
+	}
+	if remaining := lease.total() - lease.Paid; amount > remaining {
+		return errorResponse(invalidArgs("Only %d remains to be paid on lease %s", remaining, args[0]))
+	}
+	bike, err := getMutableBike(APIstub, lease.BikeKey)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	lease.Paid += amount
+	lease.Payments = append(lease.Payments, LeasePayment{Amount: amount, PaidAt: now, TxID: APIstub.GetTxID()})
+	if lease.Paid == lease.total() {
+		lease.Status = leaseCompleted
+		bike.Status = statusActive
+		if err := putBike(APIstub, lease.BikeKey, bike); err != nil {
+			return errorResponse(err)
+		}
+	}
+	if err := putLease(APIstub, lease); err != nil {
+		return errorResponse(err)
+	}
+
+	statusAsBytes, _ := json.Marshal(lease.status(now))
+	return shim.Success(statusAsBytes)
+}
+
+// getLeaseStatus returns a lease with what is due on it as of the transaction time, see LeaseStatus. Args: leaseID
+func (s *SmartContract) getLeaseStatus(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	lease, err := getLease(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	statusAsBytes, _ := json.Marshal(lease.status(now))
+	return shim.Success(statusAsBytes)
+}
@@ -0,0 +1,196 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Lien is a lender's claim on a bike financed by a lease or loan. While it is in place the
+// bike only changes hands to an owner the lender approved, and the lien stays on the bike.
+type Lien struct {
+	BikeKey      string `json:"bikeKey"`
+	LenderMSP    string `json:"lenderMSP"`
+	Amount       int64  `json:"amount"`
+	RegisteredBy string `json:"registeredBy"`
+	RegisteredAt int64  `json:"registeredAt"`
+	ApprovedTo   string `json:"approvedTo,omitempty"`
+}
+
+func lienKey(APIstub shim.ChaincodeStubInterface, bikeKey string) (string, error) {
+	return APIstub.CreateCompositeKey("LIEN", []string{bikeKey})
+}
+
+// getLien returns the lien on a bike, or nil if it has none
+func getLien(APIstub shim.ChaincodeStubInterface, bikeKey string) (*Lien, error) {
+	key, err := lienKey(APIstub, bikeKey)
+	if err != nil {
+		return nil, err
+	}
+	lienAsBytes, err := APIstub.GetState(key)
+	if err != nil || lienAsBytes == nil {
+		return nil, err
+	}
+
+	lien := Lien{}
+	err = json.Unmarshal(lienAsBytes, &lien)
+	return &lien, err
+}
+
+func putLien(APIstub shim.ChaincodeStubInterface, lien Lien) error {
+	key, err := lienKey(APIstub, lien.BikeKey)
+	if err != nil {
+		return err
+	}
+	lienAsBytes, _ := json.Marshal(lien)
+	return APIstub.PutState(key, lienAsBytes)
+}
+
+// assertLienApproved fails if a lien on the bike forbids handing it to newOwner, and
+// returns the lien if there is one
+func assertLienApproved(APIstub shim.ChaincodeStubInterface, bikeKey string, newOwner string) (*Lien, error) {
+	lien, err := getLien(APIstub, bikeKey)
+	if err != nil || lien == nil {
+		return nil, err
+	}
+	if lien.ApprovedTo != newOwner {
+		return lien, fmt.Errorf("Bike %s is encumbered by a lien of %s, who has not approved a transfer to %s", bikeKey, lien.LenderMSP, newOwner)
+	}
+	return lien, nil
+}
+
+// consumeLienApproval fails if a lien on the bike forbids handing it to newOwner.
+// An approval is good for one transfer, so it is cleared here.
+func consumeLienApproval(APIstub shim.ChaincodeStubInterface, bikeKey string, newOwner string) error {
+	lien, err := assertLienApproved(APIstub, bikeKey, newOwner)
+	if err != nil || lien == nil {
+		return err
+	}
+
+	lien.ApprovedTo = ""
+	return putLien(APIstub, *lien)
+}
+
+/*
+ * registerLien records that the bike was financed by lenderMSP. The owner registers it,
+ * as part of taking the loan; only the lender can release it.
+ * Args: bikeKey, lenderMSP, amount
+ */
+func (s *SmartContract) registerLien(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Lender MSP must not be empty"))
+	}
+	amount, err := parseAmount(args[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	existing, err := getLien(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if existing != nil {
+		return shim.Error(fmt.Sprintf("Bike %s already has a lien of %s", args[0], existing.LenderMSP))
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	lien := Lien{
+		BikeKey:      args[0],
+		LenderMSP:    args[1],
+		Amount:       amount,
+		RegisteredBy: bike.Owner,
+		RegisteredAt: now,
+	}
+	if err := putLien(APIstub, lien); err != nil {
+		return errorResponse(err)
+	}
+
+	lienAsBytes, _ := json.Marshal(lien)
+	return shim.Success(lienAsBytes)
+}
+
+/*
+ * approveLienTransfer lets the next transfer of an encumbered bike go to newOwner.
+ * Only the lender may approve. Args: bikeKey, newOwner
+ */
+func (s *SmartContract) approveLienTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	lien, err := getLien(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if lien == nil {
+		return errorResponse(notFound("Bike %s has no lien", args[0]))
+	}
+	if err := assertMSP(APIstub, lien.LenderMSP); err != nil {
+		return errorResponse(err)
+	}
+
+	lien.ApprovedTo = args[1]
+	if err := putLien(APIstub, *lien); err != nil {
+		return errorResponse(err)
+	}
+
+	lienAsBytes, _ := json.Marshal(lien)
+	return shim.Success(lienAsBytes)
+}
+
+// releaseLien removes the lien once the loan is repaid. Only the lender may release it.
+func (s *SmartContract) releaseLien(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	lien, err := getLien(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if lien == nil {
+		return errorResponse(notFound("Bike %s has no lien", args[0]))
+	}
+	if err := assertMSP(APIstub, lien.LenderMSP); err != nil {
+		return errorResponse(err)
+	}
+
+	key, err := lienKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.DelState(key); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// getLien returns the lien on a bike
+func (s *SmartContract) getLien(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	lien, err := getLien(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if lien == nil {
+		return errorResponse(notFound("Bike %s has no lien", args[0]))
+	}
+
+	lienAsBytes, _ := json.Marshal(lien)
+	return shim.Success(lienAsBytes)
+}
@@ -0,0 +1,89 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// logLevelEnv names the environment variable that sets the log level of the chaincode
+// process. It wins over the logLevel of the Config, so a peer operator can always turn
+// debug output on or off for their own peer.
+const logLevelEnv = "FABBIKE_LOG_LEVEL"
+
+var logger = shim.NewLogger("fabbike")
+
+// appliedLogLevel is the level logger was last set to, "" while it has its default
+var appliedLogLevel string
+
+// logLevelLoaded tells whether this process has read the log level of the Config yet
+var logLevelLoaded bool
+
+// configureLogging sets the level of logger from the environment, or else from level, the
+// logLevel of the Config. Levels are those of the shim: DEBUG, INFO, NOTICE, WARNING,
+// ERROR and CRITICAL. Unknown levels leave the current one in place.
+func configureLogging(level string) {
+	if env := os.Getenv(logLevelEnv); env != "" {
+		level = env
+	}
+	level = strings.ToUpper(level)
+	if level == "" || level == appliedLogLevel {
+		return
+	}
+	parsed, err := shim.LogLevel(level)
+	if err != nil {
+		logger.Warningf("Ignoring unknown log level %s", level)
+		return
+	}
+	logger.SetLevel(parsed)
+	appliedLogLevel = level
+}
+
+// loadLogLevel applies the logLevel of the Config the first time the process runs a
+// transaction. Later changes apply where setConfig is endorsed, and elsewhere once the
+// chaincode restarts.
+func loadLogLevel(APIstub shim.ChaincodeStubInterface) {
+	if logLevelLoaded {
+		return
+	}
+	logLevelLoaded = true
+	config, err := getConfig(APIstub)
+	if err != nil {
+		logger.Warningf("Cannot read the log level: %s", err.Error())
+		return
+	}
+	configureLogging(config.LogLevel)
+}
+
+// txLogger writes to logger with the transaction ID and function name in front of every
+// line, so the lines of one transaction can be picked out of a busy peer's log
+type txLogger struct {
+	prefix string
+}
+
+// txLog returns the logger for the transaction APIstub runs
+func txLog(APIstub shim.ChaincodeStubInterface) txLogger {
+	function, _ := APIstub.GetFunctionAndParameters()
+	return txLogger{prefix: "[" + APIstub.GetTxID() + " " + function + "] "}
+}
+
+func (l txLogger) Debugf(format string, args ...interface{}) {
+	logger.Debugf(l.prefix+format, args...)
+}
+
+func (l txLogger) Infof(format string, args ...interface{}) {
+	logger.Infof(l.prefix+format, args...)
+}
+
+func (l txLogger) Warningf(format string, args ...interface{}) {
+	logger.Warningf(l.prefix+format, args...)
+}
+
+func (l txLogger) Errorf(format string, args ...interface{}) {
+	logger.Errorf(l.prefix+format, args...)
+}
@@ -0,0 +1,303 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// contractVersion is the version of the functions the contract offers, as
+// getContractMetadata reports it. Bump it when a function or its arguments change.
+const contractVersion = "1.0.0"
+
+// routeArgs names the arguments of every route, in order, for getContractMetadata. A name
+// may carry the kind of value after a colon, string if none: integer, number, timestamp
+// (Unix seconds), json, sha256 (a hex SHA-256 digest) or owner (an enrollment ID, see qualifyOwner, or owner
+// pseudonym, see pseudonymizeOwners). Arguments past MinArgs are optional; the last
+// argument of a route taking any number of arguments may repeat.
+var routeArgs = map[string][]string{
+	"queryBike":         {"key", "fields:json"},
+	"bikeExists":        {"key"},
+	"initLedger":        {},
+	"createBike":        {"key", "make", "model", "colour", "owner:owner", "registrationNo", "chassisNo"},
+	"createBikeAutoKey": {"make", "model", "colour", "owner:owner", "registrationNo", "chassisNo"},
+	"createBikesBatch":  {"bikes:json"},
+	"createVehicle":     {"key", "vehicle:json"},
+	"updateBike":        {"key", "expectedVersion:integer", "update:json"},
+	"patchBike":         {"key", "patch:json", "expectedVersion:integer"},
+
+	"requestModification":     {"bikeKey", "patch:json"},
+	"approveModification":     {"requestID"},
+	"rejectModification":      {"requestID", "reason"},
+	"getPendingModifications": {"bikeKey"},
+
+	"queryAllBikes":         {"includeArchived", "fields:json"},
+	"getBikesByRange":       {"startKey", "endKey", "fields:json"},
+	"exportLedger":          {"startKey", "endKey", "format", "pageSize:integer", "bookmark"},
+	"getBikesModifiedSince": {"since:timestamp", "pageSize:integer", "bookmark"},
+	"getCreationQuota":      {"creator"},
+
+	"archiveBike":       {"key"},
+	"restoreBike":       {"key"},
+	"queryArchivedBike": {"key"},
+
+	"freezeBike":   {"key", "reason"},
+	"unfreezeBike": {"key"},
+
+	"changeBikeOwner":    {"key", "newOwner:owner", "expectedVersion:integer"},
+	"offerTransfer":      {"key", "newOwner:owner", "price:integer", "ttlSeconds:integer", "expectedVersion:integer"},
+	"acceptTransfer":     {"bikeKey", "offerHash:sha256"},
+	"queryTransferOffer": {"bikeKey"},
+	"validateTransfer":   {"bikeKey", "newOwner:owner"},
+
+	"grantDelegate":  {"bikeKey", "delegateID:owner", "expiry:timestamp"},
+	"revokeDelegate": {"bikeKey", "delegateID:owner"},
+	"getDelegates":   {"bikeKey"},
+
+	"transferBikesBatch": {"newOwner:owner", "keys:json"},
+	"getTransferLog":     {"bikeKey"},
+
+	"recordSalePrice": {"bikeKey", "price:integer", "currency"},
+	"getPriceHistory": {"bikeKey"},
+	"estimateValue":   {"bikeKey"},
+
+	"registerConsentCert": {},
+	"buildConsentPayload": {"bikeKey", "newOwner:owner", "expiresAt:timestamp"},
+
+	"reserveBike":       {"bikeKey", "until:timestamp", "reservedFor:owner"},
+	"cancelReservation": {"bikeKey"},
+	"getReservation":    {"bikeKey"},
+
+	"addServiceRecord":  {"bikeKey", "date", "odometer:integer", "workshopID", "description"},
+	"getServiceRecords": {"bikeKey"},
+	"recordOdometer":    {"bikeKey", "reading:integer", "timestamp:timestamp"},
+	"getOdometer":       {"bikeKey"},
+
+	"issueRecall":         {"make", "model", "recallID", "description"},
+	"markRecallCompleted": {"bikeKey", "recallID"},
+	"getOpenRecalls":      {"bikeKey"},
+
+	"issueFitnessCertificate": {"bikeKey", "certID", "expiry:timestamp"},
+	"getCertificates":         {"bikeKey"},
+
+	"openDispute":    {"bikeKey", "claimantID:owner", "evidenceHash:sha256"},
+	"submitEvidence": {"disputeID", "evidenceHash:sha256"},
+	"resolveDispute": {"disputeID", "winner:owner"},
+	"getDispute":     {"disputeID"},
+	"getDisputes":    {"bikeKey"},
+
+	"addToWatchlist":      {"chassisNo", "description"},
+	"removeFromWatchlist": {"chassisNo"},
+	"checkChassisNo":      {"chassisNo"},
+	"getWatchlist":        {},
+
+	"migrateBikeKeys":           {"limit:integer"},
+	"migrate":                   {"limit:integer"},
+	"rebuildIndexes":            {},
+	"setAssetSchema":            {"assetType", "schema:json"},
+	"getAssetSchema":            {"assetType"},
+	"importFromFabcar":          {"cars:json"},
+	"queryCar":                  {"carKey"},
+	"getSchemaVersion":          {},
+	"queryBikeByRegistrationNo": {"registrationNo", "fields:json"},
+	"queryBikeByChassis":        {"chassisNo", "fields:json"},
+	"getBikeQRPayload":          {"key"},
+	"resolveQRPayload":          {"payload"},
+
+	"rentBike":         {"bikeKey", "renterID:owner", "durationHours:integer"},
+	"returnBike":       {"bikeKey"},
+	"getRentalHistory": {"bikeKey"},
+
+	"replaceComponent":    {"bikeKey", "componentType", "serialNo", "sourceHash:sha256"},
+	"getBikeComponents":   {"bikeKey"},
+	"getComponentLog":     {"bikeKey"},
+	"getComponentHistory": {"componentType", "serialNo"},
+
+	"startLease":         {"bikeKey", "lesseeID:owner", "monthlyAmount:integer", "months:integer"},
+	"recordLeasePayment": {"leaseID", "amount:integer"},
+	"getLeaseStatus":     {"leaseID"},
+
+	"startAuction": {"bikeKey", "reservePrice:integer", "endTime:timestamp"},
+	"placeBid":     {"auctionID"},
+	"revealBid":    {"auctionID"},
+	"closeAuction": {"auctionID"},
+	"queryAuction": {"auctionID"},
+	"buyBike":      {"bikeKey", "price:integer", "offerHash:sha256"},
+
+	"quoteTransferFee": {"price:integer"},
+	"getFeeReceipts":   {"txID"},
+
+	"registerLien":        {"bikeKey", "lenderMSP", "amount:integer"},
+	"approveLienTransfer": {"bikeKey", "newOwner:owner"},
+	"releaseLien":         {"bikeKey"},
+	"getLien":             {"bikeKey"},
+
+	"mint":          {"accountID:owner", "amount:integer"},
+	"transferFunds": {"from:owner", "to:owner", "amount:integer"},
+	"getBalance":    {"accountID:owner"},
+
+	"ownerOf":      {"bikeKey"},
+	"balanceOf":    {"owner:owner"},
+	"approve":      {"approved:owner", "bikeKey"},
+	"getApproved":  {"bikeKey"},
+	"transferFrom": {"from:owner", "to:owner", "bikeKey"},
+
+	"setBikeEndorsementPolicy": {"key", "mspID"},
+	"getBikeEndorsementPolicy": {"key"},
+	"getBikeAudit":             {"key"},
+	"getBikeWithMetadata":      {"key"},
+
+	"attachPolicy":  {"bikeKey", "policyID", "insurerMSP", "expiry:timestamp"},
+	"getBikePolicy": {"bikeKey"},
+	"fileClaim":     {"bikeKey", "claimDetails"},
+	"settleClaim":   {"claimID", "payout:integer"},
+	"getClaims":     {"bikeKey"},
+
+	"reportAccident":     {"bikeKey", "severity", "locationHash:sha256", "policeRefNo"},
+	"getAccidentHistory": {"bikeKey"},
+	"getAccidentDetails": {"accidentID"},
+
+	"applySubsidy": {"bikeKey", "schemeID", "amount:integer"},
+	"getSubsidies": {"bikeKey"},
+
+	"registerWarranty":  {"bikeKey", "warrantyTermMonths:integer"},
+	"checkWarranty":     {"bikeKey"},
+	"fileWarrantyClaim": {"bikeKey", "issue"},
+
+	"registerOwner":   {"id", "name", "contact", "kycHash:sha256"},
+	"updateOwner":     {"id", "name", "contact", "kycHash:sha256"},
+	"getOwnerProfile": {"ownerID"},
+	"purgeOwnerPII":   {"ownerID"},
+
+	"getConfig": {},
+	"setConfig": {"config:json"},
+
+	"queryBikesByFilter": {"filter:json", "pageSize:integer", "bookmark", "fields:json"},
+	"queryWithSelector":  {"selector:json", "pageSize:integer", "bookmark"},
+	"recordTelemetry":    {"bikeKey", "lat:number", "lon:number", "lockState", "batteryPct:integer", "ts:timestamp"},
+	"getLatestTelemetry": {"bikeKey"},
+
+	"attachDocument": {"bikeKey", "docType", "sha256:sha256", "uri"},
+	"verifyDocument": {"bikeKey", "docType", "sha256:sha256"},
+	"revokeDocument": {"bikeKey", "docType", "sha256:sha256"},
+	"listDocuments":  {"bikeKey", "docType"},
+
+	"getMetrics":        {"function"},
+	"countBikes":        {},
+	"compactBikeCounts": {},
+	"getBikeStats":      {"groupBy"},
+
+	"queryAllTenants": {"tenant"},
+
+	"continueQuery": {"continuation"},
+
+	"setOrganization":    {"mspID", "organization:json"},
+	"removeOrganization": {"mspID"},
+	"getOrganization":    {"mspID"},
+	"getOrganizations":   {},
+
+	"setOwnerSalt":     {},
+	"resolveOwnerHash": {"pseudonym"},
+
+	"getContractMetadata": {},
+}
+
+// ArgMetadata describes one argument of a function
+type ArgMetadata struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Optional bool   `json:"optional,omitempty"`
+	Repeated bool   `json:"repeated,omitempty"`
+}
+
+// FunctionMetadata describes a function callable through Invoke. MaxArgs is -1 when it
+// takes any number of arguments above MinArgs.
+type FunctionMetadata struct {
+	Name     string        `json:"name"`
+	MinArgs  int           `json:"minArgs"`
+	MaxArgs  int           `json:"maxArgs"`
+	ReadOnly bool          `json:"readOnly"`
+	Raw      bool          `json:"raw,omitempty"`
+	Args     []ArgMetadata `json:"args"`
+}
+
+// ContractMetadata is the answer of getContractMetadata
+type ContractMetadata struct {
+	Chaincode       string             `json:"chaincode"`
+	ContractVersion string             `json:"contractVersion"`
+	SchemaVersion   int                `json:"schemaVersion"`
+	QRVersion       string             `json:"qrVersion"`
+	Functions       []FunctionMetadata `json:"functions"`
+}
+
+// functionArgs describes the arguments of the named route. Routes missing from routeArgs
+// get positional names, so the metadata still shows how many arguments they take.
+func functionArgs(name string, route Route) []ArgMetadata {
+	names, ok := routeArgs[name]
+	if !ok {
+		n := route.MaxArgs
+		if n < 0 {
+			n = route.MinArgs + 1
+		}
+		for i := 0; i < n; i++ {
+			names = append(names, "arg"+strconv.Itoa(i))
+		}
+	}
+
+	args := []ArgMetadata{}
+	for i, argName := range names {
+		arg := ArgMetadata{Name: argName, Kind: "string", Optional: i >= route.MinArgs}
+		if j := strings.Index(argName, ":"); j >= 0 {
+			arg.Name, arg.Kind = argName[:j], argName[j+1:]
+		}
+		if route.MaxArgs < 0 && i == len(names)-1 {
+			arg.Repeated = true
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+/*
+ * getContractMetadata describes the contract for clients and tooling: every function
+ * from the router with the number, names and kinds of the arguments it takes and whether
+ * it writes state, plus the contract, bike schema and QR payload versions. All arguments
+ * are passed as strings; kind says what the string must hold.
+ */
+func (s *SmartContract) getContractMetadata(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	functions := []FunctionMetadata{}
+	for name, route := range s.routes() {
+		functions = append(functions, FunctionMetadata{
+			Name:     name,
+			MinArgs:  route.MinArgs,
+			MaxArgs:  route.MaxArgs,
+			ReadOnly: route.ReadOnly,
+			Raw:      route.Raw,
+			Args:     functionArgs(name, route),
+		})
+	}
+	sort.Slice(functions, func(i, j int) bool { return functions[i].Name < functions[j].Name })
+
+	metadataAsBytes, _ := json.Marshal(ContractMetadata{
+		Chaincode:       config.ChaincodeName,
+		ContractVersion: contractVersion,
+		SchemaVersion:   currentSchemaVersion,
+		QRVersion:       qrVersion,
+		Functions:       functions,
+	})
+	return shim.Success(metadataAsBytes)
+}
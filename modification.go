@@ -0,0 +1,244 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	modificationPending  = "PENDING"
+	modificationApproved = "APPROVED"
+	modificationRejected = "REJECTED"
+)
+
+// ModificationRequest is an owner's request to change what is registered about their bike,
+// e.g. a respray or an engine swap, for a registrar to approve. Patch is a BikeUpdate as
+// updateBike takes it. Its ID is the requesting transaction ID.
+type ModificationRequest struct {
+	RequestID   string          `json:"requestID"`
+	BikeKey     string          `json:"bikeKey"`
+	RequestedBy string          `json:"requestedBy"`
+	Patch       json.RawMessage `json:"patch"`
+	Status      string          `json:"status"`
+	RequestedAt int64           `json:"requestedAt"`
+	DecidedBy   string          `json:"decidedBy,omitempty"`
+	DecidedAt   int64           `json:"decidedAt,omitempty"`
+	Reason      string          `json:"reason,omitempty"`
+}
+
+// assertDirectModification fails if the config requires owners to have changes to a bike
+// approved and the invoker is not a registrar, who may still change bikes directly
+func assertDirectModification(APIstub shim.ChaincodeStubInterface, key string) error {
+	config, err := getConfig(APIstub)
+	if err != nil || !config.ModificationApproval {
+		return err
+	}
+	if err := assertRole(APIstub, "registrar"); err != nil {
+		return unauthorized("Changes to %s need registrar approval; use requestModification", key)
+	}
+	return nil
+}
+
+func getModificationRequest(APIstub shim.ChaincodeStubInterface, requestID string) (ModificationRequest, error) {
+	request := ModificationRequest{}
+
+	key, err := APIstub.CreateCompositeKey("MODREQ", []string{requestID})
+	if err != nil {
+		return request, err
+	}
+	requestAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return request, err
+	}
+	if requestAsBytes == nil {
+		return request, notFound("Modification request %s does not exist", requestID)
+	}
+
+	err = json.Unmarshal(requestAsBytes, &request)
+	return request, err
+}
+
+func putModificationRequest(APIstub shim.ChaincodeStubInterface, request ModificationRequest) error {
+	key, err := APIstub.CreateCompositeKey("MODREQ", []string{request.RequestID})
+	if err != nil {
+		return err
+	}
+	requestAsBytes, _ := json.Marshal(request)
+	return APIstub.PutState(key, requestAsBytes)
+}
+
+// modifiedBike returns bike as patch would change it, failing if the result is not a valid bike
+func modifiedBike(APIstub shim.ChaincodeStubInterface, bike Bike, patch []byte) (Bike, error) {
+	update := BikeUpdate{}
+	if err := json.Unmarshal(patch, &update); err != nil {
+		return bike, invalidArgs("Patch must be a JSON object: %s", err.Error())
+	}
+	applyUpdate(&bike, update)
+	if err := validateAsset(bike); err != nil {
+		return bike, err
+	}
+	return bike, validateAssetSchema(APIstub, bike)
+}
+
+/*
+ * requestModification asks a registrar to change the registered attributes of a bike,
+ * e.g. {"colour": "red"} or {"engineCC": 150}, in the format of updateBike. Only the owner
+ * may ask. The patch is checked now, and applied to the bike as it is then once a registrar
+ * approves it. Args: bikeKey, patch JSON
+ */
+func (s *SmartContract) requestModification(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(args[1]), &fields); err != nil || len(fields) == 0 {
+		return errorResponse(invalidArgs("Patch must be a non-empty JSON object"))
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if _, err := modifiedBike(APIstub, bike, []byte(args[1])); err != nil {
+		return errorResponse(err)
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	request := ModificationRequest{
+		RequestID:   APIstub.GetTxID(),
+		BikeKey:     args[0],
+		RequestedBy: bike.Owner,
+		Patch:       json.RawMessage(args[1]),
+		Status:      modificationPending,
+		RequestedAt: now,
+	}
+	if err := putModificationRequest(APIstub, request); err != nil {
+		return errorResponse(err)
+	}
+
+	requestAsBytes, _ := json.Marshal(request)
+	return shim.Success(requestAsBytes)
+}
+
+// pendingModification loads a request a registrar is about to decide on
+func pendingModification(APIstub shim.ChaincodeStubInterface, requestID string) (ModificationRequest, error) {
+	if err := assertRole(APIstub, "registrar"); err != nil {
+		return ModificationRequest{}, err
+	}
+	request, err := getModificationRequest(APIstub, requestID)
+	if err != nil {
+		return request, err
+	}
+	if request.Status != modificationPending {
+		return request, fmt.Errorf("Modification request %s is already %s", requestID, request.Status)
+	}
+	return request, nil
+}
+
+// decide records the registrar's decision on request
+func decide(APIstub shim.ChaincodeStubInterface, request *ModificationRequest, status string, reason string) error {
+	registrar, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return err
+	}
+	request.Status, request.Reason = status, reason
+	request.DecidedBy, request.DecidedAt = registrar, now
+	return putModificationRequest(APIstub, *request)
+}
+
+/*
+ * approveModification applies a pending modification request to its bike. Only registrars
+ * may approve. A request lapses if the bike changed hands since it was made.
+ * Args: requestID
+ */
+func (s *SmartContract) approveModification(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	request, err := pendingModification(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	bike, err := getMutableBike(APIstub, request.BikeKey)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if bike.Owner != request.RequestedBy {
+		return shim.Error(fmt.Sprintf("Modification request %s is no longer valid, bike %s changed hands", args[0], request.BikeKey))
+	}
+	bike, err = modifiedBike(APIstub, bike, request.Patch)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := putBike(APIstub, request.BikeKey, bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := decide(APIstub, &request, modificationApproved, ""); err != nil {
+		return errorResponse(err)
+	}
+
+	requestAsBytes, _ := json.Marshal(request)
+	return shim.Success(requestAsBytes)
+}
+
+// rejectModification turns down a pending modification request. Registrars only. Args: requestID, reason
+func (s *SmartContract) rejectModification(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Reason must not be empty"))
+	}
+	request, err := pendingModification(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := decide(APIstub, &request, modificationRejected, args[1]); err != nil {
+		return errorResponse(err)
+	}
+
+	requestAsBytes, _ := json.Marshal(request)
+	return shim.Success(requestAsBytes)
+}
+
+// getPendingModifications returns the modification requests awaiting a registrar, in the
+// order they were made, optionally only those for one bike. Args: [bikeKey]
+func (s *SmartContract) getPendingModifications(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("MODREQ", []string{})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	requests := []ModificationRequest{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		request := ModificationRequest{}
+		if err := json.Unmarshal(queryResponse.Value, &request); err != nil {
+			return errorResponse(err)
+		}
+		if request.Status != modificationPending || (len(args) > 0 && request.BikeKey != args[0]) {
+			continue
+		}
+		requests = append(requests, request)
+	}
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].RequestedAt < requests[j].RequestedAt })
+
+	requestsAsBytes, _ := json.Marshal(requests)
+	return shim.Success(requestsAsBytes)
+}
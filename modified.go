@@ -0,0 +1,115 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Every write of a bike leaves an entry MODIFIED~<lastModifiedAt>~<key> in the modified
+// index and removes the one of its previous write, so the index lists each bike once, in
+// the order they were last changed. The entries are simple keys rather than composite ones:
+// getBikesModifiedSince needs a range starting at a timestamp, and Fabric only allows
+// ranges over simple keys. The timestamp is zero padded so the keys sort by time.
+const modifiedIndexPrefix = "MODIFIED~"
+
+func modifiedKey(modifiedAt int64, key string) string {
+	return fmt.Sprintf("%s%012d~%s", modifiedIndexPrefix, modifiedAt, key)
+}
+
+// moveModifiedIndex moves the entry of bike key from previousAt to modifiedAt. A zero
+// previousAt is a bike without an entry yet.
+func moveModifiedIndex(APIstub shim.ChaincodeStubInterface, key string, previousAt int64, modifiedAt int64) error {
+	if previousAt != 0 {
+		if err := APIstub.DelState(modifiedKey(previousAt, key)); err != nil {
+			return err
+		}
+	}
+	return APIstub.PutState(modifiedKey(modifiedAt, key), []byte{0x00})
+}
+
+/*
+ * getBikesModifiedSince lets off-chain caches sync incrementally: it returns the bikes
+ * changed at or after since, a Unix timestamp, oldest change first. A bike archived or
+ * moved to another key meanwhile comes back with a null Record, telling the cache to drop
+ * it. Like queryAllBikes it covers the bikes of the invoker's tenant, if any.
+ * Args: since, optionally pageSize and the bookmark of the previous page
+ */
+func (s *SmartContract) getBikesModifiedSince(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	since, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || since < 0 {
+		return errorResponse(invalidArgs("Since must be a Unix timestamp"))
+	}
+	paged := len(args) > 1 && args[1] != ""
+	var pageSize int32
+	bookmark := ""
+	if paged {
+		pageSize, err = parsePageSize(args[1])
+		if err != nil {
+			return errorResponse(err)
+		}
+		if len(args) > 2 {
+			bookmark = args[2]
+		}
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	prefix, err := scopedKeyPrefix(APIstub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	startKey := modifiedKey(since, "")
+	endKey := prefixRangeEnd(modifiedIndexPrefix)
+	var resultsIterator shim.StateQueryIteratorInterface
+	var metadata *sc.QueryResponseMetadata
+	if paged {
+		resultsIterator, metadata, err = APIstub.GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+	} else {
+		resultsIterator, err = APIstub.GetStateByRange(startKey, endKey)
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	results := []QueryResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		// The key follows the timestamp and its separator
+		key := strings.TrimPrefix(queryResponse.Key, modifiedIndexPrefix)
+		if len(key) <= 13 {
+			continue
+		}
+		key = key[13:]
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		bikeAsBytes, err := APIstub.GetState(key)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if bikeAsBytes == nil {
+			bikeAsBytes = []byte("null")
+		}
+		results = append(results, newQueryResult(key, bikeAsBytes))
+	}
+
+	if paged {
+		return pagedResponse(results, metadata)
+	}
+	return resultsResponse(results)
+}
@@ -0,0 +1,111 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// OdometerReading is the latest odometer value attested for a bike
+type OdometerReading struct {
+	BikeKey    string `json:"bikeKey"`
+	Reading    int64  `json:"reading"`
+	Timestamp  int64  `json:"timestamp"`
+	WorkshopID string `json:"workshopID"`
+	TxID       string `json:"txID"`
+}
+
+func odometerKey(APIstub shim.ChaincodeStubInterface, bikeKey string) (string, error) {
+	return APIstub.CreateCompositeKey("ODOMETER", []string{bikeKey})
+}
+
+/*
+ * recordOdometer attests an odometer reading. Only identities with role=workshop may call it,
+ * and a reading lower than the last one recorded, or taken before it, is rejected.
+ * Args: bikeKey, reading, timestamp (Unix seconds when the reading was taken)
+ */
+func (s *SmartContract) recordOdometer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	reading, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || reading < 0 {
+		return errorResponse(invalidArgs("Reading must be a non-negative integer"))
+	}
+	timestamp, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errorResponse(invalidArgs("Timestamp must be Unix seconds"))
+	}
+
+	if err := assertRole(APIstub, "workshop"); err != nil {
+		return errorResponse(err)
+	}
+	workshopID, err := getInvokerID(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if _, err := getMutableBike(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+
+	key, err := odometerKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	lastAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if lastAsBytes != nil {
+		last := OdometerReading{}
+		if err := json.Unmarshal(lastAsBytes, &last); err != nil {
+			return errorResponse(err)
+		}
+		if reading < last.Reading {
+			return shim.Error(fmt.Sprintf("Reading %d is lower than the last recorded reading %d", reading, last.Reading))
+		}
+		if timestamp < last.Timestamp {
+			return shim.Error("Reading was taken before the last recorded reading")
+		}
+	}
+
+	current := OdometerReading{
+		BikeKey:    args[0],
+		Reading:    reading,
+		Timestamp:  timestamp,
+		WorkshopID: workshopID,
+		TxID:       APIstub.GetTxID(),
+	}
+	currentAsBytes, _ := json.Marshal(current)
+	if err := APIstub.PutState(key, currentAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(currentAsBytes)
+}
+
+// getOdometer returns the latest attested reading for a bike
+func (s *SmartContract) getOdometer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	key, err := odometerKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	readingAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if readingAsBytes == nil {
+		return errorResponse(notFound("No odometer reading recorded for %s", args[0]))
+	}
+
+	return shim.Success(readingAsBytes)
+}
@@ -0,0 +1,256 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Capabilities an organization can be granted in the registry
+const (
+	capabilityRegister = "register"
+	capabilityTransfer = "transfer"
+	capabilityInsure   = "insure"
+	capabilityPolice   = "police"
+)
+
+// Organization is a participating MSP in the onboarding registry, with what its members
+// may do. Once any organization is onboarded the registry decides: members of MSPs not in
+// it, or without the capability, are refused. Until then the MSP lists of the config
+// apply, so deployments that never onboard an organization keep working as before.
+// Handlers gating on a capability check it through assertCapability or
+// assertStrictCapability alone, never through those lists directly.
+type Organization struct {
+	MSPID       string `json:"mspID"`
+	Name        string `json:"name"`
+	CanRegister bool   `json:"canRegister"`
+	CanTransfer bool   `json:"canTransfer"`
+	CanInsure   bool   `json:"canInsure"`
+	CanPolice   bool   `json:"canPolice"`
+	OnboardedBy string `json:"onboardedBy"`
+	OnboardedAt int64  `json:"onboardedAt"`
+	UpdatedAt   int64  `json:"updatedAt"`
+}
+
+// can reports whether the organization holds capability
+func (org Organization) can(capability string) bool {
+	switch capability {
+	case capabilityRegister:
+		return org.CanRegister
+	case capabilityTransfer:
+		return org.CanTransfer
+	case capabilityInsure:
+		return org.CanInsure
+	case capabilityPolice:
+		return org.CanPolice
+	}
+	return false
+}
+
+func organizationKey(APIstub shim.ChaincodeStubInterface, mspID string) (string, error) {
+	return APIstub.CreateCompositeKey("ORG", []string{mspID})
+}
+
+// getOrganization returns the registry entry of mspID, or nil if it was not onboarded
+func getOrganization(APIstub shim.ChaincodeStubInterface, mspID string) (*Organization, error) {
+	key, err := organizationKey(APIstub, mspID)
+	if err != nil {
+		return nil, err
+	}
+	orgAsBytes, err := APIstub.GetState(key)
+	if err != nil || orgAsBytes == nil {
+		return nil, err
+	}
+
+	org := Organization{}
+	err = json.Unmarshal(orgAsBytes, &org)
+	return &org, err
+}
+
+// registryInUse reports whether any organization has been onboarded
+func registryInUse(APIstub shim.ChaincodeStubInterface) (bool, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("ORG", []string{})
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+	return resultsIterator.HasNext(), nil
+}
+
+// assertCapability fails unless the invoker's organization holds capability in the
+// registry. While the registry is empty it falls back to the MSPs of the config, where
+// no MSPs means anyone may.
+func assertCapability(APIstub shim.ChaincodeStubInterface, capability string, fallback []string) error {
+	return checkCapability(APIstub, capability, fallback, true)
+}
+
+// assertStrictCapability is assertCapability for capabilities that reach into records of
+// other people, such as the police's: while the registry is empty, no MSPs means nobody may
+func assertStrictCapability(APIstub shim.ChaincodeStubInterface, capability string, fallback []string) error {
+	return checkCapability(APIstub, capability, fallback, false)
+}
+
+func checkCapability(APIstub shim.ChaincodeStubInterface, capability string, fallback []string, open bool) error {
+	inUse, err := registryInUse(APIstub)
+	if err != nil {
+		return err
+	}
+	if !inUse {
+		if len(fallback) == 0 {
+			if open {
+				return nil
+			}
+			return unauthorized("No organization has the %s capability", capability)
+		}
+		return assertAnyMSP(APIstub, fallback)
+	}
+
+	identity, err := clientIdentity(APIstub)
+	if err != nil {
+		return err
+	}
+	mspID, err := identity.GetMSPID()
+	if err != nil {
+		return err
+	}
+	org, err := getOrganization(APIstub, mspID)
+	if err != nil {
+		return err
+	}
+	if org == nil {
+		return unauthorized("Organization %s is not onboarded", mspID)
+	}
+	if !org.can(capability) {
+		return unauthorized("Organization %s does not have the %s capability", mspID, capability)
+	}
+	return nil
+}
+
+/*
+ * setOrganization onboards an MSP or changes its capabilities, e.g.
+ * {"name": "City Police", "canPolice": true}. Capabilities left out are not granted.
+ * Only admins may maintain the registry; as admins are named by the config, onboarding
+ * the first organization cannot lock them out. Args: mspID, organization JSON
+ */
+func (s *SmartContract) setOrganization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[0] == "" {
+		return errorResponse(invalidArgs("MSP ID must not be empty"))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, config.AdminMSPs); err != nil {
+		return errorResponse(err)
+	}
+	org := Organization{}
+	if err := json.Unmarshal([]byte(args[1]), &org); err != nil {
+		return errorResponse(invalidArgs("Organization must be a JSON object: %s", err.Error()))
+	}
+
+	admin, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	existing, err := getOrganization(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	org.MSPID = args[0]
+	org.OnboardedBy, org.OnboardedAt = admin, now
+	if existing != nil {
+		org.OnboardedBy, org.OnboardedAt = existing.OnboardedBy, existing.OnboardedAt
+	}
+	org.UpdatedAt = now
+
+	key, err := organizationKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	orgAsBytes, _ := json.Marshal(org)
+	if err := APIstub.PutState(key, orgAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(orgAsBytes)
+}
+
+// removeOrganization takes an MSP out of the registry. Admins only. Args: mspID
+func (s *SmartContract) removeOrganization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, config.AdminMSPs); err != nil {
+		return errorResponse(err)
+	}
+	org, err := getOrganization(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if org == nil {
+		return errorResponse(notFound("Organization %s is not onboarded", args[0]))
+	}
+
+	key, err := organizationKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.DelState(key); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// getOrganization returns the registry entry of an MSP. Args: mspID
+func (s *SmartContract) getOrganization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	org, err := getOrganization(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if org == nil {
+		return errorResponse(notFound("Organization %s is not onboarded", args[0]))
+	}
+
+	orgAsBytes, _ := json.Marshal(org)
+	return shim.Success(orgAsBytes)
+}
+
+// getOrganizations returns the whole registry, in MSP ID order
+func (s *SmartContract) getOrganizations(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("ORG", []string{})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	orgs := []Organization{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		org := Organization{}
+		if err := json.Unmarshal(queryResponse.Value, &org); err != nil {
+			return errorResponse(err)
+		}
+		orgs = append(orgs, org)
+	}
+
+	orgsAsBytes, _ := json.Marshal(orgs)
+	return shim.Success(orgsAsBytes)
+}
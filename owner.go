@@ -0,0 +1,250 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Owner is a registered bike holder. ID is the qualified ID recorded as Bike.Owner;
+// KYCHash is the SHA-256 of the identity documents checked off-chain.
+// Name and Contact are personal data and live in the owner PII collection, see pii.go.
+type Owner struct {
+	ID           string `json:"id"`
+	Name         string `json:"name,omitempty"`
+	Contact      string `json:"contact,omitempty"`
+	KYCHash      string `json:"kycHash"`
+	RegisteredAt int64  `json:"registeredAt"`
+	UpdatedAt    int64  `json:"updatedAt"`
+	PIIPurgedAt  int64  `json:"piiPurgedAt,omitempty"`
+}
+
+// OwnerProfile is an owner together with the bikes they currently hold
+type OwnerProfile struct {
+	Owner Owner         `json:"owner"`
+	Bikes []QueryResult `json:"bikes"`
+}
+
+func ownerKey(APIstub shim.ChaincodeStubInterface, id string) (string, error) {
+	return APIstub.CreateCompositeKey("OWNER", []string{id})
+}
+
+// getOwner loads an owner record together with its personal data. Records written before
+// the PII collection existed still carry theirs in the public record.
+func getOwner(APIstub shim.ChaincodeStubInterface, id string) (*Owner, error) {
+	key, err := ownerKey(APIstub, id)
+	if err != nil {
+		return nil, err
+	}
+	ownerAsBytes, err := APIstub.GetState(key)
+	if err != nil || ownerAsBytes == nil {
+		return nil, err
+	}
+
+	owner := Owner{}
+	if err := json.Unmarshal(ownerAsBytes, &owner); err != nil {
+		return nil, err
+	}
+	pii, err := getOwnerPII(APIstub, key)
+	if err != nil {
+		return nil, err
+	}
+	if pii != nil {
+		owner.Name, owner.Contact = pii.Name, pii.Contact
+	}
+	return &owner, nil
+}
+
+// putOwner writes an owner record, its personal data to the PII collection and the rest to the public state
+func putOwner(APIstub shim.ChaincodeStubInterface, owner Owner) error {
+	key, err := ownerKey(APIstub, owner.ID)
+	if err != nil {
+		return err
+	}
+	if err := putOwnerPII(APIstub, key, OwnerPII{Name: owner.Name, Contact: owner.Contact}); err != nil {
+		return err
+	}
+
+	owner.Name, owner.Contact = "", ""
+	ownerAsBytes, _ := json.Marshal(owner)
+	return APIstub.PutState(key, ownerAsBytes)
+}
+
+// assertOwnerCapacity fails if owner already holds the configured maximum number of bikes.
+// Bikes given to the same owner earlier in the transaction are not counted.
+func assertOwnerCapacity(APIstub shim.ChaincodeStubInterface, owner string) error {
+	config, err := getConfig(APIstub)
+	if err != nil || config.MaxBikesPerOwner == 0 {
+		return err
+	}
+
+	held, err := countOwnedBikes(APIstub, owner)
+	if err != nil {
+		return err
+	}
+	if held >= config.MaxBikesPerOwner {
+		return fmt.Errorf("%s already holds the maximum of %d bikes", owner, config.MaxBikesPerOwner)
+	}
+	return nil
+}
+
+// assertSelfOrRegistrar fails unless the invoker is the owner id, a qualified ID, itself
+// or a registrar
+func assertSelfOrRegistrar(APIstub shim.ChaincodeStubInterface, id string) error {
+	invoker, err := getInvokerQualifiedID(APIstub)
+	if err == nil && invoker == id {
+		return nil
+	}
+	if err := assertRole(APIstub, "registrar"); err != nil {
+		return unauthorized("Only %s or a registrar can manage this owner record", id)
+	}
+	return nil
+}
+
+// parseOwnerArgs validates the id, name, contact, kycHash arguments shared by registerOwner and updateOwner.
+// Arguments are recorded in the block, so name and contact may be left empty and passed as the
+// transient "pii" field instead, see ownerPIIFromTransient.
+func parseOwnerArgs(APIstub shim.ChaincodeStubInterface, args []string) (Owner, error) {
+	id, err := qualifyOwner(APIstub, args[0])
+	if err != nil {
+		return Owner{}, err
+	}
+	owner := Owner{ID: id, Name: args[1], Contact: args[2]}
+	if owner.Name == "" && owner.Contact == "" {
+		pii, err := ownerPIIFromTransient(APIstub)
+		if err != nil {
+			return owner, err
+		}
+		if pii != nil {
+			owner.Name, owner.Contact = pii.Name, pii.Contact
+		}
+	}
+	if owner.ID == "" || owner.Name == "" {
+		return owner, invalidArgs("Owner ID and name must not be empty")
+	}
+	kycHash, err := parseDigest(args[3])
+	if err != nil {
+		return owner, err
+	}
+	owner.KYCHash = kycHash
+	return owner, nil
+}
+
+/*
+ * registerOwner creates an owner record. The owner may register themselves, or a
+ * registrar may do it for them. Args: id, name, contact, kycHash
+ */
+func (s *SmartContract) registerOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	owner, err := parseOwnerArgs(APIstub, args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertSelfOrRegistrar(APIstub, owner.ID); err != nil {
+		return errorResponse(err)
+	}
+	existing, err := getOwner(APIstub, owner.ID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if existing != nil {
+		return shim.Error(fmt.Sprintf("Owner %s is already registered", owner.ID))
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	owner.RegisteredAt = now
+	owner.UpdatedAt = now
+	if err := putOwner(APIstub, owner); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// updateOwner replaces the details of an owner record. Args: id, name, contact, kycHash
+func (s *SmartContract) updateOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	owner, err := parseOwnerArgs(APIstub, args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertSelfOrRegistrar(APIstub, owner.ID); err != nil {
+		return errorResponse(err)
+	}
+	existing, err := getOwner(APIstub, owner.ID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if existing == nil {
+		return errorResponse(notFound("Owner %s is not registered", owner.ID))
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	owner.RegisteredAt = existing.RegisteredAt
+	owner.UpdatedAt = now
+	if err := putOwner(APIstub, owner); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// getOwnerProfile returns an owner record and every bike the owner currently holds
+func (s *SmartContract) getOwnerProfile(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	id, err := qualifyOwner(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	owner, err := getOwner(APIstub, id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if owner == nil {
+		return errorResponse(notFound("Owner %s is not registered", id))
+	}
+	holder, err := ownerRef(APIstub, id)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("OWNERBIKE", []string{holder})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	profile := OwnerProfile{Owner: *owner, Bikes: []QueryResult{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return errorResponse(err)
+		}
+		bikeAsBytes, err := APIstub.GetState(attributes[1])
+		if err != nil {
+			return errorResponse(err)
+		}
+		if bikeAsBytes != nil {
+			profile.Bikes = append(profile.Bikes, newQueryResult(attributes[1], bikeAsBytes))
+		}
+	}
+
+	profileAsBytes, _ := json.Marshal(profile)
+	return shim.Success(profileAsBytes)
+}
@@ -0,0 +1,124 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// patchRule says who may correct a field with patchBike and where it lives in a bike
+type patchRule struct {
+	authorize func(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error
+	field     func(bike *Bike) *string
+}
+
+// patchRules lists the fields patchBike may change. A new correctable field only needs a line here.
+var patchRules = map[string]patchRule{
+	"colour":         {authorize: assertOwner, field: func(bike *Bike) *string { return &bike.Colour }},
+	"model":          {authorize: assertOwnerOrRegistrar, field: func(bike *Bike) *string { return &bike.Model }},
+	"registrationNo": {authorize: assertRegistrar, field: func(bike *Bike) *string { return &bike.RegistrationNo }},
+}
+
+// assertOwnerOrRegistrar fails unless the invoker owns the bike under key or is a registrar
+func assertOwnerOrRegistrar(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	if assertOwner(APIstub, key, bike) == nil {
+		return nil
+	}
+	if err := assertRole(APIstub, "registrar"); err != nil {
+		return unauthorized("Only the owner of %s or a registrar can do this", key)
+	}
+	return nil
+}
+
+// assertRegistrar fails unless the invoker is a registrar
+func assertRegistrar(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	return assertRole(APIstub, "registrar")
+}
+
+/*
+ * patchBike corrects several fields of a bike at once with JSON merge-patch semantics
+ * (RFC 7386), e.g. {"colour": "red", "registrationNo": null}: fields given are set, fields
+ * given as null are cleared, the rest is left alone. Each field has its own rule, see
+ * patchRules; the patch fails as a whole if the invoker may not change one of them. Where
+ * the config requires modification approval, only registrars patch bikes directly.
+ * Args: key, patch JSON, optionally expectedVersion
+ */
+func (s *SmartContract) patchBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	patch := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(args[1]), &patch); err != nil || patch == nil {
+		return errorResponse(invalidArgs("Patch must be a JSON object"))
+	}
+	if len(patch) == 0 {
+		return errorResponse(invalidArgs("Patch is empty"))
+	}
+	expected := ""
+	if len(args) > 2 {
+		expected = args[2]
+	}
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := checkVersion(args[0], bike, expected); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertDirectModification(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	previousRegNo := bike.RegistrationNo
+
+	// In name order, so every endorser fails on the same field
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		rule, ok := patchRules[field]
+		if !ok {
+			return errorResponse(invalidArgs("Field %s cannot be patched", field))
+		}
+		if err := rule.authorize(APIstub, args[0], bike); err != nil {
+			return errorResponse(err)
+		}
+		value := ""
+		if string(patch[field]) != "null" {
+			if err := json.Unmarshal(patch[field], &value); err != nil {
+				return errorResponse(invalidArgs("Field %s must be a string or null", field))
+			}
+		}
+		*rule.field(&bike) = value
+	}
+	if err := validateAsset(bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := validateAssetSchema(APIstub, bike); err != nil {
+		return errorResponse(err)
+	}
+
+	bike.RegistrationNo = normalizeRegistrationNo(bike.RegistrationNo)
+	if bike.RegistrationNo != previousRegNo {
+		if err := releaseRegistrationNo(APIstub, previousRegNo, args[0]); err != nil {
+			return errorResponse(err)
+		}
+		if bike.RegistrationNo != "" {
+			if err := claimRegistrationNo(APIstub, bike.RegistrationNo, args[0]); err != nil {
+				return errorResponse(err)
+			}
+		}
+	}
+
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
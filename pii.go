@@ -0,0 +1,103 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// collectionOwnerPII is the private data collection holding owners' personal data,
+// defined in collections_config.json. Only its hashes reach the channel's blocks.
+const collectionOwnerPII = "ownerPII"
+
+// OwnerPII is the personal data of an owner, kept out of the public state
+type OwnerPII struct {
+	Name    string `json:"name"`
+	Contact string `json:"contact"`
+}
+
+// getOwnerPII returns the personal data stored for the owner record under key, or nil if there is none
+func getOwnerPII(APIstub shim.ChaincodeStubInterface, key string) (*OwnerPII, error) {
+	piiAsBytes, err := APIstub.GetPrivateData(collectionOwnerPII, key)
+	if err != nil || piiAsBytes == nil {
+		return nil, err
+	}
+
+	pii := OwnerPII{}
+	err = json.Unmarshal(piiAsBytes, &pii)
+	return &pii, err
+}
+
+func putOwnerPII(APIstub shim.ChaincodeStubInterface, key string, pii OwnerPII) error {
+	piiAsBytes, _ := json.Marshal(pii)
+	return APIstub.PutPrivateData(collectionOwnerPII, key, piiAsBytes)
+}
+
+// ownerPIIFromTransient reads personal data passed as the transient field "pii", nil if there is none
+func ownerPIIFromTransient(APIstub shim.ChaincodeStubInterface) (*OwnerPII, error) {
+	transient, err := APIstub.GetTransient()
+	if err != nil || transient["pii"] == nil {
+		return nil, err
+	}
+
+	pii := OwnerPII{}
+	if err := json.Unmarshal(transient["pii"], &pii); err != nil {
+		return nil, invalidArgs("Transient field pii must be a JSON object: %s", err.Error())
+	}
+	return &pii, nil
+}
+
+/*
+ * purgeOwnerPII erases the personal data of a former owner, for right-to-be-forgotten
+ * requests. The owner record stays, with its ID and KYC digest, so bike histories that
+ * name the owner remain intact. The owner or a registrar may purge. Args: ownerID
+ *
+ * Fabric 1.4 has no PurgePrivateData: DelPrivateData removes the data from the collection's
+ * current state on every member peer, but not from the peers' private history. Personal data
+ * of records written before the PII collection existed is cleared from the public record,
+ * but stays in the block that wrote it.
+ */
+func (s *SmartContract) purgeOwnerPII(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	id, err := qualifyOwner(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertSelfOrRegistrar(APIstub, id); err != nil {
+		return errorResponse(err)
+	}
+	owner, err := getOwner(APIstub, id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if owner == nil {
+		return errorResponse(notFound("Owner %s is not registered", id))
+	}
+
+	key, err := ownerKey(APIstub, id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.DelPrivateData(collectionOwnerPII, key); err != nil {
+		return errorResponse(err)
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	owner.Name, owner.Contact = "", ""
+	owner.PIIPurgedAt = now
+	owner.UpdatedAt = now
+	ownerAsBytes, _ := json.Marshal(owner)
+	if err := APIstub.PutState(key, ownerAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(ownerAsBytes)
+}
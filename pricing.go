@@ -0,0 +1,238 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	secondsPerYear = 365 * 24 * 60 * 60
+
+	// saleOnLedger marks a price the bike was sold at through the chaincode, saleDeclared
+	// one its owner declared for a sale settled off-chain
+	saleOnLedger = "ledger"
+	saleDeclared = "declared"
+)
+
+var currencyCode = regexp.MustCompile("^[A-Z]{3,10}$")
+
+// Depreciation, part of the Config, sets how estimateValue writes bikes down: by
+// AnnualBps of their value every year, compounding, the rate of their assetType if it has
+// one, but never below FloorBps of the price they last sold at. Currency is the one the
+// prices of sales through the chaincode are recorded in.
+type Depreciation struct {
+	Currency         string           `json:"currency"`
+	DefaultAnnualBps int64            `json:"defaultAnnualBps"`
+	AnnualBps        map[string]int64 `json:"annualBps"`
+	FloorBps         int64            `json:"floorBps"`
+}
+
+func (d Depreciation) validate() error {
+	if !currencyCode.MatchString(d.Currency) {
+		return invalidArgs("depreciation currency must be an upper case currency code")
+	}
+	if d.DefaultAnnualBps < 0 || d.DefaultAnnualBps > 10000 || d.FloorBps < 0 || d.FloorBps > 10000 {
+		return invalidArgs("depreciation rates must be between 0 and 10000 basis points")
+	}
+	for assetType, bps := range d.AnnualBps {
+		if bps < 0 || bps > 10000 {
+			return invalidArgs("depreciation rate of %s must be between 0 and 10000 basis points", assetType)
+		}
+	}
+	return nil
+}
+
+// annualBps is the yearly depreciation rate of assetType
+func (d Depreciation) annualBps(assetType string) int64 {
+	if bps, ok := d.AnnualBps[assetType]; ok {
+		return bps
+	}
+	return d.DefaultAnnualBps
+}
+
+// SalePrice is one entry in the price history of a bike
+type SalePrice struct {
+	BikeKey    string `json:"bikeKey"`
+	Seq        string `json:"seq"`
+	Price      int64  `json:"price"`
+	Currency   string `json:"currency"`
+	Seller     string `json:"seller,omitempty"`
+	Buyer      string `json:"buyer"`
+	Source     string `json:"source"`
+	RecordedBy string `json:"recordedBy"`
+	TxID       string `json:"txID"`
+	SoldAt     int64  `json:"soldAt"`
+}
+
+// ValueEstimate is the answer of estimateValue
+type ValueEstimate struct {
+	BikeKey        string  `json:"bikeKey"`
+	LastPrice      int64   `json:"lastPrice"`
+	Currency       string  `json:"currency"`
+	SoldAt         int64   `json:"soldAt"`
+	AnnualBps      int64   `json:"annualBps"`
+	Years          float64 `json:"years"`
+	EstimatedValue int64   `json:"estimatedValue"`
+	EstimatedAt    int64   `json:"estimatedAt"`
+}
+
+// recordSalePrice appends sale to the price history of its bike
+func recordSalePrice(APIstub shim.ChaincodeStubInterface, sale SalePrice) error {
+	invoker, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return err
+	}
+	seq, err := nextSeq(APIstub, "PRICE", sale.BikeKey)
+	if err != nil {
+		return err
+	}
+	sale.Seq = seq
+	sale.RecordedBy = invoker
+	sale.TxID = APIstub.GetTxID()
+
+	key, err := APIstub.CreateCompositeKey("PRICE", []string{sale.BikeKey, seq})
+	if err != nil {
+		return err
+	}
+	saleAsBytes, _ := json.Marshal(sale)
+	return APIstub.PutState(key, saleAsBytes)
+}
+
+// getPriceHistory returns the recorded sales of a bike, oldest first
+func getPriceHistory(APIstub shim.ChaincodeStubInterface, bikeKey string) ([]SalePrice, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("PRICE", []string{bikeKey})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	sales := []SalePrice{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		sale := SalePrice{}
+		if err := json.Unmarshal(queryResponse.Value, &sale); err != nil {
+			return nil, err
+		}
+		sales = append(sales, sale)
+	}
+	return sales, nil
+}
+
+/*
+ * recordSalePrice lets the owner declare what they paid for a bike they bought off-chain,
+ * so the price history is not limited to sales settled through the chaincode, whose
+ * prices are recorded on their own. Each owner can declare one price, for the transfer
+ * that brought them the bike, and none if that transfer already recorded one.
+ * Args: bikeKey, price, currency
+ */
+func (s *SmartContract) recordSalePrice(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	price, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || price <= 0 {
+		return errorResponse(invalidArgs("Price must be a positive integer"))
+	}
+	currency := strings.ToUpper(args[2])
+	if !currencyCode.MatchString(currency) {
+		return errorResponse(invalidArgs("Currency must be a currency code such as INR"))
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	acquiredAt := bike.LastTransferAt
+	if acquiredAt == 0 {
+		acquiredAt = bike.RegisteredAt
+	}
+	sales, err := getPriceHistory(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if n := len(sales); n > 0 && sales[n-1].Buyer == bike.Owner && sales[n-1].SoldAt >= acquiredAt {
+		return shim.Error(fmt.Sprintf("A price was already recorded for the sale of %s to %s", args[0], bike.Owner))
+	}
+
+	sale := SalePrice{BikeKey: args[0], Price: price, Currency: currency, Buyer: bike.Owner, Source: saleDeclared, SoldAt: acquiredAt}
+	if err := recordSalePrice(APIstub, sale); err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+// getPriceHistory returns the recorded sale prices of a bike, oldest first. Args: bikeKey
+func (s *SmartContract) getPriceHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	sales, err := getPriceHistory(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	salesAsBytes, _ := json.Marshal(sales)
+	return shim.Success(salesAsBytes)
+}
+
+/*
+ * estimateValue writes the price a bike last sold at down to today, by the depreciation
+ * rates of the Config, as a value signal for insurers and lenders. It is only as good as
+ * the recorded prices and says nothing about the bike's condition. Args: bikeKey
+ */
+func (s *SmartContract) estimateValue(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	sales, err := getPriceHistory(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(sales) == 0 {
+		return errorResponse(notFound("No sale price is recorded for bike %s", args[0]))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	last := sales[len(sales)-1]
+	estimate := ValueEstimate{
+		BikeKey:     args[0],
+		LastPrice:   last.Price,
+		Currency:    last.Currency,
+		SoldAt:      last.SoldAt,
+		AnnualBps:   config.Depreciation.annualBps(bike.AssetType),
+		EstimatedAt: now,
+	}
+	if now > last.SoldAt {
+		estimate.Years = float64(now-last.SoldAt) / secondsPerYear
+	}
+	value := float64(last.Price) * math.Pow(1-float64(estimate.AnnualBps)/10000, estimate.Years)
+	floor := float64(last.Price) * float64(config.Depreciation.FloorBps) / 10000
+	estimate.EstimatedValue = int64(math.Round(math.Max(value, floor)))
+
+	estimateAsBytes, _ := json.Marshal(estimate)
+	return shim.Success(estimateAsBytes)
+}
@@ -0,0 +1,57 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+)
+
+// parseFields reads the optional projection argument of the bike queries, a JSON array of
+// bike fields such as ["make", "owner"]. An empty argument means the whole record.
+func parseFields(args []string, i int) ([]string, error) {
+	if len(args) <= i || args[i] == "" {
+		return nil, nil
+	}
+
+	var fields []string
+	if err := json.Unmarshal([]byte(args[i]), &fields); err != nil {
+		return nil, invalidArgs("Fields must be a JSON array of strings: %s", err.Error())
+	}
+	known := bikeFieldNames()
+	for _, field := range fields {
+		if !known[field] {
+			return nil, invalidArgs("Unknown bike field %s", field)
+		}
+	}
+	return fields, nil
+}
+
+// projectRecord keeps only the named fields of a JSON record. Without fields, and for
+// records that are not JSON objects, the record is returned whole.
+func projectRecord(record []byte, fields []string) []byte {
+	if fields == nil || record == nil {
+		return record
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(record, &all); err != nil {
+		return record
+	}
+
+	kept := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			kept[field] = value
+		}
+	}
+	projected, _ := json.Marshal(kept)
+	return projected
+}
+
+// projectResults applies projectRecord to every query result
+func projectResults(results []QueryResult, fields []string) {
+	for i := range results {
+		results[i].Record = projectRecord(results[i].Record, fields)
+	}
+}
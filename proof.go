@@ -0,0 +1,71 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// BikeWithMetadata is a bike as stored, with what a light client needs to check it against
+// the ledger without trusting the peer that answered. Bike holds the stored bytes exactly,
+// unlike queryBike, which may upgrade old layouts; StateHash is their SHA-256. TxID is the
+// transaction that last wrote the bike, and ModifiedAt its timestamp: the client fetches that
+// transaction from another peer, e.g. with qscc GetTransactionByID, checks its block against
+// block headers it trusts, and compares the value it wrote to Bike under Key in Namespace.
+// The version field of the bike counts writes, so a replayed old answer shows up as well.
+// EndorsingOrgs lists the key-level endorsement policy the write had to satisfy on top of
+// the chaincode's, none without one. Bikes last written before the transaction ID was
+// recorded have an empty TxID.
+type BikeWithMetadata struct {
+	Key           string          `json:"key"`
+	Bike          json.RawMessage `json:"bike"`
+	StateHash     string          `json:"stateHash"`
+	TxID          string          `json:"txID"`
+	ModifiedAt    int64           `json:"modifiedAt"`
+	Version       int             `json:"version"`
+	ChannelID     string          `json:"channelID"`
+	Namespace     string          `json:"namespace"`
+	EndorsingOrgs []string        `json:"endorsingOrgs"`
+}
+
+// getBikeWithMetadata returns a bike with the metadata to verify it by, see BikeWithMetadata. Args: key
+func (s *SmartContract) getBikeWithMetadata(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bikeAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if bikeAsBytes == nil {
+		return errorResponse(bikeNotFound(args[0]))
+	}
+	bike := Bike{}
+	if err := json.Unmarshal(bikeAsBytes, &bike); err != nil {
+		return shim.Error("Record " + args[0] + " is not a bike")
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	orgs, err := endorsingOrgs(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	metadataAsBytes, _ := json.Marshal(BikeWithMetadata{
+		Key:           args[0],
+		Bike:          bikeAsBytes,
+		StateHash:     stateHash(bikeAsBytes),
+		TxID:          bike.LastModifiedTxID,
+		ModifiedAt:    bike.LastModifiedAt,
+		Version:       bike.Version,
+		ChannelID:     APIstub.GetChannelID(),
+		Namespace:     config.ChaincodeName,
+		EndorsingOrgs: orgs,
+	})
+	return shim.Success(metadataAsBytes)
+}
@@ -0,0 +1,256 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// collectionOwnerPseudonyms is the private data collection holding the pseudonym salt
+	// and the owner behind each pseudonym, defined in collections_config.json
+	collectionOwnerPseudonyms = "ownerPseudonyms"
+	// pseudonymSaltKey holds the salt in the collection
+	pseudonymSaltKey = "SALT"
+	// pseudonymPrefix starts every pseudonym, so they cannot be taken for enrollment IDs
+	pseudonymPrefix = "anon:"
+	// minSaltLength is the shortest salt setOwnerSalt accepts, in bytes
+	minSaltLength = 16
+)
+
+var pseudonymPattern = regexp.MustCompile("^" + pseudonymPrefix + "[0-9a-f]{64}$")
+
+// isPseudonym reports whether id is an owner pseudonym rather than an enrollment ID
+func isPseudonym(id string) bool {
+	return pseudonymPattern.MatchString(id)
+}
+
+func pseudonymKey(APIstub shim.ChaincodeStubInterface, pseudonym string) (string, error) {
+	return APIstub.CreateCompositeKey("PSEUDONYM", []string{pseudonym})
+}
+
+// getPseudonymSalt returns the salt, nil if none was set
+func getPseudonymSalt(APIstub shim.ChaincodeStubInterface) ([]byte, error) {
+	return APIstub.GetPrivateData(collectionOwnerPseudonyms, pseudonymSaltKey)
+}
+
+// ownerPseudonym returns the pseudonym of the qualified ID id: the HMAC-SHA256 of id under
+// the salt, so every endorser derives the same one and nobody without the salt can test
+// guesses against it. It writes nothing, so queries can call it; writing transactions
+// record the owner behind it with recordPseudonym. When the config does not store owners
+// as pseudonyms, id is returned.
+func ownerPseudonym(APIstub shim.ChaincodeStubInterface, id string) (string, error) {
+	config, err := getConfig(APIstub)
+	if err != nil || !config.OwnerPseudonyms || id == "" {
+		return id, err
+	}
+	salt, err := getPseudonymSalt(APIstub)
+	if err != nil {
+		return "", err
+	}
+	if salt == nil {
+		return "", fmt.Errorf("Owner pseudonyms are on but no salt was set with setOwnerSalt")
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(id))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// recordPseudonym records in the collection the owner named id behind its pseudonym, for
+// resolveOwnerHash, unless it is known already or owners are not stored as pseudonyms
+func recordPseudonym(APIstub shim.ChaincodeStubInterface, id string) error {
+	qualified, err := qualifyOwner(APIstub, id)
+	if err != nil || isPseudonym(qualified) {
+		return err
+	}
+	pseudonym, err := ownerPseudonym(APIstub, qualified)
+	if err != nil || pseudonym == qualified {
+		return err
+	}
+	key, err := pseudonymKey(APIstub, pseudonym)
+	if err != nil {
+		return err
+	}
+	known, err := APIstub.GetPrivateData(collectionOwnerPseudonyms, key)
+	if err != nil || known != nil {
+		return err
+	}
+	return APIstub.PutPrivateData(collectionOwnerPseudonyms, key, []byte(qualified))
+}
+
+// ownerRef returns how the owner named by a caller is recorded: arguments may name owners
+// by qualified or bare enrollment ID, see qualifyOwner, or by the pseudonym queries
+// returned, which is kept as it is
+func ownerRef(APIstub shim.ChaincodeStubInterface, id string) (string, error) {
+	qualified, err := qualifyOwner(APIstub, id)
+	if err != nil || isPseudonym(qualified) {
+		return qualified, err
+	}
+	return ownerPseudonym(APIstub, qualified)
+}
+
+// pseudonymOwner returns the qualified ID behind pseudonym, if this peer holds the collection
+func pseudonymOwner(APIstub shim.ChaincodeStubInterface, pseudonym string) (string, error) {
+	key, err := pseudonymKey(APIstub, pseudonym)
+	if err != nil {
+		return "", err
+	}
+	owner, err := APIstub.GetPrivateData(collectionOwnerPseudonyms, key)
+	if err != nil {
+		return "", err
+	}
+	if owner == nil {
+		return "", notFound("Pseudonym %s is not known", pseudonym)
+	}
+	return string(owner), nil
+}
+
+// pseudonymizeOwners hands the handler of the named route the owners named in its
+// arguments, those routeArgs gives the owner kind, as owners are recorded. Handlers can
+// then compare and store them as they are, whether or not the config uses pseudonyms.
+// Writing routes also record who is behind the pseudonyms of those owners and of the
+// invoker, the only parties that can end up recorded; queries write nothing.
+func pseudonymizeOwners(name string, route Route, next HandlerFunc) HandlerFunc {
+	var owners []int
+	for i, arg := range routeArgs[name] {
+		if strings.HasSuffix(arg, ":owner") {
+			owners = append(owners, i)
+		}
+	}
+	if len(owners) == 0 && route.ReadOnly {
+		return next
+	}
+	return func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+		refs := append([]string(nil), args...)
+		for _, i := range owners {
+			if i >= len(refs) {
+				break
+			}
+			if !route.ReadOnly {
+				if err := recordPseudonym(APIstub, refs[i]); err != nil {
+					return errorResponse(err)
+				}
+			}
+			ref, err := ownerRef(APIstub, refs[i])
+			if err != nil {
+				return errorResponse(err)
+			}
+			refs[i] = ref
+		}
+		if !route.ReadOnly {
+			if id, err := getInvokerQualifiedID(APIstub); err == nil {
+				if err := recordPseudonym(APIstub, id); err != nil {
+					return errorResponse(err)
+				}
+			}
+		}
+		return next(APIstub, refs)
+	}
+}
+
+// checkPseudonymSwitch guards turning owner pseudonyms on or off. They can only be turned
+// on, once a salt is set, while no bike is held by anyone, as owners recorded by name could
+// no longer be matched against their invokers; and never off again, for the same reason.
+func checkPseudonymSwitch(APIstub shim.ChaincodeStubInterface, on bool) error {
+	if !on {
+		return invalidArgs("ownerPseudonyms cannot be switched off once on")
+	}
+	salt, err := getPseudonymSalt(APIstub)
+	if err != nil {
+		return err
+	}
+	if salt == nil {
+		return invalidArgs("ownerPseudonyms need a salt, set with setOwnerSalt first")
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("OWNERBIKE", []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	if resultsIterator.HasNext() {
+		return invalidArgs("ownerPseudonyms can only be switched on before any bike is registered")
+	}
+	return nil
+}
+
+/*
+ * setOwnerSalt sets the secret salt owner pseudonyms are derived with, passed as the
+ * transient field "salt" of at least 16 bytes so it never reaches a block. The chaincode
+ * draws no randomness, which endorsers could not agree on; the admin brings the salt. It
+ * can be set once: another salt would give every owner a new pseudonym. Admins only.
+ */
+func (s *SmartContract) setOwnerSalt(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, config.AdminMSPs); err != nil {
+		return errorResponse(err)
+	}
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(transient["salt"]) < minSaltLength {
+		return errorResponse(invalidArgs("Transient field salt must hold at least %d bytes", minSaltLength))
+	}
+	salt, err := getPseudonymSalt(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if salt != nil {
+		return shim.Error("The owner salt is already set")
+	}
+
+	if err := APIstub.PutPrivateData(collectionOwnerPseudonyms, pseudonymSaltKey, transient["salt"]); err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+// ResolvedOwner is the answer of resolveOwnerHash
+type ResolvedOwner struct {
+	Pseudonym string `json:"pseudonym"`
+	Owner     string `json:"owner"`
+}
+
+/*
+ * resolveOwnerHash returns the qualified enrollment ID behind an owner pseudonym. Only registrars
+ * and organizations with the police capability may resolve them, on peers of the organizations of the pseudonym
+ * collection. Args: pseudonym
+ */
+func (s *SmartContract) resolveOwnerHash(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertRole(APIstub, "registrar"); err != nil {
+		config, err := getConfig(APIstub)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if assertStrictCapability(APIstub, capabilityPolice, config.PoliceMSPs) != nil {
+			return errorResponse(unauthorized("Only registrars and the police can resolve owner pseudonyms"))
+		}
+	}
+	if !isPseudonym(args[0]) {
+		return errorResponse(invalidArgs("%s is not an owner pseudonym", args[0]))
+	}
+	owner, err := pseudonymOwner(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	resolvedAsBytes, _ := json.Marshal(ResolvedOwner{Pseudonym: args[0], Owner: owner})
+	return shim.Success(resolvedAsBytes)
+}
@@ -0,0 +1,92 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A QR payload reads FB1;<channel>;<chaincode>;<chassis hash>;<bike key>, short enough for
+// a small sticker. FB1 is the format version. The chassis hash ties the sticker to the
+// bike it was printed for without putting the chassis number itself on it; it is the first
+// qrHashLength hex digits of the SHA-256 of the chassis number, empty for bikes without one.
+// The key comes last, as the only field that may hold the separator.
+const (
+	qrVersion    = "FB1"
+	qrSeparator  = ";"
+	qrHashLength = 16
+)
+
+// qrChassisHash is the chassis hash of a QR payload for chassisNo
+func qrChassisHash(chassisNo string) string {
+	if chassisNo == "" {
+		return ""
+	}
+	digest := sha256.Sum256([]byte(chassisNo))
+	return hex.EncodeToString(digest[:])[:qrHashLength]
+}
+
+func qrPayload(APIstub shim.ChaincodeStubInterface, config Config, key string, bike Bike) string {
+	return strings.Join([]string{qrVersion, APIstub.GetChannelID(), config.ChaincodeName, qrChassisHash(bike.ChassisNo), key}, qrSeparator)
+}
+
+// getBikeQRPayload returns the QR payload of a bike, to print on a sticker. Args: key
+func (s *SmartContract) getBikeQRPayload(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	payloadAsString, _ := json.Marshal(qrPayload(APIstub, config, args[0], bike))
+	return shim.Success(payloadAsString)
+}
+
+/*
+ * resolveQRPayload returns the bike a scanned QR payload stands for, as a QueryResult. It
+ * fails if the payload is of an unknown version, was printed for another channel or
+ * chaincode, or if the chassis number of the bike no longer matches it, e.g. because the
+ * sticker was moved to another bike. Args: payload
+ */
+func (s *SmartContract) resolveQRPayload(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	fields := strings.SplitN(args[0], qrSeparator, 5)
+	if len(fields) != 5 || fields[4] == "" {
+		return errorResponse(invalidArgs("Payload is not a bike QR payload"))
+	}
+	if fields[0] != qrVersion {
+		return errorResponse(invalidArgs("QR payload version %s is not supported", fields[0]))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if fields[1] != APIstub.GetChannelID() || fields[2] != config.ChaincodeName {
+		return errorResponse(invalidArgs("QR payload is for chaincode %s on channel %s", fields[2], fields[1]))
+	}
+
+	key := fields[4]
+	bike, err := getBike(APIstub, key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if fields[3] != qrChassisHash(bike.ChassisNo) {
+		return shim.Error("QR payload does not match the chassis number of bike " + key)
+	}
+
+	bikeAsBytes, _ := json.Marshal(bike)
+	resultAsBytes, _ := json.Marshal(newQueryResult(key, bikeAsBytes))
+	return shim.Success(resultAsBytes)
+}
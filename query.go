@@ -0,0 +1,105 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxQueryPageSize caps the pageSize of paginated queries
+const maxQueryPageSize = 1000
+
+// QueryResult is one entry of the {Key, Record} arrays returned by the query functions
+type QueryResult struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
+
+// PagedResults is one page of a paginated query. Pass ResponseMetadata.Bookmark back
+// to fetch the next page.
+type PagedResults struct {
+	Results          []QueryResult    `json:"results"`
+	ResponseMetadata ResponseMetadata `json:"responseMetadata"`
+}
+
+// ResponseMetadata tells how many records the page fetched and where the next one starts.
+// Pages listing every bike also carry TotalCount, how many there are in all, read from
+// the counters of countBikes so that showing the fleet size takes no scan.
+type ResponseMetadata struct {
+	FetchedRecordsCount int32  `json:"fetchedRecordsCount"`
+	Bookmark            string `json:"bookmark"`
+	TotalCount          *int   `json:"totalCount,omitempty"`
+}
+
+func parsePageSize(arg string) (int32, error) {
+	pageSize, err := strconv.ParseInt(arg, 10, 32)
+	if err != nil || pageSize <= 0 || pageSize > maxQueryPageSize {
+		return 0, invalidArgs("Page size must be between 1 and %d", maxQueryPageSize)
+	}
+	return int32(pageSize), nil
+}
+
+// newQueryResult pairs a key with its stored value. Values that are not valid JSON are
+// carried as a JSON string so a single bad record cannot corrupt the whole response.
+func newQueryResult(key string, value []byte) QueryResult {
+	if !json.Valid(value) {
+		value, _ = json.Marshal(string(value))
+	}
+	return QueryResult{Key: key, Record: value}
+}
+
+// collectResults drains an iterator into QueryResults, skipping the entries keep rejects.
+// A nil keep keeps everything.
+func collectResults(resultsIterator shim.StateQueryIteratorInterface, keep func(*queryresult.KV) bool) ([]QueryResult, error) {
+	results := []QueryResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if keep != nil && !keep(queryResponse) {
+			continue
+		}
+		results = append(results, newQueryResult(queryResponse.Key, queryResponse.Value))
+	}
+	return results, nil
+}
+
+// resultsResponse marshals query results as the success payload
+func resultsResponse(results []QueryResult) sc.Response {
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(resultsAsBytes)
+}
+
+// pagedResponse marshals a page of query results with its metadata as the success payload
+func pagedResponse(results []QueryResult, metadata *sc.QueryResponseMetadata) sc.Response {
+	return countedPagedResponse(results, metadata, nil)
+}
+
+// countedPagedResponse is pagedResponse for the pages of a listing of total records in all
+func countedPagedResponse(results []QueryResult, metadata *sc.QueryResponseMetadata, total *int) sc.Response {
+	page := PagedResults{Results: results}
+	if metadata != nil {
+		page.ResponseMetadata = ResponseMetadata{
+			FetchedRecordsCount: metadata.FetchedRecordsCount,
+			Bookmark:            metadata.Bookmark,
+		}
+	}
+	page.ResponseMetadata.TotalCount = total
+
+	pageAsBytes, err := json.Marshal(page)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(pageAsBytes)
+}
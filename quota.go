@@ -0,0 +1,161 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// statusQuotaExceeded is the status of creations beyond the quota
+const statusQuotaExceeded = 429
+
+// CreationQuota counts the bikes one identity created in the current quota window
+type CreationQuota struct {
+	Creator     string `json:"creator"`
+	Count       int    `json:"count"`
+	WindowStart int64  `json:"windowStart"`
+	Limit       int    `json:"limit"`
+}
+
+func quotaKey(APIstub shim.ChaincodeStubInterface, creator string) (string, error) {
+	return APIstub.CreateCompositeKey("QUOTA", []string{creator})
+}
+
+// getCreationQuota returns the quota record of creator, starting a new window if the last
+// one is over
+func getCreationQuota(APIstub shim.ChaincodeStubInterface, config Config, creator string) (CreationQuota, error) {
+	quota := CreationQuota{Creator: creator}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return quota, err
+	}
+	key, err := quotaKey(APIstub, creator)
+	if err != nil {
+		return quota, err
+	}
+	quotaAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return quota, err
+	}
+	if quotaAsBytes != nil {
+		if err := json.Unmarshal(quotaAsBytes, &quota); err != nil {
+			return quota, err
+		}
+	}
+	if quotaAsBytes == nil || (config.CreationQuotaWindowSeconds > 0 && now >= quota.WindowStart+config.CreationQuotaWindowSeconds) {
+		quota.Count = 0
+		quota.WindowStart = now
+	}
+	quota.Limit = config.CreationQuota
+	return quota, nil
+}
+
+// quotaTracker counts the bikes a transaction creates against the invoker's quota. Writes
+// are invisible to reads within a transaction, so batches count in here and save once.
+type quotaTracker struct {
+	quota CreationQuota
+	added int
+}
+
+// trackCreationQuota returns the tracker for the invoker, nil if they are not limited:
+// without a quota in the config, and for registrars, who create bikes for others
+func trackCreationQuota(APIstub shim.ChaincodeStubInterface) (*quotaTracker, error) {
+	config, err := getConfig(APIstub)
+	if err != nil || config.CreationQuota == 0 {
+		return nil, err
+	}
+	if assertRole(APIstub, "registrar") == nil {
+		return nil, nil
+	}
+	creator, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return nil, err
+	}
+	quota, err := getCreationQuota(APIstub, config, creator)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaTracker{quota: quota}, nil
+}
+
+// allow fails if the invoker has no creation left
+func (q *quotaTracker) allow() error {
+	if q == nil || q.quota.Count+q.added < q.quota.Limit {
+		return nil
+	}
+	return codedError{code: codeQuotaExceeded, message: fmt.Sprintf("%s has used up the quota of %d bikes", q.quota.Creator, q.quota.Limit)}
+}
+
+// add counts one created bike
+func (q *quotaTracker) add() {
+	if q != nil {
+		q.added++
+	}
+}
+
+// save stores the count, if any bike was created
+func (q *quotaTracker) save(APIstub shim.ChaincodeStubInterface) error {
+	if q == nil || q.added == 0 {
+		return nil
+	}
+	key, err := quotaKey(APIstub, q.quota.Creator)
+	if err != nil {
+		return err
+	}
+	quota := q.quota
+	quota.Count += q.added
+	quotaAsBytes, _ := json.Marshal(quota)
+	return APIstub.PutState(key, quotaAsBytes)
+}
+
+// createWithinQuota runs create, which registers one bike, against the invoker's quota
+func createWithinQuota(APIstub shim.ChaincodeStubInterface, create func() error) error {
+	quota, err := trackCreationQuota(APIstub)
+	if err != nil {
+		return err
+	}
+	if err := quota.allow(); err != nil {
+		return err
+	}
+	if err := create(); err != nil {
+		return err
+	}
+	quota.add()
+	return quota.save(APIstub)
+}
+
+// getCreationQuota returns how many bikes an identity created in the current window,
+// the invoker if none is named. Args: optionally the creator as <mspID>/<enrollmentID>
+func (s *SmartContract) getCreationQuota(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	creator := ""
+	if len(args) == 1 {
+		creator = args[0]
+		// Creators are recorded by label, whose ID is pseudonymized along with owners
+		if i := strings.Index(creator, "/"); i >= 0 && !isPseudonym(creator[i+1:]) {
+			if creator, err = identityLabel(APIstub, creator[:i], creator[i+1:]); err != nil {
+				return errorResponse(err)
+			}
+		}
+	} else if creator, err = getInvokerLabel(APIstub); err != nil {
+		return errorResponse(err)
+	}
+	quota, err := getCreationQuota(APIstub, config, creator)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	quotaAsBytes, _ := json.Marshal(quota)
+	return shim.Success(quotaAsBytes)
+}
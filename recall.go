@@ -0,0 +1,220 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Recall is a manufacturer's safety campaign covering every bike of one make and model
+type Recall struct {
+	RecallID    string `json:"recallID"`
+	Make        string `json:"make"`
+	Model       string `json:"model"`
+	Description string `json:"description"`
+	IssuedBy    string `json:"issuedBy"`
+	IssuedAt    int64  `json:"issuedAt"`
+}
+
+// RecallCompletion records that the work of a recall was done on a bike
+type RecallCompletion struct {
+	BikeKey     string `json:"bikeKey"`
+	RecallID    string `json:"recallID"`
+	CompletedBy string `json:"completedBy"`
+	CompletedAt int64  `json:"completedAt"`
+}
+
+// recallScope normalizes make and model, so "Honda" recalls reach bikes registered as "HONDA"
+func recallScope(bikeMake string, model string) []string {
+	return []string{strings.ToUpper(strings.TrimSpace(bikeMake)), strings.ToUpper(strings.TrimSpace(model))}
+}
+
+func recallCompletionKey(APIstub shim.ChaincodeStubInterface, bikeKey string, recallID string) (string, error) {
+	return APIstub.CreateCompositeKey("RECALLDONE", []string{bikeKey, recallID})
+}
+
+// manufacturerMSP returns the organization the config names as manufacturer of bikeMake
+func manufacturerMSP(APIstub shim.ChaincodeStubInterface, bikeMake string) (string, error) {
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return "", err
+	}
+
+	makes := make([]string, 0, len(config.Manufacturers))
+	for name := range config.Manufacturers {
+		makes = append(makes, name)
+	}
+	sort.Strings(makes)
+	for _, name := range makes {
+		if strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(bikeMake)) {
+			return config.Manufacturers[name], nil
+		}
+	}
+	return "", fmt.Errorf("No manufacturer is configured for %s", bikeMake)
+}
+
+func getRecall(APIstub shim.ChaincodeStubInterface, bike Bike, recallID string) (*Recall, error) {
+	key, err := APIstub.CreateCompositeKey("RECALL", append(recallScope(bike.Make, bike.Model), recallID))
+	if err != nil {
+		return nil, err
+	}
+	recallAsBytes, err := APIstub.GetState(key)
+	if err != nil || recallAsBytes == nil {
+		return nil, err
+	}
+
+	recall := Recall{}
+	err = json.Unmarshal(recallAsBytes, &recall)
+	return &recall, err
+}
+
+// openRecalls returns the recalls covering a bike that were not completed on it
+func openRecalls(APIstub shim.ChaincodeStubInterface, bikeKey string, bike Bike) ([]Recall, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("RECALL", recallScope(bike.Make, bike.Model))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	recalls := []Recall{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		recall := Recall{}
+		if err := json.Unmarshal(queryResponse.Value, &recall); err != nil {
+			return nil, err
+		}
+
+		key, err := recallCompletionKey(APIstub, bikeKey, recall.RecallID)
+		if err != nil {
+			return nil, err
+		}
+		completionAsBytes, err := APIstub.GetState(key)
+		if err != nil {
+			return nil, err
+		}
+		if completionAsBytes == nil {
+			recalls = append(recalls, recall)
+		}
+	}
+	return recalls, nil
+}
+
+/*
+ * issueRecall opens a recall for every bike of a make and model. Only the manufacturer's
+ * organization, as set in the config's manufacturers, may issue it.
+ * Args: make, model, recallID, description
+ */
+func (s *SmartContract) issueRecall(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[0] == "" || args[1] == "" || args[2] == "" {
+		return errorResponse(invalidArgs("Make, model and recall ID must not be empty"))
+	}
+	mspID, err := manufacturerMSP(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertMSP(APIstub, mspID); err != nil {
+		return errorResponse(err)
+	}
+
+	key, err := APIstub.CreateCompositeKey("RECALL", append(recallScope(args[0], args[1]), args[2]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	existing, err := APIstub.GetState(key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if existing != nil {
+		return shim.Error("Recall " + args[2] + " already exists")
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	recall := Recall{
+		RecallID:    args[2],
+		Make:        args[0],
+		Model:       args[1],
+		Description: args[3],
+		IssuedBy:    mspID,
+		IssuedAt:    now,
+	}
+	recallAsBytes, _ := json.Marshal(recall)
+	if err := APIstub.PutState(key, recallAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(recallAsBytes)
+}
+
+/*
+ * markRecallCompleted records that the recall work was done on a bike. A workshop or
+ * the manufacturer who issued the recall may mark it. Args: bikeKey, recallID
+ */
+func (s *SmartContract) markRecallCompleted(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	recall, err := getRecall(APIstub, bike, args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if recall == nil {
+		return shim.Error("Recall " + args[1] + " does not cover " + args[0])
+	}
+	if assertRole(APIstub, "workshop") != nil && assertMSP(APIstub, recall.IssuedBy) != nil {
+		return errorResponse(unauthorized("Only a workshop or %s can complete a recall", recall.IssuedBy))
+	}
+
+	invoker, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	completion := RecallCompletion{BikeKey: args[0], RecallID: args[1], CompletedBy: invoker, CompletedAt: now}
+
+	key, err := recallCompletionKey(APIstub, args[0], args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	completionAsBytes, _ := json.Marshal(completion)
+	if err := APIstub.PutState(key, completionAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(completionAsBytes)
+}
+
+// getOpenRecalls returns the outstanding recalls of a bike
+func (s *SmartContract) getOpenRecalls(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	recalls, err := openRecalls(APIstub, args[0], bike)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	recallsAsBytes, _ := json.Marshal(recalls)
+	return shim.Success(recallsAsBytes)
+}
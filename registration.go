@@ -0,0 +1,111 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// normalizeRegistrationNo strips spacing and case so "ka-01 ab 1234" and "KA01AB1234" collide
+func normalizeRegistrationNo(regNo string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(regNo))
+}
+
+func regNoKey(APIstub shim.ChaincodeStubInterface, regNo string) (string, error) {
+	return APIstub.CreateCompositeKey("REGNO", []string{regNo})
+}
+
+// lookupRegistrationNo returns the key of the bike holding regNo, or "" if none does.
+// Index entries left behind by a bike that has since been given another number are ignored.
+func lookupRegistrationNo(APIstub shim.ChaincodeStubInterface, regNo string) (string, error) {
+	indexKey, err := regNoKey(APIstub, regNo)
+	if err != nil {
+		return "", err
+	}
+	keyAsBytes, err := APIstub.GetState(indexKey)
+	if err != nil || keyAsBytes == nil {
+		return "", err
+	}
+
+	bike, err := getBike(APIstub, string(keyAsBytes))
+	if err != nil || bike.RegistrationNo != regNo {
+		return "", nil
+	}
+	return string(keyAsBytes), nil
+}
+
+// claimRegistrationNo reserves regNo for the bike stored under bikeKey, failing if another bike holds it
+func claimRegistrationNo(APIstub shim.ChaincodeStubInterface, regNo string, bikeKey string) error {
+	holder, err := lookupRegistrationNo(APIstub, regNo)
+	if err != nil {
+		return err
+	}
+	if holder != "" && holder != bikeKey {
+		return fmt.Errorf("Registration number %s is already assigned to %s", regNo, holder)
+	}
+
+	indexKey, err := regNoKey(APIstub, regNo)
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(indexKey, []byte(bikeKey))
+}
+
+// releaseRegistrationNo drops the index entry of regNo if it still points at the bike under bikeKey
+func releaseRegistrationNo(APIstub shim.ChaincodeStubInterface, regNo string, bikeKey string) error {
+	if regNo == "" {
+		return nil
+	}
+	indexKey, err := regNoKey(APIstub, regNo)
+	if err != nil {
+		return err
+	}
+	keyAsBytes, err := APIstub.GetState(indexKey)
+	if err != nil || string(keyAsBytes) != bikeKey {
+		return err
+	}
+	return APIstub.DelState(indexKey)
+}
+
+// queryBikeByRegistrationNo returns the bike carrying a registration number as a QueryResult, optionally only the given fields
+func (s *SmartContract) queryBikeByRegistrationNo(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	fields, err := parseFields(args, 1)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := lookupRegistrationNo(APIstub, normalizeRegistrationNo(args[0]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	if key == "" {
+		return errorResponse(notFound("No bike with registration number %s", args[0]))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertTenantKey(APIstub, config, key); err != nil {
+		return errorResponse(err)
+	}
+	bike, err := getBike(APIstub, key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	bikeAsBytes, _ := json.Marshal(bike)
+
+	resultAsBytes, _ := json.Marshal(newQueryResult(key, projectRecord(bikeAsBytes, fields)))
+	return shim.Success(resultAsBytes)
+}
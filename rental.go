@@ -0,0 +1,194 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	statusRented = "RENTED"
+	// maxRentalHours caps a single rental at 30 days
+	maxRentalHours = 30 * 24
+)
+
+// Rental is one hire of a bike. ReturnedAt is 0 while the bike is still out.
+type Rental struct {
+	BikeKey    string `json:"bikeKey"`
+	Seq        string `json:"seq"`
+	RenterID   string `json:"renterID"`
+	StartAt    int64  `json:"startAt"`
+	DueAt      int64  `json:"dueAt"`
+	ReturnedAt int64  `json:"returnedAt"`
+	Late       bool   `json:"late"`
+	TxID       string `json:"txID"`
+}
+
+func activeRentalKey(APIstub shim.ChaincodeStubInterface, bikeKey string) (string, error) {
+	return APIstub.CreateCompositeKey("ACTIVERENTAL", []string{bikeKey})
+}
+
+func putRental(APIstub shim.ChaincodeStubInterface, rental Rental) error {
+	key, err := APIstub.CreateCompositeKey("RENTAL", []string{rental.BikeKey, rental.Seq})
+	if err != nil {
+		return err
+	}
+	rentalAsBytes, _ := json.Marshal(rental)
+	return APIstub.PutState(key, rentalAsBytes)
+}
+
+/*
+ * rentBike hires a bike out. Only the owner may rent it out, and a rented bike
+ * cannot be transferred until it is returned. Args: bikeKey, renterID, durationHours
+ */
+func (s *SmartContract) rentBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	hours, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || hours <= 0 || hours > maxRentalHours {
+		return errorResponse(invalidArgs("Duration must be between 1 and %d hours", maxRentalHours))
+	}
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Renter ID must not be empty"))
+	}
+	if err := requireFeature(APIstub, featureRentals); err != nil {
+		return errorResponse(err)
+	}
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if bike.Status != statusActive {
+		return shim.Error(fmt.Sprintf("Bike %s is %s and cannot be rented", args[0], bike.Status))
+	}
+	if err := assertNotReserved(APIstub, args[0], args[1]); err != nil {
+		return errorResponse(err)
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	seq, err := nextSeq(APIstub, "RENTAL", args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	rental := Rental{
+		BikeKey:  args[0],
+		Seq:      seq,
+		RenterID: args[1],
+		StartAt:  now,
+		DueAt:    now + hours*60*60,
+		TxID:     APIstub.GetTxID(),
+	}
+	if err := putRental(APIstub, rental); err != nil {
+		return errorResponse(err)
+	}
+	activeKey, err := activeRentalKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	rentalAsBytes, _ := json.Marshal(rental)
+	if err := APIstub.PutState(activeKey, rentalAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	bike.Status = statusRented
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(rentalAsBytes)
+}
+
+// returnBike ends the current rental of a bike. The owner or the renter may call it.
+func (s *SmartContract) returnBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	activeKey, err := activeRentalKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	rentalAsBytes, err := APIstub.GetState(activeKey)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if rentalAsBytes == nil {
+		return shim.Error(fmt.Sprintf("Bike %s is not rented out", args[0]))
+	}
+	rental := Rental{}
+	if err := json.Unmarshal(rentalAsBytes, &rental); err != nil {
+		return errorResponse(err)
+	}
+
+	invoker, err := getInvokerRef(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if invoker != bike.Owner && invoker != rental.RenterID {
+		return errorResponse(unauthorized("Only the owner or the renter can return the bike"))
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	rental.ReturnedAt = now
+	rental.Late = now > rental.DueAt
+	if err := putRental(APIstub, rental); err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.DelState(activeKey); err != nil {
+		return errorResponse(err)
+	}
+
+	bike.Status = statusActive
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	rentalAsBytes, _ = json.Marshal(rental)
+	return shim.Success(rentalAsBytes)
+}
+
+// getRentalHistory returns every rental of a bike, oldest first
+func (s *SmartContract) getRentalHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("RENTAL", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	rentals := []Rental{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		rental := Rental{}
+		if err := json.Unmarshal(queryResponse.Value, &rental); err != nil {
+			return errorResponse(err)
+		}
+		rentals = append(rentals, rental)
+	}
+
+	rentalsAsBytes, _ := json.Marshal(rentals)
+	return shim.Success(rentalsAsBytes)
+}
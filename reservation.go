@@ -0,0 +1,185 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxReservationSeconds caps how far ahead a bike can be held, 14 days
+const maxReservationSeconds = 14 * 24 * 60 * 60
+
+// Reservation holds a bike for a customer, for a test ride say, until Until. While it
+// holds, the bike can only be transferred or rented to ReservedFor, or to nobody if that is
+// empty. It lapses by itself: once the transaction timestamp passes Until it is ignored.
+type Reservation struct {
+	BikeKey     string `json:"bikeKey"`
+	ReservedBy  string `json:"reservedBy"`
+	ReservedFor string `json:"reservedFor,omitempty"`
+	ReservedAt  int64  `json:"reservedAt"`
+	Until       int64  `json:"until"`
+}
+
+func reservationKey(APIstub shim.ChaincodeStubInterface, bikeKey string) (string, error) {
+	return APIstub.CreateCompositeKey("RESERVATION", []string{bikeKey})
+}
+
+// getReservation returns the reservation holding a bike right now, or nil if there is
+// none or it has lapsed
+func getReservation(APIstub shim.ChaincodeStubInterface, bikeKey string) (*Reservation, error) {
+	key, err := reservationKey(APIstub, bikeKey)
+	if err != nil {
+		return nil, err
+	}
+	reservationAsBytes, err := APIstub.GetState(key)
+	if err != nil || reservationAsBytes == nil {
+		return nil, err
+	}
+	reservation := Reservation{}
+	if err := json.Unmarshal(reservationAsBytes, &reservation); err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return nil, err
+	}
+	if now > reservation.Until {
+		return nil, nil
+	}
+	return &reservation, nil
+}
+
+// clearReservation drops any reservation on a bike, lapsed or not
+func clearReservation(APIstub shim.ChaincodeStubInterface, bikeKey string) error {
+	key, err := reservationKey(APIstub, bikeKey)
+	if err != nil {
+		return err
+	}
+	return APIstub.DelState(key)
+}
+
+// assertNotReserved fails if a reservation holds the bike for someone other than recipient.
+// Pass an empty recipient for moves that hand the bike to nobody in particular, like auctions.
+func assertNotReserved(APIstub shim.ChaincodeStubInterface, bikeKey string, recipient string) error {
+	reservation, err := getReservation(APIstub, bikeKey)
+	if err != nil || reservation == nil {
+		return err
+	}
+	if reservation.ReservedFor == "" || recipient != reservation.ReservedFor {
+		return fmt.Errorf("Bike %s is reserved until %d", bikeKey, reservation.Until)
+	}
+	return nil
+}
+
+/*
+ * reserveBike holds a bike until a Unix timestamp, optionally for one customer, who alone may
+ * then be offered or rent it. Only the owner may reserve, a new reservation replaces the last,
+ * and none may run more than 14 days ahead. Args: bikeKey, until, [reservedFor]
+ */
+func (s *SmartContract) reserveBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	until, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errorResponse(invalidArgs("Until must be a Unix timestamp"))
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if bike.Status != statusActive {
+		return shim.Error(fmt.Sprintf("Bike %s is %s and cannot be reserved", args[0], bike.Status))
+	}
+	if err := assertNotAuctioned(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	reservedFor := ""
+	if len(args) == 3 {
+		reservedFor = args[2]
+	}
+	if reservedFor == bike.Owner {
+		return shim.Error("Bike is already owned by " + reservedFor)
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if until <= now || until > now+maxReservationSeconds {
+		return errorResponse(invalidArgs("Until must be after %d and at most %d", now, now+maxReservationSeconds))
+	}
+
+	reservation := Reservation{
+		BikeKey:     args[0],
+		ReservedBy:  bike.Owner,
+		ReservedFor: reservedFor,
+		ReservedAt:  now,
+		Until:       until,
+	}
+	key, err := reservationKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	reservationAsBytes, _ := json.Marshal(reservation)
+	if err := APIstub.PutState(key, reservationAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(reservationAsBytes)
+}
+
+// cancelReservation releases a bike early. The owner or the customer it is held for may cancel.
+func (s *SmartContract) cancelReservation(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	reservation, err := getReservation(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if reservation == nil {
+		return errorResponse(notFound("Bike %s is not reserved", args[0]))
+	}
+	invoker, err := getInvokerRef(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if invoker != bike.Owner && (reservation.ReservedFor == "" || invoker != reservation.ReservedFor) {
+		return errorResponse(unauthorized("Only the owner or the customer can cancel the reservation"))
+	}
+
+	if err := clearReservation(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+// getReservation returns the reservation holding a bike, failing if there is none or it has lapsed
+func (s *SmartContract) getReservation(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	reservation, err := getReservation(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if reservation == nil {
+		return errorResponse(notFound("Bike %s is not reserved", args[0]))
+	}
+
+	reservationAsBytes, _ := json.Marshal(reservation)
+	return shim.Success(reservationAsBytes)
+}
@@ -0,0 +1,365 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// HandlerFunc is implemented by every function callable through Invoke
+type HandlerFunc func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response
+
+// Route registers a function with the number of arguments it takes.
+// MaxArgs is -1 when any number of arguments above MinArgs is allowed.
+// ReadOnly functions never write state, so there is nothing to count for them.
+// Raw functions answer in a format fixed elsewhere and skip the response envelope.
+type Route struct {
+	Handler  HandlerFunc
+	MinArgs  int
+	MaxArgs  int
+	ReadOnly bool
+	Raw      bool
+}
+
+// Middleware wraps the handler of the named route
+type Middleware func(name string, route Route, next HandlerFunc) HandlerFunc
+
+// fixed, between and atLeast build routes taking exactly n, min to max, or at least min arguments
+func fixed(handler HandlerFunc, n int) Route {
+	return Route{Handler: handler, MinArgs: n, MaxArgs: n}
+}
+
+func between(handler HandlerFunc, min int, max int) Route {
+	return Route{Handler: handler, MinArgs: min, MaxArgs: max}
+}
+
+func atLeast(handler HandlerFunc, min int) Route {
+	return Route{Handler: handler, MinArgs: min, MaxArgs: -1}
+}
+
+func query(route Route) Route {
+	route.ReadOnly = true
+	return route
+}
+
+func raw(route Route) Route {
+	route.Raw = true
+	return route
+}
+
+// noArgs adapts a handler that takes no arguments
+func noArgs(handler func(shim.ChaincodeStubInterface) sc.Response) HandlerFunc {
+	return func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+		return handler(APIstub)
+	}
+}
+
+// routes lists every function of the Smart Contract. A new function only needs a line here
+// and the names of its arguments in routeArgs.
+func (s *SmartContract) routes() map[string]Route {
+	return map[string]Route{
+		"queryBike":         query(between(s.queryBike, 1, 2)),
+		"bikeExists":        query(fixed(s.bikeExists, 1)),
+		"initLedger":        fixed(noArgs(s.initLedger), 0),
+		"createBike":        between(s.createBike, 5, 7),
+		"createBikeAutoKey": between(s.createBikeAutoKey, 4, 6),
+		"createBikesBatch":  between(s.createBikesBatch, 0, 1),
+		"createVehicle":     fixed(s.createVehicle, 2),
+		"updateBike":        fixed(s.updateBike, 3),
+		"patchBike":         between(s.patchBike, 2, 3),
+
+		"requestModification":     fixed(s.requestModification, 2),
+		"approveModification":     fixed(s.approveModification, 1),
+		"rejectModification":      fixed(s.rejectModification, 2),
+		"getPendingModifications": query(between(s.getPendingModifications, 0, 1)),
+
+		"queryAllBikes":         query(between(s.queryAllBikes, 0, 2)),
+		"getBikesByRange":       query(between(s.getBikesByRange, 2, 3)),
+		"exportLedger":          query(between(s.exportLedger, 3, 5)),
+		"getBikesModifiedSince": query(between(s.getBikesModifiedSince, 1, 3)),
+		"getCreationQuota":      query(between(s.getCreationQuota, 0, 1)),
+
+		"archiveBike":       fixed(s.archiveBike, 1),
+		"restoreBike":       fixed(s.restoreBike, 1),
+		"queryArchivedBike": query(fixed(s.queryArchivedBike, 1)),
+
+		"freezeBike":   fixed(s.freezeBike, 2),
+		"unfreezeBike": fixed(s.unfreezeBike, 1),
+
+		"changeBikeOwner":    between(s.changeBikeOwner, 2, 3),
+		"offerTransfer":      between(s.offerTransfer, 3, 5),
+		"acceptTransfer":     between(s.acceptTransfer, 1, 2),
+		"queryTransferOffer": query(fixed(s.queryTransferOffer, 1)),
+		"validateTransfer":   query(fixed(s.validateTransfer, 2)),
+
+		"grantDelegate":  fixed(s.grantDelegate, 3),
+		"revokeDelegate": fixed(s.revokeDelegate, 2),
+		"getDelegates":   query(fixed(s.getDelegates, 1)),
+
+		"transferBikesBatch": fixed(s.transferBikesBatch, 2),
+		"getTransferLog":     query(fixed(s.getTransferLog, 1)),
+
+		"recordSalePrice": fixed(s.recordSalePrice, 3),
+		"getPriceHistory": query(fixed(s.getPriceHistory, 1)),
+		"estimateValue":   query(fixed(s.estimateValue, 1)),
+
+		"registerConsentCert": fixed(noArgs(s.registerConsentCert), 0),
+		"buildConsentPayload": query(fixed(s.buildConsentPayload, 3)),
+
+		"reserveBike":       between(s.reserveBike, 2, 3),
+		"cancelReservation": fixed(s.cancelReservation, 1),
+		"getReservation":    query(fixed(s.getReservation, 1)),
+
+		"addServiceRecord":  fixed(s.addServiceRecord, 5),
+		"getServiceRecords": query(fixed(s.getServiceRecords, 1)),
+		"recordOdometer":    fixed(s.recordOdometer, 3),
+		"getOdometer":       query(fixed(s.getOdometer, 1)),
+
+		"issueRecall":         fixed(s.issueRecall, 4),
+		"markRecallCompleted": fixed(s.markRecallCompleted, 2),
+		"getOpenRecalls":      query(fixed(s.getOpenRecalls, 1)),
+
+		"issueFitnessCertificate": fixed(s.issueFitnessCertificate, 3),
+		"getCertificates":         query(fixed(s.getCertificates, 1)),
+
+		"openDispute":    fixed(s.openDispute, 3),
+		"submitEvidence": fixed(s.submitEvidence, 2),
+		"resolveDispute": fixed(s.resolveDispute, 2),
+		"getDispute":     query(fixed(s.getDispute, 1)),
+		"getDisputes":    query(fixed(s.getDisputes, 1)),
+
+		"addToWatchlist":      fixed(s.addToWatchlist, 2),
+		"removeFromWatchlist": fixed(s.removeFromWatchlist, 1),
+		"checkChassisNo":      query(fixed(s.checkChassisNo, 1)),
+		"getWatchlist":        query(fixed(noArgs(s.getWatchlist), 0)),
+
+		"migrateBikeKeys":           between(s.migrateBikeKeys, 0, 1),
+		"migrate":                   between(s.migrate, 0, 1),
+		"rebuildIndexes":            fixed(noArgs(s.rebuildIndexes), 0),
+		"setAssetSchema":            fixed(s.setAssetSchema, 2),
+		"getAssetSchema":            query(fixed(s.getAssetSchema, 1)),
+		"importFromFabcar":          between(s.importFromFabcar, 0, 1),
+		"queryCar":                  raw(query(fixed(s.queryCar, 1))),
+		"getSchemaVersion":          query(fixed(noArgs(s.getSchemaVersion), 0)),
+		"queryBikeByRegistrationNo": query(between(s.queryBikeByRegistrationNo, 1, 2)),
+		"queryBikeByChassis":        query(between(s.queryBikeByChassis, 1, 2)),
+		"getBikeQRPayload":          query(fixed(s.getBikeQRPayload, 1)),
+		"resolveQRPayload":          query(fixed(s.resolveQRPayload, 1)),
+
+		"rentBike":         fixed(s.rentBike, 3),
+		"returnBike":       fixed(s.returnBike, 1),
+		"getRentalHistory": query(fixed(s.getRentalHistory, 1)),
+
+		"replaceComponent":    fixed(s.replaceComponent, 4),
+		"getBikeComponents":   query(fixed(s.getBikeComponents, 1)),
+		"getComponentLog":     query(fixed(s.getComponentLog, 1)),
+		"getComponentHistory": query(fixed(s.getComponentHistory, 2)),
+
+		"startLease":         fixed(s.startLease, 4),
+		"recordLeasePayment": fixed(s.recordLeasePayment, 2),
+		"getLeaseStatus":     query(fixed(s.getLeaseStatus, 1)),
+
+		"startAuction": fixed(s.startAuction, 3),
+		"placeBid":     fixed(s.placeBid, 1),
+		"revealBid":    fixed(s.revealBid, 1),
+		"closeAuction": fixed(s.closeAuction, 1),
+		"queryAuction": query(fixed(s.queryAuction, 1)),
+		"buyBike":      between(s.buyBike, 2, 3),
+
+		"quoteTransferFee": query(fixed(s.quoteTransferFee, 1)),
+		"getFeeReceipts":   query(fixed(s.getFeeReceipts, 1)),
+
+		"registerLien":        fixed(s.registerLien, 3),
+		"approveLienTransfer": fixed(s.approveLienTransfer, 2),
+		"releaseLien":         fixed(s.releaseLien, 1),
+		"getLien":             query(fixed(s.getLien, 1)),
+
+		"mint":          fixed(s.mint, 2),
+		"transferFunds": fixed(s.transferFunds, 3),
+		"getBalance":    query(fixed(s.getBalance, 1)),
+
+		"ownerOf":      query(fixed(s.ownerOf, 1)),
+		"balanceOf":    query(fixed(s.balanceOf, 1)),
+		"approve":      fixed(s.approve, 2),
+		"getApproved":  query(fixed(s.getApproved, 1)),
+		"transferFrom": fixed(s.transferFrom, 3),
+
+		"setBikeEndorsementPolicy": atLeast(s.setBikeEndorsementPolicy, 2),
+		"getBikeEndorsementPolicy": query(fixed(s.getBikeEndorsementPolicy, 1)),
+		"getBikeAudit":             query(fixed(s.getBikeAudit, 1)),
+		"getBikeWithMetadata":      query(fixed(s.getBikeWithMetadata, 1)),
+
+		"attachPolicy":  fixed(s.attachPolicy, 4),
+		"getBikePolicy": query(fixed(s.getBikePolicy, 1)),
+		"fileClaim":     fixed(s.fileClaim, 2),
+		"settleClaim":   fixed(s.settleClaim, 2),
+		"getClaims":     query(fixed(s.getClaims, 1)),
+
+		"reportAccident":     fixed(s.reportAccident, 4),
+		"getAccidentHistory": query(fixed(s.getAccidentHistory, 1)),
+		"getAccidentDetails": query(fixed(s.getAccidentDetails, 1)),
+
+		"applySubsidy": fixed(s.applySubsidy, 3),
+		"getSubsidies": query(fixed(s.getSubsidies, 1)),
+
+		"registerWarranty":  fixed(s.registerWarranty, 2),
+		"checkWarranty":     query(fixed(s.checkWarranty, 1)),
+		"fileWarrantyClaim": fixed(s.fileWarrantyClaim, 2),
+
+		"registerOwner":   fixed(s.registerOwner, 4),
+		"updateOwner":     fixed(s.updateOwner, 4),
+		"getOwnerProfile": query(fixed(s.getOwnerProfile, 1)),
+		"purgeOwnerPII":   fixed(s.purgeOwnerPII, 1),
+
+		"getConfig": query(fixed(noArgs(s.getConfig), 0)),
+		"setConfig": fixed(s.setConfig, 1),
+
+		"queryBikesByFilter": query(between(s.queryBikesByFilter, 1, 4)),
+		"queryWithSelector":  query(between(s.queryWithSelector, 2, 3)),
+		"recordTelemetry":    fixed(s.recordTelemetry, 6),
+		"getLatestTelemetry": query(fixed(s.getLatestTelemetry, 1)),
+
+		"attachDocument": fixed(s.attachDocument, 4),
+		"verifyDocument": query(fixed(s.verifyDocument, 3)),
+		"revokeDocument": fixed(s.revokeDocument, 3),
+		"listDocuments":  query(between(s.listDocuments, 1, 2)),
+
+		"getMetrics":        query(between(s.getMetrics, 0, 1)),
+		"countBikes":        query(fixed(noArgs(s.countBikes), 0)),
+		"compactBikeCounts": fixed(noArgs(s.compactBikeCounts), 0),
+		"getBikeStats":      query(fixed(s.getBikeStats, 1)),
+
+		"queryAllTenants": query(between(s.queryAllTenants, 0, 1)),
+
+		"continueQuery": query(fixed(s.continueQuery, 1)),
+
+		"setOrganization":    fixed(s.setOrganization, 2),
+		"removeOrganization": fixed(s.removeOrganization, 1),
+		"getOrganization":    query(fixed(s.getOrganization, 1)),
+		"getOrganizations":   query(fixed(noArgs(s.getOrganizations), 0)),
+
+		"setOwnerSalt":     fixed(noArgs(s.setOwnerSalt), 0),
+		"resolveOwnerHash": query(fixed(s.resolveOwnerHash, 1)),
+
+		"getContractMetadata": query(fixed(noArgs(s.getContractMetadata), 0)),
+	}
+}
+
+// middleware is applied to every route, outermost first
+var middleware = []Middleware{wrapEnvelope, logInvocation, countInvocation, chunkResults, checkArgCount, scopeTenant, pseudonymizeOwners}
+
+// dispatch looks up the named function and runs it through the middleware
+func (s *SmartContract) dispatch(APIstub shim.ChaincodeStubInterface, function string, args []string) sc.Response {
+	route, ok := s.routes()[function]
+	if !ok {
+		return envelope(APIstub, errorResponse(codedError{code: codeUnknownFunction, message: "Invalid Smart Contract function name."}))
+	}
+
+	handler := route.Handler
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](function, route, handler)
+	}
+	return handler(APIstub, args)
+}
+
+// checkArgCount rejects calls with a number of arguments the route does not take
+func checkArgCount(name string, route Route, next HandlerFunc) HandlerFunc {
+	return func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+		n := len(args)
+		if n < route.MinArgs || (route.MaxArgs >= 0 && n > route.MaxArgs) {
+			return errorResponse(invalidArgs("Incorrect number of arguments. Expecting %s", argCountText(route)))
+		}
+		return next(APIstub, args)
+	}
+}
+
+func argCountText(route Route) string {
+	switch {
+	case route.MaxArgs < 0:
+		return fmt.Sprintf("at least %d", route.MinArgs)
+	case route.MinArgs == route.MaxArgs:
+		return fmt.Sprintf("%d", route.MinArgs)
+	case route.MaxArgs == route.MinArgs+1:
+		return fmt.Sprintf("%d or %d", route.MinArgs, route.MaxArgs)
+	default:
+		return fmt.Sprintf("%d to %d", route.MinArgs, route.MaxArgs)
+	}
+}
+
+// logInvocation logs who called which function and how it ended, and at debug level the
+// arguments. Logs stay on the peer, so unlike state they need not be the same on every endorser.
+func logInvocation(name string, route Route, next HandlerFunc) HandlerFunc {
+	return func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+		loadLogLevel(APIstub)
+		log := txLog(APIstub)
+		invoker, err := getInvokerLabel(APIstub)
+		if err != nil {
+			invoker = "unknown"
+		}
+		log.Infof("called by %s", invoker)
+		log.Debugf("args %q", args)
+
+		response := next(APIstub, args)
+		if response.Status >= shim.ERRORTHRESHOLD {
+			log.Warningf("failed with status %d: %s", response.Status, response.Message)
+		}
+		return response
+	}
+}
+
+// countInvocation records each successful call of a writing function under
+// METRIC[function, txID]. Giving every transaction its own key keeps concurrent calls
+// from conflicting on a shared counter; getMetrics adds them up. Failed calls are never
+// committed, so they cannot be counted on the ledger.
+func countInvocation(name string, route Route, next HandlerFunc) HandlerFunc {
+	if route.ReadOnly {
+		return next
+	}
+	return func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+		response := next(APIstub, args)
+		if response.Status >= shim.ERRORTHRESHOLD {
+			return response
+		}
+
+		metricKey, err := APIstub.CreateCompositeKey("METRIC", []string{name, APIstub.GetTxID()})
+		if err != nil {
+			return errorResponse(err)
+		}
+		if err := APIstub.PutState(metricKey, []byte{0x00}); err != nil {
+			return errorResponse(err)
+		}
+		return response
+	}
+}
+
+// getMetrics returns the number of committed calls per function, or for one function
+func (s *SmartContract) getMetrics(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("METRIC", args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	counts := map[string]int{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return errorResponse(err)
+		}
+		counts[attributes[0]]++
+	}
+
+	countsAsBytes, _ := json.Marshal(counts)
+	return shim.Success(countsAsBytes)
+}
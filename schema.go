@@ -0,0 +1,159 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// currentSchemaVersion is the Bike layout this chaincode writes.
+	// Bump it together with a new entry in schemaUpgrades.
+	currentSchemaVersion = 3
+	// schemaVersionKey holds the version every stored bike has been migrated to
+	schemaVersionKey = "SCHEMA_VERSION"
+
+	statusActive = "ACTIVE"
+)
+
+// schemaUpgrades[i] upgrades a bike from version i+1 to i+2. Upgrades also fill in
+// defaults for freshly created bikes, so they must leave fields that are already set alone.
+var schemaUpgrades = []func(bike *Bike){
+	// 1 -> 2: bikes get a status
+	func(bike *Bike) {
+		if bike.Status == "" {
+			bike.Status = statusActive
+		}
+	},
+	// 2 -> 3: bikes get an asset type
+	func(bike *Bike) {
+		if bike.AssetType == "" {
+			bike.AssetType = assetMotorbike
+		}
+	},
+}
+
+// upgradeBike brings a bike read in any older layout up to currentSchemaVersion.
+// Records written before versioning existed carry no version and are treated as version 1.
+func upgradeBike(bike *Bike) {
+	if bike.SchemaVersion == 0 {
+		bike.SchemaVersion = 1
+	}
+	for bike.SchemaVersion < currentSchemaVersion {
+		schemaUpgrades[bike.SchemaVersion-1](bike)
+		bike.SchemaVersion = bike.SchemaVersion + 1
+	}
+}
+
+// MigrationStatus is the result of a migrate call
+type MigrationStatus struct {
+	SchemaVersion int  `json:"schemaVersion"`
+	Migrated      int  `json:"migrated"`
+	Done          bool `json:"done"`
+}
+
+/*
+ * migrate eagerly rewrites stored bikes in the current schema after a chaincode upgrade.
+ * Bikes are also upgraded lazily whenever they are read and written back, so running it is
+ * only needed to make raw range queries consistent. The bikes of every tenant are covered.
+ * Args: optionally the maximum number of bikes to rewrite; call again until done is true,
+ * which also records the ledger schema version.
+ */
+func (s *SmartContract) migrate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	limit := defaultMigrationLimit
+	if len(args) == 1 {
+		var err error
+		limit, err = strconv.Atoi(args[0])
+		if err != nil || limit <= 0 {
+			return errorResponse(invalidArgs("Limit must be a positive integer"))
+		}
+	}
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	status := MigrationStatus{SchemaVersion: currentSchemaVersion, Done: true}
+	for _, tenant := range append([]string{""}, tenantNames(config)...) {
+		prefix := tenantKeyPrefix(config, tenant)
+		if err := migratePrefix(APIstub, prefix, limit, &status); err != nil {
+			return errorResponse(err)
+		}
+		if !status.Done {
+			break
+		}
+	}
+
+	if status.Done {
+		if err := APIstub.PutState(schemaVersionKey, []byte(strconv.Itoa(currentSchemaVersion))); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	statusAsBytes, _ := json.Marshal(status)
+	return shim.Success(statusAsBytes)
+}
+
+// migratePrefix rewrites the outdated bikes under prefix until status holds limit of them,
+// clearing status.Done if more are left
+func migratePrefix(APIstub shim.ChaincodeStubInterface, prefix string, limit int, status *MigrationStatus) error {
+	resultsIterator, err := APIstub.GetStateByRange(prefix, prefixRangeEnd(prefix))
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		bike := Bike{}
+		if err := json.Unmarshal(queryResponse.Value, &bike); err != nil {
+			return fmt.Errorf("Record %s is not a bike", queryResponse.Key)
+		}
+		if bike.SchemaVersion >= currentSchemaVersion {
+			continue
+		}
+		if status.Migrated == limit {
+			status.Done = false
+			return nil
+		}
+		if err := putBike(APIstub, queryResponse.Key, bike); err != nil {
+			return err
+		}
+		status.Migrated = status.Migrated + 1
+	}
+	return nil
+}
+
+// getSchemaVersion reports the schema this chaincode writes and the one the ledger was last migrated to
+func (s *SmartContract) getSchemaVersion(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	versionAsBytes, err := APIstub.GetState(schemaVersionKey)
+	if err != nil {
+		return errorResponse(err)
+	}
+	ledgerVersion := 1
+	if versionAsBytes != nil {
+		ledgerVersion, err = strconv.Atoi(string(versionAsBytes))
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(map[string]int{
+		"chaincode": currentSchemaVersion,
+		"ledger":    ledgerVersion,
+	})
+	return shim.Success(resultAsBytes)
+}
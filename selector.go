@@ -0,0 +1,81 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// selectorQuery renders a caller's Mango selector as a CouchDB query that can only match
+// bikes with keys starting with keyPrefix, whatever the selector says about _id
+func selectorQuery(selectorJSON string, keyPrefix string) (string, error) {
+	selector := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(selectorJSON), &selector); err != nil || selector == nil {
+		return "", invalidArgs("Selector must be a JSON object")
+	}
+	query := map[string]interface{}{
+		"selector": map[string]interface{}{
+			"$and": []interface{}{
+				map[string]interface{}{"_id": map[string]string{"$regex": "^" + regexp.QuoteMeta(keyPrefix)}},
+				selector,
+			},
+		},
+	}
+	queryAsBytes, _ := json.Marshal(query)
+	return string(queryAsBytes), nil
+}
+
+/*
+ * queryWithSelector runs a Mango selector of the caller's, e.g.
+ * {"engineCC": {"$gte": 150}, "make": {"$in": ["Honda", "Bajaj"]}}, against the bikes the
+ * caller may list, for analytics the other queries do not cover. Only identities with the
+ * role=analyst attribute may run one. Only the selector is taken from the caller, so it
+ * cannot pick indexes or fields, and results always come in pages, which CouchDB bounds.
+ * It needs CouchDB as the state database and fails on LevelDB.
+ * Args: selector JSON, pageSize, [bookmark]
+ */
+func (s *SmartContract) queryWithSelector(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertRole(APIstub, "analyst"); err != nil {
+		return errorResponse(err)
+	}
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	bookmark := ""
+	if len(args) > 2 {
+		bookmark = args[2]
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	prefix, err := scopedKeyPrefix(APIstub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
+	query, err := selectorQuery(args[0], prefix)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	resultsIterator, metadata, err := APIstub.GetQueryResultWithPagination(query, pageSize, bookmark)
+	if err != nil {
+		return errorResponse(fmt.Errorf("Selector queries need CouchDB as the state database: %s", err.Error()))
+	}
+	defer resultsIterator.Close()
+
+	results, err := collectResults(resultsIterator, nil)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return pagedResponse(results, metadata)
+}
@@ -0,0 +1,100 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ServiceRecord is one entry in a bike's maintenance history
+type ServiceRecord struct {
+	BikeKey     string `json:"bikeKey"`
+	Seq         string `json:"seq"`
+	Date        string `json:"date"`
+	Odometer    int64  `json:"odometer"`
+	WorkshopID  string `json:"workshopID"`
+	Description string `json:"description"`
+	TxID        string `json:"txID"`
+}
+
+/*
+ * addServiceRecord appends a maintenance entry to a bike's history.
+ * Args: bikeKey, date (YYYY-MM-DD), odometer, workshopID, description
+ */
+func (s *SmartContract) addServiceRecord(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if _, err := time.Parse("2006-01-02", args[1]); err != nil {
+		return errorResponse(invalidArgs("Date must be formatted as YYYY-MM-DD"))
+	}
+	odometer, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || odometer < 0 {
+		return errorResponse(invalidArgs("Odometer must be a non-negative integer"))
+	}
+	if args[3] == "" {
+		return errorResponse(invalidArgs("Workshop ID must not be empty"))
+	}
+	if _, err := getMutableBike(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+
+	seq, err := nextSeq(APIstub, "SERVICE", args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	record := ServiceRecord{
+		BikeKey:     args[0],
+		Seq:         seq,
+		Date:        args[1],
+		Odometer:    odometer,
+		WorkshopID:  args[3],
+		Description: args[4],
+		TxID:        APIstub.GetTxID(),
+	}
+
+	key, err := APIstub.CreateCompositeKey("SERVICE", []string{args[0], seq})
+	if err != nil {
+		return errorResponse(err)
+	}
+	recordAsBytes, _ := json.Marshal(record)
+	if err := APIstub.PutState(key, recordAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(recordAsBytes)
+}
+
+// getServiceRecords returns a bike's service history, oldest first
+func (s *SmartContract) getServiceRecords(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("SERVICE", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	records := []ServiceRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		record := ServiceRecord{}
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return errorResponse(err)
+		}
+		records = append(records, record)
+	}
+
+	recordsAsBytes, _ := json.Marshal(records)
+	return shim.Success(recordsAsBytes)
+}
@@ -0,0 +1,110 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Conflicts come in two kinds. A transaction whose read set was changed by another one
+// committed first is marked MVCC_READ_CONFLICT by the peers when it is validated, after
+// the chaincode has run; the chaincode cannot see those. What it can see is state that
+// moved on since the client read it: a bike at another version, an offer that was
+// replaced. Those fail with VERSION_CONFLICT or STATE_CONFLICT. All of them are transient,
+// a retry on fresh state may succeed, and the envelope flags them as retryable, unlike
+// the failures of business rules.
+
+// stateConflict reports that a record is no longer in the state the caller last read
+type stateConflict struct {
+	what string
+}
+
+func (e stateConflict) Error() string {
+	return fmt.Sprintf("%s changed since it was read; re-read it and retry", e.what)
+}
+
+// stateHash fingerprints a stored value, for clients to hand back as a precondition
+func stateHash(value []byte) string {
+	digest := sha256.Sum256(value)
+	return hex.EncodeToString(digest[:])
+}
+
+// stagedState is the ledger as a multi-step flow sees it within one transaction. Fabric
+// answers reads from the state committed before the transaction, so a flow that writes a
+// key and reads it again, as several of its steps may, would see the old value.
+// stagedState passes writes on at once and answers later reads of the same keys from them.
+// It also keeps what it first read of every key, the transaction's read set, for
+// preconditions to be checked against. Range and composite key queries do not see staged
+// writes. It can stand in for the stub anywhere, so helpers need no changes to use it.
+type stagedState struct {
+	shim.ChaincodeStubInterface
+	writes map[string][]byte
+	reads  map[string][]byte
+}
+
+// stageState wraps APIstub in a stagedState, unless it is one already
+func stageState(APIstub shim.ChaincodeStubInterface) *stagedState {
+	if staged, ok := APIstub.(*stagedState); ok {
+		return staged
+	}
+	return &stagedState{ChaincodeStubInterface: APIstub, writes: map[string][]byte{}, reads: map[string][]byte{}}
+}
+
+// GetState returns the value the transaction last wrote under key, or else the committed one
+func (s *stagedState) GetState(key string) ([]byte, error) {
+	if value, ok := s.writes[key]; ok {
+		return value, nil
+	}
+	return s.committed(key)
+}
+
+// committed returns the value of key before the transaction, reading it at most once
+func (s *stagedState) committed(key string) ([]byte, error) {
+	if value, ok := s.reads[key]; ok {
+		return value, nil
+	}
+	value, err := s.ChaincodeStubInterface.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	s.reads[key] = value
+	return value, nil
+}
+
+func (s *stagedState) PutState(key string, value []byte) error {
+	if err := s.ChaincodeStubInterface.PutState(key, value); err != nil {
+		return err
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *stagedState) DelState(key string) error {
+	if err := s.ChaincodeStubInterface.DelState(key); err != nil {
+		return err
+	}
+	s.writes[key] = nil
+	return nil
+}
+
+// assertUnchanged fails with a stateConflict naming what unless key held a value hashing
+// to expected before the transaction. An empty expected hash skips the check.
+func (s *stagedState) assertUnchanged(key string, expected string, what string) error {
+	if expected == "" {
+		return nil
+	}
+	value, err := s.committed(key)
+	if err != nil {
+		return err
+	}
+	if value == nil || stateHash(value) != expected {
+		return stateConflict{what: what}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// StolenRegistry, part of the Config, names the chaincode consulted before a bike changes hands. It must
+// implement isStolen(bikeKey, registrationNo) returning the payload "true" or "false".
+// An empty Channel means the channel this chaincode runs on.
+type StolenRegistry struct {
+	Chaincode string `json:"chaincode"`
+	Channel   string `json:"channel"`
+}
+
+// assertNotStolen asks the configured stolen-vehicle registry about a bike and fails if it is
+// flagged. Without a registry configured every bike passes; if the registry cannot be
+// reached the check fails rather than letting a possibly stolen bike through.
+func assertNotStolen(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	registry := config.StolenRegistry
+	if registry.Chaincode == "" {
+		return nil
+	}
+
+	response := APIstub.InvokeChaincode(registry.Chaincode, [][]byte{[]byte("isStolen"), []byte(key), []byte(bike.RegistrationNo)}, registry.Channel)
+	if response.Status != shim.OK {
+		return fmt.Errorf("Could not check %s against the stolen vehicle registry: %s", key, response.Message)
+	}
+	if string(response.Payload) == "true" {
+		return fmt.Errorf("Bike %s is reported stolen", key)
+	}
+	return nil
+}
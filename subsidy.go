@@ -0,0 +1,175 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Subsidy is an EV incentive a government agency paid out on an e-bike under one of its
+// schemes, anchored to the bike so the registry shows it wherever the bike goes. GrantedTo
+// is the owner at the time.
+type Subsidy struct {
+	BikeKey   string `json:"bikeKey"`
+	SchemeID  string `json:"schemeID"`
+	Amount    int64  `json:"amount"`
+	GrantedTo string `json:"grantedTo"`
+	GrantedBy string `json:"grantedBy"`
+	GrantedAt int64  `json:"grantedAt"`
+}
+
+/*
+ * applySubsidy records a subsidy paid on an e-bike under a scheme. Only members of the
+ * subsidy MSPs of the config may apply one. A scheme pays out once per bike: a second
+ * claim fails, whoever owns the bike by then, and so does a claim for a bike with the
+ * same chassis number registered again under another key. Args: bikeKey, schemeID, amount
+ */
+func (s *SmartContract) applySubsidy(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Scheme ID must not be empty"))
+	}
+	amount, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || amount <= 0 {
+		return errorResponse(invalidArgs("Amount must be a positive integer"))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, config.SubsidyMSPs); err != nil {
+		return errorResponse(err)
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if bike.AssetType != assetEBike {
+		return errorResponse(invalidArgs("Subsidies are only for e-bikes, %s is a %s", args[0], bike.AssetType))
+	}
+
+	key, err := APIstub.CreateCompositeKey("SUBSIDY", []string{args[0], args[1]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	subsidyAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if subsidyAsBytes != nil {
+		return shim.Error(fmt.Sprintf("Scheme %s already paid a subsidy on %s", args[1], args[0]))
+	}
+	if bike.ChassisNo != "" {
+		chassisKey, err := APIstub.CreateCompositeKey("SUBSIDYCHASSIS", []string{args[1], normalizeChassisNo(bike.ChassisNo)})
+		if err != nil {
+			return errorResponse(err)
+		}
+		claimedBy, err := APIstub.GetState(chassisKey)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if claimedBy != nil {
+			return shim.Error(fmt.Sprintf("Scheme %s already paid a subsidy on chassis number %s, as %s", args[1], bike.ChassisNo, claimedBy))
+		}
+		if err := APIstub.PutState(chassisKey, []byte(args[0])); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	grantedBy, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	subsidy := Subsidy{
+		BikeKey:   args[0],
+		SchemeID:  args[1],
+		Amount:    amount,
+		GrantedTo: bike.Owner,
+		GrantedBy: grantedBy,
+		GrantedAt: now,
+	}
+	subsidyAsBytes, _ = json.Marshal(subsidy)
+	if err := APIstub.PutState(key, subsidyAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(subsidyAsBytes)
+}
+
+// moveSubsidyChassis points the once-per-scheme chassis guards of a bike moved from one key to another at its new key
+func moveSubsidyChassis(APIstub shim.ChaincodeStubInterface, from string, to string, bike Bike) error {
+	if bike.ChassisNo == "" {
+		return nil
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("SUBSIDY", []string{from})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return err
+		}
+		chassisKey, err := APIstub.CreateCompositeKey("SUBSIDYCHASSIS", []string{attributes[1], normalizeChassisNo(bike.ChassisNo)})
+		if err != nil {
+			return err
+		}
+		claimedBy, err := APIstub.GetState(chassisKey)
+		if err != nil {
+			return err
+		}
+		if string(claimedBy) != from {
+			continue
+		}
+		if err := APIstub.PutState(chassisKey, []byte(to)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSubsidies returns the subsidies paid on a bike, in scheme order. Args: bikeKey
+func (s *SmartContract) getSubsidies(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("SUBSIDY", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	subsidies := []Subsidy{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		subsidy := Subsidy{}
+		if err := json.Unmarshal(queryResponse.Value, &subsidy); err != nil {
+			return errorResponse(err)
+		}
+		subsidies = append(subsidies, subsidy)
+	}
+
+	subsidiesAsBytes, _ := json.Marshal(subsidies)
+	return shim.Success(subsidiesAsBytes)
+}
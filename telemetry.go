@@ -0,0 +1,144 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Telemetry is a compact location and lock report from a bike's smart lock
+type Telemetry struct {
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	Lock    string  `json:"lock"`
+	Battery int     `json:"bat"`
+	TS      int64   `json:"ts"`
+}
+
+func telemetryKey(APIstub shim.ChaincodeStubInterface, bikeKey string, ts int64) (string, error) {
+	// Padding keeps entries in time order under composite key iteration
+	return APIstub.CreateCompositeKey("TELEMETRY", []string{bikeKey, fmt.Sprintf("%012d", ts)})
+}
+
+/*
+ * recordTelemetry stores a report from a bike's smart lock. Only identities with role=device
+ * may submit reports. Args: bikeKey, lat, lon, lockState ("locked" or "unlocked"),
+ * batteryPct, ts (Unix seconds the report was taken)
+ */
+func (s *SmartContract) recordTelemetry(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	lat, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return errorResponse(invalidArgs("Latitude must be between -90 and 90"))
+	}
+	lon, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return errorResponse(invalidArgs("Longitude must be between -180 and 180"))
+	}
+	if args[3] != "locked" && args[3] != "unlocked" {
+		return errorResponse(invalidArgs("Lock state must be locked or unlocked"))
+	}
+	battery, err := strconv.Atoi(args[4])
+	if err != nil || battery < 0 || battery > 100 {
+		return errorResponse(invalidArgs("Battery must be a percentage between 0 and 100"))
+	}
+	ts, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil || ts < 0 {
+		return errorResponse(invalidArgs("Timestamp must be Unix seconds"))
+	}
+
+	if err := requireFeature(APIstub, featureTelemetry); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertRole(APIstub, "device"); err != nil {
+		return errorResponse(err)
+	}
+	if _, err := getMutableBike(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+
+	entry := Telemetry{Lat: lat, Lon: lon, Lock: args[3], Battery: battery, TS: ts}
+	key, err := telemetryKey(APIstub, args[0], ts)
+	if err != nil {
+		return errorResponse(err)
+	}
+	entryAsBytes, _ := json.Marshal(entry)
+	if err := APIstub.PutState(key, entryAsBytes); err != nil {
+		return errorResponse(err)
+	}
+	if err := pruneTelemetry(APIstub, args[0], key); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// pruneTelemetry deletes the oldest entries of a bike beyond the configured retention. The entry
+// just written under added is invisible to the iterator, so it is merged in by hand; a
+// late report older than everything retained is dropped again straight away.
+func pruneTelemetry(APIstub shim.ChaincodeStubInterface, bikeKey string, added string) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("TELEMETRY", []string{bikeKey})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	keys := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if queryResponse.Key != added {
+			keys = append(keys, queryResponse.Key)
+		}
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	position := sort.SearchStrings(keys, added)
+	keys = append(keys[:position], append([]string{added}, keys[position:]...)...)
+
+	for i := 0; i < len(keys)-config.TelemetryRetention; i++ {
+		if err := APIstub.DelState(keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getLatestTelemetry returns the most recent report for a bike
+func (s *SmartContract) getLatestTelemetry(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("TELEMETRY", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	var latest []byte
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		latest = queryResponse.Value
+	}
+	if latest == nil {
+		return errorResponse(notFound("No telemetry recorded for %s", args[0]))
+	}
+
+	return shim.Success(latest)
+}
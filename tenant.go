@@ -0,0 +1,207 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Several registries can share one deployment as tenants. The Config maps the MSPs of each
+// registry to its tenant, and the bikes of tenant ORG1 live under keys such as
+// ORG1|BIKE000001, everything attached to them being keyed by that full key. Members of a
+// tenant's MSPs are confined to its namespace: their listings cover it alone and they
+// cannot name another tenant's keys. MSPs outside the map, such as the police or banks,
+// are not confined, and the admins can list every tenant with queryAllTenants.
+
+// tenantSeparator ends the tenant part of a key
+const tenantSeparator = "|"
+
+// callerTenant returns the tenant the invoker is confined to, "" if none
+func callerTenant(APIstub shim.ChaincodeStubInterface, config Config) (string, error) {
+	if len(config.Tenants) == 0 {
+		return "", nil
+	}
+	identity, err := clientIdentity(APIstub)
+	if err != nil {
+		return "", err
+	}
+	mspID, err := identity.GetMSPID()
+	if err != nil {
+		return "", err
+	}
+	return config.Tenants[mspID], nil
+}
+
+// tenantNames returns the tenants of the config, sorted and without repeats
+func tenantNames(config Config) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, tenant := range config.Tenants {
+		if !seen[tenant] {
+			seen[tenant] = true
+			names = append(names, tenant)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tenantKeyPrefix is the key prefix of tenant's bikes, the plain key prefix for no tenant
+func tenantKeyPrefix(config Config, tenant string) string {
+	if tenant == "" {
+		return config.KeyPrefix
+	}
+	return tenant + tenantSeparator + config.KeyPrefix
+}
+
+// scopedKeyPrefix is the key prefix of the bikes the invoker lists and registers by default
+func scopedKeyPrefix(APIstub shim.ChaincodeStubInterface, config Config) (string, error) {
+	tenant, err := callerTenant(APIstub, config)
+	if err != nil {
+		return "", err
+	}
+	return tenantKeyPrefix(config, tenant), nil
+}
+
+// assertTenantKey fails if the invoker is confined to a tenant and key lies outside its namespace
+func assertTenantKey(APIstub shim.ChaincodeStubInterface, config Config, key string) error {
+	tenant, err := callerTenant(APIstub, config)
+	if err != nil || tenant == "" {
+		return err
+	}
+	if !strings.HasPrefix(key, tenant+tenantSeparator) {
+		return unauthorized("Key %s is outside the namespace of tenant %s", key, tenant)
+	}
+	return nil
+}
+
+// assertTenantRange fails if the invoker is confined to a tenant and [startKey, endKey)
+// reaches outside its namespace
+func assertTenantRange(APIstub shim.ChaincodeStubInterface, config Config, startKey string, endKey string) error {
+	tenant, err := callerTenant(APIstub, config)
+	if err != nil || tenant == "" {
+		return err
+	}
+	namespace := tenant + tenantSeparator
+	if !strings.HasPrefix(startKey, namespace) || endKey == "" || endKey > prefixRangeEnd(namespace) {
+		return unauthorized("Range must lie in the namespace of tenant %s", tenant)
+	}
+	return nil
+}
+
+// namespaceTenant returns the tenant whose name key starts with, "" if none. Config.validate
+// keeps tenant names from being prefixes of one another, so there is at most one.
+func namespaceTenant(config Config, key string) string {
+	for _, tenant := range tenantNames(config) {
+		if strings.HasPrefix(key, tenant+tenantSeparator) {
+			return tenant
+		}
+	}
+	return ""
+}
+
+// argStrings returns arg and, if it is a JSON payload, every string in it, object keys
+// included and payloads within recursed into, so keys are checked once unescaped.
+// Object members go in sorted order, so every endorser reports the same key.
+func argStrings(arg string) []string {
+	strs := []string{arg}
+	var payload interface{}
+	if err := json.Unmarshal([]byte(arg), &payload); err != nil {
+		return strs
+	}
+	return append(strs, payloadStrings(payload)...)
+}
+
+// payloadStrings returns the strings in a decoded JSON value, see argStrings
+func payloadStrings(payload interface{}) []string {
+	strs := []string{}
+	switch value := payload.(type) {
+	case string:
+		strs = append(strs, argStrings(value)...)
+	case []interface{}:
+		for _, element := range value {
+			strs = append(strs, payloadStrings(element)...)
+		}
+	case map[string]interface{}:
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			strs = append(strs, argStrings(name)...)
+			strs = append(strs, payloadStrings(value[name])...)
+		}
+	}
+	return strs
+}
+
+// scopeTenant stops invokers confined to a tenant from naming the keys of any other
+// tenant, wherever they appear in the arguments, JSON payloads included
+func scopeTenant(name string, route Route, next HandlerFunc) HandlerFunc {
+	return func(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+		config, err := getConfig(APIstub)
+		if err != nil {
+			return errorResponse(err)
+		}
+		tenant, err := callerTenant(APIstub, config)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if tenant == "" {
+			return next(APIstub, args)
+		}
+
+		for _, arg := range args {
+			for _, str := range argStrings(arg) {
+				if other := namespaceTenant(config, str); other != "" && other != tenant {
+					return errorResponse(unauthorized("Tenant %s cannot use the keys of tenant %s", tenant, other))
+				}
+			}
+		}
+		return next(APIstub, args)
+	}
+}
+
+/*
+ * queryAllTenants lists the live bikes of every tenant, and those outside any tenant,
+ * for the admins of the deployment. Args: optionally one tenant to list alone
+ */
+func (s *SmartContract) queryAllTenants(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertAnyMSP(APIstub, config.AdminMSPs); err != nil {
+		return errorResponse(err)
+	}
+
+	tenants := append([]string{""}, tenantNames(config)...)
+	if len(args) == 1 {
+		tenants = []string{args[0]}
+	}
+	results := []QueryResult{}
+	for _, tenant := range tenants {
+		prefix := tenantKeyPrefix(config, tenant)
+		resultsIterator, err := APIstub.GetStateByRange(prefix, prefixRangeEnd(prefix))
+		if err != nil {
+			return errorResponse(err)
+		}
+		found, err := collectResults(resultsIterator, nil)
+		resultsIterator.Close()
+		if err != nil {
+			return errorResponse(err)
+		}
+		results = append(results, found...)
+	}
+
+	return resultsResponse(results)
+}
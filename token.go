@@ -0,0 +1,242 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The functions here present each bike as a non-fungible token, after ERC-721, so wallets
+// built for the Fabric token samples can work with the registry. The bike key is the token ID
+// and owners are qualified enrollment IDs, as everywhere else.
+
+// Approval lets Approved transfer the bike once on the owner's behalf. It is cleared by the
+// transfer, and by any other change of owner.
+type Approval struct {
+	BikeKey    string `json:"bikeKey"`
+	Approved   string `json:"approved"`
+	ApprovedBy string `json:"approvedBy"`
+	ApprovedAt int64  `json:"approvedAt"`
+}
+
+func approvalKey(APIstub shim.ChaincodeStubInterface, bikeKey string) (string, error) {
+	return APIstub.CreateCompositeKey("APPROVAL", []string{bikeKey})
+}
+
+// getApproval returns the approval standing on a bike, or nil if there is none
+func getApproval(APIstub shim.ChaincodeStubInterface, bikeKey string) (*Approval, error) {
+	key, err := approvalKey(APIstub, bikeKey)
+	if err != nil {
+		return nil, err
+	}
+	approvalAsBytes, err := APIstub.GetState(key)
+	if err != nil || approvalAsBytes == nil {
+		return nil, err
+	}
+
+	approval := Approval{}
+	err = json.Unmarshal(approvalAsBytes, &approval)
+	return &approval, err
+}
+
+// clearApproval drops any approval standing on a bike
+func clearApproval(APIstub shim.ChaincodeStubInterface, bikeKey string) error {
+	key, err := approvalKey(APIstub, bikeKey)
+	if err != nil {
+		return err
+	}
+	return APIstub.DelState(key)
+}
+
+// countOwnedBikes counts the bikes in owner's holdings, from the owner index
+func countOwnedBikes(APIstub shim.ChaincodeStubInterface, owner string) (int, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("OWNERBIKE", []string{owner})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	held := 0
+	for resultsIterator.HasNext() {
+		if _, err := resultsIterator.Next(); err != nil {
+			return 0, err
+		}
+		held++
+	}
+	return held, nil
+}
+
+// ownerOf returns the owner of a bike as a JSON string
+func (s *SmartContract) ownerOf(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	ownerAsBytes, _ := json.Marshal(bike.Owner)
+	return shim.Success(ownerAsBytes)
+}
+
+// balanceOf returns the number of bikes an owner holds
+func (s *SmartContract) balanceOf(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	held, err := countOwnedBikes(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success([]byte(strconv.Itoa(held)))
+}
+
+/*
+ * approve lets another identity transfer the bike with transferFrom. Only the owner may
+ * approve, and there is at most one approval per bike: a new one replaces the last, and
+ * an empty approved clears it. Args: approved, bikeKey
+ */
+func (s *SmartContract) approve(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	bike, err := getMutableBike(APIstub, args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[1], bike); err != nil {
+		return errorResponse(err)
+	}
+	if args[0] == bike.Owner {
+		return shim.Error("Bike is already owned by " + args[0])
+	}
+
+	if args[0] == "" {
+		if err := clearApproval(APIstub, args[1]); err != nil {
+			return errorResponse(err)
+		}
+		return shim.Success(nil)
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	approval := Approval{BikeKey: args[1], Approved: args[0], ApprovedBy: bike.Owner, ApprovedAt: now}
+	key, err := approvalKey(APIstub, args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	approvalAsBytes, _ := json.Marshal(approval)
+	if err := APIstub.PutState(key, approvalAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(approvalAsBytes)
+}
+
+// getApproved returns the identity approved to transfer a bike as a JSON string, null if none
+func (s *SmartContract) getApproved(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if _, err := getBike(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	approval, err := getApproval(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if approval == nil {
+		return shim.Success(nil)
+	}
+
+	approvedAsBytes, _ := json.Marshal(approval.Approved)
+	return shim.Success(approvedAsBytes)
+}
+
+/*
+ * transferFrom hands the bike from its owner to another identity straight away, without an
+ * offer to accept. It must be signed by the owner or the approved identity, and from must be
+ * the current owner. The same checks as for accepting an offer apply. The transfer fee is
+ * only debited from the new owner if they signed the transfer themselves.
+ * Args: from, to, bikeKey
+ */
+func (s *SmartContract) transferFrom(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	from, to, key := args[0], args[1], args[2]
+	if to == "" {
+		return errorResponse(invalidArgs("New owner must not be empty"))
+	}
+
+	bike, err := getMutableBike(APIstub, key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if bike.Owner != from {
+		return shim.Error(fmt.Sprintf("Bike %s is not owned by %s", key, from))
+	}
+	if to == from {
+		return shim.Error("Bike is already owned by " + to)
+	}
+
+	invoker, err := getInvokerRef(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if invoker != bike.Owner {
+		approval, err := getApproval(APIstub, key)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if approval == nil || approval.Approved != invoker {
+			return errorResponse(unauthorized("%s is neither the owner of %s nor approved to transfer it", invoker, key))
+		}
+	}
+
+	if err := assertTransferable(APIstub, key, bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertCapability(APIstub, capabilityTransfer, nil); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertNotAuctioned(APIstub, key); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertNotReserved(APIstub, key, to); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwnerCapacity(APIstub, to); err != nil {
+		return errorResponse(err)
+	}
+	if err := consumeLienApproval(APIstub, key, to); err != nil {
+		return errorResponse(err)
+	}
+
+	// A pending sale cannot go through any more
+	if _, offer, err := getOffer(APIstub, key); err == nil {
+		if err := APIstub.DelState(offer); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	bike.Owner = to
+	if err := putBike(APIstub, key, bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := recordTransfer(APIstub, key, from, to, 0); err != nil {
+		return errorResponse(err)
+	}
+	receipt, err := recordTransferFee(APIstub, key, from, to, 0, invoker == to)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if receipt.Paid {
+		if err := moveFunds(APIstub, to, receipt.Collector, receipt.Fee); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	return shim.Success(nil)
+}
@@ -0,0 +1,335 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// TransferOffer is a pending sale of a bike, waiting for the new owner to accept it.
+// BikeVersion is the version of the bike on offer; accepting fails if it changed since.
+// OpenRecalls lists the safety recalls outstanding on the bike, so the buyer sees them.
+// StateHash fingerprints the offer as stored; accepting with it fails if the offer was
+// replaced since.
+type TransferOffer struct {
+	BikeKey     string   `json:"bikeKey"`
+	Seller      string   `json:"seller"`
+	NewOwner    string   `json:"newOwner"`
+	Price       int64    `json:"price"`
+	BikeVersion int      `json:"bikeVersion"`
+	CreatedAt   int64    `json:"createdAt"`
+	ExpiresAt   int64    `json:"expiresAt"`
+	OpenRecalls []Recall `json:"openRecalls"`
+	StateHash   string   `json:"stateHash,omitempty"`
+}
+
+func offerKey(APIstub shim.ChaincodeStubInterface, bikeKey string) (string, error) {
+	return APIstub.CreateCompositeKey("OFFER", []string{bikeKey})
+}
+
+/*
+ * offerTransfer records that the current owner is willing to hand the bike over to newOwner.
+ * The owner offers, or a delegate of theirs, see delegate.go.
+ * Args: key, newOwner, price, and optionally the number of seconds the offer stays open
+ * (empty for the default) and the version of the bike the seller last read.
+ * A new offer replaces any pending one for the same bike.
+ */
+func (s *SmartContract) offerTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	price, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || price < 0 {
+		return errorResponse(invalidArgs("Price must be a non-negative integer"))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	ttl := config.OfferTTLSeconds
+	if len(args) > 3 && args[3] != "" {
+		ttl, err = strconv.ParseInt(args[3], 10, 64)
+		if err != nil || ttl <= 0 {
+			return errorResponse(invalidArgs("Offer lifetime must be a positive number of seconds"))
+		}
+	}
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(args) == 5 {
+		if err := checkVersion(args[0], bike, args[4]); err != nil {
+			return errorResponse(err)
+		}
+	}
+	if err := assertOwnerOrDelegate(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if args[1] == bike.Owner {
+		return shim.Error("Bike is already owned by " + args[1])
+	}
+	if err := assertTransferable(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertCapability(APIstub, capabilityTransfer, nil); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertNotAuctioned(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertNotReserved(APIstub, args[0], args[1]); err != nil {
+		return errorResponse(err)
+	}
+
+	recalls, err := openRecalls(APIstub, args[0], bike)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	offer := TransferOffer{
+		BikeKey:     args[0],
+		Seller:      bike.Owner,
+		NewOwner:    args[1],
+		Price:       price,
+		BikeVersion: bike.Version,
+		CreatedAt:   now,
+		ExpiresAt:   now + ttl,
+		OpenRecalls: recalls,
+	}
+
+	key, err := offerKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	offerAsBytes, _ := json.Marshal(offer)
+	if err := APIstub.PutState(key, offerAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(offerAsBytes)
+}
+
+/*
+ * acceptTransfer completes a pending offer. It has to be signed by the prospective
+ * owner named in the offer, and fails once the offer has expired, or with status 409
+ * if the bike was modified after the offer was made. The transfer fee is debited from
+ * the new owner if the fee schedule says so. Args: bikeKey, optionally the stateHash of
+ * the offer the new owner read, failing with status 409 if it was replaced since
+ */
+func (s *SmartContract) acceptTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	expectedHash := ""
+	if len(args) > 1 {
+		expectedHash = args[1]
+	}
+	staged := stageState(APIstub)
+	offer, err := acceptOffer(staged, args[0], expectedHash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	receipt, err := recordTransferFee(staged, args[0], offer.Seller, offer.NewOwner, offer.Price, true)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if receipt.Paid {
+		if err := moveFunds(staged, offer.NewOwner, receipt.Collector, receipt.Fee); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	return shim.Success(nil)
+}
+
+// acceptOffer checks the invoker may take up the pending offer for bikeKey, the one
+// hashing to expectedHash if given, then hands the bike over and closes the offer. Its
+// steps run on staged state, so each sees what the ones before wrote. Callers settle any
+// payment themselves.
+func acceptOffer(APIstub shim.ChaincodeStubInterface, bikeKey string, expectedHash string) (TransferOffer, error) {
+	staged := stageState(APIstub)
+	offer, key, err := getOffer(staged, bikeKey)
+	if err != nil {
+		return offer, err
+	}
+	if err := staged.assertUnchanged(key, expectedHash, "Offer for "+bikeKey); err != nil {
+		return offer, err
+	}
+
+	invoker, err := getInvokerRef(staged)
+	if err != nil {
+		return offer, err
+	}
+	if invoker != offer.NewOwner {
+		return offer, unauthorized("Only %s can accept the offer for %s", offer.NewOwner, bikeKey)
+	}
+
+	now, err := txTime(staged)
+	if err != nil {
+		return offer, err
+	}
+	if now > offer.ExpiresAt {
+		return offer, fmt.Errorf("Offer for %s expired", bikeKey)
+	}
+
+	bike, err := getMutableBike(staged, bikeKey)
+	if err != nil {
+		return offer, err
+	}
+	// The bike may have changed hands since the offer was made
+	if bike.Owner != offer.Seller {
+		return offer, fmt.Errorf("Offer for %s is no longer valid", bikeKey)
+	}
+	if bike.Version != offer.BikeVersion {
+		return offer, conflictError{key: bikeKey, expected: offer.BikeVersion, actual: bike.Version}
+	}
+	if err := assertTransferable(staged, bikeKey, bike); err != nil {
+		return offer, err
+	}
+	if err := assertCapability(staged, capabilityTransfer, nil); err != nil {
+		return offer, err
+	}
+	if err := assertNotReserved(staged, bikeKey, offer.NewOwner); err != nil {
+		return offer, err
+	}
+	if err := assertOwnerCapacity(staged, offer.NewOwner); err != nil {
+		return offer, err
+	}
+	if err := consumeLienApproval(staged, bikeKey, offer.NewOwner); err != nil {
+		return offer, err
+	}
+
+	bike.Owner = offer.NewOwner
+	if err := putBike(staged, bikeKey, bike); err != nil {
+		return offer, err
+	}
+	if err := recordTransfer(staged, bikeKey, offer.Seller, offer.NewOwner, offer.Price); err != nil {
+		return offer, err
+	}
+	return offer, staged.DelState(key)
+}
+
+/*
+ * buyBike accepts a pending offer and pays for it from the buyer's token account in the
+ * same transaction, so ownership and funds can never get out of step. The price argument
+ * must match the offer, guarding the buyer against a seller re-pricing before the sale lands.
+ * Any transfer fee due is paid along with the price. Args: bikeKey, price, optionally the
+ * stateHash of the offer, as for acceptTransfer
+ */
+func (s *SmartContract) buyBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	price, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || price < 0 {
+		return errorResponse(invalidArgs("Price must be a non-negative integer"))
+	}
+	if err := requireFeature(APIstub, featureTokens); err != nil {
+		return errorResponse(err)
+	}
+
+	expectedHash := ""
+	if len(args) > 2 {
+		expectedHash = args[2]
+	}
+	staged := stageState(APIstub)
+	offer, err := acceptOffer(staged, args[0], expectedHash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if offer.Price != price {
+		return shim.Error(fmt.Sprintf("Bike %s is offered at %d, not %d", args[0], offer.Price, price))
+	}
+	receipt, err := recordTransferFee(staged, args[0], offer.Seller, offer.NewOwner, price, true)
+	if err != nil {
+		return errorResponse(err)
+	}
+	payments := map[string]int64{offer.Seller: price}
+	if receipt.Paid {
+		payments[receipt.Collector] = payments[receipt.Collector] + receipt.Fee
+	}
+	if err := payFunds(staged, offer.NewOwner, payments); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// transferCheck is one of the checks a bike has to pass to change hands
+type transferCheck struct {
+	name  string
+	check func() error
+}
+
+// transferChecks are the checks of assertTransferable, in the order it runs them
+func transferChecks(APIstub shim.ChaincodeStubInterface, key string, bike Bike) []transferCheck {
+	return []transferCheck{
+		{"status", func() error {
+			if bike.Status != statusActive {
+				return fmt.Errorf("Bike %s is %s and cannot be transferred", key, bike.Status)
+			}
+			return nil
+		}},
+		{"freeze", func() error { return assertNotFrozen(key, bike) }},
+		// A transaction carries one event, so a stolen bike alert replaces a fitness one
+		{"fitness", func() error { return checkFitness(APIstub, key) }},
+		{"watchlist", func() error { return checkWatchlist(APIstub, key, bike) }},
+		{"stolen", func() error { return assertNotStolen(APIstub, key, bike) }},
+	}
+}
+
+// assertTransferable fails if anything currently prevents the bike from changing hands
+func assertTransferable(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	for _, check := range transferChecks(APIstub, key, bike) {
+		if err := check.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryTransferOffer returns the pending offer for a bike, with the recalls open right now
+func (s *SmartContract) queryTransferOffer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	offer, _, err := getOffer(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	bike, err := getBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	offer.OpenRecalls, err = openRecalls(APIstub, args[0], bike)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	offerAsBytes, _ := json.Marshal(offer)
+	return shim.Success(offerAsBytes)
+}
+
+// getOffer loads the pending offer for bikeKey, with its StateHash, and returns it with its state key
+func getOffer(APIstub shim.ChaincodeStubInterface, bikeKey string) (TransferOffer, string, error) {
+	offer := TransferOffer{}
+
+	key, err := offerKey(APIstub, bikeKey)
+	if err != nil {
+		return offer, "", err
+	}
+	offerAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return offer, "", err
+	}
+	if offerAsBytes == nil {
+		return offer, "", notFound("No pending transfer offer for %s", bikeKey)
+	}
+
+	err = json.Unmarshal(offerAsBytes, &offer)
+	offer.StateHash = stateHash(offerAsBytes)
+	return offer, key, err
+}
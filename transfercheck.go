@@ -0,0 +1,94 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// TransferValidation reports whether a bike could change hands to NewOwner right now.
+// Valid is set when every check passed; each failed check carries the error code and
+// message the transfer itself would fail with. OpenRecalls do not block a transfer, but
+// are listed, as the buyer takes them over.
+type TransferValidation struct {
+	BikeKey     string          `json:"bikeKey"`
+	NewOwner    string          `json:"newOwner"`
+	Valid       bool            `json:"valid"`
+	Checks      []TransferCheck `json:"checks"`
+	OpenRecalls []Recall        `json:"openRecalls"`
+}
+
+// TransferCheck is the outcome of one check of a TransferValidation
+type TransferCheck struct {
+	Check   string `json:"check"`
+	Passed  bool   `json:"passed"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+/*
+ * validateTransfer is a dry run of a transfer of bikeKey to newOwner: it runs every check
+ * offering and accepting the transfer would, without writing anything, and reports all
+ * that fail instead of stopping at the first. The capability check applies to the invoker,
+ * so a buyer validating before they accept sees whether their organization may transfer.
+ * Whether the invoker is the owner is not checked, so buyers can validate too.
+ * Args: bikeKey, newOwner
+ */
+func (s *SmartContract) validateTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	key, newOwner := args[0], args[1]
+	if newOwner == "" {
+		return errorResponse(invalidArgs("New owner must not be empty"))
+	}
+	bike, err := getBike(APIstub, key)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	checks := append(transferChecks(APIstub, key, bike),
+		transferCheck{"newOwner", func() error {
+			if newOwner == bike.Owner {
+				return invalidArgs("Bike %s is already owned by %s", key, newOwner)
+			}
+			return nil
+		}},
+		transferCheck{"capability", func() error { return assertCapability(APIstub, capabilityTransfer, nil) }},
+		transferCheck{"auction", func() error { return assertNotAuctioned(APIstub, key) }},
+		transferCheck{"reservation", func() error { return assertNotReserved(APIstub, key, newOwner) }},
+		transferCheck{"lien", func() error {
+			_, err := assertLienApproved(APIstub, key, newOwner)
+			return err
+		}},
+		transferCheck{"kyc", func() error { return assertKYCVerified(APIstub, newOwner) }},
+		transferCheck{"ownerCapacity", func() error { return assertOwnerCapacity(APIstub, newOwner) }},
+	)
+
+	validation := TransferValidation{BikeKey: key, NewOwner: newOwner, Valid: true, Checks: []TransferCheck{}}
+	for _, check := range checks {
+		result := TransferCheck{Check: check.name, Passed: true}
+		if err := check.check(); err != nil {
+			result = TransferCheck{Check: check.name, Code: errorCode(err), Message: err.Error()}
+			validation.Valid = false
+		}
+		validation.Checks = append(validation.Checks, result)
+	}
+
+	validation.OpenRecalls, err = openRecalls(APIstub, key, bike)
+	if err != nil {
+		return errorResponse(err)
+	}
+	recalls := TransferCheck{Check: "recalls", Passed: true}
+	if len(validation.OpenRecalls) > 0 {
+		recalls.Message = fmt.Sprintf("Bike %s has %d open recalls", key, len(validation.OpenRecalls))
+	}
+	validation.Checks = append(validation.Checks, recalls)
+
+	validationAsBytes, _ := json.Marshal(validation)
+	return shim.Success(validationAsBytes)
+}
@@ -0,0 +1,105 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// TransferEvent is one entry in a bike's ownership log. Entries are only ever appended, so
+// the provenance of a bike survives on the ledger itself, unlike the peer's key history,
+// which is local to each peer and may be pruned. Function names the chaincode function the
+// bike changed hands through.
+type TransferEvent struct {
+	BikeKey       string `json:"bikeKey"`
+	Seq           string `json:"seq"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Price         int64  `json:"price"`
+	Function      string `json:"function"`
+	TxID          string `json:"txID"`
+	TransferredAt int64  `json:"transferredAt"`
+}
+
+// recordTransfer appends the handover of bikeKey from one owner to another at price to its
+// ownership log, and a sale at a price to its price history
+func recordTransfer(APIstub shim.ChaincodeStubInterface, bikeKey string, from string, to string, price int64) error {
+	now, err := txTime(APIstub)
+	if err != nil {
+		return err
+	}
+	seq, err := nextSeq(APIstub, "TRANSFER", bikeKey)
+	if err != nil {
+		return err
+	}
+	function, _ := APIstub.GetFunctionAndParameters()
+	event := TransferEvent{
+		BikeKey:       bikeKey,
+		Seq:           seq,
+		From:          from,
+		To:            to,
+		Price:         price,
+		Function:      function,
+		TxID:          APIstub.GetTxID(),
+		TransferredAt: now,
+	}
+
+	key, err := APIstub.CreateCompositeKey("TRANSFER", []string{bikeKey, seq})
+	if err != nil {
+		return err
+	}
+	eventAsBytes, _ := json.Marshal(event)
+	if err := APIstub.PutState(key, eventAsBytes); err != nil {
+		return err
+	}
+	if price == 0 {
+		return nil
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	return recordSalePrice(APIstub, SalePrice{
+		BikeKey:  bikeKey,
+		Price:    price,
+		Currency: config.Depreciation.Currency,
+		Seller:   from,
+		Buyer:    to,
+		Source:   saleOnLedger,
+		SoldAt:   now,
+	})
+}
+
+// getTransferLog returns the ownership log of a bike, oldest transfer first. Args: bikeKey
+func (s *SmartContract) getTransferLog(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("TRANSFER", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	events := []TransferEvent{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		event := TransferEvent{}
+		if err := json.Unmarshal(queryResponse.Value, &event); err != nil {
+			return errorResponse(err)
+		}
+		events = append(events, event)
+	}
+
+	eventsAsBytes, _ := json.Marshal(events)
+	return shim.Success(eventsAsBytes)
+}
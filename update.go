@@ -0,0 +1,136 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// statusConflict is returned instead of shim.ERROR when a write lost a race with another one.
+// It is still an error status for the peer, but tells clients a retry on fresh state may succeed.
+const statusConflict = 409
+
+// conflictError reports that a bike is no longer at the version the caller based its change on
+type conflictError struct {
+	key      string
+	expected int
+	actual   int
+}
+
+func (e conflictError) Error() string {
+	return fmt.Sprintf("Bike %s is at version %d, not %d; re-read it and retry", e.key, e.actual, e.expected)
+}
+
+// checkVersion fails with a conflictError unless bike is at the expected version.
+// An empty expected version skips the check.
+func checkVersion(key string, bike Bike, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	version, err := strconv.Atoi(expected)
+	if err != nil {
+		return invalidArgs("Expected version must be an integer")
+	}
+	if version != bike.Version {
+		return conflictError{key: key, expected: version, actual: bike.Version}
+	}
+	return nil
+}
+
+// BikeUpdate lists the attributes updateBike may change. Ownership only moves through transfers.
+type BikeUpdate struct {
+	Make               *string  `json:"make"`
+	Model              *string  `json:"model"`
+	Colour             *string  `json:"colour"`
+	EngineCC           *int     `json:"engineCC"`
+	BatteryCapacityKWh *float64 `json:"batteryCapacityKWh"`
+	// Attributes are merged into those of the bike, a null one is removed
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+/*
+ * updateBike changes descriptive attributes of a bike, e.g. {"colour": "red"}. Only the owner
+ * may update, and only if the bike is still at expectedVersion; otherwise the call fails with
+ * status 409 so the client can re-read and retry. Where the config requires modification
+ * approval, owners request the change with requestModification instead.
+ * Args: key, expectedVersion, update JSON
+ */
+func (s *SmartContract) updateBike(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	update := BikeUpdate{}
+	if err := json.Unmarshal([]byte(args[2]), &update); err != nil {
+		return errorResponse(invalidArgs("Update must be a JSON object: %s", err.Error()))
+	}
+
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := checkVersion(args[0], bike, args[1]); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertOwner(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := assertDirectModification(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+
+	applyUpdate(&bike, update)
+	if err := validateAsset(bike); err != nil {
+		return errorResponse(err)
+	}
+	if err := validateAssetSchema(APIstub, bike); err != nil {
+		return errorResponse(err)
+	}
+
+	if err := putBike(APIstub, args[0], bike); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// applyUpdate sets the attributes given in update on bike. The attribute map is copied
+// rather than changed in place, so bike may be a copy that is thrown away.
+func applyUpdate(bike *Bike, update BikeUpdate) {
+	if update.Make != nil {
+		bike.Make = *update.Make
+	}
+	if update.Model != nil {
+		bike.Model = *update.Model
+	}
+	if update.Colour != nil {
+		bike.Colour = *update.Colour
+	}
+	if update.EngineCC != nil {
+		bike.EngineCC = *update.EngineCC
+	}
+	if update.BatteryCapacityKWh != nil {
+		bike.BatteryCapacityKWh = *update.BatteryCapacityKWh
+	}
+	if update.Attributes != nil {
+		attributes := map[string]interface{}{}
+		for name, value := range bike.Attributes {
+			attributes[name] = value
+		}
+		bike.Attributes = attributes
+	}
+	for name, value := range update.Attributes {
+		if value == nil {
+			delete(bike.Attributes, name)
+		} else {
+			bike.Attributes[name] = value
+		}
+	}
+	if len(bike.Attributes) == 0 {
+		bike.Attributes = nil
+	}
+}
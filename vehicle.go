@@ -0,0 +1,205 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Asset types. Bikes stored before types existed are motorbikes.
+const (
+	assetMotorbike = "motorbike"
+	assetScooter   = "scooter"
+	assetEBike     = "ebike"
+	assetCycle     = "cycle"
+)
+
+// AssetKind holds the rules specific to one type of two-wheeler
+type AssetKind interface {
+	// Validate checks the type-specific fields of a vehicle of this kind
+	Validate(bike Bike) error
+}
+
+type motorbikeKind struct{}
+
+func (motorbikeKind) Validate(bike Bike) error {
+	if bike.BatteryCapacityKWh != 0 {
+		return fmt.Errorf("A motorbike has no traction battery")
+	}
+	return nil
+}
+
+// Scooters come with either a combustion engine or a battery, but not both
+type scooterKind struct{}
+
+func (scooterKind) Validate(bike Bike) error {
+	if bike.EngineCC > 0 && bike.BatteryCapacityKWh > 0 {
+		return fmt.Errorf("A scooter has either an engine or a battery, not both")
+	}
+	return nil
+}
+
+type eBikeKind struct{}
+
+func (eBikeKind) Validate(bike Bike) error {
+	if bike.BatteryCapacityKWh <= 0 {
+		return fmt.Errorf("An e-bike needs a battery capacity")
+	}
+	if bike.EngineCC != 0 {
+		return fmt.Errorf("An e-bike has no engine")
+	}
+	return nil
+}
+
+type cycleKind struct{}
+
+func (cycleKind) Validate(bike Bike) error {
+	if bike.EngineCC != 0 || bike.BatteryCapacityKWh != 0 {
+		return fmt.Errorf("A cycle has neither an engine nor a battery")
+	}
+	return nil
+}
+
+var assetKinds = map[string]AssetKind{
+	assetMotorbike: motorbikeKind{},
+	assetScooter:   scooterKind{},
+	assetEBike:     eBikeKind{},
+	assetCycle:     cycleKind{},
+}
+
+// validateAsset checks the fields every vehicle needs, then the rules of its type
+func validateAsset(bike Bike) error {
+	if bike.Make == "" || bike.Model == "" || bike.Colour == "" || bike.Owner == "" {
+		return invalidArgs("make, model, colour and owner are all required")
+	}
+	if bike.EngineCC < 0 || bike.BatteryCapacityKWh < 0 {
+		return invalidArgs("Engine size and battery capacity cannot be negative")
+	}
+	kind, ok := assetKinds[bike.AssetType]
+	if !ok {
+		return invalidArgs("Unknown asset type %s", bike.AssetType)
+	}
+	return kind.Validate(bike)
+}
+
+// registerBike stores a new vehicle under key after validating it and claiming its registration and chassis numbers
+func registerBike(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	if key == "" {
+		return invalidArgs("Key must not be empty")
+	}
+	existing, err := APIstub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("Bike %s already exists", key)
+	}
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	if err := assertCapability(APIstub, capabilityRegister, config.RegistrarMSPs); err != nil {
+		return err
+	}
+	if err := assertTenantKey(APIstub, config, key); err != nil {
+		return err
+	}
+	if err := recordPseudonym(APIstub, bike.Owner); err != nil {
+		return err
+	}
+	if bike.Owner, err = ownerRef(APIstub, bike.Owner); err != nil {
+		return err
+	}
+	if err := assertOwnerCapacity(APIstub, bike.Owner); err != nil {
+		return err
+	}
+
+	if bike.AssetType == "" {
+		bike.AssetType = assetMotorbike
+	}
+	if err := validateAsset(bike); err != nil {
+		return err
+	}
+	if err := validateAssetSchema(APIstub, bike); err != nil {
+		return err
+	}
+	if bike.RegistrationNo != "" {
+		bike.RegistrationNo = normalizeRegistrationNo(bike.RegistrationNo)
+		if err := claimRegistrationNo(APIstub, bike.RegistrationNo, key); err != nil {
+			return err
+		}
+	}
+	if bike.ChassisNo != "" {
+		bike.ChassisNo = normalizeChassisNo(bike.ChassisNo)
+		if err := validateChassisNo(bike.ChassisNo); err != nil {
+			return err
+		}
+		if err := claimChassisNo(APIstub, bike.ChassisNo, key); err != nil {
+			return err
+		}
+	}
+	if err := checkWatchlist(APIstub, key, bike); err != nil {
+		return err
+	}
+	return putBike(APIstub, key, bike)
+}
+
+// VehicleInput is the payload of createVehicle
+type VehicleInput struct {
+	AssetType          string                 `json:"assetType"`
+	Make               string                 `json:"make"`
+	Model              string                 `json:"model"`
+	Colour             string                 `json:"colour"`
+	Owner              string                 `json:"owner"`
+	RegistrationNo     string                 `json:"registrationNo"`
+	ChassisNo          string                 `json:"chassisNo"`
+	EngineCC           int                    `json:"engineCC"`
+	BatteryCapacityKWh float64                `json:"batteryCapacityKWh"`
+	Attributes         map[string]interface{} `json:"attributes"`
+}
+
+func (v VehicleInput) toBike() Bike {
+	return Bike{
+		AssetType:          v.AssetType,
+		Make:               v.Make,
+		Model:              v.Model,
+		Colour:             v.Colour,
+		Owner:              v.Owner,
+		RegistrationNo:     v.RegistrationNo,
+		ChassisNo:          v.ChassisNo,
+		EngineCC:           v.EngineCC,
+		BatteryCapacityKWh: v.BatteryCapacityKWh,
+		Attributes:         v.Attributes,
+	}
+}
+
+/*
+ * createVehicle registers a two-wheeler of any type, e.g.
+ * {"assetType": "ebike", "make": "Ather", "model": "450X", "colour": "grey", "owner": "Asha", "batteryCapacityKWh": 2.9}
+ * Args: key, vehicle JSON
+ */
+func (s *SmartContract) createVehicle(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	input := VehicleInput{}
+	if err := json.Unmarshal([]byte(args[1]), &input); err != nil {
+		return errorResponse(invalidArgs("Vehicle must be a JSON object: %s", err.Error()))
+	}
+	if input.AssetType == "" {
+		return errorResponse(invalidArgs("Asset type is required"))
+	}
+	err := createWithinQuota(APIstub, func() error {
+		return registerBike(APIstub, args[0], input.toBike())
+	})
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
@@ -0,0 +1,240 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxWarrantyMonths caps a warranty at ten years
+const maxWarrantyMonths = 120
+
+// Warranty is the manufacturer's warranty on a bike. It runs for TermMonths calendar
+// months from StartsAt, when the bike was registered, so it is the same on every peer
+// and cannot be stretched by registering it late.
+type Warranty struct {
+	BikeKey      string `json:"bikeKey"`
+	TermMonths   int    `json:"termMonths"`
+	StartsAt     int64  `json:"startsAt"`
+	ExpiresAt    int64  `json:"expiresAt"`
+	RegisteredBy string `json:"registeredBy"`
+	RegisteredAt int64  `json:"registeredAt"`
+}
+
+// WarrantyClaim is a fault reported under a bike's warranty. Its ID is the filing transaction ID.
+type WarrantyClaim struct {
+	ClaimID string `json:"claimID"`
+	BikeKey string `json:"bikeKey"`
+	Seq     string `json:"seq"`
+	Issue   string `json:"issue"`
+	FiledBy string `json:"filedBy"`
+	FiledAt int64  `json:"filedAt"`
+}
+
+// WarrantyStatus is the answer of checkWarranty
+type WarrantyStatus struct {
+	Warranty  Warranty        `json:"warranty"`
+	Valid     bool            `json:"valid"`
+	CheckedAt int64           `json:"checkedAt"`
+	Claims    []WarrantyClaim `json:"claims"`
+}
+
+func warrantyKey(APIstub shim.ChaincodeStubInterface, bikeKey string) (string, error) {
+	return APIstub.CreateCompositeKey("WARRANTY", []string{bikeKey})
+}
+
+// getWarranty returns the warranty registered for a bike, or nil if there is none
+func getWarranty(APIstub shim.ChaincodeStubInterface, bikeKey string) (*Warranty, error) {
+	key, err := warrantyKey(APIstub, bikeKey)
+	if err != nil {
+		return nil, err
+	}
+	warrantyAsBytes, err := APIstub.GetState(key)
+	if err != nil || warrantyAsBytes == nil {
+		return nil, err
+	}
+
+	warranty := Warranty{}
+	err = json.Unmarshal(warrantyAsBytes, &warranty)
+	return &warranty, err
+}
+
+// validWarranty returns the warranty of a bike if it is in force now
+func validWarranty(APIstub shim.ChaincodeStubInterface, bikeKey string) (*Warranty, error) {
+	warranty, err := getWarranty(APIstub, bikeKey)
+	if err != nil {
+		return nil, err
+	}
+	if warranty == nil {
+		return nil, notFound("Bike %s has no warranty", bikeKey)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return nil, err
+	}
+	if now > warranty.ExpiresAt {
+		return nil, invalidArgs("Warranty of %s expired at %d", bikeKey, warranty.ExpiresAt)
+	}
+	return warranty, nil
+}
+
+/*
+ * registerWarranty records the manufacturer's warranty on a bike for a number of months
+ * from its registration. Only the manufacturer's organization, as set in the config's
+ * manufacturers, may register it, and only once per bike. Args: bikeKey, warrantyTermMonths
+ */
+func (s *SmartContract) registerWarranty(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	months, err := strconv.Atoi(args[1])
+	if err != nil || months <= 0 || months > maxWarrantyMonths {
+		return errorResponse(invalidArgs("Warranty term must be between 1 and %d months", maxWarrantyMonths))
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	mspID, err := manufacturerMSP(APIstub, bike.Make)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertMSP(APIstub, mspID); err != nil {
+		return errorResponse(err)
+	}
+	if bike.RegisteredAt == 0 {
+		return errorResponse(invalidArgs("Bike %s has no registration time to run a warranty from", args[0]))
+	}
+	existing, err := getWarranty(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if existing != nil {
+		return errorResponse(invalidArgs("Bike %s already has a warranty", args[0]))
+	}
+
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	warranty := Warranty{
+		BikeKey:      args[0],
+		TermMonths:   months,
+		StartsAt:     bike.RegisteredAt,
+		ExpiresAt:    time.Unix(bike.RegisteredAt, 0).UTC().AddDate(0, months, 0).Unix(),
+		RegisteredBy: mspID,
+		RegisteredAt: now,
+	}
+	key, err := warrantyKey(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	warrantyAsBytes, _ := json.Marshal(warranty)
+	if err := APIstub.PutState(key, warrantyAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(warrantyAsBytes)
+}
+
+/*
+ * checkWarranty tells whether a bike's warranty is in force at the transaction time,
+ * with the claims filed under it, so service centers need not ask the manufacturer.
+ * Args: bikeKey
+ */
+func (s *SmartContract) checkWarranty(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if err := assertBikeKnown(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+	warranty, err := getWarranty(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if warranty == nil {
+		return errorResponse(notFound("Bike %s has no warranty", args[0]))
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("WARRANTYCLAIM", []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	claims := []WarrantyClaim{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		claim := WarrantyClaim{}
+		if err := json.Unmarshal(queryResponse.Value, &claim); err != nil {
+			return errorResponse(err)
+		}
+		claims = append(claims, claim)
+	}
+
+	statusAsBytes, _ := json.Marshal(WarrantyStatus{Warranty: *warranty, Valid: now <= warranty.ExpiresAt, CheckedAt: now, Claims: claims})
+	return shim.Success(statusAsBytes)
+}
+
+/*
+ * fileWarrantyClaim reports a fault under a bike's warranty, accepted only while the
+ * warranty is in force. The owner or a workshop may file one. Args: bikeKey, issue
+ */
+func (s *SmartContract) fileWarrantyClaim(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if args[1] == "" {
+		return errorResponse(invalidArgs("Issue must not be empty"))
+	}
+	bike, err := getMutableBike(APIstub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if assertOwner(APIstub, args[0], bike) != nil && assertRole(APIstub, "workshop") != nil {
+		return errorResponse(unauthorized("Only the owner of %s or a workshop can file a warranty claim", args[0]))
+	}
+	if _, err := validWarranty(APIstub, args[0]); err != nil {
+		return errorResponse(err)
+	}
+
+	filedBy, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	seq, err := nextSeq(APIstub, "WARRANTYCLAIM", args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	claim := WarrantyClaim{
+		ClaimID: APIstub.GetTxID(),
+		BikeKey: args[0],
+		Seq:     seq,
+		Issue:   args[1],
+		FiledBy: filedBy,
+		FiledAt: now,
+	}
+	key, err := APIstub.CreateCompositeKey("WARRANTYCLAIM", []string{args[0], seq})
+	if err != nil {
+		return errorResponse(err)
+	}
+	claimAsBytes, _ := json.Marshal(claim)
+	if err := APIstub.PutState(key, claimAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(claimAsBytes)
+}
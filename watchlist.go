@@ -0,0 +1,206 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// stolenBikeAlertEvent is the chaincode event set when a watchlisted bike is registered or transferred
+const stolenBikeAlertEvent = "StolenBikeAlert"
+
+// WatchlistEntry is a police report of a stolen bike, keyed by its chassis number so the
+// bike is recognized whatever key or registration number it turns up under
+type WatchlistEntry struct {
+	ChassisNo   string `json:"chassisNo"`
+	Description string `json:"description"`
+	ReportedBy  string `json:"reportedBy"`
+	ReportedAt  int64  `json:"reportedAt"`
+}
+
+// StolenBikeAlert is the payload of the StolenBikeAlert event
+type StolenBikeAlert struct {
+	BikeKey   string         `json:"bikeKey"`
+	Function  string         `json:"function"`
+	Invoker   string         `json:"invoker"`
+	Entry     WatchlistEntry `json:"entry"`
+	AlertedAt int64          `json:"alertedAt"`
+}
+
+func watchlistKey(APIstub shim.ChaincodeStubInterface, chassisNo string) (string, error) {
+	return APIstub.CreateCompositeKey("WATCHLIST", []string{chassisNo})
+}
+
+// getWatchlistEntry returns the watchlist entry for a normalized chassis number, or nil if there is none
+func getWatchlistEntry(APIstub shim.ChaincodeStubInterface, chassisNo string) (*WatchlistEntry, error) {
+	key, err := watchlistKey(APIstub, chassisNo)
+	if err != nil {
+		return nil, err
+	}
+	entryAsBytes, err := APIstub.GetState(key)
+	if err != nil || entryAsBytes == nil {
+		return nil, err
+	}
+
+	entry := WatchlistEntry{}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	return &entry, err
+}
+
+// checkWatchlist raises a StolenBikeAlert if the bike's chassis number is on the watchlist,
+// and fails as well if the config blocks watchlisted bikes. A failed transaction is never
+// committed, so a blocked attempt shows up as the error rather than as an event.
+func checkWatchlist(APIstub shim.ChaincodeStubInterface, key string, bike Bike) error {
+	if bike.ChassisNo == "" {
+		return nil
+	}
+	entry, err := getWatchlistEntry(APIstub, bike.ChassisNo)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return err
+	}
+	if config.BlockWatchlisted {
+		return fmt.Errorf("Bike %s matches the stolen bike watchlist entry for chassis %s", key, entry.ChassisNo)
+	}
+
+	invoker, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return err
+	}
+	function, _ := APIstub.GetFunctionAndParameters()
+	alert := StolenBikeAlert{
+		BikeKey:   key,
+		Function:  function,
+		Invoker:   invoker,
+		Entry:     *entry,
+		AlertedAt: now,
+	}
+	alertAsBytes, _ := json.Marshal(alert)
+	return APIstub.SetEvent(stolenBikeAlertEvent, alertAsBytes)
+}
+
+/*
+ * addToWatchlist reports a bike stolen by its chassis number. Only the police MSPs of the
+ * config may maintain the watchlist; a new report replaces an earlier one.
+ * Args: chassisNo, description
+ */
+func (s *SmartContract) addToWatchlist(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	chassisNo := normalizeChassisNo(args[0])
+	if chassisNo == "" {
+		return errorResponse(invalidArgs("Chassis number must not be empty"))
+	}
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertCapability(APIstub, capabilityPolice, config.PoliceMSPs); err != nil {
+		return errorResponse(err)
+	}
+
+	reporter, err := getInvokerLabel(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	entry := WatchlistEntry{ChassisNo: chassisNo, Description: args[1], ReportedBy: reporter, ReportedAt: now}
+	key, err := watchlistKey(APIstub, chassisNo)
+	if err != nil {
+		return errorResponse(err)
+	}
+	entryAsBytes, _ := json.Marshal(entry)
+	if err := APIstub.PutState(key, entryAsBytes); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(entryAsBytes)
+}
+
+// removeFromWatchlist takes a recovered bike off the watchlist. Police MSPs only. Args: chassisNo
+func (s *SmartContract) removeFromWatchlist(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := assertCapability(APIstub, capabilityPolice, config.PoliceMSPs); err != nil {
+		return errorResponse(err)
+	}
+	chassisNo := normalizeChassisNo(args[0])
+	entry, err := getWatchlistEntry(APIstub, chassisNo)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if entry == nil {
+		return errorResponse(notFound("Chassis %s is not on the watchlist", chassisNo))
+	}
+
+	key, err := watchlistKey(APIstub, chassisNo)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err := APIstub.DelState(key); err != nil {
+		return errorResponse(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// checkChassisNo returns the watchlist entry for a chassis number. Anyone may check.
+func (s *SmartContract) checkChassisNo(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	chassisNo := normalizeChassisNo(args[0])
+	entry, err := getWatchlistEntry(APIstub, chassisNo)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if entry == nil {
+		return errorResponse(notFound("Chassis %s is not on the watchlist", chassisNo))
+	}
+
+	entryAsBytes, _ := json.Marshal(entry)
+	return shim.Success(entryAsBytes)
+}
+
+// getWatchlist returns the whole watchlist as a JSON array of WatchlistEntry
+func (s *SmartContract) getWatchlist(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("WATCHLIST", []string{})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	entries := []WatchlistEntry{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		entry := WatchlistEntry{}
+		if err := json.Unmarshal(queryResponse.Value, &entry); err != nil {
+			return errorResponse(err)
+		}
+		entries = append(entries, entry)
+	}
+
+	entriesAsBytes, _ := json.Marshal(entries)
+	return shim.Success(entriesAsBytes)
+}